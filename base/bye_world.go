@@ -29,7 +29,7 @@ func ByeWorld(m *Message) {
 		deleteFrom = d
 	}
 
-	botInChat, err := config.BotConfig.Bot.ChatMemberOf(m.Chat, config.BotConfig.Bot.Me)
+	botInChat, err := config.BotConfig().Bot.ChatMemberOf(m.Chat, config.BotConfig().Bot.Me)
 	if err != nil {
 		util.SendReply(m.Chat, "哎呀，一不小心就在时间的湍流中迷失了自我，也许现在不是时候，让我们重新来过吧！😅", m)
 		return
@@ -121,7 +121,7 @@ func (p *VoiceDb) RandomVoiceByCh(ch string) *VoiceChip {
 
 // InitGetVoice init get voice service
 func InitGetVoice() error {
-	c := config.BotConfig.GetVoiceConfig
+	c := config.BotConfig().GetVoiceConfig
 
 	if !c.Enable {
 		return nil
@@ -211,8 +211,8 @@ func InitGetVoice() error {
 func getMeilisearchClient(c *config.MeiliSearch) meilisearch.ServiceManager {
 	if c == nil {
 		c = &config.MeiliSearch{
-			Host:   config.BotConfig.MeiliConfig.HostAddr,
-			ApiKey: config.BotConfig.MeiliConfig.ApiKey,
+			Host:   config.BotConfig().MeiliConfig.HostAddr,
+			ApiKey: config.BotConfig().MeiliConfig.ApiKey,
 		}
 	}
 	opts := []meilisearch.Option{}
@@ -466,7 +466,7 @@ func getVoice(ctx tb.Context, index string, text string) error {
 
 // GetVoice for get voice handle
 func GetVoice(ctx tb.Context) error {
-	if !config.BotConfig.GetVoiceConfig.Enable {
+	if !config.BotConfig().GetVoiceConfig.Enable {
 		return ctx.Reply("功能未启用")
 	}
 
@@ -547,7 +547,7 @@ func handleVoiceError(ctx tb.Context, err error, indexName string) error {
 	errorCaption := fmt.Sprintf("%s%s\n<blockquote expandable>…异常…</blockquote>\n%s",
 		gameTag, "#异常", errorMsg)
 
-	errAudio := config.BotConfig.ErrAudioUrl
+	errAudio := config.BotConfig().ErrAudioUrl
 	if errAudio != "" {
 		if sendErr := sendVoiceMessage(ctx, errAudio, errorCaption); sendErr != nil {
 			log.Error("failed to send error audio", zap.Error(sendErr))
@@ -13,10 +13,10 @@ func TestGetVoiceMeta(t *testing.T) {
 	t.Parallel()
 
 	config.InitViper("../config.yaml", "BOT")
-	config.BotConfig = config.NewBotConfig()
+	config.SetBotConfig(config.NewBotConfig())
 	config.ReadConfig(
-		config.BotConfig.GetVoiceConfig)
-	config.BotConfig.DebugMode = true
+		config.BotConfig().GetVoiceConfig)
+	config.BotConfig().DebugMode = true
 	log.InitLogger()
 	InitGetVoice()
 
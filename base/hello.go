@@ -53,7 +53,7 @@ func Boot(m *Message) {
 	text := GetHitokoto("i", false) + " 早上好，新的一天加油哦! :)"
 	orm.Boot(m.Chat.ID)
 	if orm.IsShutdown(m.Chat.ID) {
-		text = config.BotConfig.MessageConfig.BootFailed
+		text = config.BotConfig().MessageConfig.BootFailed
 	}
 	util.SendReply(m.Chat, text, m)
 }
@@ -72,7 +72,7 @@ func Sleep(ctx Context) error {
 
 // NoSleep is handle for command `no_sleep`.
 func NoSleep(ctx Context) error {
-	return ctx.Reply(config.BotConfig.MessageConfig.NoSleep)
+	return ctx.Reply(config.BotConfig().MessageConfig.NoSleep)
 }
 
 // Forward is handle for command `forward`.
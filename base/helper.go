@@ -23,7 +23,7 @@ var lastBoot = time.Now().In(util.TimeZoneCST).Format(util.TimeFormat)
 // Info - build info.
 func Info(ctx Context) error {
 	msg := "```\n----- Bot Info -----\n"
-	msg += fmt.Sprintf("UserName:    %s\n", config.BotConfig.Bot.Me.Username)
+	msg += fmt.Sprintf("UserName:    %s\n", config.BotConfig().Bot.Me.Username)
 	msg += fmt.Sprintf("Version:     %s\n", version)
 	msg += fmt.Sprintf("Branch:      %s\n", branch)
 	msg += fmt.Sprintf("Build Time:  %s\n", buildTime)
@@ -34,7 +34,7 @@ func Info(ctx Context) error {
 	} else {
 		msg += "API Server:  OFFICIAL\n"
 	}
-	if config.BotConfig.DebugMode {
+	if config.BotConfig().DebugMode {
 		msg += "Debug Mode:  YES\n"
 	}
 	msg += "```"
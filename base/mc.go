@@ -27,7 +27,7 @@ type mcSascrfice struct {
 }
 
 func computeSas(idx int) int {
-	baseSas := config.BotConfig.McConfig.Sacrifices
+	baseSas := config.BotConfig().McConfig.Sacrifices
 	if idx >= len(baseSas) {
 		return baseSas[len(baseSas)-1]
 	}
@@ -93,7 +93,7 @@ func reburnHelper(chatID, prayer int64) (bool, []*mcSascrfice, error) {
 			continue
 		}
 		if isPrayed {
-			sascrfice.Odds = config.BotConfig.McConfig.Odds
+			sascrfice.Odds = config.BotConfig().McConfig.Odds
 		}
 		_ = orm.ClearPrayer(sascrfice.ChatID, sascrfice.UserID)
 	}
@@ -114,7 +114,7 @@ func reburnHelper(chatID, prayer int64) (bool, []*mcSascrfice, error) {
 
 // MC handle `/mc` command
 func MC(ctx tb.Context) error {
-	if config.BotConfig.McConfig.Mc2Dead <= 0 {
+	if config.BotConfig().McConfig.Mc2Dead <= 0 {
 		return ctx.Reply("再mc自杀（也不一定）")
 	}
 
@@ -144,7 +144,7 @@ func MC(ctx tb.Context) error {
 
 // Reburn handle `/reburn` command
 func Reburn(ctx tb.Context) error {
-	if config.BotConfig.McConfig.Mc2Dead <= 0 {
+	if config.BotConfig().McConfig.Mc2Dead <= 0 {
 		return nil
 	}
 
@@ -13,7 +13,7 @@ func WelcomeNewMember(ctx Context) error {
 	usersJoined := ctx.Message().UsersJoined
 	for idx := range usersJoined {
 		member := &usersJoined[idx]
-		text := config.BotConfig.MessageConfig.WelcomeMessage + util.GetName(member)
+		text := config.BotConfig().MessageConfig.WelcomeMessage + util.GetName(member)
 		if err := ctx.Send(text); err != nil {
 			return err
 		}
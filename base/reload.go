@@ -0,0 +1,22 @@
+package base
+
+import (
+	"csust-got/config"
+	"csust-got/log"
+
+	"go.uber.org/zap"
+	. "gopkg.in/telebot.v3"
+)
+
+// ReloadConfig is handler for command `reload`, only admins of bot can reload config.
+func ReloadConfig(ctx Context) error {
+	if !config.BotConfig().IsAdmin(ctx.Sender().ID) {
+		return ctx.Reply("只有bot管理员可以重新加载配置哦")
+	}
+	if err := config.ReloadConfig(); err != nil {
+		log.Error("reload config failed", zap.Int64("user", ctx.Sender().ID), zap.Error(err))
+		return ctx.Reply("配置有误，继续使用原来的配置: " + err.Error())
+	}
+	log.Info("config reloaded by command", zap.Int64("user", ctx.Sender().ID))
+	return ctx.Reply("配置已重新加载")
+}
@@ -0,0 +1,338 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+
+	"csust-got/log"
+	"csust-got/orm"
+	"csust-got/store"
+	"csust-got/util"
+
+	"go.uber.org/zap"
+	. "gopkg.in/telebot.v3"
+)
+
+// RemindSnoozeUnique is the unique of snooze buttons on fired reminders.
+const RemindSnoozeUnique = "remind_snooze"
+
+// defaultRemindClock is the time of day used when a rule has no time, like `every monday`.
+const defaultRemindClock = 9 * time.Hour
+
+var (
+	// ErrRemindRule means the rule of reminder can't be parsed.
+	ErrRemindRule = errors.New("invalid remind rule")
+	// ErrRemindInPast means the time of reminder has passed.
+	ErrRemindInPast = errors.New("remind time has passed")
+)
+
+var remindWeekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "sun": time.Sunday, "周日": time.Sunday, "周天": time.Sunday, "星期日": time.Sunday, "星期天": time.Sunday,
+	"monday": time.Monday, "mon": time.Monday, "周一": time.Monday, "星期一": time.Monday,
+	"tuesday": time.Tuesday, "tue": time.Tuesday, "周二": time.Tuesday, "星期二": time.Tuesday,
+	"wednesday": time.Wednesday, "wed": time.Wednesday, "周三": time.Wednesday, "星期三": time.Wednesday,
+	"thursday": time.Thursday, "thu": time.Thursday, "周四": time.Thursday, "星期四": time.Thursday,
+	"friday": time.Friday, "fri": time.Friday, "周五": time.Friday, "星期五": time.Friday,
+	"saturday": time.Saturday, "sat": time.Saturday, "周六": time.Saturday, "星期六": time.Saturday,
+}
+
+var remindDays = map[string]int{
+	"today": 0, "今天": 0,
+	"tomorrow": 1, "明天": 1,
+	"后天": 2,
+}
+
+var snoozeOptions = []struct {
+	text  string
+	delay string
+}{
+	{"⏰ 10分钟后", "10m"},
+	{"⏰ 1小时后", "1h"},
+	{"⏰ 明天", "24h"},
+}
+
+// remindRule is when a reminder fires.
+type remindRule struct {
+	// at is the first time to fire
+	at time.Time
+	// repeat is the schedule rule if the reminder is recurring
+	repeat string
+}
+
+// parseClock parses time of day like `9:00`, returns the offset from start of day.
+func parseClock(s string) (time.Duration, bool) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, true
+}
+
+// takeClock takes an optional time of day at args[i], returns the clock and count of args taken.
+func takeClock(args []string, i int) (time.Duration, int) {
+	if i < len(args) {
+		if clock, ok := parseClock(args[i]); ok {
+			return clock, 1
+		}
+	}
+	return defaultRemindClock, 0
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// dailyCron returns cron expression firing at clock on days, days is `*` or a list of weekdays.
+func dailyCron(clock time.Duration, days string) string {
+	return fmt.Sprintf("%d %d * * %s", int(clock.Minutes())%60, int(clock.Hours()), days)
+}
+
+// parseRemindRule parses the rule at the beginning of args, returns the rule and count of args taken.
+// now should be in time zone of the chat. Rules are:
+//   - a delay: `30m`, `1h30m`
+//   - an absolute time: `21:00`, `tomorrow 9:00`, `monday 9:00`, `11-01 20:00`, `2026-11-01 20:00`
+//   - a cron expression: `cron 0 9 * * 1-5`
+//   - a recurring rule: `every 2h`, `every day 9:00`, `every weekday 9:00`, `every monday 9:00`
+func parseRemindRule(args []string, now time.Time) (remindRule, int, error) {
+	if len(args) == 0 {
+		return remindRule{}, 0, ErrRemindRule
+	}
+	first := strings.ToLower(args[0])
+
+	switch first {
+	case "cron":
+		if len(args) < 6 {
+			return remindRule{}, 0, ErrRemindRule
+		}
+		rule, err := recurringRule(strings.Join(args[1:6], " "), now)
+		return rule, 6, err
+	case "every", "每":
+		return parseEveryRule(args, now)
+	case "每天", "daily":
+		rule, n, err := parseEveryRule(append([]string{"every", "day"}, args[1:]...), now)
+		return rule, n - 1, err
+	}
+
+	if delay, err := util.EvalDuration(first); err == nil {
+		if delay < time.Second {
+			return remindRule{}, 0, ErrRemindRule
+		}
+		return remindRule{at: now.Add(delay)}, 1, nil
+	}
+
+	var day time.Time
+	if days, ok := remindDays[first]; ok {
+		day = startOfDay(now).AddDate(0, 0, days)
+	} else if wd, ok := remindWeekdays[first]; ok {
+		days := (int(wd) - int(now.Weekday()) + 7) % 7
+		day = startOfDay(now).AddDate(0, 0, days)
+	} else if d, err := time.ParseInLocation(time.DateOnly, first, now.Location()); err == nil {
+		day = d
+	} else if d, err := time.ParseInLocation("01-02", first, now.Location()); err == nil {
+		day = time.Date(now.Year(), d.Month(), d.Day(), 0, 0, 0, 0, now.Location())
+		if day.Before(startOfDay(now)) {
+			day = day.AddDate(1, 0, 0)
+		}
+	} else if clock, ok := parseClock(first); ok {
+		// only time of day, today or tomorrow if passed
+		at := startOfDay(now).Add(clock)
+		if !at.After(now) {
+			at = at.AddDate(0, 0, 1)
+		}
+		return remindRule{at: at}, 1, nil
+	} else {
+		return remindRule{}, 0, ErrRemindRule
+	}
+
+	clock, n := takeClock(args, 1)
+	at := day.Add(clock)
+	if _, isWeekday := remindWeekdays[first]; isWeekday && !at.After(now) {
+		at = at.AddDate(0, 0, 7)
+	}
+	if !at.After(now) {
+		return remindRule{}, 0, ErrRemindInPast
+	}
+	return remindRule{at: at}, 1 + n, nil
+}
+
+// parseEveryRule parses rules begin with `every`.
+func parseEveryRule(args []string, now time.Time) (remindRule, int, error) {
+	if len(args) < 2 {
+		return remindRule{}, 0, ErrRemindRule
+	}
+	what := strings.ToLower(args[1])
+	clock, n := takeClock(args, 2)
+
+	var days string
+	switch what {
+	case "day", "天":
+		days = "*"
+	case "weekday", "workday", "工作日":
+		days = "1-5"
+	case "weekend", "周末":
+		days = "0,6"
+	default:
+		if wd, ok := remindWeekdays[what]; ok {
+			days = strconv.Itoa(int(wd))
+			break
+		}
+		if _, err := util.EvalDuration(what); err == nil {
+			rule, err := recurringRule("@every "+what, now)
+			return rule, 2, err
+		}
+		return remindRule{}, 0, ErrRemindRule
+	}
+	rule, err := recurringRule(dailyCron(clock, days), now)
+	return rule, 2 + n, err
+}
+
+func recurringRule(repeat string, now time.Time) (remindRule, error) {
+	schedule, err := util.ParseSchedule(repeat)
+	if err != nil {
+		return remindRule{}, errors.Join(ErrRemindRule, err)
+	}
+	at := schedule.Next(now)
+	if at.IsZero() {
+		return remindRule{}, ErrRemindRule
+	}
+	return remindRule{at: at, repeat: repeat}, nil
+}
+
+// describeRepeat returns the readable form of schedule rule.
+func describeRepeat(repeat string) string {
+	if d, ok := strings.CutPrefix(repeat, "@every "); ok {
+		return "每 " + d
+	}
+	return "cron " + repeat
+}
+
+// Remind handles `/remind <rule> <content>`, rules are described in parseRemindRule.
+func Remind(ctx Context) error {
+	usage := "用法：/remind &lt;时间&gt; &lt;内容&gt;，时间可以是：\n" +
+		"<code>30m</code>、<code>21:00</code>、<code>tomorrow 9:00</code>、<code>2026-11-01 20:00</code>\n" +
+		"<code>every 2h</code>、<code>every day 9:00</code>、<code>every monday 9:00</code>、<code>every weekday 9:00</code>\n" +
+		"<code>cron 0 9 * * 1-5</code>"
+
+	tz := orm.GetChatTimezone(ctx.Chat().ID)
+	loc := orm.GetChatLocation(ctx.Chat().ID)
+	now := time.Now().In(loc)
+
+	args := ctx.Args()
+	rule, n, err := parseRemindRule(args, now)
+	if errors.Is(err, ErrRemindInPast) {
+		return ctx.Reply("这个时间已经过去了哦")
+	}
+	info := strings.TrimSpace(strings.Join(args[n:], " "))
+	if err != nil || info == "" {
+		return ctx.Reply(usage, ModeHTML)
+	}
+
+	task := &store.Task{
+		User:     ctx.Sender().Username,
+		UserId:   ctx.Sender().ID,
+		ChatId:   ctx.Chat().ID,
+		Info:     info,
+		ExecTime: rule.at.UnixMilli(),
+		SetTime:  now.UnixMilli(),
+		Repeat:   rule.repeat,
+		TZ:       tz,
+	}
+	timerTaskRunner.AddTask(task)
+
+	text := fmt.Sprintf("好的，%s 我会提醒你 <code>%s</code>", rule.at.Format("2006-01-02 15:04 MST"), html.EscapeString(info))
+	if rule.repeat != "" {
+		text += fmt.Sprintf("\n🔁 %s", html.EscapeString(describeRepeat(rule.repeat)))
+	}
+	text += fmt.Sprintf("\nID：<code>%s</code>，可以用 /remind_cancel %s 取消", task.ID, task.ID)
+	return ctx.Reply(text, ModeHTML)
+}
+
+// isReminder reports whether task is a reminder which can be managed by id.
+func isReminder(task *store.Task) bool {
+	return task.Kind == "" && task.ID != ""
+}
+
+// Reminders handles `/reminders`, lists pending reminders of the user in current chat.
+func Reminders(ctx Context) error {
+	chatID, userID := ctx.Chat().ID, ctx.Sender().ID
+	return replyTasks(ctx, func(task *store.Task) bool {
+		return isReminder(task) && task.ChatId == chatID && task.UserId == userID
+	}, false, "你的提醒：", "你在这里没有待触发的提醒", "用 /remind_cancel &lt;ID&gt; 取消提醒")
+}
+
+// RemindCancel handles `/remind_cancel <id>`, cancels a reminder of the user.
+func RemindCancel(ctx Context) error {
+	if len(ctx.Args()) != 1 {
+		return ctx.Reply("用法：/remind_cancel <ID>，ID 可以用 /reminders 查看")
+	}
+	return cancelChatTask(ctx, ctx.Args()[0])
+}
+
+// snoozeMarkup is the keyboard on fired reminder.
+func snoozeMarkup(id string) *ReplyMarkup {
+	markup := &ReplyMarkup{}
+	btns := make([]Btn, 0, len(snoozeOptions))
+	for _, opt := range snoozeOptions {
+		btns = append(btns, markup.Data(opt.text, RemindSnoozeUnique, id, opt.delay))
+	}
+	markup.Inline(markup.Row(btns...))
+	return markup
+}
+
+// RemindSnooze handles snooze buttons on fired reminder, reminds the user again later.
+func RemindSnooze(ctx Context) error {
+	id, delayStr, _ := strings.Cut(ctx.Callback().Data, "|")
+	delay, err := util.EvalDuration(delayStr)
+	if err != nil {
+		return ctx.Respond()
+	}
+	task, err := orm.GetFiredTask(id)
+	if err != nil {
+		return ctx.Respond(&CallbackResponse{Text: "这个提醒已经过期了"})
+	}
+	if task.UserId != ctx.Sender().ID {
+		return ctx.Respond(&CallbackResponse{Text: "这不是你的提醒哦"})
+	}
+
+	now := time.Now()
+	at := now.Add(delay)
+	timerTaskRunner.AddTask(&store.Task{
+		User:     task.User,
+		UserId:   task.UserId,
+		ChatId:   task.ChatId,
+		Info:     task.Info,
+		ExecTime: at.UnixMilli(),
+		SetTime:  now.UnixMilli(),
+		TZ:       task.TZ,
+	})
+	if _, err = ctx.Bot().EditReplyMarkup(ctx.Message(), nil); err != nil {
+		log.Warn("remove snooze buttons failed", zap.Error(err))
+	}
+	return ctx.Respond(&CallbackResponse{Text: "好的，" + at.In(task.Location()).Format("01-02 15:04") + " 再提醒你"})
+}
+
+// ChatTimezone handles `/timezone [name]`, shows or sets time zone of chat used by reminders, setting needs admin in groups.
+func ChatTimezone(ctx Context) error {
+	chatID := ctx.Chat().ID
+	if len(ctx.Args()) == 0 {
+		loc := orm.GetChatLocation(chatID)
+		return ctx.Reply(fmt.Sprintf("当前时区：%s，现在是 %s", loc, time.Now().In(loc).Format(time.DateTime)))
+	}
+	if ctx.Chat().Type != ChatPrivate && !util.IsChatAdmin(ctx.Bot(), ctx.Chat(), ctx.Sender()) {
+		return ctx.Reply("只有管理员可以设置时区哦")
+	}
+
+	tz := ctx.Args()[0]
+	loc, err := time.LoadLocation(tz)
+	if err != nil || tz == "" || strings.EqualFold(tz, "local") {
+		return ctx.Reply("时区格式不对，例如 /timezone Asia/Shanghai")
+	}
+	if err = orm.SetChatTimezone(chatID, loc.String()); err != nil {
+		return ctx.Reply("设置失败了😔")
+	}
+	return ctx.Reply(fmt.Sprintf("时区已设置为 %s，现在是 %s", loc, time.Now().In(loc).Format(time.DateTime)))
+}
@@ -0,0 +1,59 @@
+package base
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRemindRule(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*3600)
+	now := time.Date(2026, 10, 14, 10, 30, 0, 0, loc) // Wednesday
+
+	tests := []struct {
+		input  string
+		at     time.Time
+		repeat string
+		taken  int
+	}{
+		{"30m 喝水", now.Add(30 * time.Minute), "", 1},
+		{"21:00 喝水", time.Date(2026, 10, 14, 21, 0, 0, 0, loc), "", 1},
+		{"9:00 喝水", time.Date(2026, 10, 15, 9, 0, 0, 0, loc), "", 1},
+		{"tomorrow 9:00 喝水", time.Date(2026, 10, 15, 9, 0, 0, 0, loc), "", 2},
+		{"明天 喝水", time.Date(2026, 10, 15, 9, 0, 0, 0, loc), "", 1},
+		{"2026-11-01 20:00 喝水", time.Date(2026, 11, 1, 20, 0, 0, 0, loc), "", 2},
+		{"01-02 8:00 喝水", time.Date(2027, 1, 2, 8, 0, 0, 0, loc), "", 2},
+		{"monday 喝水", time.Date(2026, 10, 19, 9, 0, 0, 0, loc), "", 1},
+		{"wednesday 9:00 喝水", time.Date(2026, 10, 21, 9, 0, 0, 0, loc), "", 2},
+		{"every 2h 喝水", now.Add(2 * time.Hour), "@every 2h", 2},
+		{"every day 22:00 喝水", time.Date(2026, 10, 14, 22, 0, 0, 0, loc), "0 22 * * *", 3},
+		{"每天 8:15 喝水", time.Date(2026, 10, 15, 8, 15, 0, 0, loc), "15 8 * * *", 2},
+		{"every monday 喝水", time.Date(2026, 10, 19, 9, 0, 0, 0, loc), "0 9 * * 1", 2},
+		{"every weekday 9:00 喝水", time.Date(2026, 10, 15, 9, 0, 0, 0, loc), "0 9 * * 1-5", 3},
+		{"cron 0 12 * * 6 喝水", time.Date(2026, 10, 17, 12, 0, 0, 0, loc), "0 12 * * 6", 6},
+	}
+	for _, tt := range tests {
+		args := strings.Fields(tt.input)
+		rule, n, err := parseRemindRule(args, now)
+		require.NoError(t, err, tt.input)
+		assert.Equal(t, tt.at, rule.at, tt.input)
+		assert.Equal(t, tt.repeat, rule.repeat, tt.input)
+		assert.Equal(t, tt.taken, n, tt.input)
+		assert.Equal(t, "喝水", strings.Join(args[n:], " "), tt.input)
+	}
+}
+
+func TestParseRemindRuleInvalid(t *testing.T) {
+	now := time.Date(2026, 10, 14, 10, 30, 0, 0, time.UTC)
+
+	_, _, err := parseRemindRule(strings.Fields("2026-10-01 9:00 喝水"), now)
+	require.ErrorIs(t, err, ErrRemindInPast)
+
+	for _, input := range []string{"", "喝水", "every", "every 10s", "cron 0 9 * *", "cron 0 25 * * * 喝水"} {
+		_, _, err = parseRemindRule(strings.Fields(input), now)
+		assert.ErrorIs(t, err, ErrRemindRule, input)
+	}
+}
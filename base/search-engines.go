@@ -41,7 +41,7 @@ func searchEngine(engineFunc searchEngineFunc) htmlMapper {
 		}
 		if rep.Sticker != nil {
 			stickerSetName := rep.Sticker.SetName
-			stickerSet, err := config.BotConfig.Bot.StickerSet(stickerSetName)
+			stickerSet, err := config.BotConfig().Bot.StickerSet(stickerSetName)
 			if err == nil {
 				return engineFunc(stickerSet.Title)
 			}
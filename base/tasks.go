@@ -0,0 +1,151 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"csust-got/orm"
+	"csust-got/store"
+	"csust-got/util"
+
+	. "gopkg.in/telebot.v3"
+)
+
+// describeTask returns what the task does.
+func describeTask(task *store.Task) string {
+	if h, ok := taskHandlers[task.Kind]; ok && h.Describe != nil {
+		return h.Describe(task)
+	}
+	return "提醒：" + task.Info
+}
+
+// canManageTask reports whether user can cancel or edit the task, admins of group can manage all tasks in it.
+func canManageTask(ctx Context, task *store.Task) bool {
+	if task.UserId == ctx.Sender().ID {
+		return true
+	}
+	return ctx.Chat().Type != ChatPrivate && util.IsChatAdmin(ctx.Bot(), ctx.Chat(), ctx.Sender())
+}
+
+// findChatTask finds the pending task with id in current chat.
+func findChatTask(ctx Context, id string) (*store.Task, error) {
+	chatID := ctx.Chat().ID
+	tasks, err := timerTaskRunner.PendingTasks(func(task *store.Task) bool {
+		return task.ID == id && task.ChatId == chatID
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(tasks) == 0 {
+		return nil, orm.ErrNoTask
+	}
+	return tasks[0], nil
+}
+
+// formatTasks formats tasks as telegram HTML, with owners if withOwner.
+func formatTasks(tasks []*store.Task, loc *time.Location, withOwner bool) string {
+	var sb strings.Builder
+	for _, task := range tasks {
+		fmt.Fprintf(&sb, "<code>%s</code> %s", task.ID, time.UnixMilli(task.ExecTime).In(loc).Format("01-02 15:04"))
+		if task.Repeat != "" {
+			fmt.Fprintf(&sb, " 🔁 %s", html.EscapeString(describeRepeat(task.Repeat)))
+		}
+		if withOwner {
+			owner := "@" + task.User
+			if task.User == "" {
+				owner = fmt.Sprint(task.UserId)
+			}
+			fmt.Fprintf(&sb, " %s", html.EscapeString(owner))
+		}
+		fmt.Fprintf(&sb, "\n  %s\n", html.EscapeString(describeTask(task)))
+	}
+	return sb.String()
+}
+
+// replyTasks replies pending tasks which filter returns true, with owners if withOwner.
+func replyTasks(ctx Context, filter func(task *store.Task) bool, withOwner bool, title, empty, hint string) error {
+	tasks, err := timerTaskRunner.PendingTasks(filter)
+	if err != nil {
+		return ctx.Reply("获取任务失败了😔")
+	}
+	if len(tasks) == 0 {
+		return ctx.Reply(empty)
+	}
+	text := title + "\n" + formatTasks(tasks, orm.GetChatLocation(ctx.Chat().ID), withOwner) + hint
+	return ctx.Reply(text, ModeHTML)
+}
+
+// cancelChatTask cancels the pending task with id in current chat, if the user can manage it.
+func cancelChatTask(ctx Context, id string) error {
+	task, err := findChatTask(ctx, id)
+	if errors.Is(err, orm.ErrNoTask) {
+		return ctx.Reply("没有找到这个任务")
+	}
+	if err != nil {
+		return ctx.Reply("获取任务失败了😔")
+	}
+	if !canManageTask(ctx, task) {
+		return ctx.Reply("只能取消自己的任务哦")
+	}
+
+	if _, err = timerTaskRunner.CancelTask(task.ID); err != nil && !errors.Is(err, orm.ErrNoTask) {
+		return ctx.Reply("取消失败了😔")
+	}
+	if h, ok := taskHandlers[task.Kind]; ok && h.OnCancel != nil {
+		h.OnCancel(task)
+	}
+	return ctx.Reply(fmt.Sprintf("已取消任务 <code>%s</code>", html.EscapeString(describeTask(task))), ModeHTML)
+}
+
+// Tasks handles `/tasks [all]`, lists pending tasks of the user in current chat,
+// admins can list all tasks in the chat with `all`.
+func Tasks(ctx Context) error {
+	chatID, userID := ctx.Chat().ID, ctx.Sender().ID
+	all := len(ctx.Args()) > 0 && ctx.Args()[0] == "all"
+	if all && (ctx.Chat().Type == ChatPrivate || !util.IsChatAdmin(ctx.Bot(), ctx.Chat(), ctx.Sender())) {
+		return ctx.Reply("只有管理员可以查看所有任务哦")
+	}
+
+	return replyTasks(ctx, func(task *store.Task) bool {
+		// tasks added by old versions have no id, and can't be managed
+		return task.ID != "" && task.ChatId == chatID && (all || task.UserId == userID)
+	}, all, "待执行的任务：", "这里没有待执行的任务",
+		"用 /cancel_task &lt;ID&gt; 取消任务，/edit_task &lt;ID&gt; &lt;内容&gt; 修改提醒内容")
+}
+
+// CancelTask handles `/cancel_task <id>`, cancels a pending task in current chat.
+func CancelTask(ctx Context) error {
+	if len(ctx.Args()) != 1 {
+		return ctx.Reply("用法：/cancel_task <ID>，ID 可以用 /tasks 查看")
+	}
+	return cancelChatTask(ctx, ctx.Args()[0])
+}
+
+// EditTask handles `/edit_task <id> <content>`, changes content of a pending reminder in current chat.
+func EditTask(ctx Context) error {
+	if len(ctx.Args()) < 2 {
+		return ctx.Reply("用法：/edit_task <ID> <新的提醒内容>，ID 可以用 /tasks 查看")
+	}
+	task, err := findChatTask(ctx, ctx.Args()[0])
+	if errors.Is(err, orm.ErrNoTask) {
+		return ctx.Reply("没有找到这个任务")
+	}
+	if err != nil {
+		return ctx.Reply("获取任务失败了😔")
+	}
+	if task.Kind != "" {
+		return ctx.Reply("只能修改提醒的内容哦")
+	}
+	if !canManageTask(ctx, task) {
+		return ctx.Reply("只能修改自己的任务哦")
+	}
+
+	info := strings.Join(ctx.Args()[1:], " ")
+	if _, err = timerTaskRunner.EditTask(task.ID, func(t *store.Task) { t.Info = info }); err != nil {
+		return ctx.Reply("修改失败了😔")
+	}
+	return ctx.Reply(fmt.Sprintf("已修改提醒内容为 <code>%s</code>", html.EscapeString(info)), ModeHTML)
+}
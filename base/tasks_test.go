@@ -0,0 +1,27 @@
+package base
+
+import (
+	"testing"
+	"time"
+
+	"csust-got/store"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatTasks(t *testing.T) {
+	RegisterTaskHandler("test", TaskHandler{Describe: func(*store.Task) string { return "测试任务" }})
+	defer delete(taskHandlers, "test")
+
+	loc := time.FixedZone("UTC+8", 8*3600)
+	at := time.Date(2026, 10, 14, 21, 0, 0, 0, loc).UnixMilli()
+	tasks := []*store.Task{
+		{ID: "abc123", User: "alice", Info: "<喝水>", ExecTime: at},
+		{ID: "def456", UserId: 42, Kind: "test", Repeat: "0 21 * * *", ExecTime: at},
+	}
+
+	assert.Equal(t, "<code>abc123</code> 10-14 21:00\n  提醒：&lt;喝水&gt;\n"+
+		"<code>def456</code> 10-14 21:00 🔁 cron 0 21 * * *\n  测试任务\n", formatTasks(tasks, loc, false))
+	assert.Equal(t, "<code>abc123</code> 10-14 21:00 @alice\n  提醒：&lt;喝水&gt;\n"+
+		"<code>def456</code> 10-14 21:00 🔁 cron 0 21 * * * 42\n  测试任务\n", formatTasks(tasks, loc, true))
+}
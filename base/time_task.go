@@ -19,10 +19,40 @@ import (
 
 var (
 	timerTaskRunner *store.TimeTask
+	taskHandlers    = make(map[string]TaskHandler)
 )
 
+// TaskHandler runs timer tasks of a kind.
+type TaskHandler struct {
+	Run func(task *store.Task)
+	// Alive reports whether a recurring task is still wanted, it stops if false. Nil means always.
+	Alive func(task *store.Task) bool
+	// Describe returns what the task does, shown in `/tasks`.
+	Describe func(task *store.Task) string
+	// OnCancel is called after the task is cancelled by `/cancel_task`, nil means nothing to do.
+	OnCancel func(task *store.Task)
+}
+
+// RegisterTaskHandler registers handler of timer tasks whose Kind is kind, should be called before Init.
+func RegisterTaskHandler(kind string, h TaskHandler) {
+	taskHandlers[kind] = h
+}
+
+func timerTaskAlive(task *store.Task) bool {
+	h, ok := taskHandlers[task.Kind]
+	if !ok || h.Alive == nil {
+		return true
+	}
+	return h.Alive(task)
+}
+
 func initTimeTaskRunner() {
 	timerTaskRunner = store.NewTimeTask(runTimerTask)
+	timerTaskRunner.SetAliveCheck(timerTaskAlive)
+	// a recurring task should have only one run waiting
+	if n, err := orm.DedupRecurringTasks(); err == nil && n > 0 {
+		log.Info("deleted duplicated runs of recurring tasks", zap.Int("count", n))
+	}
 	go timerTaskRunner.Run()
 
 	now := time.Now()
@@ -42,15 +72,27 @@ func initTimeTaskRunner() {
 	for _, t := range tasks {
 		if t.ExecTime < ddl {
 			log.Info("task exec time expired, skip it", zap.String("task", t.Raw))
+			// recurring task is not lost, skip to its next run
+			timerTaskRunner.Reschedule(&t.Task)
 			continue
 		}
 		timerTaskRunner.AddTask(&t.Task)
 	}
 }
 
+// AddTimerTask adds a task to timer task runner.
+func AddTimerTask(task *store.Task) {
+	timerTaskRunner.AddTask(task)
+}
+
 func runTimerTask(task *store.Task) {
 	log.Debug("running task", zap.Any("task", task))
-	bot := config.BotConfig.Bot
+	if h, ok := taskHandlers[task.Kind]; ok {
+		h.Run(task)
+		return
+	}
+
+	bot := config.BotConfig().Bot
 	chat, err := bot.ChatByID(task.ChatId)
 	if err != nil {
 		log.Error("run timer task, get chat by id error", zap.Int64("chat_id", task.ChatId), zap.Error(err))
@@ -68,7 +110,16 @@ func runTimerTask(task *store.Task) {
 		hint = fmt.Sprintf("@%s, %s", user.Username, hint)
 	}
 
-	_, err = bot.Send(chat, hint, ModeHTML)
+	if task.Repeat != "" {
+		hint += fmt.Sprintf("\n🔁 %s，/remind_cancel %s 可以取消", html.EscapeString(describeRepeat(task.Repeat)), task.ID)
+	}
+
+	opts := []any{ModeHTML}
+	// reminders with id can be snoozed
+	if task.ID != "" && orm.SetFiredTask(task) == nil {
+		opts = append(opts, snoozeMarkup(task.ID))
+	}
+	_, err = bot.Send(chat, hint, opts...)
 	if err != nil {
 		log.Error("Run Task send msg failed", zap.Any("task", task), zap.Error(err))
 	}
@@ -91,15 +142,17 @@ func RunTask(ctx Context) error {
 	// info := cmd.ArgAllInOneFrom(1)
 	info := strings.TrimSpace(rest)
 
-	timerTaskRunner.AddTask(&store.Task{
+	task := &store.Task{
 		User:     ctx.Sender().Username,
 		UserId:   ctx.Sender().ID,
 		ChatId:   ctx.Chat().ID,
 		Info:     info,
 		ExecTime: now.Add(delay).UnixMilli(),
 		SetTime:  now.UnixMilli(),
-	})
+	}
+	timerTaskRunner.AddTask(task)
 
-	text = fmt.Sprintf("好的, 在 %v 后我会来叫你…… <code>%s</code> , 嗯, 不愧是我。", delay, html.EscapeString(info))
+	text = fmt.Sprintf("好的, 在 %v 后我会来叫你…… <code>%s</code> , 嗯, 不愧是我。\n写错了的话可以用 /cancel_task %s 取消",
+		delay, html.EscapeString(info), task.ID)
 	return ctx.Reply(text, ModeHTML)
 }
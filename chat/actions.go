@@ -0,0 +1,201 @@
+package chat
+
+import (
+	"context"
+	"csust-got/config"
+	"csust-got/log"
+	"csust-got/orm"
+	"errors"
+	"slices"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/puzpuzpuz/xsync/v4"
+	"github.com/redis/go-redis/v9"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	tb "gopkg.in/telebot.v3"
+)
+
+const (
+	chatStopUnique       = "chat_stop"
+	chatRegenerateUnique = "chat_regen"
+	chatContinueUnique   = "chat_cont"
+
+	// continuePrompt asks model to go on with the last answer
+	continuePrompt = "请从上一条回答中断的地方继续回答，不要重复已经回答过的内容。"
+)
+
+// chatRun is a running chat which can be stopped by user
+type chatRun struct {
+	userID int64
+	cancel context.CancelFunc
+}
+
+var (
+	runningChats = xsync.NewMap[string, *chatRun]()
+	chatRunSeq   atomic.Int64
+)
+
+// registerChatRun makes the chat can be stopped by the stop button, returns id of the run and function to unregister
+func registerChatRun(userID int64, cancel context.CancelFunc) (string, func()) {
+	id := strconv.FormatInt(chatRunSeq.Add(1), 36)
+	runningChats.Store(id, &chatRun{userID: userID, cancel: cancel})
+	return id, func() { runningChats.Delete(id) }
+}
+
+// stopMarkup is the keyboard shown while answering
+func stopMarkup(runID string) *tb.ReplyMarkup {
+	markup := &tb.ReplyMarkup{}
+	markup.Inline(markup.Row(markup.Data("⏹ 停止", chatStopUnique, runID)))
+	return markup
+}
+
+// answerMarkup is the keyboard shown on the final answer
+func answerMarkup() *tb.ReplyMarkup {
+	markup := &tb.ReplyMarkup{}
+	markup.Inline(markup.Row(
+		markup.Data("🔄 重新生成", chatRegenerateUnique),
+		markup.Data("➡️ 继续", chatContinueUnique),
+	))
+	return markup
+}
+
+// sendOptions appends the markup to options if it's not nil
+func sendOptions(markup *tb.ReplyMarkup, opts ...any) []any {
+	if markup != nil {
+		opts = append(opts, markup)
+	}
+	return opts
+}
+
+// saveChatAnswer saves the request of answer, so that the answer can be regenerated or continued by buttons.
+// Encoded images are too large to be saved, only their file ids are kept.
+func saveChatAnswer(v2 *config.ChatConfigSingle, sender *tb.User, replyTo, answerMsg *tb.Message,
+	messages []openai.ChatCompletionMessage, images []string, answer string) {
+	if answerMsg == nil {
+		return
+	}
+	err := orm.SetChatAnswer(answerMsg.Chat.ID, answerMsg.ID, &orm.ChatAnswer{
+		Name:     v2.Name,
+		UserID:   sender.ID,
+		ReplyTo:  replyTo.ID,
+		Messages: withoutImages(messages),
+		Images:   images,
+		Answer:   answer,
+	})
+	if err != nil {
+		log.Warn("[ChatButtons] save chat answer failed", zap.Int64("chat", answerMsg.Chat.ID),
+			zap.Int("msg", answerMsg.ID), zap.Error(err))
+	}
+}
+
+func findChatConfig(name string) *config.ChatConfigSingle {
+	for _, c := range *config.BotConfig().ChatConfigV2 {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func chatStopHandler(ctx tb.Context) error {
+	args := ctx.Args()
+	if len(args) != 1 {
+		return ctx.Respond()
+	}
+	run, ok := runningChats.Load(args[0])
+	if !ok {
+		return ctx.Respond(&tb.CallbackResponse{Text: "回答已经结束了"})
+	}
+	if ctx.Sender().ID != run.userID {
+		return ctx.Respond(&tb.CallbackResponse{Text: "只有发起对话的人可以停止哦"})
+	}
+	run.cancel()
+	return ctx.Respond(&tb.CallbackResponse{Text: "已停止"})
+}
+
+// loadAnswerForCallback loads the answer of the message which the button is on
+func loadAnswerForCallback(ctx tb.Context) (*orm.ChatAnswer, *config.ChatConfigSingle, bool) {
+	msg := ctx.Message()
+	if msg == nil {
+		_ = ctx.Respond()
+		return nil, nil, false
+	}
+	answer, err := orm.GetChatAnswer(ctx.Chat().ID, msg.ID)
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			_ = ctx.Respond(&tb.CallbackResponse{Text: "这个回答已经过期了"})
+		} else {
+			_ = ctx.Respond(&tb.CallbackResponse{Text: "出错了，请稍后再试"})
+		}
+		return nil, nil, false
+	}
+	if ctx.Sender().ID != answer.UserID {
+		_ = ctx.Respond(&tb.CallbackResponse{Text: "只有发起对话的人可以操作哦"})
+		return nil, nil, false
+	}
+	v2 := lookupChatConfig(ctx.Chat().ID, answer.Name)
+	if v2 == nil {
+		_ = ctx.Respond(&tb.CallbackResponse{Text: "这个对话配置已经不存在了"})
+		return nil, nil, false
+	}
+	if !checkQuota(ctx) {
+		_ = ctx.Respond(&tb.CallbackResponse{Text: "你今天的额度已经用完了，明天再来吧😴"})
+		return nil, nil, false
+	}
+
+	_ = ctx.Respond()
+	// buttons can only be used once
+	if _, err := ctx.Bot().EditReplyMarkup(msg, nil); err != nil {
+		log.Warn("[ChatButtons] remove buttons failed", zap.Error(err))
+	}
+	return answer, v2, true
+}
+
+// answerMessages returns the saved messages of answer, with images downloaded again.
+// Images are dropped if the chat config doesn't support them any more.
+func answerMessages(ctx tb.Context, answer *orm.ChatAnswer, v2 *config.ChatConfigSingle) ([]openai.ChatCompletionMessage, bool) {
+	if !v2.Model.Features.Image || !v2.Features.Image {
+		answer.Images = nil
+		return answer.Messages, true
+	}
+	messages, err := withImages(ctx.Bot(), answer.Messages, answer.Images, &v2.Features)
+	if err != nil {
+		_ = ctx.Reply("图片处理失败，无法识别图片内容😔")
+		return nil, false
+	}
+	return messages, true
+}
+
+func chatRegenerateHandler(ctx tb.Context) error {
+	answer, v2, ok := loadAnswerForCallback(ctx)
+	if !ok {
+		return nil
+	}
+	messages, ok := answerMessages(ctx, answer, v2)
+	if !ok {
+		return nil
+	}
+	replyTo := &tb.Message{ID: answer.ReplyTo, Chat: ctx.Chat()}
+	return runChat(ctx, v2, messages, answer.Images, replyTo, false)
+}
+
+func chatContinueHandler(ctx tb.Context) error {
+	answer, v2, ok := loadAnswerForCallback(ctx)
+	if !ok {
+		return nil
+	}
+	messages, ok := answerMessages(ctx, answer, v2)
+	if !ok {
+		return nil
+	}
+	messages = append(slices.Clip(messages), openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleAssistant,
+		Content: stripReason(answer.Answer),
+	}, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: continuePrompt,
+	})
+	return runChat(ctx, v2, messages, answer.Images, ctx.Message(), false)
+}
@@ -0,0 +1,67 @@
+package chat
+
+import (
+	"context"
+	"testing"
+
+	"csust-got/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tb "gopkg.in/telebot.v3"
+)
+
+func TestRegisterChatRun(t *testing.T) {
+	chatCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	id, unregister := registerChatRun(42, cancel)
+	run, ok := runningChats.Load(id)
+	require.True(t, ok)
+	assert.Equal(t, int64(42), run.userID)
+
+	sp := &streamProcessor{chatCtx: chatCtx}
+	assert.False(t, sp.stopped())
+	run.cancel()
+	assert.True(t, sp.stopped())
+
+	unregister()
+	_, ok = runningChats.Load(id)
+	assert.False(t, ok)
+
+	timeoutCtx, cancelTimeout := context.WithTimeout(context.Background(), 0)
+	defer cancelTimeout()
+	<-timeoutCtx.Done()
+	assert.False(t, (&streamProcessor{chatCtx: timeoutCtx}).stopped())
+}
+
+func TestChatMarkups(t *testing.T) {
+	markup := stopMarkup("abc")
+	require.Len(t, markup.InlineKeyboard, 1)
+	assert.Equal(t, chatStopUnique, markup.InlineKeyboard[0][0].Unique)
+	assert.Equal(t, "abc", markup.InlineKeyboard[0][0].Data)
+
+	markup = answerMarkup()
+	require.Len(t, markup.InlineKeyboard, 1)
+	require.Len(t, markup.InlineKeyboard[0], 2)
+	assert.Equal(t, chatRegenerateUnique, markup.InlineKeyboard[0][0].Unique)
+	assert.Equal(t, chatContinueUnique, markup.InlineKeyboard[0][1].Unique)
+
+	assert.Equal(t, []any{tb.ModeHTML}, sendOptions(nil, tb.ModeHTML))
+	assert.Equal(t, []any{tb.ModeHTML, markup}, sendOptions(markup, tb.ModeHTML))
+
+	sp := &streamProcessor{config: &config.ChatConfigSingle{}}
+	assert.Nil(t, sp.answerMarkup())
+	sp.config.Format.Buttons = true
+	assert.NotNil(t, sp.answerMarkup())
+}
+
+func TestFindChatConfig(t *testing.T) {
+	old := config.BotConfig().ChatConfigV2
+	defer func() { config.BotConfig().ChatConfigV2 = old }()
+
+	chats := config.ChatConfigV2{{Name: "a"}, {Name: "b"}}
+	config.BotConfig().ChatConfigV2 = &chats
+	assert.Equal(t, "b", findChatConfig("b").Name)
+	assert.Nil(t, findChatConfig("c"))
+}
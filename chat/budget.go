@@ -0,0 +1,214 @@
+package chat
+
+import (
+	"bytes"
+	"csust-got/config"
+	"csust-got/log"
+	"slices"
+
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	tb "gopkg.in/telebot.v3"
+)
+
+// truncatedMark is appended to the truncated text
+const truncatedMark = "…"
+
+// renderPrompts renders the system prompt and user prompt with data
+func renderPrompts(v2 *config.ChatConfigSingle, templs chatTemplate, data *promptData) (systemPrompt, prompt string, err error) {
+	var buf bytes.Buffer
+
+	systemPrompt = v2.SystemPrompt.String()
+	if templs.SystemPromptTemplate != nil {
+		if err = templs.SystemPromptTemplate.Execute(&buf, data); err != nil {
+			return "", "", err
+		}
+		systemPrompt = buf.String()
+		buf.Reset()
+	}
+
+	if err = templs.PromptTemplate.Execute(&buf, data); err != nil {
+		return "", "", err
+	}
+	return systemPrompt, buf.String(), nil
+}
+
+// renderPromptsInLimit renders prompts and keeps the system prompt, conversation history and user prompt
+// within `Model.PromptLimit`, it returns the history kept.
+// The oldest turns of history are dropped first, then the oldest context messages,
+// then the replied message is truncated, at last the whole history is dropped.
+func renderPromptsInLimit(v2 *config.ChatConfigSingle, templs chatTemplate, data *promptData, replyTo *tb.Message,
+	history []openai.ChatCompletionMessage) (systemPrompt, prompt string, kept []openai.ChatCompletionMessage, err error) {
+	systemPrompt, prompt, err = renderPrompts(v2, templs, data)
+	limit := v2.Model.PromptLimit
+	if err != nil || limit <= 0 {
+		return systemPrompt, prompt, history, err
+	}
+
+	tk := tokenizerOf(v2.Model.Model)
+	promptTokens := tk.count(systemPrompt) + tk.count(prompt)
+	historyTokens := tk.countMessages(history)
+	tokens := promptTokens + historyTokens
+	if tokens <= limit {
+		return systemPrompt, prompt, history, nil
+	}
+	before := tokens
+
+	// drop the oldest turns of history
+	keptMessages := len(history)
+	history = trimHistory(tk, history, max(limit-promptTokens, 0))
+	historyTokens = tk.countMessages(history)
+	tokens = promptTokens + historyTokens
+
+	// drop the oldest context messages
+	dropped := 0
+	for tokens > limit && len(data.ContextMessages) > 0 {
+		data.ContextMessages = data.ContextMessages[1:]
+		data.ContextText = FormatContextMessages(data.ContextMessages)
+		data.ContextXml = FormatContextMessagesWithXml(data.ContextMessages)
+		dropped++
+
+		if systemPrompt, prompt, err = renderPrompts(v2, templs, data); err != nil {
+			return "", "", nil, err
+		}
+		tokens = tk.count(systemPrompt) + tk.count(prompt) + historyTokens
+	}
+
+	// then truncate the replied message
+	truncated := 0
+	if replyTo != nil {
+		text := []rune(replyTo.Text)
+		if len(text) == 0 {
+			text = []rune(replyTo.Caption)
+		}
+		keep := len(text)
+		for tokens > limit && keep > 0 {
+			// one token is at least one char, cut 1/8 at least to converge quickly
+			keep = max(keep-max(tokens-limit, keep/8), 0)
+			data.ReplyToXml = FormatSingleTbMessage(truncateMessageText(replyTo, string(text[:keep])), "REPLY_TO")
+			truncated = len(text) - keep
+
+			if systemPrompt, prompt, err = renderPrompts(v2, templs, data); err != nil {
+				return "", "", nil, err
+			}
+			tokens = tk.count(systemPrompt) + tk.count(prompt) + historyTokens
+		}
+	}
+
+	// the latest turn of history is still too long
+	if tokens > limit && len(history) > 0 {
+		tokens -= historyTokens
+		history = nil
+	}
+
+	fields := []zap.Field{
+		zap.String("name", v2.Name), zap.Int("limit", limit),
+		zap.Int("tokensBefore", before), zap.Int("tokensAfter", tokens),
+		zap.Int("droppedHistory", keptMessages-len(history)), zap.Int("keptHistory", len(history)),
+		zap.Int("droppedContext", dropped), zap.Int("keptContext", len(data.ContextMessages)),
+		zap.Int("truncatedReplyChars", truncated),
+	}
+	if tokens > limit {
+		log.Warn("[ChatBudget] prompt still exceeds limit after trimming", fields...)
+	} else {
+		log.Info("[ChatBudget] prompt trimmed to fit limit", fields...)
+	}
+	return systemPrompt, prompt, history, nil
+}
+
+// truncateMessageText returns a copy of message with text replaced,
+// entities are dropped because the offsets are no longer valid.
+func truncateMessageText(msg *tb.Message, text string) *tb.Message {
+	cp := *msg
+	cp.Text = text + truncatedMark
+	cp.Caption = ""
+	cp.Entities = nil
+	cp.CaptionEntities = nil
+	return &cp
+}
+
+// fitMessages fits messages to the model: image parts are replaced with placeholders if model doesn't support images,
+// then the oldest turns of history are dropped and the current user message is truncated to fit `PromptLimit`.
+// The leading system prompts and the current turn are always kept. Messages are returned as is if they fit.
+func fitMessages(model *config.Model, messages []openai.ChatCompletionMessage) []openai.ChatCompletionMessage {
+	if !model.Features.Image && slices.ContainsFunc(messages, hasImage) {
+		compacted := make([]openai.ChatCompletionMessage, 0, len(messages))
+		for _, msg := range messages {
+			compacted = append(compacted, compactMessage(msg))
+		}
+		messages = compacted
+	}
+
+	limit := model.PromptLimit
+	if limit <= 0 {
+		return messages
+	}
+	tk := tokenizerOf(model.Model)
+	before := tk.countMessages(messages)
+	if before <= limit {
+		return messages
+	}
+
+	head := 0
+	for head < len(messages) && messages[head].Role == openai.ChatMessageRoleSystem {
+		head++
+	}
+	current := len(messages) - 1
+	for current >= head && messages[current].Role != openai.ChatMessageRoleUser {
+		current--
+	}
+	if current < head {
+		return messages
+	}
+
+	// drop the oldest turns of history, or the whole history if the latest turn is still too long
+	fixed := tk.countMessages(messages[:head]) + tk.countMessages(messages[current:])
+	history := trimHistory(tk, messages[head:current], max(limit-fixed, 0))
+	if fixed+tk.countMessages(history) > limit {
+		history = nil
+	}
+	fitted := make([]openai.ChatCompletionMessage, 0, head+len(history)+len(messages)-current)
+	fitted = append(fitted, messages[:head]...)
+	fitted = append(fitted, history...)
+	fitted = append(fitted, messages[current:]...)
+
+	// then truncate the text of current user message
+	tokens := tk.countMessages(fitted)
+	if over := tokens - limit; over > 0 {
+		// one more token for the truncated mark
+		over++
+		msg := &fitted[head+len(history)]
+		if len(msg.MultiContent) > 0 {
+			msg.MultiContent = slices.Clone(msg.MultiContent)
+			if i := slices.IndexFunc(msg.MultiContent, isTextPart); i >= 0 {
+				part := &msg.MultiContent[i]
+				part.Text = tk.truncate(part.Text, max(tk.count(part.Text)-over, 0))
+			}
+		} else {
+			msg.Content = tk.truncate(msg.Content, max(tk.count(msg.Content)-over, 0))
+		}
+		tokens = tk.countMessages(fitted)
+	}
+
+	fields := []zap.Field{
+		zap.String("model", model.Name), zap.Int("limit", limit),
+		zap.Int("tokensBefore", before), zap.Int("tokensAfter", tokens),
+		zap.Int("droppedHistory", current-head-len(history)), zap.Int("keptHistory", len(history)),
+	}
+	if tokens > limit {
+		log.Warn("[ChatBudget] messages still exceed limit of model after trimming", fields...)
+	} else {
+		log.Info("[ChatBudget] messages trimmed to fit limit of model", fields...)
+	}
+	return fitted
+}
+
+func hasImage(msg openai.ChatCompletionMessage) bool {
+	return slices.ContainsFunc(msg.MultiContent, func(part openai.ChatMessagePart) bool {
+		return part.Type == openai.ChatMessagePartTypeImageURL
+	})
+}
+
+func isTextPart(part openai.ChatMessagePart) bool {
+	return part.Type == openai.ChatMessagePartTypeText
+}
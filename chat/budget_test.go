@@ -0,0 +1,156 @@
+package chat
+
+import (
+	"csust-got/config"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tb "gopkg.in/telebot.v3"
+)
+
+func newBudgetTestTemplate(t *testing.T) chatTemplate {
+	t.Helper()
+	return chatTemplate{
+		PromptTemplate: template.Must(template.New("prompt").Parse("{{.ContextXml}}\n{{.ReplyToXml}}\n{{.Input}}")),
+	}
+}
+
+func newBudgetTestData(contextMsgs []*ContextMessage, replyTo *tb.Message) *promptData {
+	return &promptData{
+		Input:           "总结一下",
+		ContextMessages: contextMsgs,
+		ContextText:     FormatContextMessages(contextMsgs),
+		ContextXml:      FormatContextMessagesWithXml(contextMsgs),
+		ReplyToXml:      FormatSingleTbMessage(replyTo, "REPLY_TO"),
+	}
+}
+
+func TestRenderPromptsInLimit(t *testing.T) {
+	templs := newBudgetTestTemplate(t)
+	contextMsgs := []*ContextMessage{
+		{ID: 1, User: "alice", Text: strings.Repeat("很早的消息", 20)},
+		{ID: 2, User: "bob", Text: strings.Repeat("中间的消息", 20)},
+		{ID: 3, User: "carol", Text: "最新的消息"},
+	}
+	replyTo := &tb.Message{ID: 10, Sender: &tb.User{Username: "dave"}, Text: strings.Repeat("被回复的长消息", 50)}
+
+	t.Run("no limit", func(t *testing.T) {
+		v2 := &config.ChatConfigSingle{Model: &config.Model{}}
+		data := newBudgetTestData(contextMsgs, replyTo)
+		_, prompt, _, err := renderPromptsInLimit(v2, templs, data, replyTo, nil)
+		require.NoError(t, err)
+		assert.Len(t, data.ContextMessages, 3)
+		assert.Contains(t, prompt, "很早的消息")
+	})
+
+	t.Run("drop oldest context first", func(t *testing.T) {
+		full := newBudgetTestData(contextMsgs, replyTo)
+		_, fullPrompt, err := renderPrompts(&config.ChatConfigSingle{}, templs, full)
+		require.NoError(t, err)
+
+		v2 := &config.ChatConfigSingle{Model: &config.Model{PromptLimit: tokenizerOf("").count(fullPrompt) - 10}}
+		data := newBudgetTestData(contextMsgs, replyTo)
+		_, prompt, _, err := renderPromptsInLimit(v2, templs, data, replyTo, nil)
+		require.NoError(t, err)
+		assert.Len(t, data.ContextMessages, 2)
+		assert.NotContains(t, prompt, "很早的消息")
+		assert.Contains(t, prompt, "中间的消息")
+		assert.NotContains(t, prompt, truncatedMark)
+		assert.LessOrEqual(t, tokenizerOf("").count(prompt), v2.Model.PromptLimit)
+	})
+
+	t.Run("truncate reply after context", func(t *testing.T) {
+		v2 := &config.ChatConfigSingle{Model: &config.Model{PromptLimit: 200}}
+		data := newBudgetTestData(contextMsgs, replyTo)
+		_, prompt, _, err := renderPromptsInLimit(v2, templs, data, replyTo, nil)
+		require.NoError(t, err)
+		assert.Empty(t, data.ContextMessages)
+		assert.Contains(t, prompt, truncatedMark)
+		assert.Contains(t, prompt, "总结一下")
+		assert.LessOrEqual(t, tokenizerOf("").count(prompt), v2.Model.PromptLimit)
+	})
+
+	t.Run("drop oldest history first", func(t *testing.T) {
+		tk := tokenizerOf("")
+		history := []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleUser, Content: strings.Repeat("很早的问题", 20)},
+			{Role: openai.ChatMessageRoleAssistant, Content: strings.Repeat("很早的回答", 20)},
+			{Role: openai.ChatMessageRoleUser, Content: "上一个问题"},
+			{Role: openai.ChatMessageRoleAssistant, Content: "上一个回答"},
+		}
+		full := newBudgetTestData(contextMsgs, replyTo)
+		_, fullPrompt, err := renderPrompts(&config.ChatConfigSingle{}, templs, full)
+		require.NoError(t, err)
+
+		limit := tk.count(fullPrompt) + tk.countMessages(history[2:])
+		v2 := &config.ChatConfigSingle{Model: &config.Model{PromptLimit: limit}}
+		data := newBudgetTestData(contextMsgs, replyTo)
+		_, prompt, kept, err := renderPromptsInLimit(v2, templs, data, replyTo, history)
+		require.NoError(t, err)
+		assert.Equal(t, history[2:], kept)
+		assert.Len(t, data.ContextMessages, 3)
+		assert.LessOrEqual(t, tk.count(prompt)+tk.countMessages(kept), limit)
+	})
+
+	t.Run("drop whole history at last", func(t *testing.T) {
+		history := []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleUser, Content: strings.Repeat("很长的问题", 100)},
+			{Role: openai.ChatMessageRoleAssistant, Content: "回答"},
+		}
+		v2 := &config.ChatConfigSingle{Model: &config.Model{PromptLimit: 200}}
+		data := newBudgetTestData(contextMsgs, replyTo)
+		_, prompt, kept, err := renderPromptsInLimit(v2, templs, data, replyTo, history)
+		require.NoError(t, err)
+		assert.Empty(t, kept)
+		assert.LessOrEqual(t, tokenizerOf("").count(prompt), v2.Model.PromptLimit)
+	})
+}
+
+func TestFitMessages(t *testing.T) {
+	image := openai.ChatMessagePart{Type: openai.ChatMessagePartTypeImageURL,
+		ImageURL: &openai.ChatMessageImageURL{URL: "data:image/jpeg;base64,AAAA"}}
+	system := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: "你是一个助手"}
+	oldTurn := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleUser, Content: strings.Repeat("很久以前的问题", 20)},
+		{Role: openai.ChatMessageRoleAssistant, Content: strings.Repeat("很久以前的回答", 20)},
+	}
+	current := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, MultiContent: []openai.ChatMessagePart{
+		image, {Type: openai.ChatMessagePartTypeText, Text: "这是什么"},
+	}}
+	messages := append(append([]openai.ChatCompletionMessage{system}, oldTurn...), current)
+
+	t.Run("as is", func(t *testing.T) {
+		model := &config.Model{Model: "gpt-4o", Features: config.ModelFeatures{Image: true}}
+		assert.Equal(t, messages, fitMessages(model, messages))
+	})
+
+	t.Run("drop images", func(t *testing.T) {
+		got := fitMessages(&config.Model{Model: "gpt-4o"}, messages)
+		require.Len(t, got, len(messages))
+		assert.Empty(t, got[3].MultiContent)
+		assert.Contains(t, got[3].Content, "<image_placeholder />")
+		assert.Contains(t, got[3].Content, "这是什么")
+		// the original messages are not changed
+		assert.Len(t, messages[3].MultiContent, 2)
+	})
+
+	t.Run("drop oldest history", func(t *testing.T) {
+		model := &config.Model{Model: "gpt-4o", PromptLimit: tokensPerImage + 50, Features: config.ModelFeatures{Image: true}}
+		got := fitMessages(model, messages)
+		assert.Equal(t, []openai.ChatCompletionMessage{system, current}, got)
+	})
+
+	t.Run("truncate current message", func(t *testing.T) {
+		long := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: strings.Repeat("问题", 100)}
+		model := &config.Model{Model: "gpt-4o", PromptLimit: 50}
+		got := fitMessages(model, []openai.ChatCompletionMessage{system, long})
+		require.Len(t, got, 2)
+		assert.True(t, strings.HasSuffix(got[1].Content, truncatedMark))
+		assert.LessOrEqual(t, tokenizerOf(model.Model).countMessages(got), 50)
+		assert.Equal(t, strings.Repeat("问题", 100), long.Content)
+	})
+}
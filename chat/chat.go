@@ -1,43 +1,53 @@
 package chat
 
 import (
-	"bytes"
 	"context"
 	"csust-got/config"
 	"csust-got/entities"
 	"csust-got/log"
 	"csust-got/util"
-	"encoding/base64"
-	"image"
-	"image/jpeg"
 	"net/http"
-	"net/url"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"text/template"
 	"time"
 
 	"github.com/puzpuzpuz/xsync/v4"
 	"github.com/sashabaranov/go-openai"
 	"go.uber.org/zap"
-	"golang.org/x/image/draw"
-
-	_ "golang.org/x/image/webp"
 	tb "gopkg.in/telebot.v3"
 )
 
-var clients map[string]*openai.Client
-var templates *xsync.Map[string, chatTemplate]
+// clients and templates are built by InitAiClients, and replaced as a whole when reloading
+var (
+	clients   atomic.Pointer[map[string]*openai.Client]
+	templates atomic.Pointer[xsync.Map[string, chatTemplate]]
+)
+
+// clientOf returns ai client of model
+func clientOf(model string) (*openai.Client, bool) {
+	m := clients.Load()
+	if m == nil {
+		return nil, false
+	}
+	client, ok := (*m)[model]
+	return client, ok
+}
 
 type chatTemplate struct {
 	PromptTemplate       *template.Template
 	SystemPromptTemplate *template.Template
 }
 
+// getTemplate parses templates of chat, the parsed templates are cached by name if cache is true
 func getTemplate(c *config.ChatConfigSingle, cache bool) (chatTemplate, error) {
-	tpl, ok := templates.Load(c.Name)
-	if ok {
-		return tpl, nil
+	cached := templates.Load()
+	cache = cache && cached != nil
+	if cache {
+		if tpl, ok := cached.Load(c.Name); ok {
+			return tpl, nil
+		}
 	}
 	var ret chatTemplate
 	if c.SystemPrompt != "" {
@@ -55,53 +65,64 @@ func getTemplate(c *config.ChatConfigSingle, cache bool) (chatTemplate, error) {
 	ret.PromptTemplate = p
 
 	if cache && (ret.PromptTemplate != nil || ret.SystemPromptTemplate != nil) {
-		templates.Store(c.Name, ret)
+		cached.Store(c.Name, ret)
 	}
 	return ret, nil
 }
 
 // InitAiClients 初始化AI客户端
 func InitAiClients(configs []*config.ChatConfigSingle) {
-	clients = make(map[string]*openai.Client)
-	// templates = make(map[string]*template.Template)
-	templates = xsync.NewMap[string, chatTemplate](xsync.WithPresize(len(configs)))
+	newClients := make(map[string]*openai.Client)
+	newTemplates := xsync.NewMap[string, chatTemplate](xsync.WithPresize(len(configs)))
 
 	for _, c := range configs {
 		// 初始化模板
-		if _, ok := templates.Load(c.Name); !ok {
+		if _, ok := newTemplates.Load(c.Name); !ok {
 			var sysPrompt *template.Template
 			if c.SystemPrompt != "" {
 				sysPrompt = template.Must(template.New("systemPrompt").Parse(c.SystemPrompt.String()))
 			}
-			templates.Store(c.Name, chatTemplate{
+			newTemplates.Store(c.Name, chatTemplate{
 				PromptTemplate:       template.Must(template.New("prompt").Parse(c.PromptTemplate.String())),
 				SystemPromptTemplate: sysPrompt,
 			})
 		}
 
-		if _, ok := clients[c.Model.Name]; ok {
-			continue
-		}
-
-		clientConfig := openai.DefaultConfig(c.Model.ApiKey)
-		clientConfig.BaseURL = c.Model.BaseUrl
-
-		if c.Model.Proxy != "" {
-			proxyURL, err := url.Parse(c.Model.Proxy)
-			if err != nil {
-				zap.L().Fatal("failed to parse proxy URL", zap.Error(err))
+		for _, m := range c.Models() {
+			if _, ok := newClients[m.Name]; ok {
+				continue
 			}
-			httpClient := &http.Client{
-				Transport: &http.Transport{
-					Proxy: http.ProxyURL(proxyURL),
-				},
+			client, err := newAiClient(m)
+			if err != nil {
+				log.Error("chat: create model client failed", zap.String("model", m.Name), zap.Error(err))
+				continue
 			}
-			clientConfig.HTTPClient = httpClient
+			newClients[m.Name] = client
 		}
+	}
 
-		client := openai.NewClientWithConfig(clientConfig)
-		clients[c.Model.Name] = client
+	clients.Store(&newClients)
+	templates.Store(newTemplates)
+}
+
+func newAiClient(m *config.Model) (*openai.Client, error) {
+	clientConfig := openai.DefaultConfig(m.ApiKey)
+	clientConfig.BaseURL = m.BaseUrl
+
+	proxyURL, err := m.ProxyURL()
+	if err != nil {
+		return nil, err
 	}
+	if proxyURL != nil {
+		httpClient := &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyURL(proxyURL),
+			},
+		}
+		clientConfig.HTTPClient = httpClient
+	}
+
+	return openai.NewClientWithConfig(clientConfig), nil
 }
 
 // 使用template处理prompt模板
@@ -117,11 +138,13 @@ type promptData struct {
 
 // Chat 处理聊天请求
 func Chat(ctx tb.Context, v2 *config.ChatConfigSingle, trigger *config.ChatTrigger) error {
+	// persona of this chat overrides the config
+	v2, customized := withChatPersona(ctx.Chat().ID, v2)
 
 	// 检查白名单
 	if v2.Model.Features.WhiteList {
-		if !config.BotConfig.WhiteListConfig.Check(ctx.Chat().ID) &&
-			!config.BotConfig.WhiteListConfig.Check(ctx.Sender().ID) {
+		if !config.BotConfig().WhiteListConfig.Check(ctx.Chat().ID) &&
+			!config.BotConfig().WhiteListConfig.Check(ctx.Sender().ID) {
 			return nil
 		}
 	}
@@ -137,6 +160,10 @@ func Chat(ctx tb.Context, v2 *config.ChatConfigSingle, trigger *config.ChatTrigg
 		}
 	}
 
+	if !checkQuota(ctx) {
+		return ctx.Reply("你今天的额度已经用完了，明天再来吧😴")
+	}
+
 	// if gacha, reply and not send placeholder
 	isGacha := trigger.Gacha > 0
 
@@ -156,21 +183,19 @@ func Chat(ctx tb.Context, v2 *config.ChatConfigSingle, trigger *config.ChatTrigg
 		BotUsername:     ctx.Bot().Me.Username, // 添加 Bot 的用户名
 	}
 
-	templs, err := getTemplate(v2, false)
+	templs, err := getTemplate(v2, !customized)
 	if err != nil {
 		log.Error("chat: parse template failed", zap.String("name", v2.Name))
 		return err
 	}
 
-	var promptBuf bytes.Buffer
-	systemPrompt := v2.SystemPrompt.String()
+	// reload the conversation when replying to a bot answer
+	history := loadChatMemory(ctx, v2)
 
-	if templs.SystemPromptTemplate != nil {
-		if err := templs.SystemPromptTemplate.Execute(&promptBuf, data); err != nil {
-			return err
-		}
-		systemPrompt = promptBuf.String()
-		promptBuf.Reset()
+	// render prompts, trim history and context to fit the prompt limit of model
+	systemPrompt, prompt, history, err := renderPromptsInLimit(v2, templs, &data, ctx.Message().ReplyTo, history)
+	if err != nil {
+		return err
 	}
 
 	messages := make([]openai.ChatCompletionMessage, 0)
@@ -181,91 +206,59 @@ func Chat(ctx tb.Context, v2 *config.ChatConfigSingle, trigger *config.ChatTrigg
 		})
 	}
 
-	if err := templs.PromptTemplate.Execute(&promptBuf, data); err != nil {
-		return err
-	}
+	messages = append(messages, history...)
 
-	multiPartContent := false
-	var contents []openai.ChatMessagePart
+	userMsg := openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: prompt,
+	}
+	var images []string
 	if v2.Model.Features.Image && v2.Features.Image {
-		// TODO handle multi photos album
-		msg := ctx.Message()
-		for msg.ReplyTo != nil {
-			if msg.Photo != nil {
-				break
-			}
-			msg = msg.ReplyTo
+		images = imageFileIDs(ctx.Message())
+		imgParts, err := getImageParts(ctx.Bot(), images, &v2.Features)
+		if err != nil {
+			_ = ctx.Reply("图片处理失败，无法识别图片内容😔")
+			return err
 		}
-		imgs := msg.Photo
-		if imgs != nil {
-			contents = make([]openai.ChatMessagePart, 0, 2)
-			w, h := imgs.Width, imgs.Height
-			file, _ := ctx.Bot().File(imgs.MediaFile())
-			ori, _, err := image.Decode(file)
-			if err != nil {
-				log.Error("Failed to decode image", zap.Error(err))
-				// TODO handle error
-				goto final
-			}
-
-			w, h = v2.Features.ImageResize(w, h)
-			img := image.NewRGBA(image.Rect(0, 0, w, h))
-			log.Info("convert image size", zap.Any("from", ori.Bounds().Size()), zap.Any("to", img.Bounds().Size()))
-			draw.ApproxBiLinear.Scale(img, img.Rect, ori, ori.Bounds(), draw.Over, nil)
-
-			buf := bytes.NewBuffer(nil)
-			err = jpeg.Encode(buf, img, &jpeg.Options{Quality: 90})
-			if err != nil {
-				log.Error("Failed to encode image to jpeg", zap.Error(err))
-				// TODO handle error
-				goto final
-			}
-			log.Info("encoded jpeg image size", zap.Int("size", buf.Len()))
-			base64Img := []byte("data:image/jpeg;base64,")
-			base64Img = base64.StdEncoding.AppendEncode(base64Img, buf.Bytes())
-			log.Info("encoded base64 image data url size", zap.Int("size", len(base64Img)))
-			contents = append(contents,
-				openai.ChatMessagePart{
-					Type: openai.ChatMessagePartTypeImageURL,
-					ImageURL: &openai.ChatMessageImageURL{
-						URL: string(base64Img),
-					},
-				},
-				openai.ChatMessagePart{
-					Type: openai.ChatMessagePartTypeText,
-					Text: promptBuf.String(),
-				})
-
-			multiPartContent = true
+		if len(imgParts) > 0 {
+			userMsg.Content = ""
+			userMsg.MultiContent = append(imgParts, openai.ChatMessagePart{
+				Type: openai.ChatMessagePartTypeText,
+				Text: prompt,
+			})
 		}
 	}
-
-final:
-	if !multiPartContent {
-		messages = append(messages, openai.ChatCompletionMessage{
-			Role:    openai.ChatMessageRoleUser,
-			Content: promptBuf.String(),
-		})
-	} else {
-		messages = append(messages, openai.ChatCompletionMessage{
-			Role:         openai.ChatMessageRoleUser,
-			MultiContent: contents,
-		})
-	}
+	messages = append(messages, userMsg)
 
 	// zap.L().Debug("Chat context messages", zap.Any("messages", messages))
 
-	client := clients[v2.Model.Name]
+	return runChat(ctx, v2, messages, images, ctx.Message(), isGacha)
+}
+
+// runChat requests the model with messages and sends the answer as a reply to replyTo,
+// images are file ids of images in messages, saved for regenerating.
+func runChat(ctx tb.Context, v2 *config.ChatConfigSingle, messages []openai.ChatCompletionMessage, images []string,
+	replyTo *tb.Message, isGacha bool) error {
+	chatCtx, cancel := context.WithTimeout(context.Background(), v2.GetTimeout())
+	defer cancel()
+
+	var runMarkup *tb.ReplyMarkup
+	if v2.Format.Buttons {
+		runID, unregister := registerChatRun(ctx.Sender().ID, cancel)
+		defer unregister()
+		runMarkup = stopMarkup(runID)
+	}
 
 	// 处理place_holder功能
 	var placeholderMsg *tb.Message
+	var err error
 	switch {
 	case isGacha:
 		// 如果是gacha模式，不使用placeholder
 	case v2.PlaceHolder != "":
 		// 如果有place_holder，先发送placeholder消息
 		var placeHolderErr error
-		placeholderMsg, placeHolderErr = ctx.Bot().Reply(ctx.Message(), v2.PlaceHolder, tb.ModeMarkdownV2)
+		placeholderMsg, placeHolderErr = ctx.Bot().Reply(replyTo, v2.PlaceHolder, sendOptions(runMarkup, tb.ModeMarkdownV2)...)
 		if placeHolderErr != nil {
 			log.Error("Failed to send placeholder message", zap.Error(placeHolderErr))
 			// 如果发送placeholder失败，继续正常流程，不使用placeholder功能
@@ -277,23 +270,31 @@ final:
 		}
 	}
 
-	chatCtx, cancel := context.WithTimeout(context.Background(), v2.GetTimeout())
-	defer cancel()
+	var toolNames []string
+	if v2.ToolsEnabled() {
+		toolNames = tools.ResolveToolNames(v2.Tools)
+	}
+	useMcp := len(toolNames) > 0
 
-	useMcp := v2.UseMcpo && config.BotConfig.McpoServer.Enable
+	// keep the prompt for regenerating, tool calls will be appended to messages
+	prompt := append([]openai.ChatCompletionMessage{}, messages...)
 
 	request := openai.ChatCompletionRequest{
 		Model:       v2.Model.Model,
 		Messages:    messages,
 		Temperature: v2.GetTemperature(),
 		Stream:      true, // Enable streaming
+		StreamOptions: &openai.StreamOptions{
+			IncludeUsage: true,
+		},
 	}
 	if useMcp {
-		request.Tools = mcpo.GetToolSet("")
+		request.Tools = tools.GetTools(toolNames)
 	}
 
-	// Create a streaming response
-	stream, err := client.CreateChatCompletionStream(chatCtx, request)
+	// Create a streaming response, retry and fallback to other models if failed
+	models := v2.Models()
+	stream, modelIdx, err := openChatStream(chatCtx, models, 0, &request)
 	if err != nil {
 		log.Error("Failed to create chat completion stream", zap.Error(err))
 		// 如果使用了placeholder且出现错误，更新placeholder消息为错误提示
@@ -307,8 +308,20 @@ final:
 	}
 
 	// Process the streaming response using streamProcessor
+	if modelIdx > 0 && placeholderMsg != nil {
+		// let users know which model is answering
+		text := v2.PlaceHolder + " " + util.EscapeTgMDv2ReservedChars(models[modelIdx].ShowName())
+		if edited, editErr := util.EditMessageWithError(placeholderMsg, text, sendOptions(runMarkup, tb.ModeMarkdownV2)...); editErr == nil {
+			placeholderMsg = edited
+		}
+	}
+
 	processor := newStreamProcessor(chatCtx, ctx, placeholderMsg, useMcp, &request, &messages, v2)
+	processor.modelIdx = modelIdx
+	processor.replyTo = replyTo
+	processor.runMarkup = runMarkup
 	response, err := processor.process(stream)
+	recordUsage(ctx, processor)
 	if err != nil {
 		log.Error("Failed to process streaming response", zap.Error(err))
 		if placeholderMsg != nil {
@@ -320,9 +333,28 @@ final:
 		return err
 	}
 
+	if v2.Format.Voice != "" && !processor.stopped() && processor.replyMsg != nil {
+		voiceMsg, voiceErr := sendVoiceAnswer(ctx.Bot(), v2, replyTo, response, processor.answerMarkup())
+		switch {
+		case voiceErr == nil:
+			// voices take the place of text answer
+			processor.deleteAnswer()
+			processor.replyMsg = voiceMsg
+		case voiceMsg != nil:
+			log.Error("Failed to send voice answer", zap.Error(voiceErr))
+		default:
+			// the text answer is kept as fallback
+			log.Warn("Failed to synthesize voice answer", zap.String("name", v2.Name), zap.Error(voiceErr))
+		}
+	}
+
+	saveChatMemory(v2, processor.replyMsg, messages, response)
+	if v2.Format.Buttons {
+		saveChatAnswer(v2, ctx.Sender(), replyTo, processor.replyMsg, prompt, images, response)
+	}
+
 	log.Debug("Chat response", zap.String("response", response))
 	return nil
-
 }
 
 var extractReasonPatt = regexp.MustCompile(`(?si)^\s*<think>\s*(?P<reason>.*?)(?:\s*</think>|$)\s*`)
@@ -368,7 +400,7 @@ func formatOutput(text string, format *config.ChatOutputFormatConfig) string {
 
 	payloadFormat := format.GetPayloadFormat()
 	if payloadFormat == "" {
-		log.Warn("chat payload output format must in [plain, quote, collapse, block], will set to plain")
+		log.Warn("chat payload output format must in [plain, quote, collapse, block, markdown-block, rich], will set to plain")
 		payloadFormat = "plain"
 	}
 
@@ -382,6 +414,8 @@ func formatOutput(text string, format *config.ChatOutputFormatConfig) string {
 		payloadType = wholeTextTypeBlock
 	case "markdown-block":
 		payloadType = wholeTextTypeMdBlock
+	case "rich":
+		payloadType = wholeTextTypeRich
 	}
 
 	formatText(&buf, payload, outputFormat, payloadType)
@@ -396,6 +430,7 @@ const (
 	wholeTextTypeCollapse wholeTextType = "collapse"
 	wholeTextTypeBlock    wholeTextType = "block"
 	wholeTextTypeMdBlock  wholeTextType = "markdown-block"
+	wholeTextTypeRich     wholeTextType = "rich"
 )
 
 func formatText(buf *strings.Builder, text string, format string, t wholeTextType) {
@@ -431,6 +466,8 @@ func formatText(buf *strings.Builder, text string, format string, t wholeTextTyp
 			buf.WriteString("\n")
 			buf.WriteString(util.EscapeTgMDv2ReservedChars(text))
 			buf.WriteString("\n```\n")
+		case wholeTextTypeRich:
+			buf.WriteString(renderMarkdown(text, format))
 		}
 	case "html":
 		switch t {
@@ -454,6 +491,8 @@ func formatText(buf *strings.Builder, text string, format string, t wholeTextTyp
 				buf.WriteString(`</code class="language-markdown">`)
 			}
 			buf.WriteString("</pre>")
+		case wholeTextTypeRich:
+			buf.WriteString(renderMarkdown(text, format))
 		}
 	default:
 		buf.WriteString(text)
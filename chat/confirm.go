@@ -0,0 +1,123 @@
+package chat
+
+import (
+	"csust-got/log"
+	"csust-got/util"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/puzpuzpuz/xsync/v4"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	tb "gopkg.in/telebot.v3"
+)
+
+const (
+	// toolConfirmTimeout is how long to wait for user to confirm a dangerous tool call
+	toolConfirmTimeout = 60 * time.Second
+	toolConfirmUnique  = "tool_confirm"
+
+	// maxConfirmArgsLen is the max length of tool arguments shown in confirmation
+	maxConfirmArgsLen = 1000
+)
+
+// toolConfirmation is a pending confirmation of dangerous tool call
+type toolConfirmation struct {
+	userID int64
+	result chan bool
+}
+
+var (
+	pendingConfirms = xsync.NewMap[string, *toolConfirmation]()
+	confirmSeq      atomic.Int64
+)
+
+// RegisterCallbackHandlers registers handlers of inline buttons sent by chat
+func RegisterCallbackHandlers(bot *tb.Bot) {
+	bot.Handle(&tb.InlineButton{Unique: toolConfirmUnique}, toolConfirmHandler)
+	bot.Handle(&tb.InlineButton{Unique: chatStopUnique}, chatStopHandler)
+	bot.Handle(&tb.InlineButton{Unique: chatRegenerateUnique}, chatRegenerateHandler)
+	bot.Handle(&tb.InlineButton{Unique: chatContinueUnique}, chatContinueHandler)
+}
+
+// toolNameSet returns names of tools
+func toolNameSet(toolDefs []openai.Tool) map[string]bool {
+	set := make(map[string]bool, len(toolDefs))
+	for _, t := range toolDefs {
+		if t.Function != nil {
+			set[t.Function.Name] = true
+		}
+	}
+	return set
+}
+
+// confirmToolCall asks the user who triggered the chat to confirm the tool call,
+// returns false if user denied or did not answer in time.
+func (sp *streamProcessor) confirmToolCall(toolCall openai.ToolCall) bool {
+	id := strconv.FormatInt(confirmSeq.Add(1), 36)
+	confirm := &toolConfirmation{userID: sp.ctx.Sender().ID, result: make(chan bool, 1)}
+	pendingConfirms.Store(id, confirm)
+	defer pendingConfirms.Delete(id)
+
+	args := []rune(toolCall.Function.Arguments)
+	if len(args) > maxConfirmArgsLen {
+		args = append(args[:maxConfirmArgsLen], []rune(truncatedMark)...)
+	}
+	text := fmt.Sprintf("⚠️ 模型想要调用工具 <code>%s</code>\n参数：\n<pre>%s</pre>\n是否允许？",
+		util.EscapeTgHTMLReservedChars(toolCall.Function.Name), util.EscapeTgHTMLReservedChars(string(args)))
+
+	markup := &tb.ReplyMarkup{}
+	markup.Inline(markup.Row(
+		markup.Data("✅ 允许", toolConfirmUnique, id, "y"),
+		markup.Data("❌ 拒绝", toolConfirmUnique, id, "n"),
+	))
+	msg, err := sp.ctx.Bot().Reply(sp.replyTo, text, tb.ModeHTML, markup)
+	if err != nil {
+		log.Error("Failed to send tool confirmation", zap.String("toolName", toolCall.Function.Name), zap.Error(err))
+		return false
+	}
+
+	timer := time.NewTimer(toolConfirmTimeout)
+	defer timer.Stop()
+
+	allowed, status := false, "⌛ 已超时"
+	select {
+	case allowed = <-confirm.result:
+		status = "❌ 已拒绝"
+		if allowed {
+			status = "✅ 已允许"
+		}
+	case <-timer.C:
+	case <-sp.chatCtx.Done():
+	}
+	log.Info("tool call confirmation", zap.String("toolName", toolCall.Function.Name),
+		zap.Int64("user", confirm.userID), zap.Bool("allowed", allowed))
+
+	// remove the keyboard
+	if _, err := sp.ctx.Bot().Edit(msg, text+"\n\n"+status, tb.ModeHTML); err != nil {
+		log.Warn("Failed to edit tool confirmation", zap.Error(err))
+	}
+	return allowed
+}
+
+func toolConfirmHandler(ctx tb.Context) error {
+	args := ctx.Args()
+	if len(args) != 2 {
+		return ctx.Respond()
+	}
+	confirm, ok := pendingConfirms.Load(args[0])
+	if !ok {
+		return ctx.Respond(&tb.CallbackResponse{Text: "这个确认已经失效了"})
+	}
+	if ctx.Sender().ID != confirm.userID {
+		return ctx.Respond(&tb.CallbackResponse{Text: "只有发起对话的人可以确认哦"})
+	}
+
+	select {
+	case confirm.result <- args[1] == "y":
+	default:
+	}
+	return ctx.Respond()
+}
@@ -350,6 +350,9 @@ func getPreviousMessages(chatID int64, messageID int, count int) ([]*ContextMess
 			// Fallback to raw text if no entities
 			msgText = msg.Text
 		}
+		if msgText == "" && imageFile(msg) != nil {
+			msgText = "<image_placeholder />"
+		}
 
 		return &ContextMessage{
 			Text:    msgText,
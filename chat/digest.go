@@ -0,0 +1,146 @@
+package chat
+
+import (
+	"csust-got/base"
+	"csust-got/config"
+	"csust-got/log"
+	"csust-got/orm"
+	"csust-got/store"
+	"csust-got/util"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	tb "gopkg.in/telebot.v3"
+)
+
+// digestTaskKind is the kind of timer task which posts daily digest
+const digestTaskKind = "digest"
+
+// digestWindow is the time range of messages in daily digest
+const digestWindow = 24 * time.Hour
+
+// InitDigest registers the timer task of daily digest
+func InitDigest() {
+	base.RegisterTaskHandler(digestTaskKind, base.TaskHandler{
+		Run:   runDigest,
+		Alive: digestAlive,
+		Describe: func(*store.Task) string {
+			return "每日群聊日报"
+		},
+		OnCancel: func(task *store.Task) {
+			if digestAlive(task) {
+				_ = orm.DelChatDigest(task.ChatId)
+			}
+		},
+	})
+}
+
+// digestAlive reports whether the digest task is the latest setting of chat
+func digestAlive(task *store.Task) bool {
+	digest, err := orm.GetChatDigest(task.ChatId)
+	if errors.Is(err, redis.Nil) {
+		return false
+	}
+	if err != nil {
+		// keep it when redis is unavailable for a while
+		return true
+	}
+	return digest.UpdatedAt == task.SetTime
+}
+
+// parseDigestTime parses time of day like `21:30`, returns the schedule rule of it
+func parseDigestTime(s string) (string, string, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return "", "", err
+	}
+	return t.Format("15:04"), fmt.Sprintf("%d %d * * *", t.Minute(), t.Hour()), nil
+}
+
+func runDigest(task *store.Task) {
+	bot := config.BotConfig().Bot
+	cfg := config.BotConfig().ChatSummary
+	v2 := findChatConfig(cfg.Chat)
+	if v2 == nil {
+		log.Warn("[ChatDigest] chat config not found", zap.String("chat", cfg.Chat))
+		return
+	}
+
+	msgs, err := orm.GetMessagesFromStream(task.ChatId, "+", "-", int64(cfg.MaxMessages), true)
+	if err != nil {
+		return
+	}
+	msgs = filterSummaryMessages(msgs, summaryRange{window: digestWindow}, bot.Me.ID, time.Now())
+	if len(msgs) == 0 {
+		log.Info("[ChatDigest] no message today, skip", zap.Int64("chat", task.ChatId))
+		return
+	}
+
+	digest, err := summarizeMessages(v2, task.ChatId, task.UserId, msgs, "📅 今日群聊日报")
+	if err != nil {
+		log.Error("[ChatDigest] summarize failed", zap.Int64("chat", task.ChatId), zap.Error(err))
+		return
+	}
+	if _, err = bot.Send(tb.ChatID(task.ChatId), digest, tb.ModeHTML, tb.NoPreview); err != nil {
+		log.Error("[ChatDigest] send digest failed", zap.Int64("chat", task.ChatId), zap.Error(err))
+	}
+}
+
+// DigestHandler handles `/digest [HH:MM|off]`, shows, sets or disables daily digest of group.
+// Setting needs admin.
+func DigestHandler(ctx tb.Context) error {
+	chatID := ctx.Chat().ID
+	arg := strings.TrimSpace(strings.Join(ctx.Args(), " "))
+	if arg == "" {
+		digest, err := orm.GetChatDigest(chatID)
+		if err != nil {
+			return ctx.Reply("本群没有开启每日群聊日报，管理员可以用 /digest 21:30 开启")
+		}
+		return ctx.Reply(fmt.Sprintf("本群每天 %s 发送群聊日报，/digest off 可以关闭", digest.Time))
+	}
+
+	if !util.IsChatAdmin(ctx.Bot(), ctx.Chat(), ctx.Sender()) {
+		return ctx.Reply("只有管理员可以设置群聊日报哦")
+	}
+
+	if arg == "off" {
+		if err := orm.DelChatDigest(chatID); err != nil {
+			return ctx.Reply("关闭失败了😔")
+		}
+		return ctx.Reply("已关闭每日群聊日报")
+	}
+
+	at, repeat, err := parseDigestTime(arg)
+	if err != nil {
+		return ctx.Reply("用法：/digest [HH:MM|off]，例如 /digest 21:30")
+	}
+	schedule, err := util.ParseSchedule(repeat)
+	if err != nil {
+		return err
+	}
+
+	// the digest is sent at the time of chat time zone
+	tz := orm.GetChatTimezone(chatID)
+	now := time.Now().In(orm.GetChatLocation(chatID))
+	digest := &orm.ChatDigest{Time: at, Repeat: repeat, UpdatedBy: ctx.Sender().ID, UpdatedAt: now.UnixMilli()}
+	if err = orm.SetChatDigest(chatID, digest); err != nil {
+		return ctx.Reply("设置失败了😔")
+	}
+	// the task set before is outdated and stops at its next run
+	base.AddTimerTask(&store.Task{
+		User:     ctx.Sender().Username,
+		UserId:   ctx.Sender().ID,
+		ChatId:   chatID,
+		Info:     "daily digest",
+		ExecTime: schedule.Next(now).UnixMilli(),
+		SetTime:  digest.UpdatedAt,
+		Kind:     digestTaskKind,
+		Repeat:   repeat,
+		TZ:       tz,
+	})
+	return ctx.Reply(fmt.Sprintf("好的，每天 %s 我会发送过去 24 小时的群聊日报", at))
+}
@@ -0,0 +1,25 @@
+package chat
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDigestTime(t *testing.T) {
+	at, repeat, err := parseDigestTime("9:05")
+	require.NoError(t, err)
+	assert.Equal(t, "09:05", at)
+	assert.Equal(t, "5 9 * * *", repeat)
+
+	at, repeat, err = parseDigestTime(" 21:30 ")
+	require.NoError(t, err)
+	assert.Equal(t, "21:30", at)
+	assert.Equal(t, "30 21 * * *", repeat)
+
+	for _, s := range []string{"25:00", "21:60", "abc", "2130"} {
+		_, _, err = parseDigestTime(s)
+		assert.Error(t, err, s)
+	}
+}
@@ -0,0 +1,193 @@
+package chat
+
+import (
+	"bytes"
+	"csust-got/config"
+	"csust-got/log"
+	"csust-got/orm"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"golang.org/x/image/draw"
+
+	_ "golang.org/x/image/webp"
+	_ "image/gif"
+	_ "image/png"
+
+	tb "gopkg.in/telebot.v3"
+)
+
+// maxAlbumSize is the max count of medias in an album
+const maxAlbumSize = 10
+
+var (
+	// ErrImageDownload means the image file cannot be downloaded from telegram
+	ErrImageDownload = errors.New("download image failed")
+	// ErrImageDecode means the image file is not a supported image
+	ErrImageDecode = errors.New("decode image failed")
+)
+
+// fileDownloader downloads files from telegram, implemented by *tb.Bot
+type fileDownloader interface {
+	File(file *tb.File) (io.ReadCloser, error)
+}
+
+// imageFile returns the image file in message,
+// photos, static stickers and image documents are supported.
+func imageFile(msg *tb.Message) *tb.File {
+	switch {
+	case msg.Photo != nil:
+		return &msg.Photo.File
+	case msg.Sticker != nil && !msg.Sticker.Animated && !msg.Sticker.Video:
+		return &msg.Sticker.File
+	case msg.Document != nil && strings.HasPrefix(msg.Document.MIME, "image/"):
+		return &msg.Document.File
+	}
+	return nil
+}
+
+// findImageMessage finds the first message with image on the reply chain
+func findImageMessage(msg *tb.Message) *tb.Message {
+	for ; msg != nil; msg = msg.ReplyTo {
+		if imageFile(msg) != nil {
+			return msg
+		}
+	}
+	return nil
+}
+
+// getAlbumMessages gathers messages of the same album from message stream,
+// album messages always have adjacent ids.
+func getAlbumMessages(msg *tb.Message) []*tb.Message {
+	album := []*tb.Message{msg}
+	if msg.AlbumID == "" {
+		return album
+	}
+
+	msgs, err := orm.GetMessagesFromStream(msg.Chat.ID, strconv.Itoa(max(msg.ID-maxAlbumSize, 0)),
+		strconv.Itoa(msg.ID+maxAlbumSize), 2*maxAlbumSize+1, false)
+	if err != nil {
+		log.Warn("get album messages failed", zap.Int64("chat", msg.Chat.ID), zap.String("album", msg.AlbumID), zap.Error(err))
+		return album
+	}
+
+	for _, m := range msgs {
+		if m.AlbumID == msg.AlbumID && m.ID != msg.ID && imageFile(m) != nil {
+			album = append(album, m)
+		}
+	}
+	slices.SortFunc(album, func(a, b *tb.Message) int { return a.ID - b.ID })
+	return album
+}
+
+// encodeImage downloads the image, resizes it and encodes it to a jpeg data url
+func encodeImage(bot fileDownloader, file *tb.File, feature *config.FeatureSetting) (string, error) {
+	reader, err := bot.File(file)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrImageDownload, err)
+	}
+	defer func() { _ = reader.Close() }()
+
+	ori, _, err := image.Decode(reader)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrImageDecode, err)
+	}
+
+	size := ori.Bounds().Size()
+	w, h := feature.ImageResize(size.X, size.Y)
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	log.Info("convert image size", zap.Any("from", size), zap.Any("to", img.Bounds().Size()))
+	draw.ApproxBiLinear.Scale(img, img.Rect, ori, ori.Bounds(), draw.Over, nil)
+
+	buf := bytes.NewBuffer(nil)
+	if err = jpeg.Encode(buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		return "", err
+	}
+	log.Info("encoded jpeg image size", zap.Int("size", buf.Len()))
+
+	base64Img := []byte("data:image/jpeg;base64,")
+	base64Img = base64.StdEncoding.AppendEncode(base64Img, buf.Bytes())
+	log.Info("encoded base64 image data url size", zap.Int("size", len(base64Img)))
+	return string(base64Img), nil
+}
+
+// imageFileIDs returns file ids of the first image message on the reply chain,
+// all images of the album are included.
+func imageFileIDs(msg *tb.Message) []string {
+	imgMsg := findImageMessage(msg)
+	if imgMsg == nil {
+		return nil
+	}
+
+	album := getAlbumMessages(imgMsg)
+	ids := make([]string, 0, len(album))
+	for _, m := range album {
+		ids = append(ids, imageFile(m).FileID)
+	}
+	return ids
+}
+
+// getImageParts downloads the images and encodes them to image parts
+func getImageParts(bot fileDownloader, fileIDs []string, feature *config.FeatureSetting) ([]openai.ChatMessagePart, error) {
+	parts := make([]openai.ChatMessagePart, 0, len(fileIDs))
+	for _, id := range fileIDs {
+		dataUrl, err := encodeImage(bot, &tb.File{FileID: id}, feature)
+		if err != nil {
+			log.Error("Failed to process image", zap.String("file", id), zap.Error(err))
+			return nil, err
+		}
+		parts = append(parts, openai.ChatMessagePart{
+			Type:     openai.ChatMessagePartTypeImageURL,
+			ImageURL: &openai.ChatMessageImageURL{URL: dataUrl},
+		})
+	}
+	return parts, nil
+}
+
+// withoutImages returns messages whose image parts are removed, the text parts are kept.
+// The images can be restored by withImages.
+func withoutImages(messages []openai.ChatCompletionMessage) []openai.ChatCompletionMessage {
+	result := make([]openai.ChatCompletionMessage, 0, len(messages))
+	for _, msg := range messages {
+		if len(msg.MultiContent) > 0 {
+			msg.MultiContent = slices.DeleteFunc(slices.Clone(msg.MultiContent), func(part openai.ChatMessagePart) bool {
+				return part.Type == openai.ChatMessagePartTypeImageURL
+			})
+		}
+		result = append(result, msg)
+	}
+	return result
+}
+
+// withImages downloads the images again, and puts them before the text of the last user message with parts.
+// Messages are not changed if no image or the last user message has no parts.
+func withImages(bot fileDownloader, messages []openai.ChatCompletionMessage, fileIDs []string,
+	feature *config.FeatureSetting) ([]openai.ChatCompletionMessage, error) {
+	if len(fileIDs) == 0 {
+		return messages, nil
+	}
+	idx := len(messages) - 1
+	for idx >= 0 && (messages[idx].Role != openai.ChatMessageRoleUser || len(messages[idx].MultiContent) == 0) {
+		idx--
+	}
+	if idx < 0 {
+		return messages, nil
+	}
+
+	parts, err := getImageParts(bot, fileIDs, feature)
+	if err != nil {
+		return nil, err
+	}
+	messages = slices.Clone(messages)
+	messages[idx].MultiContent = append(parts, messages[idx].MultiContent...)
+	return messages, nil
+}
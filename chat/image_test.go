@@ -0,0 +1,135 @@
+package chat
+
+import (
+	"bytes"
+	"csust-got/config"
+	"image"
+	"image/png"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tb "gopkg.in/telebot.v3"
+)
+
+type fakeDownloader map[string][]byte
+
+func (f fakeDownloader) File(file *tb.File) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(f[file.FileID])), nil
+}
+
+func newTestPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	buf := bytes.NewBuffer(nil)
+	require.NoError(t, png.Encode(buf, image.NewRGBA(image.Rect(0, 0, w, h))))
+	return buf.Bytes()
+}
+
+func TestImageFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      *tb.Message
+		expected string
+	}{
+		{name: "text", msg: &tb.Message{Text: "hi"}},
+		{name: "photo", msg: &tb.Message{Photo: &tb.Photo{File: tb.File{FileID: "photo"}}}, expected: "photo"},
+		{name: "static sticker", msg: &tb.Message{Sticker: &tb.Sticker{File: tb.File{FileID: "sticker"}}}, expected: "sticker"},
+		{name: "animated sticker", msg: &tb.Message{Sticker: &tb.Sticker{File: tb.File{FileID: "tgs"}, Animated: true}}},
+		{name: "video sticker", msg: &tb.Message{Sticker: &tb.Sticker{File: tb.File{FileID: "webm"}, Video: true}}},
+		{name: "image document", msg: &tb.Message{Document: &tb.Document{File: tb.File{FileID: "doc"}, MIME: "image/png"}}, expected: "doc"},
+		{name: "pdf document", msg: &tb.Message{Document: &tb.Document{File: tb.File{FileID: "pdf"}, MIME: "application/pdf"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := imageFile(tt.msg)
+			if tt.expected == "" {
+				assert.Nil(t, file)
+				return
+			}
+			require.NotNil(t, file)
+			assert.Equal(t, tt.expected, file.FileID)
+		})
+	}
+}
+
+func TestFindImageMessage(t *testing.T) {
+	photo := &tb.Message{ID: 1, Photo: &tb.Photo{File: tb.File{FileID: "photo"}}}
+	msg := &tb.Message{ID: 3, Text: "看看这个", ReplyTo: &tb.Message{ID: 2, Text: "hi", ReplyTo: photo}}
+	assert.Equal(t, photo, findImageMessage(msg))
+	assert.Nil(t, findImageMessage(&tb.Message{ID: 4, Text: "no image"}))
+}
+
+func TestGetImageParts(t *testing.T) {
+	feature := &config.FeatureSetting{}
+	feature.ImageResizeSetting.MaxWidth = 64
+	feature.ImageResizeSetting.MaxHeight = 64
+
+	files := fakeDownloader{
+		"doc": newTestPNG(t, 256, 128),
+		"bad": []byte("not an image"),
+	}
+
+	t.Run("image document", func(t *testing.T) {
+		msg := &tb.Message{ID: 1, Chat: &tb.Chat{ID: 1},
+			Document: &tb.Document{File: tb.File{FileID: "doc"}, MIME: "image/png"}}
+		ids := imageFileIDs(msg)
+		require.Equal(t, []string{"doc"}, ids)
+		parts, err := getImageParts(files, ids, feature)
+		require.NoError(t, err)
+		require.Len(t, parts, 1)
+		assert.Equal(t, openai.ChatMessagePartTypeImageURL, parts[0].Type)
+		assert.True(t, strings.HasPrefix(parts[0].ImageURL.URL, "data:image/jpeg;base64,"))
+	})
+
+	t.Run("no image", func(t *testing.T) {
+		ids := imageFileIDs(&tb.Message{ID: 1, Text: "hi"})
+		assert.Empty(t, ids)
+		parts, err := getImageParts(files, ids, feature)
+		require.NoError(t, err)
+		assert.Empty(t, parts)
+	})
+
+	t.Run("decode failed", func(t *testing.T) {
+		_, err := getImageParts(files, []string{"bad"}, feature)
+		assert.ErrorIs(t, err, ErrImageDecode)
+	})
+}
+
+func TestWithImages(t *testing.T) {
+	feature := &config.FeatureSetting{}
+	feature.ImageResizeSetting.MaxWidth = 64
+	feature.ImageResizeSetting.MaxHeight = 64
+	files := fakeDownloader{"photo": newTestPNG(t, 32, 32)}
+
+	messages := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: "system"},
+		{Role: openai.ChatMessageRoleUser, MultiContent: []openai.ChatMessagePart{
+			{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: "data:image/jpeg;base64,AAAA"}},
+			{Type: openai.ChatMessagePartTypeText, Text: "这是什么"},
+		}},
+	}
+
+	saved := withoutImages(messages)
+	require.Len(t, saved, 2)
+	assert.Equal(t, []openai.ChatMessagePart{{Type: openai.ChatMessagePartTypeText, Text: "这是什么"}}, saved[1].MultiContent)
+	// the original messages are not changed
+	assert.Len(t, messages[1].MultiContent, 2)
+
+	restored, err := withImages(files, saved, []string{"photo"}, feature)
+	require.NoError(t, err)
+	require.Len(t, restored[1].MultiContent, 2)
+	assert.Equal(t, openai.ChatMessagePartTypeImageURL, restored[1].MultiContent[0].Type)
+	assert.Equal(t, "这是什么", restored[1].MultiContent[1].Text)
+	assert.Len(t, saved[1].MultiContent, 1)
+
+	restored, err = withImages(files, saved, nil, feature)
+	require.NoError(t, err)
+	assert.Equal(t, saved, restored)
+
+	_, err = withImages(fakeDownloader{}, saved, []string{"missing"}, feature)
+	assert.ErrorIs(t, err, ErrImageDecode)
+}
@@ -0,0 +1,407 @@
+package chat
+
+import (
+	"context"
+	"csust-got/base"
+	"csust-got/config"
+	"csust-got/meili"
+	"csust-got/orm"
+	"csust-got/sd"
+	"csust-got/store"
+	"csust-got/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	tb "gopkg.in/telebot.v3"
+)
+
+const (
+	localToolSet = "local"
+
+	maxSearchResults  = 20
+	maxRecentMessages = 50
+	// userLookupRange is how many recent messages are scanned to find user by username
+	userLookupRange = 500
+)
+
+var (
+	// ErrNoToolEnv means the tool is not called in a chat
+	ErrNoToolEnv = errors.New("tool is not called in a chat")
+	// ErrUserNotFound means the user cannot be found in chat
+	ErrUserNotFound = errors.New("user not found")
+)
+
+type toolEnvKey struct{}
+
+// withToolEnv attaches the telegram context which triggered the chat, so local tools know where they are called
+func withToolEnv(ctx context.Context, env tb.Context) context.Context {
+	return context.WithValue(ctx, toolEnvKey{}, env)
+}
+
+func toolEnvFrom(ctx context.Context) (tb.Context, bool) {
+	env, ok := ctx.Value(toolEnvKey{}).(tb.Context)
+	return env, ok && env != nil
+}
+
+type toolReplyToKey struct{}
+
+// withToolReplyTo sets the message which files sent by local tools reply to, usually the answer of chat
+func withToolReplyTo(ctx context.Context, msg *tb.Message) context.Context {
+	return context.WithValue(ctx, toolReplyToKey{}, msg)
+}
+
+// toolReplyTo returns the message which files sent by local tools reply to, the triggering message by default
+func toolReplyTo(ctx context.Context, env tb.Context) *tb.Message {
+	if msg, ok := ctx.Value(toolReplyToKey{}).(*tb.Message); ok && msg != nil {
+		return msg
+	}
+	return env.Message()
+}
+
+// localTool is a tool implemented in bot
+type localTool struct {
+	def openai.Tool
+	fn  func(ctx context.Context, env tb.Context, param string) (string, error)
+}
+
+func newLocalTool(name, desc string, params map[string]any,
+	fn func(ctx context.Context, env tb.Context, param string) (string, error)) *localTool {
+	return &localTool{
+		def: openai.Tool{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        name,
+				Description: desc,
+				Parameters:  params,
+			},
+		},
+		fn: fn,
+	}
+}
+
+// Definition returns the function definition of tool
+func (t *localTool) Definition() openai.Tool {
+	return t.def
+}
+
+// Call calls the local tool in the chat attached to ctx
+func (t *localTool) Call(ctx context.Context, param string) (string, error) {
+	env, ok := toolEnvFrom(ctx)
+	if !ok {
+		return "", ErrNoToolEnv
+	}
+	if param == "" {
+		param = "{}"
+	}
+	return t.fn(ctx, env, param)
+}
+
+func objectSchema(props map[string]any, required ...string) map[string]any {
+	return map[string]any{
+		"type":       "object",
+		"properties": props,
+		"required":   append([]string{}, required...),
+	}
+}
+
+// InitLocalTools registers tools implemented in bot
+func InitLocalTools() {
+	registerLocalTools(tools, config.BotConfig().MeiliConfig.Enabled)
+}
+
+func registerLocalTools(registry *toolRegistry, withSearch bool) {
+	if withSearch {
+		registry.Register(localToolSet, newLocalTool("search_chat_history",
+			"Search history messages of current chat by keywords, optionally sent by a user or in a time range, "+
+				"returns matched messages with sender and time.",
+			objectSchema(map[string]any{
+				"query":    map[string]any{"type": "string", "description": "keywords to search"},
+				"limit":    map[string]any{"type": "integer", "description": "max count of messages, default 10, at most 20"},
+				"username": map[string]any{"type": "string", "description": "only messages sent by the user of username, without @"},
+				"user_id":  map[string]any{"type": "integer", "description": "only messages sent by the user of id"},
+				"since": map[string]any{"type": "string",
+					"description": "only messages sent since the time, `YYYY-MM-DD` or `YYYY-MM-DD HH:MM` in time zone of chat"},
+				"until": map[string]any{"type": "string",
+					"description": "only messages sent before the time, `YYYY-MM-DD` (the whole day is included) or `YYYY-MM-DD HH:MM`"},
+			}, "query"),
+			searchChatHistory))
+	}
+	registry.Register(localToolSet, newLocalTool("schedule_reminder",
+		"Remind the user in current chat after a delay.",
+		objectSchema(map[string]any{
+			"delay":   map[string]any{"type": "string", "description": "delay before reminding, e.g. `30m`, `2h`, `1d2h`"},
+			"content": map[string]any{"type": "string", "description": "what to remind"},
+		}, "delay", "content"),
+		scheduleReminder))
+	registry.Register(localToolSet, newLocalTool("get_recent_messages",
+		"Get the latest messages of current chat, returns messages with sender and time.",
+		objectSchema(map[string]any{
+			"count": map[string]any{"type": "integer", "description": "count of messages, default 20, at most 50"},
+		}),
+		getRecentMessages))
+	registry.Register(localToolSet, newLocalTool("get_user_info",
+		"Get information of a member of current chat, such as names and role. Returns the user who is talking if no argument.",
+		objectSchema(map[string]any{
+			"username": map[string]any{"type": "string", "description": "username of user, without @"},
+			"user_id":  map[string]any{"type": "integer", "description": "id of user"},
+		}),
+		getUserInfo))
+	registry.Register(localToolSet, newLocalTool("generate_image",
+		"Draw images by stable diffusion with the drawing config of the user who is talking, images are sent to current chat. "+
+			"It may take minutes.",
+		objectSchema(map[string]any{
+			"prompt": map[string]any{"type": "string",
+				"description": "what to draw, comma separated English tags, e.g. `1cat, sitting by window, sunset, watercolor`"},
+		}, "prompt"),
+		generateImage))
+}
+
+// parseToolTime parses time of `YYYY-MM-DD HH:MM` or `YYYY-MM-DD` in loc,
+// a date means the start of the day, or the end of the day if endOfDay.
+func parseToolTime(s string, loc *time.Location, endOfDay bool) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.ParseInLocation("2006-01-02 15:04", s, loc); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, s, loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func searchChatHistory(_ context.Context, env tb.Context, param string) (string, error) {
+	var args struct {
+		Query    string `json:"query"`
+		Limit    int64  `json:"limit"`
+		Username string `json:"username"`
+		UserID   int64  `json:"user_id"`
+		Since    string `json:"since"`
+		Until    string `json:"until"`
+	}
+	if err := json.Unmarshal([]byte(param), &args); err != nil || args.Query == "" {
+		return "", ErrInvaliableParameter
+	}
+	if args.Limit <= 0 {
+		args.Limit = 10
+	}
+
+	filter := meili.MessageFilter{SenderID: args.UserID}
+	if filter.SenderID == 0 && args.Username != "" {
+		u, err := findUserByUsername(env.Chat().ID, strings.TrimPrefix(args.Username, "@"))
+		if err != nil {
+			return "User not found in recent messages of this chat", nil
+		}
+		filter.SenderID = u.ID
+	}
+	loc := orm.GetChatLocation(env.Chat().ID)
+	var err error
+	if args.Since != "" {
+		if filter.Since, err = parseToolTime(args.Since, loc, false); err != nil {
+			return "Invalid since, use format like `2025-01-02` or `2025-01-02 15:04`", nil
+		}
+	}
+	if args.Until != "" {
+		if filter.Until, err = parseToolTime(args.Until, loc, true); err != nil {
+			return "Invalid until, use format like `2025-01-02` or `2025-01-02 15:04`", nil
+		}
+	}
+
+	results, err := meili.SearchMessages(env.Chat().ID, args.Query, filter, min(args.Limit, maxSearchResults))
+	if err != nil {
+		return "", err
+	}
+	if len(results) == 0 {
+		return "No message found", nil
+	}
+
+	var sb strings.Builder
+	for _, r := range results {
+		fmt.Fprintf(&sb, "[%s] %s", r["id"], r["name"])
+		if r["username"] != "" {
+			fmt.Fprintf(&sb, " (@%s)", r["username"])
+		}
+		if r["date"] != "" {
+			fmt.Fprintf(&sb, " at %s", r["date"])
+		}
+		fmt.Fprintf(&sb, ": %s\n", r["text"])
+	}
+	return sb.String(), nil
+}
+
+func scheduleReminder(_ context.Context, env tb.Context, param string) (string, error) {
+	var args struct {
+		Delay   string `json:"delay"`
+		Content string `json:"content"`
+	}
+	if err := json.Unmarshal([]byte(param), &args); err != nil || strings.TrimSpace(args.Content) == "" {
+		return "", ErrInvaliableParameter
+	}
+	delay, err := util.EvalDuration(args.Delay)
+	if err != nil || delay < time.Second {
+		return "Invalid delay, use format like `30m`, `2h`, `1d2h`", nil
+	}
+
+	now := time.Now()
+	execTime := now.Add(delay)
+	base.AddTimerTask(&store.Task{
+		User:     env.Sender().Username,
+		UserId:   env.Sender().ID,
+		ChatId:   env.Chat().ID,
+		Info:     strings.TrimSpace(args.Content),
+		ExecTime: execTime.UnixMilli(),
+		SetTime:  now.UnixMilli(),
+	})
+	return fmt.Sprintf("Reminder scheduled at %s", execTime.Format(time.DateTime)), nil
+}
+
+func getRecentMessages(_ context.Context, env tb.Context, param string) (string, error) {
+	var args struct {
+		Count int64 `json:"count"`
+	}
+	if err := json.Unmarshal([]byte(param), &args); err != nil {
+		return "", ErrInvaliableParameter
+	}
+	if args.Count <= 0 {
+		args.Count = 20
+	}
+
+	msgs, err := orm.GetMessagesFromStream(env.Chat().ID, "+", "-", min(args.Count, maxRecentMessages), true)
+	if err != nil {
+		return "", err
+	}
+	if len(msgs) == 0 {
+		return "No message found", nil
+	}
+
+	var sb strings.Builder
+	for i := len(msgs) - 1; i >= 0; i-- {
+		sb.WriteString(formatToolMessage(msgs[i]))
+	}
+	return sb.String(), nil
+}
+
+func formatToolMessage(msg *tb.Message) string {
+	text := getMessageTextWithEntities(msg, false)
+	if text == "" {
+		text = msg.Text
+	}
+	if text == "" && imageFile(msg) != nil {
+		text = "<image_placeholder />"
+	}
+
+	name := ""
+	if msg.Sender != nil {
+		name = (&userNames{First: msg.Sender.FirstName, Last: msg.Sender.LastName}).ShowName()
+		if msg.Sender.Username != "" {
+			name += " (@" + msg.Sender.Username + ")"
+		}
+	}
+	return fmt.Sprintf("[%d] %s at %s: %s\n", msg.ID, name, msg.Time().Format(time.DateTime), text)
+}
+
+// findUserByUsername looks up user in recent messages of chat
+func findUserByUsername(chatID int64, username string) (*tb.User, error) {
+	msgs, err := orm.GetMessagesFromStream(chatID, "+", "-", userLookupRange, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		if msg.Sender != nil && strings.EqualFold(msg.Sender.Username, username) {
+			return msg.Sender, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+// isChatMember reports whether the user of member is in the chat
+func isChatMember(member *tb.ChatMember) bool {
+	if member == nil || member.User == nil {
+		return false
+	}
+	switch member.Role {
+	case tb.Left, tb.Kicked:
+		return false
+	case tb.Restricted:
+		return member.Member
+	}
+	return true
+}
+
+func getUserInfo(_ context.Context, env tb.Context, param string) (string, error) {
+	var args struct {
+		Username string `json:"username"`
+		UserID   int64  `json:"user_id"`
+	}
+	if err := json.Unmarshal([]byte(param), &args); err != nil {
+		return "", ErrInvaliableParameter
+	}
+
+	user := env.Sender()
+	switch {
+	case args.UserID != 0:
+		user = &tb.User{ID: args.UserID}
+	case args.Username != "":
+		u, err := findUserByUsername(env.Chat().ID, strings.TrimPrefix(args.Username, "@"))
+		if err != nil {
+			return "User not found in recent messages of this chat", nil
+		}
+		user = u
+	}
+
+	// only members of current chat can be looked up
+	member, err := env.Bot().ChatMemberOf(env.Chat(), user)
+	if err != nil || !isChatMember(member) {
+		return "User not found in this chat", nil
+	}
+	user = member.User
+	info := map[string]any{"user_id": user.ID, "role": member.Role}
+	if member.Title != "" {
+		info["title"] = member.Title
+	}
+	info["first_name"] = user.FirstName
+	info["last_name"] = user.LastName
+	info["username"] = user.Username
+	info["is_bot"] = user.IsBot
+	if user.LanguageCode != "" {
+		info["language_code"] = user.LanguageCode
+	}
+
+	buf, err := json.Marshal(info)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func generateImage(ctx context.Context, env tb.Context, param string) (string, error) {
+	var args struct {
+		Prompt string `json:"prompt"`
+	}
+	if err := json.Unmarshal([]byte(param), &args); err != nil || strings.TrimSpace(args.Prompt) == "" {
+		return "", ErrInvaliableParameter
+	}
+	// same as `/sd`, which is only available in white list
+	whiteList := config.BotConfig().WhiteListConfig
+	if whiteList.Enabled && !whiteList.Check(env.Chat().ID) {
+		return "Drawing is not available in this chat", nil
+	}
+
+	n, err := sd.Generate(ctx, env, toolReplyTo(ctx, env), strings.TrimSpace(args.Prompt))
+	switch {
+	case errors.Is(err, sd.ErrServerNotConfigured):
+		return "Drawing server is not configured, the user can configure one by /sdcfg", nil
+	case errors.Is(err, sd.ErrUserBusy), errors.Is(err, sd.ErrQueueFull):
+		return "Too many images are being drawn, try again later", nil
+	case err != nil:
+		return "", err
+	}
+	return fmt.Sprintf("%d image(s) have been sent to the chat", n), nil
+}
@@ -0,0 +1,104 @@
+package chat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tb "gopkg.in/telebot.v3"
+)
+
+func newTestToolEnv(t *testing.T) tb.Context {
+	t.Helper()
+	bot, err := tb.NewBot(tb.Settings{Offline: true})
+	require.NoError(t, err)
+	return bot.NewContext(tb.Update{Message: &tb.Message{
+		ID:     1,
+		Chat:   &tb.Chat{ID: -100, Type: tb.ChatGroup},
+		Sender: &tb.User{ID: 42, Username: "alice"},
+		Text:   "/chat remind me",
+	}})
+}
+
+func TestRegisterLocalTools(t *testing.T) {
+	registry := newToolRegistry()
+	registerLocalTools(registry, false)
+	assert.Equal(t, []string{"schedule_reminder", "get_recent_messages", "get_user_info", "generate_image"},
+		registry.GetToolSetToolNames(localToolSet))
+
+	registry = newToolRegistry()
+	registerLocalTools(registry, true)
+	assert.Contains(t, registry.GetToolSetToolNames(localToolSet), "search_chat_history")
+}
+
+func TestLocalToolCall(t *testing.T) {
+	registry := newToolRegistry()
+	registerLocalTools(registry, false)
+	reminder, ok := registry.GetTool("schedule_reminder")
+	require.True(t, ok)
+
+	_, err := reminder.Call(context.Background(), `{"delay":"1h","content":"drink water"}`)
+	assert.ErrorIs(t, err, ErrNoToolEnv)
+
+	ctx := withToolEnv(context.Background(), newTestToolEnv(t))
+	_, err = reminder.Call(ctx, `{"delay":"1h"}`)
+	assert.ErrorIs(t, err, ErrInvaliableParameter)
+
+	result, err := reminder.Call(ctx, `{"delay":"soon","content":"drink water"}`)
+	require.NoError(t, err)
+	assert.Contains(t, result, "Invalid delay")
+}
+
+func TestToolReplyTo(t *testing.T) {
+	env := newTestToolEnv(t)
+	assert.Equal(t, env.Message(), toolReplyTo(context.Background(), env))
+
+	answer := &tb.Message{ID: 2, Chat: env.Chat()}
+	assert.Equal(t, answer, toolReplyTo(withToolReplyTo(context.Background(), answer), env))
+}
+
+func TestFormatToolMessage(t *testing.T) {
+	date := time.Date(2025, 3, 1, 12, 30, 0, 0, time.Local)
+	msg := &tb.Message{
+		ID:       7,
+		Unixtime: date.Unix(),
+		Sender:   &tb.User{FirstName: "Alice", Username: "alice"},
+		Text:     "hello",
+	}
+	assert.Equal(t, "[7] Alice (@alice) at 2025-03-01 12:30:00: hello\n", formatToolMessage(msg))
+
+	msg.Text = ""
+	msg.Photo = &tb.Photo{}
+	assert.Equal(t, "[7] Alice (@alice) at 2025-03-01 12:30:00: <image_placeholder />\n", formatToolMessage(msg))
+}
+
+func TestParseToolTime(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*3600)
+	got, err := parseToolTime("2025-01-02 15:04", loc, true)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2025, 1, 2, 15, 4, 0, 0, loc), got)
+
+	got, err = parseToolTime(" 2025-01-02 ", loc, false)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2025, 1, 2, 0, 0, 0, 0, loc), got)
+
+	got, err = parseToolTime("2025-01-02", loc, true)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2025, 1, 3, 0, 0, 0, 0, loc), got)
+
+	_, err = parseToolTime("yesterday", loc, false)
+	assert.Error(t, err)
+}
+
+func TestIsChatMember(t *testing.T) {
+	user := &tb.User{ID: 42}
+	assert.True(t, isChatMember(&tb.ChatMember{User: user, Role: tb.Member}))
+	assert.True(t, isChatMember(&tb.ChatMember{User: user, Role: tb.Administrator}))
+	assert.True(t, isChatMember(&tb.ChatMember{User: user, Role: tb.Restricted, Member: true}))
+	assert.False(t, isChatMember(&tb.ChatMember{User: user, Role: tb.Restricted}))
+	assert.False(t, isChatMember(&tb.ChatMember{User: user, Role: tb.Left}))
+	assert.False(t, isChatMember(&tb.ChatMember{User: user, Role: tb.Kicked}))
+	assert.False(t, isChatMember(nil))
+}
@@ -0,0 +1,19 @@
+package chat
+
+import (
+	"csust-got/config"
+	"csust-got/log"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv(mcpTestServerEnv) == "1" {
+		serveTestMcpStdio(os.Stdin, os.Stdout)
+		os.Exit(0)
+	}
+
+	config.SetBotConfig(config.NewBotConfig())
+	log.InitLogger()
+	os.Exit(m.Run())
+}
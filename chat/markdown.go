@@ -0,0 +1,652 @@
+package chat
+
+import (
+	"csust-got/util"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The converter renders markdown written by model into telegram HTML or MarkdownV2.
+// Telegram only supports a few entities, so headings become bold, lists are written with bullets,
+// and tables are degraded to monospace blocks.
+// Markers which are not closed are kept as text, so the output is always valid for partial text in streaming.
+
+type mdInlineKind int
+
+const (
+	mdText mdInlineKind = iota
+	mdBold
+	mdItalic
+	mdStrike
+	mdCode
+	mdLink
+)
+
+// mdInline is an inline node of markdown
+type mdInline struct {
+	kind     mdInlineKind
+	text     string // text of mdText and mdCode
+	url      string // url of mdLink
+	children []mdInline
+}
+
+type mdBlockKind int
+
+const (
+	mdParagraph mdBlockKind = iota
+	mdBlank
+	mdHeading
+	mdListItem
+	mdCodeBlock
+	mdQuote
+	mdTable
+	mdRule
+)
+
+// mdBlock is a block of markdown
+type mdBlock struct {
+	kind     mdBlockKind
+	lines    []string // lines of paragraph, code block and table
+	text     string   // text of heading and list item
+	lang     string   // language of code block
+	marker   string   // marker of list item
+	level    int      // nesting level of list item
+	children []mdBlock
+}
+
+var (
+	mdFencePatt     = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})\\s*([^`\\s]*)")
+	mdHeadingPatt   = regexp.MustCompile(`^ {0,3}#{1,6}(?:\s+(.*?))?(?:\s+#+)?\s*$`)
+	mdRulePatt      = regexp.MustCompile(`^ {0,3}(?:(?:-\s*){3,}|(?:\*\s*){3,}|(?:_\s*){3,})$`)
+	mdQuotePatt     = regexp.MustCompile(`^ {0,3}> ?`)
+	mdListPatt      = regexp.MustCompile(`^(\s*)([-*+]|\d{1,9}[.)])\s+(.*)$`)
+	mdTaskPatt      = regexp.MustCompile(`^\[([ xX])\]\s+`)
+	mdTableSepPatt  = regexp.MustCompile(`^\s*\|?\s*:?-+:?\s*(?:\|\s*:?-+:?\s*)*\|?\s*$`)
+	mdCodeLangPatt  = regexp.MustCompile(`^[\w#+.-]+$`)
+	mdLinkSchemPatt = regexp.MustCompile(`^(?i:https?://|tg://|mailto:)\S+$`)
+)
+
+// renderMarkdown converts markdown to telegram text in format `html` or `markdown`(MarkdownV2)
+func renderMarkdown(text, format string) string {
+	blocks := parseMarkdownBlocks(strings.Split(strings.TrimRight(text, "\n"), "\n"))
+	r := &mdRenderer{html: format == "html"}
+	r.renderBlocks(blocks)
+	return strings.TrimRight(r.buf.String(), "\n")
+}
+
+func parseMarkdownBlocks(lines []string) []mdBlock {
+	var blocks []mdBlock
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			if len(blocks) > 0 && blocks[len(blocks)-1].kind != mdBlank {
+				blocks = append(blocks, mdBlock{kind: mdBlank})
+			}
+		case mdFencePatt.MatchString(line):
+			m := mdFencePatt.FindStringSubmatch(line)
+			fence := m[1]
+			block := mdBlock{kind: mdCodeBlock, lang: m[2]}
+			// code block which is not closed lasts to the end
+			for i++; i < len(lines); i++ {
+				if t := strings.TrimSpace(lines[i]); strings.HasPrefix(t, fence) && strings.Trim(t, fence[:1]) == "" {
+					break
+				}
+				block.lines = append(block.lines, lines[i])
+			}
+			blocks = append(blocks, block)
+		case mdHeadingPatt.MatchString(line):
+			blocks = append(blocks, mdBlock{kind: mdHeading, text: mdHeadingPatt.FindStringSubmatch(line)[1]})
+		case mdRulePatt.MatchString(line):
+			blocks = append(blocks, mdBlock{kind: mdRule})
+		case mdQuotePatt.MatchString(line):
+			var quoted []string
+			for ; i < len(lines) && mdQuotePatt.MatchString(lines[i]); i++ {
+				quoted = append(quoted, mdQuotePatt.ReplaceAllString(lines[i], ""))
+			}
+			i--
+			blocks = append(blocks, mdBlock{kind: mdQuote, children: parseMarkdownBlocks(quoted)})
+		case strings.Contains(line, "|") && i+1 < len(lines) && mdTableSepPatt.MatchString(lines[i+1]) &&
+			strings.Contains(lines[i+1], "-"):
+			block := mdBlock{kind: mdTable, lines: []string{line}}
+			for i += 2; i < len(lines) && strings.Contains(lines[i], "|") && strings.TrimSpace(lines[i]) != ""; i++ {
+				block.lines = append(block.lines, lines[i])
+			}
+			i--
+			blocks = append(blocks, block)
+		case mdListPatt.MatchString(line):
+			m := mdListPatt.FindStringSubmatch(line)
+			indent := strings.ReplaceAll(m[1], "\t", "    ")
+			block := mdBlock{kind: mdListItem, marker: m[2], level: len(indent) / 2, text: m[3]}
+			if strings.ContainsAny(m[2][:1], "-*+") {
+				block.marker = "•"
+			}
+			if t := mdTaskPatt.FindStringSubmatch(block.text); t != nil {
+				block.marker = "☐"
+				if t[1] != " " {
+					block.marker = "☑"
+				}
+				block.text = block.text[len(t[0]):]
+			}
+			blocks = append(blocks, block)
+		default:
+			if n := len(blocks); n > 0 && blocks[n-1].kind == mdParagraph {
+				blocks[n-1].lines = append(blocks[n-1].lines, line)
+			} else {
+				blocks = append(blocks, mdBlock{kind: mdParagraph, lines: []string{line}})
+			}
+		}
+	}
+	if n := len(blocks); n > 0 && blocks[n-1].kind == mdBlank {
+		blocks = blocks[:n-1]
+	}
+	return blocks
+}
+
+// unclosedFence returns the opening line of code block which is not closed at the end of text
+func unclosedFence(text string) string {
+	var open, fence string
+	for _, line := range strings.Split(text, "\n") {
+		if fence == "" {
+			if m := mdFencePatt.FindStringSubmatch(line); m != nil {
+				open, fence = strings.TrimSpace(line), m[1]
+			}
+		} else if t := strings.TrimSpace(line); strings.HasPrefix(t, fence) && strings.Trim(t, fence[:1]) == "" {
+			open, fence = "", ""
+		}
+	}
+	return open
+}
+
+func isASCIIPunct(c byte) bool {
+	return c < utf8.RuneSelf && unicode.IsPunct(rune(c)) || strings.IndexByte("$+<=>^`|~", c) >= 0
+}
+
+func isSpaceByte(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n'
+}
+
+func isWordByte(c byte) bool {
+	return c >= utf8.RuneSelf || c == '_' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c))
+}
+
+// parseInline parses inline markdown, markers which are not closed are kept as text
+func parseInline(s string) []mdInline {
+	var nodes []mdInline
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			nodes = append(nodes, mdInline{kind: mdText, text: text.String()})
+			text.Reset()
+		}
+	}
+	add := func(node mdInline) {
+		flush()
+		nodes = append(nodes, node)
+	}
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch c {
+		case '\\':
+			if i+1 < len(s) && isASCIIPunct(s[i+1]) {
+				text.WriteByte(s[i+1])
+				i += 2
+				continue
+			}
+		case '`':
+			n := countByte(s[i:], '`')
+			if end := findCodeSpanEnd(s, i+n, n); end >= 0 {
+				code := s[i+n : end]
+				if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.Trim(code, " ") != "" {
+					code = code[1 : len(code)-1]
+				}
+				add(mdInline{kind: mdCode, text: code})
+				i = end + n
+				continue
+			}
+			text.WriteString(s[i : i+n])
+			i += n
+			continue
+		case '*', '_', '~':
+			if node, next, ok := parseEmphasis(s, i); ok {
+				add(node)
+				i = next
+				continue
+			}
+			// a run of markers which is not closed
+			n := countByte(s[i:], c)
+			text.WriteString(s[i : i+n])
+			i += n
+			continue
+		case '!':
+			if i+1 < len(s) && s[i+1] == '[' {
+				if node, next, ok := parseLink(s, i+1); ok {
+					add(node)
+					i = next
+					continue
+				}
+			}
+		case '[':
+			if node, next, ok := parseLink(s, i); ok {
+				add(node)
+				i = next
+				continue
+			}
+		}
+		text.WriteByte(c)
+		i++
+	}
+	flush()
+	return nodes
+}
+
+func countByte(s string, c byte) int {
+	n := 0
+	for n < len(s) && s[n] == c {
+		n++
+	}
+	return n
+}
+
+// findCodeSpanEnd finds the closing backticks of a code span, which is a run of exactly n backticks
+func findCodeSpanEnd(s string, from, n int) int {
+	for i := from; i < len(s); {
+		if s[i] != '`' {
+			i++
+			continue
+		}
+		m := countByte(s[i:], '`')
+		if m == n {
+			return i
+		}
+		i += m
+	}
+	return -1
+}
+
+// parseEmphasis parses bold, italic and strikethrough starting at i
+func parseEmphasis(s string, i int) (mdInline, int, bool) {
+	c := s[i]
+	delim, kind := s[i:i+1], mdItalic
+	switch {
+	case c == '~' && strings.HasPrefix(s[i:], "~~"):
+		delim, kind = "~~", mdStrike
+	case c == '~':
+		return mdInline{}, 0, false
+	case i+1 < len(s) && s[i+1] == c:
+		delim, kind = s[i:i+2], mdBold
+	}
+
+	start := i + len(delim)
+	if start >= len(s) || isSpaceByte(s[start]) {
+		return mdInline{}, 0, false
+	}
+	// `_` inside word is not a marker, such as snake_case
+	if c == '_' && i > 0 && isWordByte(s[i-1]) {
+		return mdInline{}, 0, false
+	}
+
+	for j := start; j < len(s); {
+		switch {
+		case s[j] == '\\':
+			j += 2
+			continue
+		case s[j] == '`':
+			n := countByte(s[j:], '`')
+			if end := findCodeSpanEnd(s, j+n, n); end >= 0 {
+				j = end + n
+			} else {
+				j += n
+			}
+			continue
+		case s[j] != c:
+			j++
+			continue
+		}
+
+		n := countByte(s[j:], c)
+		if n < len(delim) || isSpaceByte(s[j-1]) || j == start {
+			j += n
+			continue
+		}
+		if kind == mdItalic && n == 2 {
+			// bold inside italic
+			j += n
+			continue
+		}
+		// for `***text***`, the inner markers belong to content
+		end := j + n - len(delim)
+		if c == '_' && end+len(delim) < len(s) && isWordByte(s[end+len(delim)]) {
+			j += n
+			continue
+		}
+		return mdInline{kind: kind, children: parseInline(s[start:end])}, end + len(delim), true
+	}
+	return mdInline{}, 0, false
+}
+
+// parseLink parses `[text](url)` starting at i
+func parseLink(s string, i int) (mdInline, int, bool) {
+	depth := 0
+	closeText := -1
+	for j := i; j < len(s) && closeText < 0; j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				closeText = j
+			}
+		case '\n':
+			if j+1 < len(s) && s[j+1] == '\n' {
+				return mdInline{}, 0, false
+			}
+		}
+	}
+	if closeText < 0 || closeText+1 >= len(s) || s[closeText+1] != '(' {
+		return mdInline{}, 0, false
+	}
+
+	depth = 0
+	for j := closeText + 1; j < len(s); j++ {
+		switch s[j] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth > 0 {
+				continue
+			}
+			url := strings.TrimSpace(s[closeText+2 : j])
+			// drop the title
+			if idx := strings.IndexAny(url, " \t"); idx >= 0 {
+				url = url[:idx]
+			}
+			url = strings.TrimSuffix(strings.TrimPrefix(url, "<"), ">")
+			return mdInline{kind: mdLink, url: url, children: parseInline(s[i+1 : closeText])}, j + 1, true
+		case '\n':
+			return mdInline{}, 0, false
+		}
+	}
+	return mdInline{}, 0, false
+}
+
+// plainText returns the text of inline nodes without any format
+func plainText(nodes []mdInline) string {
+	var sb strings.Builder
+	for _, n := range nodes {
+		switch n.kind {
+		case mdText, mdCode:
+			sb.WriteString(n.text)
+		default:
+			sb.WriteString(plainText(n.children))
+		}
+	}
+	return sb.String()
+}
+
+// mdRenderer writes markdown blocks as telegram HTML or MarkdownV2
+type mdRenderer struct {
+	html    bool
+	buf     strings.Builder
+	inQuote bool
+}
+
+func (r *mdRenderer) escape(s string) string {
+	if r.html {
+		return util.EscapeTgHTMLReservedChars(s)
+	}
+	return util.EscapeTgMDv2ReservedChars(s)
+}
+
+// escapeCode escapes text inside code and pre entities
+func (r *mdRenderer) escapeCode(s string) string {
+	if r.html {
+		return util.EscapeTgHTMLReservedChars(s)
+	}
+	return strings.NewReplacer("\\", "\\\\", "`", "\\`").Replace(s)
+}
+
+func (r *mdRenderer) renderBlocks(blocks []mdBlock) {
+	for _, b := range blocks {
+		r.renderBlock(b)
+	}
+}
+
+func (r *mdRenderer) renderBlock(b mdBlock) {
+	switch b.kind {
+	case mdBlank:
+		r.buf.WriteString("\n")
+	case mdParagraph:
+		r.renderInline(parseInline(strings.Join(b.lines, "\n")), nil)
+		r.buf.WriteString("\n")
+	case mdHeading:
+		r.renderInline([]mdInline{{kind: mdBold, children: parseInline(b.text)}}, nil)
+		r.buf.WriteString("\n")
+	case mdRule:
+		r.buf.WriteString("——————\n")
+	case mdListItem:
+		r.buf.WriteString(strings.Repeat("  ", b.level))
+		r.buf.WriteString(r.escape(b.marker))
+		r.buf.WriteString(" ")
+		r.renderInline(parseInline(b.text), nil)
+		r.buf.WriteString("\n")
+	case mdCodeBlock:
+		r.renderPre(strings.Join(b.lines, "\n"), b.lang)
+	case mdTable:
+		r.renderPre(formatTable(b.lines), "")
+	case mdQuote:
+		r.renderQuote(b.children)
+	}
+}
+
+func (r *mdRenderer) renderPre(code, lang string) {
+	if r.inQuote {
+		// quote can't contain pre, write lines as code
+		for _, line := range strings.Split(code, "\n") {
+			if line != "" {
+				r.renderInline([]mdInline{{kind: mdCode, text: line}}, nil)
+			}
+			r.buf.WriteString("\n")
+		}
+		return
+	}
+	if !mdCodeLangPatt.MatchString(lang) {
+		lang = ""
+	}
+	if r.html {
+		if lang != "" {
+			r.buf.WriteString(`<pre><code class="language-` + lang + `">` + r.escapeCode(code) + "</code></pre>\n")
+		} else {
+			r.buf.WriteString("<pre>" + r.escapeCode(code) + "</pre>\n")
+		}
+		return
+	}
+	r.buf.WriteString("```" + lang + "\n" + r.escapeCode(code) + "\n```\n")
+}
+
+func (r *mdRenderer) renderQuote(children []mdBlock) {
+	if r.inQuote {
+		// quote can't be nested
+		r.renderBlocks(children)
+		return
+	}
+
+	inner := &mdRenderer{html: r.html, inQuote: true}
+	inner.renderBlocks(children)
+	text := strings.TrimRight(inner.buf.String(), "\n")
+	if r.html {
+		r.buf.WriteString("<blockquote>" + text + "</blockquote>\n")
+		return
+	}
+	for _, line := range strings.Split(text, "\n") {
+		r.buf.WriteString(">" + line + "\n")
+	}
+}
+
+// renderInline writes inline nodes, active is the entities already opened, they will not be nested again
+func (r *mdRenderer) renderInline(nodes []mdInline, active map[mdInlineKind]bool) {
+	for _, n := range nodes {
+		switch n.kind {
+		case mdText:
+			r.buf.WriteString(r.escape(n.text))
+		case mdCode:
+			if active[mdLink] || active[mdCode] {
+				r.buf.WriteString(r.escape(n.text))
+				continue
+			}
+			if r.html {
+				r.buf.WriteString("<code>" + r.escapeCode(n.text) + "</code>")
+			} else {
+				r.buf.WriteString("`" + r.escapeCode(n.text) + "`")
+			}
+		case mdLink:
+			if active[mdLink] || !mdLinkSchemPatt.MatchString(n.url) {
+				// invalid url is not accepted by telegram
+				r.renderInline(n.children, active)
+				if !active[mdLink] && n.url != "" {
+					r.buf.WriteString(r.escape(" (" + n.url + ")"))
+				}
+				continue
+			}
+			children := n.children
+			if plainText(children) == "" {
+				children = []mdInline{{kind: mdText, text: n.url}}
+			}
+			if r.html {
+				r.buf.WriteString(`<a href="` + strings.ReplaceAll(util.EscapeTgHTMLReservedChars(n.url), `"`, "&quot;") + `">`)
+				r.renderInline(children, with(active, mdLink))
+				r.buf.WriteString("</a>")
+			} else {
+				r.buf.WriteString("[")
+				r.renderInline(children, with(active, mdLink))
+				r.buf.WriteString("](" + strings.NewReplacer("\\", "\\\\", ")", "\\)").Replace(n.url) + ")")
+			}
+		default:
+			if active[n.kind] {
+				r.renderInline(n.children, active)
+				continue
+			}
+			open, closing := r.marker(n.kind)
+			if !r.html && open == "_" && strings.HasSuffix(r.buf.String(), "_") && !strings.HasSuffix(r.buf.String(), "\\_") {
+				// `__` means underline, separate italics by an empty bold entity
+				r.buf.WriteString("**")
+			}
+			r.buf.WriteString(open)
+			r.renderInline(n.children, with(active, n.kind))
+			r.buf.WriteString(closing)
+		}
+	}
+}
+
+func (r *mdRenderer) marker(kind mdInlineKind) (string, string) {
+	var tag, md string
+	switch kind {
+	case mdBold:
+		tag, md = "b", "*"
+	case mdItalic:
+		tag, md = "i", "_"
+	case mdStrike:
+		tag, md = "s", "~"
+	}
+	if r.html {
+		return "<" + tag + ">", "</" + tag + ">"
+	}
+	return md, md
+}
+
+func with(active map[mdInlineKind]bool, kind mdInlineKind) map[mdInlineKind]bool {
+	m := make(map[mdInlineKind]bool, len(active)+1)
+	for k, v := range active {
+		m[k] = v
+	}
+	m[kind] = true
+	return m
+}
+
+// formatTable formats markdown table rows as aligned monospace text
+func formatTable(lines []string) string {
+	rows := make([][]string, 0, len(lines))
+	var widths []int
+	for _, line := range lines {
+		cells := splitTableRow(line)
+		for i, cell := range cells {
+			if i >= len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[i] = max(widths[i], displayWidth(cell))
+		}
+		rows = append(rows, cells)
+	}
+
+	out := make([]string, 0, len(rows)+1)
+	for i, row := range rows {
+		var sb strings.Builder
+		for j := range widths {
+			cell := ""
+			if j < len(row) {
+				cell = row[j]
+			}
+			if j > 0 {
+				sb.WriteString(" | ")
+			}
+			sb.WriteString(cell)
+			sb.WriteString(strings.Repeat(" ", widths[j]-displayWidth(cell)))
+		}
+		out = append(out, strings.TrimRight(sb.String(), " "))
+		if i == 0 {
+			seps := make([]string, len(widths))
+			for j, w := range widths {
+				seps[j] = strings.Repeat("-", w)
+			}
+			out = append(out, strings.Join(seps, "-+-"))
+		}
+	}
+	return strings.Join(out, "\n")
+}
+
+func splitTableRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, `\|`) {
+		line = line[:len(line)-1]
+	}
+
+	var cells []string
+	var cell strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && line[i+1] == '|':
+			cell.WriteByte('|')
+			i++
+		case line[i] == '|':
+			cells = append(cells, strings.TrimSpace(plainText(parseInline(cell.String()))))
+			cell.Reset()
+		default:
+			cell.WriteByte(line[i])
+		}
+	}
+	return append(cells, strings.TrimSpace(plainText(parseInline(cell.String()))))
+}
+
+// displayWidth returns width of text in monospace font, wide characters take two columns
+func displayWidth(s string) int {
+	w := 0
+	for _, r := range s {
+		switch {
+		case unicode.Is(unicode.Han, r), unicode.Is(unicode.Hangul, r), unicode.Is(unicode.Hiragana, r),
+			unicode.Is(unicode.Katakana, r), r >= 0xFF01 && r <= 0xFF60, r >= 0x3000 && r <= 0x303F, r >= 0x1F300:
+			w += 2
+		case unicode.Is(unicode.Mn, r):
+		default:
+			w++
+		}
+	}
+	return w
+}
@@ -0,0 +1,234 @@
+package chat
+
+import (
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files of markdown tests")
+
+func TestRenderMarkdownGolden(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "markdown", "*.md"))
+	require.NoError(t, err)
+	require.NotEmpty(t, inputs)
+
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".md")
+		t.Run(name, func(t *testing.T) {
+			src, err := os.ReadFile(input)
+			require.NoError(t, err)
+
+			for format, ext := range map[string]string{"html": ".html", "markdown": ".mdv2"} {
+				golden := strings.TrimSuffix(input, ".md") + ext
+				got := renderMarkdown(string(src), format)
+				if *updateGolden {
+					require.NoError(t, os.WriteFile(golden, []byte(got+"\n"), 0o600))
+				}
+				want, err := os.ReadFile(golden)
+				require.NoError(t, err)
+				assert.Equal(t, strings.TrimSuffix(string(want), "\n"), got, golden)
+			}
+		})
+	}
+}
+
+// TestRenderMarkdownPartial checks output is valid for every prefix of inputs, as text in streaming.
+func TestRenderMarkdownPartial(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "markdown", "*.md"))
+	require.NoError(t, err)
+
+	for _, input := range inputs {
+		src, err := os.ReadFile(input)
+		require.NoError(t, err)
+		text := string(src)
+		for i := range len(text) + 1 {
+			if !utf8.ValidString(text[:i]) {
+				continue
+			}
+			html := renderMarkdown(text[:i], "html")
+			require.NoError(t, checkTgHTML(html), "%s[:%d]\n%s", input, i, html)
+			md := renderMarkdown(text[:i], "markdown")
+			require.NoError(t, checkTgMDv2(md), "%s[:%d]\n%s", input, i, md)
+		}
+	}
+}
+
+func TestRenderMarkdownInline(t *testing.T) {
+	cases := []struct {
+		in, html, md string
+	}{
+		{"**a** *b*", "<b>a</b> <i>b</i>", "*a* _b_"},
+		{"**unclosed", "**unclosed", `\*\*unclosed`},
+		{"snake_case_name", "snake_case_name", `snake\_case\_name`},
+		{"*a*", "<i>a</i>", "_a_"},
+		{"**bold *it* bold**", "<b>bold <i>it</i> bold</b>", "*bold _it_ bold*"},
+		{"***x***", "<b><i>x</i></b>", "*_x_*"},
+		{"_a_ _b_", "<i>a</i> <i>b</i>", "_a_ _b_"},
+		{"*a*_b_", "<i>a</i><i>b</i>", "_a_**_b_"},
+		{"[t](javascript:alert(1))", "t (javascript:alert(1))", `t \(javascript:alert\(1\)\)`},
+		{"[](https://a.b)", `<a href="https://a.b">https://a.b</a>`, `[https://a\.b](https://a.b)`},
+		{"`a\\`", "<code>a\\</code>", "`a\\\\`"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.html, renderMarkdown(c.in, "html"), c.in)
+		assert.Equal(t, c.md, renderMarkdown(c.in, "markdown"), c.in)
+	}
+}
+
+func TestDisplayWidth(t *testing.T) {
+	assert.Equal(t, 5, displayWidth("hello"))
+	assert.Equal(t, 4, displayWidth("苹果"))
+	assert.Equal(t, 3, displayWidth("a，"))
+}
+
+var tgHTMLTags = map[string]bool{"b": true, "i": true, "s": true, "u": true, "code": true, "pre": true, "a": true, "blockquote": true}
+
+// checkTgHTML checks text is well-formed telegram HTML
+func checkTgHTML(text string) error {
+	d := xml.NewDecoder(strings.NewReader("<root>" + text + "</root>"))
+	var stack []string
+	for {
+		tok, err := d.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			name := tok.Name.Local
+			if name == "root" {
+				continue
+			}
+			if !tgHTMLTags[name] {
+				return fmt.Errorf("unsupported tag <%s>", name)
+			}
+			for _, open := range stack {
+				if open == name || open == "code" || open == "pre" && name != "code" || open == "blockquote" && name == "pre" {
+					return fmt.Errorf("<%s> can't be inside <%s>", name, open)
+				}
+			}
+			stack = append(stack, name)
+		case xml.EndElement:
+			if tok.Name.Local != "root" {
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+}
+
+// checkTgMDv2 checks text is valid telegram MarkdownV2
+//
+//nolint:gocyclo // a small state machine of MarkdownV2 syntax
+func checkTgMDv2(text string) error {
+	var stack []string
+	inLink := false
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '\\':
+			if i+1 >= len(text) || text[i+1] == '\n' {
+				return fmt.Errorf("bad escape at %d", i)
+			}
+			i++
+		case strings.HasPrefix(text[i:], "```"):
+			if len(stack) > 0 || inLink {
+				return fmt.Errorf("pre inside entity at %d", i)
+			}
+			end, err := skipMDv2Code(text, i+3, "```")
+			if err != nil {
+				return err
+			}
+			i = end + 2
+		case c == '`':
+			end, err := skipMDv2Code(text, i+1, "`")
+			if err != nil {
+				return err
+			}
+			if strings.Contains(text[i:end], "\n") {
+				return fmt.Errorf("inline code contains new line at %d", i)
+			}
+			i = end
+		case c == '*' || c == '_' || c == '~':
+			marker := string(c)
+			if c == '_' && i+1 < len(text) && text[i+1] == '_' {
+				marker = "__"
+				i++
+			}
+			switch {
+			case len(stack) > 0 && stack[len(stack)-1] == marker:
+				stack = stack[:len(stack)-1]
+			case containsString(stack, marker):
+				return fmt.Errorf("entities cross at %d", i)
+			default:
+				stack = append(stack, marker)
+			}
+		case c == '[':
+			if inLink {
+				return fmt.Errorf("link inside link at %d", i)
+			}
+			inLink = true
+		case c == ']':
+			if !inLink || i+1 >= len(text) || text[i+1] != '(' {
+				return fmt.Errorf("bad link at %d", i)
+			}
+			inLink = false
+			j := i + 2
+			for ; j < len(text) && text[j] != ')'; j++ {
+				if text[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(text) {
+				return fmt.Errorf("unclosed link url at %d", i)
+			}
+			i = j
+		case c == '>':
+			if i > 0 && text[i-1] != '\n' {
+				return fmt.Errorf("unescaped `>` at %d", i)
+			}
+		case strings.IndexByte("()#+-=|{}.!", c) >= 0:
+			return fmt.Errorf("unescaped `%c` at %d", c, i)
+		}
+	}
+	if len(stack) > 0 || inLink {
+		return fmt.Errorf("unclosed entities %v", stack)
+	}
+	return nil
+}
+
+// skipMDv2Code returns the position of end delimiter of code
+func skipMDv2Code(text string, from int, delim string) (int, error) {
+	for i := from; i < len(text); i++ {
+		switch {
+		case text[i] == '\\':
+			i++
+		case strings.HasPrefix(text[i:], delim):
+			return i, nil
+		case text[i] == '`':
+			return 0, fmt.Errorf("unescaped ` in code at %d", i)
+		}
+	}
+	return 0, fmt.Errorf("unclosed code at %d", from)
+}
+
+func containsString(s []string, v string) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
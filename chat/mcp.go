@@ -0,0 +1,294 @@
+package chat
+
+import (
+	"context"
+	"csust-got/config"
+	"csust-got/log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+)
+
+// mcpProtocolVersion is the mcp protocol version used in initialization
+const mcpProtocolVersion = "2025-03-26"
+
+// ErrUnknownMcpTransport means the transport in config is not supported
+var ErrUnknownMcpTransport = errors.New("unknown mcp transport")
+
+var mcpClients []*McpClient
+
+// McpClient is a native mcp client which talks to a mcp server with jsonrpc
+type McpClient struct {
+	cnf       *config.McpServerConfig
+	transport mcpTransport
+	nextID    atomic.Int64
+}
+
+// McpTool is a tool provided by mcp server
+type McpTool struct {
+	client *McpClient
+	Name   string // name of tool in mcp server, may differ from function name
+
+	openai.Tool
+}
+
+// mcpToolInfo is the tool defined in `tools/list` result
+type mcpToolInfo struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"inputSchema"`
+}
+
+// mcpContent is the content in `tools/call` result
+type mcpContent struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	MimeType string          `json:"mimeType,omitempty"`
+	Resource json.RawMessage `json:"resource,omitempty"`
+}
+
+// NewMcpClient creates a [McpClient] and starts the transport, [McpClient.Initialize] should be called before use.
+func NewMcpClient(cnf *config.McpServerConfig) (*McpClient, error) {
+	var transport mcpTransport
+	switch cnf.GetTransport() {
+	case config.McpTransportStdio:
+		t, err := newStdioTransport(cnf.Name, cnf.Command, cnf.Args, cnf.Env)
+		if err != nil {
+			return nil, err
+		}
+		transport = t
+	case config.McpTransportHttp:
+		transport = newHttpTransport(cnf.Url, cnf.Headers)
+	case config.McpTransportSse:
+		t, err := newSseTransport(cnf.Url, cnf.Headers, cnf.GetTimeout())
+		if err != nil {
+			return nil, err
+		}
+		transport = t
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMcpTransport, cnf.Transport)
+	}
+	return &McpClient{cnf: cnf, transport: transport}, nil
+}
+
+// InitMcpClients connects all enabled mcp servers and registers their tools
+func InitMcpClients() {
+	for _, cnf := range *config.BotConfig().McpServers {
+		if !cnf.Enable {
+			continue
+		}
+		client, err := NewMcpClient(cnf)
+		if err != nil {
+			log.Error("failed to start mcp client", zap.String("server", cnf.Name), zap.Error(err))
+			continue
+		}
+		count, err := client.registerTools(context.Background(), tools)
+		if err != nil {
+			log.Error("failed to init mcp client", zap.String("server", cnf.Name), zap.Error(err))
+			_ = client.Close()
+			continue
+		}
+		mcpClients = append(mcpClients, client)
+		log.Info("mcp server connected", zap.String("server", cnf.Name), zap.Int("tools", count))
+	}
+}
+
+// registerTools initializes client and registers tools of server into registry
+func (c *McpClient) registerTools(ctx context.Context, registry *toolRegistry) (int, error) {
+	if err := c.Initialize(ctx); err != nil {
+		return 0, err
+	}
+	mcpTools, err := c.ListTools(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	set := "mcp_" + c.cnf.Name
+	for _, tool := range mcpTools {
+		if len(c.cnf.Tools) > 0 && !slices.Contains(c.cnf.Tools, tool.Name) {
+			continue
+		}
+		if !registry.Register(set, tool) {
+			// name conflicts with other tool, add server name as prefix
+			tool.Function.Name = c.cnf.Name + "_" + tool.Name
+			if !registry.Register(set, tool) {
+				continue
+			}
+		}
+		if slices.Contains(c.cnf.DangerousTools, tool.Name) {
+			registry.MarkDangerous(tool.Function.Name)
+		}
+		count++
+		log.Debug("enable mcp tool", zap.String("server", c.cnf.Name), zap.String("name", tool.Function.Name),
+			zap.String("desc", tool.Function.Description))
+	}
+	return count, nil
+}
+
+// call sends a request to server and decodes the result
+func (c *McpClient) call(ctx context.Context, method string, params any, result any) error {
+	ctx, cancel := context.WithTimeout(ctx, c.cnf.GetTimeout())
+	defer cancel()
+
+	req := &jsonrpcMessage{
+		JSONRPC: jsonrpcVersion,
+		ID:      json.RawMessage(strconv.FormatInt(c.nextID.Add(1), 10)),
+		Method:  method,
+	}
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		req.Params = data
+	}
+
+	resp, err := c.transport.RoundTrip(ctx, req)
+	if err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+// Initialize does the mcp initialization handshake
+func (c *McpClient) Initialize(ctx context.Context) error {
+	params := map[string]any{
+		"protocolVersion": mcpProtocolVersion,
+		"capabilities":    map[string]any{},
+		"clientInfo":      map[string]any{"name": "csust-got", "version": "1.0.0"},
+	}
+	var result struct {
+		ProtocolVersion string `json:"protocolVersion"`
+		ServerInfo      struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"serverInfo"`
+	}
+	if err := c.call(ctx, "initialize", params, &result); err != nil {
+		return err
+	}
+	log.Debug("mcp server initialized", zap.String("server", c.cnf.Name), zap.String("protocol", result.ProtocolVersion),
+		zap.String("name", result.ServerInfo.Name), zap.String("version", result.ServerInfo.Version))
+
+	ctx, cancel := context.WithTimeout(ctx, c.cnf.GetTimeout())
+	defer cancel()
+	return c.transport.Notify(ctx, &jsonrpcMessage{JSONRPC: jsonrpcVersion, Method: "notifications/initialized"})
+}
+
+// ListTools lists all tools of server
+func (c *McpClient) ListTools(ctx context.Context) ([]*McpTool, error) {
+	var ret []*McpTool
+	cursor := ""
+	for {
+		params := map[string]any{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+		var result struct {
+			Tools      []mcpToolInfo `json:"tools"`
+			NextCursor string        `json:"nextCursor"`
+		}
+		if err := c.call(ctx, "tools/list", params, &result); err != nil {
+			return nil, err
+		}
+
+		for _, info := range result.Tools {
+			var schema any = info.InputSchema
+			if len(info.InputSchema) == 0 {
+				schema = map[string]any{"type": "object", "properties": map[string]any{}}
+			}
+			ret = append(ret, &McpTool{
+				client: c,
+				Name:   info.Name,
+				Tool: openai.Tool{
+					Type: openai.ToolTypeFunction,
+					Function: &openai.FunctionDefinition{
+						Name:        info.Name,
+						Description: info.Description,
+						Parameters:  schema,
+					},
+				},
+			})
+		}
+
+		if result.NextCursor == "" {
+			return ret, nil
+		}
+		cursor = result.NextCursor
+	}
+}
+
+// CallTool calls tool with json encoded arguments, and returns the contents as text
+func (c *McpClient) CallTool(ctx context.Context, name string, param string) (string, error) {
+	args := json.RawMessage("{}")
+	switch {
+	case param == "":
+		// no arguments
+	case json.Valid([]byte(param)):
+		args = json.RawMessage(param)
+	default:
+		return "", ErrInvaliableParameter
+	}
+
+	log.Debug("call mcp tool", zap.String("server", c.cnf.Name), zap.String("name", name), zap.String("param", param))
+
+	var result struct {
+		Content []mcpContent `json:"content"`
+		IsError bool         `json:"isError"`
+	}
+	if err := c.call(ctx, "tools/call", map[string]any{"name": name, "arguments": args}, &result); err != nil {
+		return "", err
+	}
+
+	text := formatMcpContents(result.Content)
+	if result.IsError {
+		// let llm know what happened
+		log.Warn("mcp tool returned error", zap.String("server", c.cnf.Name), zap.String("name", name), zap.String("result", text))
+		return "Tool error: " + text, nil
+	}
+	return text, nil
+}
+
+func formatMcpContents(contents []mcpContent) string {
+	parts := make([]string, 0, len(contents))
+	for _, content := range contents {
+		switch content.Type {
+		case "text":
+			parts = append(parts, content.Text)
+		case "resource":
+			parts = append(parts, string(content.Resource))
+		default:
+			parts = append(parts, fmt.Sprintf("[%s %s]", content.Type, content.MimeType))
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// Close closes the transport
+func (c *McpClient) Close() error {
+	return c.transport.Close()
+}
+
+// Definition returns the function definition of tool
+func (t *McpTool) Definition() openai.Tool {
+	return t.Tool
+}
+
+// Call calls the mcp tool
+func (t *McpTool) Call(ctx context.Context, param string) (string, error) {
+	return t.client.CallTool(ctx, t.Name, param)
+}
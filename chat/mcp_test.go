@@ -0,0 +1,285 @@
+package chat
+
+import (
+	"bufio"
+	"context"
+	"csust-got/config"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mcpTestServerEnv makes the test binary run as a stdio mcp server, see TestMain
+const mcpTestServerEnv = "CSUST_GOT_MCP_TEST_SERVER"
+
+// handleTestMcpRequest is a tiny mcp server with `echo` and `fail` tools
+func handleTestMcpRequest(req *jsonrpcMessage) *jsonrpcMessage {
+	resp := &jsonrpcMessage{JSONRPC: jsonrpcVersion, ID: req.ID}
+	var result any
+	switch req.Method {
+	case "initialize":
+		result = map[string]any{
+			"protocolVersion": mcpProtocolVersion,
+			"capabilities":    map[string]any{"tools": map[string]any{}},
+			"serverInfo":      map[string]any{"name": "test", "version": "0.0.1"},
+		}
+	case "tools/list":
+		var params struct {
+			Cursor string `json:"cursor"`
+		}
+		_ = json.Unmarshal(req.Params, &params)
+		// two pages to test pagination
+		if params.Cursor == "" {
+			result = map[string]any{
+				"tools": []map[string]any{{
+					"name":        "echo",
+					"description": "echo the text",
+					"inputSchema": map[string]any{
+						"type":       "object",
+						"properties": map[string]any{"text": map[string]any{"type": "string"}},
+					},
+				}},
+				"nextCursor": "2",
+			}
+		} else {
+			result = map[string]any{"tools": []map[string]any{{"name": "fail", "description": "always fail"}}}
+		}
+	case "tools/call":
+		var params struct {
+			Name      string `json:"name"`
+			Arguments struct {
+				Text string `json:"text"`
+			} `json:"arguments"`
+		}
+		_ = json.Unmarshal(req.Params, &params)
+		switch params.Name {
+		case "echo":
+			result = map[string]any{"content": []map[string]any{{"type": "text", "text": params.Arguments.Text}}}
+		case "fail":
+			result = map[string]any{"content": []map[string]any{{"type": "text", "text": "boom"}}, "isError": true}
+		default:
+			resp.Error = &jsonrpcError{Code: -32602, Message: "unknown tool"}
+		}
+	default:
+		resp.Error = &jsonrpcError{Code: jsonrpcMethodNotFound, Message: "method not found"}
+	}
+	if result != nil {
+		resp.Result, _ = json.Marshal(result)
+	}
+	return resp
+}
+
+func serveTestMcpStdio(r io.Reader, w io.Writer) {
+	scanner := bufio.NewScanner(r)
+	enc := json.NewEncoder(w)
+	for scanner.Scan() {
+		req := &jsonrpcMessage{}
+		if err := json.Unmarshal(scanner.Bytes(), req); err != nil || !req.isRequest() {
+			continue
+		}
+		if req.Method == "tools/call" {
+			// a notification and a server request before response, client should skip them
+			_ = enc.Encode(&jsonrpcMessage{JSONRPC: jsonrpcVersion, Method: "notifications/progress"})
+			_ = enc.Encode(&jsonrpcMessage{JSONRPC: jsonrpcVersion, ID: json.RawMessage(`"s1"`), Method: "ping"})
+		}
+		_ = enc.Encode(handleTestMcpRequest(req))
+	}
+}
+
+func newTestStdioMcpClient(t *testing.T, toolFilter []string) *McpClient {
+	t.Helper()
+	client, err := NewMcpClient(&config.McpServerConfig{
+		Name:    "local",
+		Command: os.Args[0],
+		Env:     map[string]string{mcpTestServerEnv: "1"},
+		Tools:   toolFilter,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+	return client
+}
+
+func TestMcpClientStdio(t *testing.T) {
+	client := newTestStdioMcpClient(t, nil)
+	registry := newToolRegistry()
+	count, err := client.registerTools(context.Background(), registry)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, []string{"echo", "fail"}, registry.GetToolSetToolNames("mcp_local"))
+	assert.Equal(t, []string{"echo", "fail"}, registry.GetToolSetToolNames(""))
+
+	echo, ok := registry.GetTool("echo")
+	require.True(t, ok)
+	result, err := echo.Call(context.Background(), `{"text":"hello"}`)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", result)
+
+	fail, ok := registry.GetTool("fail")
+	require.True(t, ok)
+	assert.NotNil(t, fail.Definition().Function.Parameters)
+	result, err = fail.Call(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, "Tool error: boom", result)
+
+	_, err = echo.Call(context.Background(), "not json")
+	assert.ErrorIs(t, err, ErrInvaliableParameter)
+
+	_, err = client.CallTool(context.Background(), "missing", "")
+	var rpcErr *jsonrpcError
+	assert.ErrorAs(t, err, &rpcErr)
+}
+
+func TestMcpClientToolFilterAndConflict(t *testing.T) {
+	registry := newToolRegistry()
+	registry.Register("", &McpTool{Name: "echo", Tool: newTestFunctionTool("echo")})
+
+	client := newTestStdioMcpClient(t, []string{"echo"})
+	count, err := client.registerTools(context.Background(), registry)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, []string{"local_echo"}, registry.GetToolSetToolNames("mcp_local"))
+
+	tool, ok := registry.GetTool("local_echo")
+	require.True(t, ok)
+	result, err := tool.Call(context.Background(), `{"text":"hi"}`)
+	require.NoError(t, err)
+	assert.Equal(t, "hi", result)
+}
+
+func TestMcpClientHttp(t *testing.T) {
+	var sessionMissing atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		req := &jsonrpcMessage{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.Method != "initialize" && r.Header.Get(mcpSessionHeader) != "session-1" {
+			sessionMissing.Add(1)
+		}
+		if !req.isRequest() {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		resp, _ := json.Marshal(handleTestMcpRequest(req))
+		if req.Method == "initialize" {
+			w.Header().Set(mcpSessionHeader, "session-1")
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(resp)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = fmt.Fprintf(w, "event: message\ndata: %s\n\n", `{"jsonrpc":"2.0","method":"notifications/progress"}`)
+		_, _ = fmt.Fprintf(w, "event: message\ndata: %s\n\n", resp)
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := NewMcpClient(&config.McpServerConfig{Name: "remote", Url: srv.URL})
+	require.NoError(t, err)
+	defer func() { _ = client.Close() }()
+
+	registry := newToolRegistry()
+	count, err := client.registerTools(context.Background(), registry)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	echo, ok := registry.GetTool("echo")
+	require.True(t, ok)
+	result, err := echo.Call(context.Background(), `{"text":"over http"}`)
+	require.NoError(t, err)
+	assert.Equal(t, "over http", result)
+	assert.Zero(t, sessionMissing.Load())
+}
+
+func TestMcpClientSse(t *testing.T) {
+	events := make(chan string, 16)
+	var pingReplied atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/sse":
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = fmt.Fprint(w, ": comment\n\nevent: endpoint\ndata: /messages?session_id=1\n\n")
+			w.(http.Flusher).Flush()
+			for {
+				select {
+				case event := <-events:
+					_, _ = fmt.Fprint(w, event)
+					w.(http.Flusher).Flush()
+				case <-r.Context().Done():
+					return
+				}
+			}
+		case r.Method == http.MethodPost && r.URL.Path == "/messages" && r.URL.Query().Get("session_id") == "1":
+			req := &jsonrpcMessage{}
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+			if req.isResponse() && string(req.ID) == `"s1"` {
+				pingReplied.Add(1)
+			}
+			if !req.isRequest() {
+				return
+			}
+			if req.Method == "tools/call" {
+				events <- "event: message\ndata: {\"jsonrpc\":\"2.0\",\"method\":\"notifications/progress\"}\n\n"
+				events <- "event: message\ndata: {\"jsonrpc\":\"2.0\",\"id\":\"s1\",\"method\":\"ping\"}\n\n"
+			}
+			resp, _ := json.Marshal(handleTestMcpRequest(req))
+			events <- fmt.Sprintf("event: message\ndata: %s\n\n", resp)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := NewMcpClient(&config.McpServerConfig{Name: "legacy", Transport: config.McpTransportSse, Url: srv.URL + "/sse"})
+	require.NoError(t, err)
+
+	registry := newToolRegistry()
+	count, err := client.registerTools(context.Background(), registry)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	echo, ok := registry.GetTool("echo")
+	require.True(t, ok)
+	result, err := echo.Call(context.Background(), `{"text":"over sse"}`)
+	require.NoError(t, err)
+	assert.Equal(t, "over sse", result)
+	assert.Eventually(t, func() bool { return pingReplied.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, client.Close())
+	_, err = echo.Call(context.Background(), `{"text":"closed"}`)
+	assert.ErrorIs(t, err, ErrMcpTransportClosed)
+}
+
+func TestMcpClientSseNoEndpoint(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = fmt.Fprint(w, "event: message\ndata: {}\n\n")
+	}))
+	t.Cleanup(srv.Close)
+
+	_, err := NewMcpClient(&config.McpServerConfig{Name: "legacy", Transport: config.McpTransportSse, Url: srv.URL})
+	assert.ErrorIs(t, err, ErrMcpNoEndpoint)
+}
+
+func newTestFunctionTool(name string) openai.Tool {
+	return openai.Tool{Type: openai.ToolTypeFunction, Function: &openai.FunctionDefinition{Name: name}}
+}
@@ -0,0 +1,630 @@
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"csust-got/log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	jsonrpcVersion = "2.0"
+
+	// jsonrpc error codes
+	jsonrpcMethodNotFound = -32601
+
+	mcpSessionHeader = "Mcp-Session-Id"
+
+	// maxMcpMessageSize is the max size of a single message from stdio server
+	maxMcpMessageSize = 16 << 20
+)
+
+var (
+	// ErrMcpTransportClosed means the transport is closed or the server exited
+	ErrMcpTransportClosed = errors.New("mcp transport closed")
+	// ErrMcpHttpStatus means the mcp server responses with unexpected http status
+	ErrMcpHttpStatus = errors.New("mcp http status not ok")
+	// ErrMcpNoResponse means the mcp server closed the stream without response
+	ErrMcpNoResponse = errors.New("mcp server sent no response")
+	// ErrMcpNoEndpoint means the legacy sse server didn't send the endpoint event first
+	ErrMcpNoEndpoint = errors.New("mcp server sent no endpoint")
+)
+
+// jsonrpcMessage is a jsonrpc 2.0 request, notification or response
+type jsonrpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonrpcError   `json:"error,omitempty"`
+}
+
+// jsonrpcError is the error object of jsonrpc response
+type jsonrpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *jsonrpcError) Error() string {
+	return fmt.Sprintf("jsonrpc error %d: %s", e.Code, e.Message)
+}
+
+func (m *jsonrpcMessage) isRequest() bool {
+	return m.Method != "" && len(m.ID) > 0
+}
+
+func (m *jsonrpcMessage) isResponse() bool {
+	return m.Method == "" && len(m.ID) > 0
+}
+
+// replyServerRequest makes the response to a request from server, only ping is supported
+func replyServerRequest(req *jsonrpcMessage) *jsonrpcMessage {
+	resp := &jsonrpcMessage{JSONRPC: jsonrpcVersion, ID: req.ID}
+	if req.Method == "ping" {
+		resp.Result = json.RawMessage("{}")
+	} else {
+		resp.Error = &jsonrpcError{Code: jsonrpcMethodNotFound, Message: "method not found: " + req.Method}
+	}
+	return resp
+}
+
+// mcpTransport sends jsonrpc messages to mcp server
+type mcpTransport interface {
+	// RoundTrip sends a request and waits for its response
+	RoundTrip(ctx context.Context, req *jsonrpcMessage) (*jsonrpcMessage, error)
+	// Notify sends a notification
+	Notify(ctx context.Context, msg *jsonrpcMessage) error
+	Close() error
+}
+
+// stdioTransport talks to a mcp server subprocess with newline delimited json over stdin and stdout
+type stdioTransport struct {
+	name  string
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	pending map[string]chan *jsonrpcMessage
+	done    chan struct{}
+	err     error
+}
+
+func newStdioTransport(name, command string, args []string, env map[string]string) (*stdioTransport, error) {
+	cmd := exec.Command(command, args...)
+	cmd.Env = os.Environ()
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	t := &stdioTransport{
+		name:    name,
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: map[string]chan *jsonrpcMessage{},
+		done:    make(chan struct{}),
+	}
+	go t.readLoop(stdout)
+	go t.logStderr(stderr)
+	return t, nil
+}
+
+func (t *stdioTransport) logStderr(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		log.Debug("mcp server stderr", zap.String("server", t.name), zap.String("line", scanner.Text()))
+	}
+}
+
+func (t *stdioTransport) readLoop(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxMcpMessageSize)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		msg := &jsonrpcMessage{}
+		if err := json.Unmarshal(line, msg); err != nil {
+			log.Warn("invalid message from mcp server", zap.String("server", t.name), zap.ByteString("line", line), zap.Error(err))
+			continue
+		}
+
+		switch {
+		case msg.isRequest():
+			if err := t.write(replyServerRequest(msg)); err != nil {
+				log.Warn("reply mcp server request failed", zap.String("server", t.name), zap.Error(err))
+			}
+		case msg.isResponse():
+			t.mu.Lock()
+			ch, ok := t.pending[string(msg.ID)]
+			delete(t.pending, string(msg.ID))
+			t.mu.Unlock()
+			if ok {
+				ch <- msg
+			}
+		default:
+			log.Debug("mcp server notification", zap.String("server", t.name), zap.String("method", msg.Method))
+		}
+	}
+
+	t.mu.Lock()
+	t.err = errors.Join(ErrMcpTransportClosed, scanner.Err())
+	t.mu.Unlock()
+	close(t.done)
+}
+
+func (t *stdioTransport) write(msg *jsonrpcMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	_, err = t.stdin.Write(append(data, '\n'))
+	return err
+}
+
+// RoundTrip implements mcpTransport
+func (t *stdioTransport) RoundTrip(ctx context.Context, req *jsonrpcMessage) (*jsonrpcMessage, error) {
+	ch := make(chan *jsonrpcMessage, 1)
+	id := string(req.ID)
+	t.mu.Lock()
+	if t.err != nil {
+		t.mu.Unlock()
+		return nil, t.err
+	}
+	t.pending[id] = ch
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, id)
+		t.mu.Unlock()
+	}()
+
+	if err := t.write(req); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-t.done:
+		return nil, t.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Notify implements mcpTransport
+func (t *stdioTransport) Notify(_ context.Context, msg *jsonrpcMessage) error {
+	return t.write(msg)
+}
+
+// Close closes stdin and waits the server to exit, kills it if it does not exit in time
+func (t *stdioTransport) Close() error {
+	_ = t.stdin.Close()
+	select {
+	case <-t.done:
+	case <-time.After(5 * time.Second):
+		_ = t.cmd.Process.Kill()
+	}
+	return t.cmd.Wait()
+}
+
+// httpTransport talks to a mcp server with streamable http,
+// the server may response with a json body or a sse stream.
+type httpTransport struct {
+	client  *http.Client
+	url     string
+	headers map[string]string
+
+	mu        sync.Mutex
+	sessionID string
+}
+
+func newHttpTransport(url string, headers map[string]string) *httpTransport {
+	return &httpTransport{
+		client:  http.DefaultClient,
+		url:     url,
+		headers: maps.Clone(headers),
+	}
+}
+
+func (t *httpTransport) newRequest(ctx context.Context, method string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, t.url, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	t.mu.Lock()
+	if t.sessionID != "" {
+		req.Header.Set(mcpSessionHeader, t.sessionID)
+	}
+	t.mu.Unlock()
+	return req, nil
+}
+
+func (t *httpTransport) post(ctx context.Context, msg *jsonrpcMessage) (*http.Response, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	req, err := t.newRequest(ctx, http.MethodPost, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%w: %d", ErrMcpHttpStatus, resp.StatusCode)
+	}
+	if sid := resp.Header.Get(mcpSessionHeader); sid != "" {
+		t.mu.Lock()
+		t.sessionID = sid
+		t.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// RoundTrip implements mcpTransport
+func (t *httpTransport) RoundTrip(ctx context.Context, req *jsonrpcMessage) (*jsonrpcMessage, error) {
+	resp, err := t.post(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "text/event-stream" {
+		return t.readEventStream(ctx, resp.Body, string(req.ID))
+	}
+
+	msg := &jsonrpcMessage{}
+	if err := json.NewDecoder(resp.Body).Decode(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// readEventStream reads sse events until the response of request id
+func (t *httpTransport) readEventStream(ctx context.Context, r io.Reader, id string) (*jsonrpcMessage, error) {
+	reader := bufio.NewReader(r)
+	for {
+		_, data, err := readSseEvent(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, ErrMcpNoResponse
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+
+		msg := &jsonrpcMessage{}
+		if jsonErr := json.Unmarshal([]byte(data), msg); jsonErr != nil {
+			log.Warn("invalid mcp sse event", zap.String("data", data), zap.Error(jsonErr))
+		} else if msg.isResponse() && string(msg.ID) == id {
+			return msg, nil
+		} else if msg.isRequest() {
+			t.replyInBackground(replyServerRequest(msg))
+		}
+	}
+}
+
+// readSseEvent reads the next sse event with data, comments and events without data are skipped.
+func readSseEvent(reader *bufio.Reader) (event, data string, err error) {
+	var buf strings.Builder
+	for {
+		line, readErr := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if buf.Len() > 0 {
+				buf.WriteByte('\n')
+			}
+			buf.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		case line == "" && buf.Len() > 0:
+			// end of an event
+			return event, buf.String(), nil
+		case line == "":
+			event = ""
+		}
+
+		if readErr != nil {
+			return "", "", readErr
+		}
+	}
+}
+
+func (t *httpTransport) replyInBackground(resp *jsonrpcMessage) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := t.Notify(ctx, resp); err != nil {
+			log.Warn("reply mcp server request failed", zap.String("url", t.url), zap.Error(err))
+		}
+	}()
+}
+
+// Notify implements mcpTransport
+func (t *httpTransport) Notify(ctx context.Context, msg *jsonrpcMessage) error {
+	resp, err := t.post(ctx, msg)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// Close terminates the session if server assigned one
+func (t *httpTransport) Close() error {
+	t.mu.Lock()
+	sid := t.sessionID
+	t.mu.Unlock()
+	if sid == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := t.newRequest(ctx, http.MethodDelete, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// sseTransport talks to a mcp server with the legacy http+sse transport of protocol 2024-11-05,
+// messages are posted to the endpoint sent by server as the first event,
+// and responses come from the long-lived sse stream.
+type sseTransport struct {
+	client   *http.Client
+	headers  map[string]string
+	endpoint string
+	cancel   context.CancelFunc
+
+	mu      sync.Mutex
+	pending map[string]chan *jsonrpcMessage
+	done    chan struct{}
+	err     error
+}
+
+// newSseTransport connects to the sse stream, and waits for the endpoint event in timeout
+func newSseTransport(rawURL string, headers map[string]string, timeout time.Duration) (*sseTransport, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &sseTransport{
+		client:  http.DefaultClient,
+		headers: maps.Clone(headers),
+		cancel:  cancel,
+		pending: map[string]chan *jsonrpcMessage{},
+		done:    make(chan struct{}),
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	t.setHeaders(req)
+	req.Header.Set("Accept", "text/event-stream")
+
+	timer := time.AfterFunc(timeout, cancel)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("%w: %d", ErrMcpHttpStatus, resp.StatusCode)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	event, data, err := readSseEvent(reader)
+	if !timer.Stop() {
+		err = errors.Join(err, context.DeadlineExceeded)
+	}
+	if err == nil && event != "endpoint" {
+		err = fmt.Errorf("%w: %s", ErrMcpNoEndpoint, event)
+	}
+	if err == nil {
+		t.endpoint, err = resolveEndpoint(rawURL, data)
+	}
+	if err != nil {
+		_ = resp.Body.Close()
+		cancel()
+		return nil, err
+	}
+
+	go t.readLoop(resp.Body, reader)
+	return t, nil
+}
+
+// resolveEndpoint resolves the endpoint sent by server, which may be relative to the sse url
+func resolveEndpoint(base, endpoint string) (string, error) {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(strings.TrimSpace(endpoint))
+	if err != nil {
+		return "", err
+	}
+	return baseURL.ResolveReference(ref).String(), nil
+}
+
+func (t *sseTransport) setHeaders(req *http.Request) {
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+}
+
+func (t *sseTransport) readLoop(body io.ReadCloser, reader *bufio.Reader) {
+	defer func() { _ = body.Close() }()
+
+	var err error
+	for {
+		var event, data string
+		event, data, err = readSseEvent(reader)
+		if err != nil {
+			break
+		}
+		if event != "" && event != "message" {
+			continue
+		}
+		msg := &jsonrpcMessage{}
+		if jsonErr := json.Unmarshal([]byte(data), msg); jsonErr != nil {
+			log.Warn("invalid mcp sse event", zap.String("data", data), zap.Error(jsonErr))
+			continue
+		}
+
+		switch {
+		case msg.isRequest():
+			go t.reply(replyServerRequest(msg))
+		case msg.isResponse():
+			t.mu.Lock()
+			ch, ok := t.pending[string(msg.ID)]
+			delete(t.pending, string(msg.ID))
+			t.mu.Unlock()
+			if ok {
+				ch <- msg
+			}
+		default:
+			log.Debug("mcp server notification", zap.String("url", t.endpoint), zap.String("method", msg.Method))
+		}
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, context.Canceled) {
+		err = nil
+	}
+	t.mu.Lock()
+	t.err = errors.Join(ErrMcpTransportClosed, err)
+	t.mu.Unlock()
+	close(t.done)
+}
+
+func (t *sseTransport) reply(resp *jsonrpcMessage) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := t.post(ctx, resp); err != nil {
+		log.Warn("reply mcp server request failed", zap.String("url", t.endpoint), zap.Error(err))
+	}
+}
+
+// post sends message to endpoint, the response of request comes from sse stream
+func (t *sseTransport) post(ctx context.Context, msg *jsonrpcMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	t.setHeaders(req)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("%w: %d", ErrMcpHttpStatus, resp.StatusCode)
+	}
+	return nil
+}
+
+// RoundTrip implements mcpTransport
+func (t *sseTransport) RoundTrip(ctx context.Context, req *jsonrpcMessage) (*jsonrpcMessage, error) {
+	ch := make(chan *jsonrpcMessage, 1)
+	id := string(req.ID)
+	t.mu.Lock()
+	if t.err != nil {
+		t.mu.Unlock()
+		return nil, t.err
+	}
+	t.pending[id] = ch
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, id)
+		t.mu.Unlock()
+	}()
+
+	if err := t.post(ctx, req); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-t.done:
+		return nil, t.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Notify implements mcpTransport
+func (t *sseTransport) Notify(ctx context.Context, msg *jsonrpcMessage) error {
+	return t.post(ctx, msg)
+}
+
+// Close closes the sse stream
+func (t *sseTransport) Close() error {
+	t.cancel()
+	<-t.done
+	return nil
+}
@@ -53,7 +53,7 @@ func NewMcpoClient(baseUrl string, tools []string) *McpoClient {
 
 // InitMcpoClient init global mcpo client
 func InitMcpoClient() {
-	cnf := config.BotConfig.McpoServer
+	cnf := config.BotConfig().McpoServer
 	if cnf.Enable {
 		mcpo = NewMcpoClient(cnf.Url, cnf.Tools).WithHttpClient(&http.Client{
 			Timeout: time.Second * 120,
@@ -62,7 +62,16 @@ func InitMcpoClient() {
 		if err != nil {
 			log.Fatal("failed to init mcpo client", zap.Error(err))
 		}
-		if config.BotConfig.DebugMode {
+		for _, set := range cnf.Tools {
+			for _, name := range mcpo.GetToolSetToolNames("mcpo_" + set) {
+				tool, _ := mcpo.GetTool(name)
+				tools.Register("mcpo_"+set, tool)
+			}
+		}
+		for _, name := range cnf.DangerousTools {
+			tools.MarkDangerous(name)
+		}
+		if config.BotConfig().DebugMode {
 			for _, tool := range mcpo.mcpTools {
 				log.Debug("enable mcp tool", zap.String("name", tool.Name),
 					zap.String("desc", tool.Function.Description),
@@ -160,6 +169,11 @@ func (c *McpoClient) getToolDefined(tool string) ([]*McpoTool, error) {
 	return ret, nil
 }
 
+// Definition returns the function definition of tool
+func (t *McpoTool) Definition() openai.Tool {
+	return t.Tool
+}
+
 // ErrInvaliableParameter error
 var ErrInvaliableParameter = errors.New("invaliable parameter")
 
@@ -179,8 +193,8 @@ func (t *McpoTool) Call(ctx context.Context, param string) (result string, err e
 	}
 
 	// Add Authorization header if API key is configured
-	if config.BotConfig.McpoServer.ApiKey != "" {
-		req.Header.Add("Authorization", "Bearer "+config.BotConfig.McpoServer.ApiKey)
+	if config.BotConfig().McpoServer.ApiKey != "" {
+		req.Header.Add("Authorization", "Bearer "+config.BotConfig().McpoServer.ApiKey)
 	}
 
 	log.Debug("call mcpo tool",
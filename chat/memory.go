@@ -0,0 +1,117 @@
+package chat
+
+import (
+	"csust-got/config"
+	"csust-got/log"
+	"csust-got/orm"
+	"errors"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	tb "gopkg.in/telebot.v3"
+)
+
+// loadChatMemory loads the conversation history when the message replies to a bot answer
+// which has been saved with memory, the history doesn't contain system prompt.
+func loadChatMemory(ctx tb.Context, v2 *config.ChatConfigSingle) []openai.ChatCompletionMessage {
+	if !v2.Memory.Enable {
+		return nil
+	}
+
+	reply := ctx.Message().ReplyTo
+	if reply == nil || reply.Sender == nil || reply.Sender.ID != ctx.Bot().Me.ID {
+		return nil
+	}
+
+	history, err := orm.GetChatContext(ctx.Chat().ID, reply.ID)
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Warn("[ChatMemory] load conversation history failed", zap.Int64("chat", ctx.Chat().ID),
+				zap.Int("msg", reply.ID), zap.Error(err))
+		}
+		return nil
+	}
+
+	before := len(history)
+	history = trimHistory(tokenizerOf(v2.Model.Model), history, v2.Memory.GetMaxTokens())
+	log.Debug("[ChatMemory] conversation history loaded", zap.Int64("chat", ctx.Chat().ID),
+		zap.Int("msg", reply.ID), zap.Int("messages", len(history)), zap.Int("dropped", before-len(history)))
+	return history
+}
+
+// saveChatMemory saves the whole conversation with the final answer under the bot answer message ID
+func saveChatMemory(v2 *config.ChatConfigSingle, replyMsg *tb.Message, messages []openai.ChatCompletionMessage, answer string) {
+	if !v2.Memory.Enable || replyMsg == nil {
+		return
+	}
+
+	history := make([]openai.ChatCompletionMessage, 0, len(messages)+1)
+	for _, msg := range messages {
+		if msg.Role == openai.ChatMessageRoleSystem {
+			continue
+		}
+		history = append(history, compactMessage(msg))
+	}
+	history = append(history, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleAssistant,
+		Content: stripReason(answer),
+	})
+	history = trimHistory(tokenizerOf(v2.Model.Model), history, v2.Memory.GetMaxTokens())
+
+	if err := orm.SetChatContext(replyMsg.Chat.ID, replyMsg.ID, history); err != nil {
+		log.Warn("[ChatMemory] save conversation history failed", zap.Int64("chat", replyMsg.Chat.ID),
+			zap.Int("msg", replyMsg.ID), zap.Error(err))
+	}
+}
+
+// trimHistory drops the oldest turns until the history fits the token budget.
+// A turn begins with a user message, and contains all following assistant and tool messages,
+// so that tool results are never separated from their tool calls.
+// The latest turn is always kept.
+func trimHistory(tk tokenizer, history []openai.ChatCompletionMessage, maxTokens int) []openai.ChatCompletionMessage {
+	total := tk.countMessages(history)
+	for total > maxTokens && len(history) > 0 {
+		end := 1
+		for end < len(history) && history[end].Role != openai.ChatMessageRoleUser {
+			end++
+		}
+		if end == len(history) {
+			break
+		}
+		total -= tk.countMessages(history[:end])
+		history = history[end:]
+	}
+	return history
+}
+
+// compactMessage replaces image parts with placeholder,
+// the encoded images are too large to be kept in the history.
+func compactMessage(msg openai.ChatCompletionMessage) openai.ChatCompletionMessage {
+	if len(msg.MultiContent) == 0 {
+		return msg
+	}
+
+	var buf strings.Builder
+	for _, part := range msg.MultiContent {
+		switch part.Type {
+		case openai.ChatMessagePartTypeText:
+			buf.WriteString(part.Text)
+		case openai.ChatMessagePartTypeImageURL:
+			buf.WriteString("<image_placeholder />\n")
+		}
+	}
+	msg.MultiContent = nil
+	msg.Content = buf.String()
+	return msg
+}
+
+// stripReason removes the leading `<think>` block of the model output
+func stripReason(text string) string {
+	matches := extractReasonPatt.FindStringSubmatchIndex(text)
+	if len(matches) != 0 {
+		text = text[matches[1]:]
+	}
+	return strings.TrimSpace(text)
+}
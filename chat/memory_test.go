@@ -0,0 +1,87 @@
+package chat
+
+import (
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountTokens(t *testing.T) {
+	tests := []struct {
+		name     string
+		model    string
+		text     string
+		expected int
+	}{
+		{name: "empty", model: "gpt-4o", text: "", expected: 0},
+		{name: "short word", model: "gpt-4o", text: "hi", expected: 1},
+		{name: "long word", model: "gpt-4o", text: "tokenizer", expected: 2},
+		{name: "words and punctuation", model: "gpt-4o", text: "Hello, world!", expected: 4},
+		{name: "cjk", model: "gpt-4o", text: "你好世界", expected: 2},
+		{name: "cjk in cl100k", model: "gpt-4", text: "你好世界", expected: 5},
+		{name: "unknown model uses o200k", model: "deepseek-chat", text: "你好世界", expected: 2},
+		{name: "mixed", model: "gpt-4o", text: "用 Go 写", expected: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tokenizerOf(tt.model).count(tt.text))
+		})
+	}
+}
+
+func TestTrimHistory(t *testing.T) {
+	user := func(s string) openai.ChatCompletionMessage {
+		return openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: s}
+	}
+	assistant := func(s string) openai.ChatCompletionMessage {
+		return openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: s}
+	}
+	toolCall := openai.ChatCompletionMessage{
+		Role: openai.ChatMessageRoleAssistant,
+		ToolCalls: []openai.ToolCall{{
+			ID:       "call_1",
+			Type:     openai.ToolTypeFunction,
+			Function: openai.FunctionCall{Name: "fetch", Arguments: `{"url":"https://example.com"}`},
+		}},
+	}
+	toolResult := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleTool, ToolCallID: "call_1", Content: "ok"}
+
+	tk := tokenizerOf("gpt-4o")
+	history := []openai.ChatCompletionMessage{
+		user("第一个问题"), toolCall, toolResult, assistant("第一个回答"),
+		user("第二个问题"), assistant("第二个回答"),
+		user("第三个问题"), assistant("第三个回答"),
+	}
+
+	t.Run("fits budget", func(t *testing.T) {
+		assert.Equal(t, history, trimHistory(tk, history, 10000))
+	})
+
+	t.Run("drop whole turn with tool calls", func(t *testing.T) {
+		budget := tk.countMessages(history[4:])
+		assert.Equal(t, history[4:], trimHistory(tk, history, budget))
+	})
+
+	t.Run("keep latest turn", func(t *testing.T) {
+		assert.Equal(t, history[6:], trimHistory(tk, history, 1))
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		assert.Empty(t, trimHistory(tk, nil, 1))
+	})
+}
+
+func TestCompactMessage(t *testing.T) {
+	msg := openai.ChatCompletionMessage{
+		Role: openai.ChatMessageRoleUser,
+		MultiContent: []openai.ChatMessagePart{
+			{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: "data:image/jpeg;base64,AAAA"}},
+			{Type: openai.ChatMessagePartTypeText, Text: "what is it?"},
+		},
+	}
+	got := compactMessage(msg)
+	assert.Nil(t, got.MultiContent)
+	assert.Equal(t, "<image_placeholder />\nwhat is it?", got.Content)
+}
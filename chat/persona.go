@@ -0,0 +1,332 @@
+package chat
+
+import (
+	"csust-got/config"
+	"csust-got/entities"
+	"csust-got/log"
+	"csust-got/orm"
+	"csust-got/util"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	tb "gopkg.in/telebot.v3"
+)
+
+// maxPersonaShowLen is the max length of prompts shown by `/persona show`
+const maxPersonaShowLen = 1000
+
+const personaUsage = `用法:
+/persona list - 列出本群可用的人设
+/persona show <名称> - 查看人设
+/persona create <名称> <基于的人设> [命令] - 创建新的人设，命令默认与名称相同
+/persona set <名称> <system_prompt|prompt|temperature|command> <值> - 修改人设
+/persona unset <名称> <system_prompt|prompt|temperature> - 恢复为配置文件中的值
+/persona delete <名称> - 删除本群的人设或修改`
+
+var personaNamePatt = regexp.MustCompile(`^[0-9a-zA-Z_]{1,32}$`)
+
+var (
+	// ErrPersonaBaseNotFound means the chat config which persona is based on does not exist
+	ErrPersonaBaseNotFound = errors.New("base chat config not found")
+	// ErrInvalidPersonaField means the field of persona is unknown or the value is invalid
+	ErrInvalidPersonaField = errors.New("invalid persona field")
+)
+
+// applyPersona returns a copy of base chat config overridden by persona
+func applyPersona(base *config.ChatConfigSingle, p *orm.ChatPersona) *config.ChatConfigSingle {
+	v2 := *base
+	v2.Name = p.Name
+	if p.Name != p.Base {
+		v2.Trigger = []*config.ChatTrigger{{Command: p.Command}}
+	}
+	if p.SystemPrompt != nil {
+		v2.SystemPrompt = config.JoinableString(*p.SystemPrompt)
+	}
+	if p.PromptTemplate != nil {
+		v2.PromptTemplate = config.JoinableString(*p.PromptTemplate)
+	}
+	if p.Temperature != nil {
+		temperature := *p.Temperature
+		v2.Temperature = &temperature
+	}
+	return &v2
+}
+
+// withChatPersona applies the persona of chat to v2, returns false if chat has no persona for v2
+func withChatPersona(chatID int64, v2 *config.ChatConfigSingle) (*config.ChatConfigSingle, bool) {
+	p, err := orm.GetChatPersona(chatID, v2.Name)
+	if err != nil {
+		return v2, false
+	}
+	base := v2
+	if p.Base != v2.Name {
+		if base = findChatConfig(p.Base); base == nil {
+			log.Warn("[ChatPersona] base chat config not found", zap.Int64("chat", chatID),
+				zap.String("name", p.Name), zap.String("base", p.Base))
+			return v2, false
+		}
+	}
+	return applyPersona(base, p), true
+}
+
+// lookupChatConfig finds chat config by name, personas of chat are included
+func lookupChatConfig(chatID int64, name string) *config.ChatConfigSingle {
+	if v2 := findChatConfig(name); v2 != nil {
+		v2, _ = withChatPersona(chatID, v2)
+		return v2
+	}
+	p, err := orm.GetChatPersona(chatID, name)
+	if err != nil {
+		return nil
+	}
+	base := findChatConfig(p.Base)
+	if base == nil {
+		return nil
+	}
+	return applyPersona(base, p)
+}
+
+// FindChatByCommand finds the chat triggered by command, personas created in chat are included
+func FindChatByCommand(chatID int64, cmd string) (*config.ChatConfigSingle, *config.ChatTrigger) {
+	if v2, trigger := config.BotConfig().ChatConfigV2.FindByCommand(cmd); v2 != nil {
+		return v2, trigger
+	}
+	personas, err := orm.GetChatPersonas(chatID)
+	if err != nil {
+		return nil, nil
+	}
+	for _, p := range personas {
+		if p.Command == "" || p.Command != cmd {
+			continue
+		}
+		if v2 := lookupChatConfig(chatID, p.Name); v2 != nil {
+			return v2, v2.Trigger[0]
+		}
+	}
+	return nil, nil
+}
+
+// setPersonaField sets field of persona, empty value means unset
+func setPersonaField(p *orm.ChatPersona, field, value string) error {
+	switch field {
+	case "system_prompt", "system":
+		p.SystemPrompt = nil
+		if value != "" {
+			p.SystemPrompt = &value
+		}
+	case "prompt", "prompt_template":
+		p.PromptTemplate = nil
+		if value != "" {
+			p.PromptTemplate = &value
+		}
+	case "temperature":
+		p.Temperature = nil
+		if value == "" {
+			return nil
+		}
+		t, err := strconv.ParseFloat(value, 32)
+		if err != nil || t < 0 || t > 2 {
+			return fmt.Errorf("%w: temperature must in [0, 2]", ErrInvalidPersonaField)
+		}
+		temperature := float32(t)
+		p.Temperature = &temperature
+	case "command":
+		if p.Name == p.Base {
+			return fmt.Errorf("%w: command of chat in config file can't be changed", ErrInvalidPersonaField)
+		}
+		if !personaNamePatt.MatchString(value) {
+			return fmt.Errorf("%w: command can only contain letters, digits and `_`", ErrInvalidPersonaField)
+		}
+		p.Command = value
+	default:
+		return fmt.Errorf("%w: unknown field `%s`", ErrInvalidPersonaField, field)
+	}
+	return nil
+}
+
+// validatePersona checks the persona can be used, templates are parsed by getTemplate
+func validatePersona(chatID int64, p *orm.ChatPersona) error {
+	base := findChatConfig(p.Base)
+	if base == nil {
+		return ErrPersonaBaseNotFound
+	}
+	if p.Name != p.Base {
+		if findChatConfig(p.Name) != nil {
+			return fmt.Errorf("%w: name is used by chat in config file", ErrInvalidPersonaField)
+		}
+		if v2, _ := FindChatByCommand(chatID, p.Command); v2 != nil && v2.Name != p.Name {
+			return fmt.Errorf("%w: command is used by `%s`", ErrInvalidPersonaField, v2.Name)
+		}
+	}
+	_, err := getTemplate(applyPersona(base, p), false)
+	return err
+}
+
+// canManagePersona reports whether user can edit personas of chat
+func canManagePersona(ctx tb.Context) bool {
+	return ctx.Chat().Type == tb.ChatPrivate || config.BotConfig().IsAdmin(ctx.Sender().ID) ||
+		util.IsChatAdmin(ctx.Bot(), ctx.Chat(), ctx.Sender())
+}
+
+// PersonaHandler manages personas of chat, which override chat configs in config file.
+func PersonaHandler(ctx tb.Context) error {
+	cmd, rest, err := entities.CommandTakeArgs(ctx.Message(), 3)
+	if err != nil || cmd.Argc() == 0 {
+		return ctx.Reply(personaUsage)
+	}
+
+	switch action := cmd.Arg(0); action {
+	case "list":
+		return listPersonas(ctx)
+	case "show":
+		return showPersona(ctx, cmd.Arg(1))
+	case "create", "set", "unset", "delete":
+		if !canManagePersona(ctx) {
+			return ctx.Reply("只有管理员才能修改人设哦")
+		}
+		if cmd.Argc() < 2 {
+			return ctx.Reply(personaUsage)
+		}
+		return editPersona(ctx, action, cmd.Arg(1), cmd.Arg(2), strings.TrimSpace(rest))
+	default:
+		return ctx.Reply(personaUsage)
+	}
+}
+
+func listPersonas(ctx tb.Context) error {
+	personas, err := orm.GetChatPersonas(ctx.Chat().ID)
+	if err != nil {
+		return ctx.Reply("获取人设失败了😔")
+	}
+	overridden := make(map[string]bool, len(personas))
+	for _, p := range personas {
+		overridden[p.Name] = true
+	}
+
+	var sb strings.Builder
+	sb.WriteString("配置文件中的人设:\n")
+	for _, v2 := range *config.BotConfig().ChatConfigV2 {
+		fmt.Fprintf(&sb, "- %s", v2.Name)
+		for _, t := range v2.Trigger {
+			if t.Command != "" {
+				fmt.Fprintf(&sb, " /%s", t.Command)
+			}
+		}
+		if overridden[v2.Name] {
+			sb.WriteString(" (本群已修改)")
+		}
+		sb.WriteString("\n")
+	}
+
+	created := false
+	for _, p := range personas {
+		if p.Name == p.Base {
+			continue
+		}
+		if !created {
+			sb.WriteString("\n本群创建的人设:\n")
+			created = true
+		}
+		fmt.Fprintf(&sb, "- %s /%s (基于 %s)\n", p.Name, p.Command, p.Base)
+	}
+	return ctx.Reply(sb.String())
+}
+
+func showPersona(ctx tb.Context, name string) error {
+	if name == "" {
+		return ctx.Reply(personaUsage)
+	}
+	v2 := lookupChatConfig(ctx.Chat().ID, name)
+	if v2 == nil {
+		return ctx.Reply("没有找到这个人设")
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "<b>%s</b>\n", util.EscapeTgHTMLReservedChars(v2.Name))
+	for _, t := range v2.Trigger {
+		if t.Command != "" {
+			fmt.Fprintf(&sb, "命令: /%s\n", t.Command)
+		}
+	}
+	fmt.Fprintf(&sb, "temperature: %.2f\n", v2.GetTemperature())
+	fmt.Fprintf(&sb, "system_prompt:\n<pre>%s</pre>\n", util.EscapeTgHTMLReservedChars(truncateRunes(v2.SystemPrompt.String(), maxPersonaShowLen)))
+	fmt.Fprintf(&sb, "prompt:\n<pre>%s</pre>", util.EscapeTgHTMLReservedChars(truncateRunes(v2.PromptTemplate.String(), maxPersonaShowLen)))
+	return ctx.Reply(sb.String(), tb.ModeHTML)
+}
+
+func truncateRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n]) + truncatedMark
+}
+
+func editPersona(ctx tb.Context, action, name, field, value string) error {
+	chatID := ctx.Chat().ID
+	if action == "delete" {
+		ok, err := orm.DelChatPersona(chatID, name)
+		switch {
+		case err != nil:
+			return ctx.Reply("删除人设失败了😔")
+		case !ok:
+			return ctx.Reply("本群没有这个人设")
+		}
+		return ctx.Reply(fmt.Sprintf("已删除人设 %s", name))
+	}
+
+	p, err := orm.GetChatPersona(chatID, name)
+	switch {
+	case err == nil && action == "create":
+		return ctx.Reply("这个人设已经存在了")
+	case errors.Is(err, redis.Nil) && action == "create":
+		if !personaNamePatt.MatchString(name) {
+			return ctx.Reply("名称只能包含字母、数字和下划线")
+		}
+		p = &orm.ChatPersona{Name: name, Base: field, Command: name}
+		if value != "" {
+			err = setPersonaField(p, "command", value)
+		}
+	case errors.Is(err, redis.Nil) && findChatConfig(name) != nil:
+		// first modification of chat in config file
+		p = &orm.ChatPersona{Name: name, Base: name}
+		err = nil
+	case errors.Is(err, redis.Nil):
+		return ctx.Reply("没有找到这个人设")
+	case err != nil:
+		return ctx.Reply("获取人设失败了😔")
+	}
+
+	switch {
+	case err != nil:
+	case action == "set" && value == "":
+		return ctx.Reply(personaUsage)
+	case action == "set":
+		err = setPersonaField(p, field, value)
+	case action == "unset" && field == "command":
+		err = fmt.Errorf("%w: command can't be unset", ErrInvalidPersonaField)
+	case action == "unset":
+		err = setPersonaField(p, field, "")
+	}
+	if err == nil {
+		err = validatePersona(chatID, p)
+	}
+	if err != nil {
+		return ctx.Reply("人设无效: " + err.Error())
+	}
+
+	p.UpdatedBy = ctx.Sender().ID
+	p.UpdatedAt = time.Now().Unix()
+	if err := orm.SetChatPersona(chatID, p); err != nil {
+		return ctx.Reply("保存人设失败了😔")
+	}
+	log.Info("[ChatPersona] persona saved", zap.Int64("chat", chatID), zap.String("name", p.Name),
+		zap.String("action", action), zap.String("field", field), zap.Int64("user", p.UpdatedBy))
+	return ctx.Reply(fmt.Sprintf("已保存人设 %s", p.Name))
+}
@@ -0,0 +1,83 @@
+package chat
+
+import (
+	"testing"
+
+	"csust-got/config"
+	"csust-got/orm"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyPersona(t *testing.T) {
+	temperature := float32(0.5)
+	base := &config.ChatConfigSingle{
+		Name:           "chat",
+		Model:          &config.Model{Name: "gpt"},
+		SystemPrompt:   "system",
+		PromptTemplate: "{{.Input}}",
+		Temperature:    &temperature,
+		Trigger:        []*config.ChatTrigger{{Command: "chat"}, {Reply: true}},
+	}
+
+	t.Run("override", func(t *testing.T) {
+		p := &orm.ChatPersona{Name: "chat", Base: "chat"}
+		require.NoError(t, setPersonaField(p, "system_prompt", "你是一只猫"))
+		require.NoError(t, setPersonaField(p, "temperature", "1.2"))
+
+		v2 := applyPersona(base, p)
+		assert.Equal(t, "chat", v2.Name)
+		assert.Equal(t, config.JoinableString("你是一只猫"), v2.SystemPrompt)
+		assert.Equal(t, config.JoinableString("{{.Input}}"), v2.PromptTemplate)
+		assert.InDelta(t, 1.2, v2.GetTemperature(), 1e-6)
+		assert.Equal(t, base.Trigger, v2.Trigger)
+		// base is not changed
+		assert.Equal(t, config.JoinableString("system"), base.SystemPrompt)
+		assert.InDelta(t, 0.5, base.GetTemperature(), 1e-6)
+
+		require.NoError(t, setPersonaField(p, "temperature", ""))
+		assert.InDelta(t, 0.5, applyPersona(base, p).GetTemperature(), 1e-6)
+	})
+
+	t.Run("created", func(t *testing.T) {
+		p := &orm.ChatPersona{Name: "cat", Base: "chat", Command: "cat"}
+		require.NoError(t, setPersonaField(p, "command", "meow"))
+		v2 := applyPersona(base, p)
+		assert.Equal(t, "cat", v2.Name)
+		assert.Equal(t, []*config.ChatTrigger{{Command: "meow"}}, v2.Trigger)
+		assert.Equal(t, base.Model, v2.Model)
+	})
+}
+
+func TestSetPersonaField(t *testing.T) {
+	override := &orm.ChatPersona{Name: "chat", Base: "chat"}
+	assert.ErrorIs(t, setPersonaField(override, "command", "meow"), ErrInvalidPersonaField)
+	assert.ErrorIs(t, setPersonaField(override, "temperature", "3"), ErrInvalidPersonaField)
+	assert.ErrorIs(t, setPersonaField(override, "temperature", "hot"), ErrInvalidPersonaField)
+	assert.ErrorIs(t, setPersonaField(override, "model", "gpt"), ErrInvalidPersonaField)
+
+	created := &orm.ChatPersona{Name: "cat", Base: "chat", Command: "cat"}
+	assert.ErrorIs(t, setPersonaField(created, "command", "喵"), ErrInvalidPersonaField)
+
+	require.NoError(t, setPersonaField(override, "prompt", "{{.Input}}!"))
+	assert.Equal(t, "{{.Input}}!", *override.PromptTemplate)
+	require.NoError(t, setPersonaField(override, "prompt", ""))
+	assert.Nil(t, override.PromptTemplate)
+}
+
+func TestValidatePersona(t *testing.T) {
+	old := config.BotConfig().ChatConfigV2
+	defer func() { config.BotConfig().ChatConfigV2 = old }()
+	chats := config.ChatConfigV2{{Name: "chat", Model: &config.Model{}, PromptTemplate: "{{.Input}}"}}
+	config.BotConfig().ChatConfigV2 = &chats
+
+	p := &orm.ChatPersona{Name: "chat", Base: "chat"}
+	require.NoError(t, setPersonaField(p, "system_prompt", "you are {{.BotUsername}}"))
+	assert.NoError(t, validatePersona(1, p))
+
+	require.NoError(t, setPersonaField(p, "prompt", "{{.Input"))
+	assert.Error(t, validatePersona(1, p))
+
+	assert.ErrorIs(t, validatePersona(1, &orm.ChatPersona{Name: "gone", Base: "gone"}), ErrPersonaBaseNotFound)
+}
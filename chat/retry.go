@@ -0,0 +1,131 @@
+package chat
+
+import (
+	"context"
+	"csust-got/config"
+	"csust-got/log"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+)
+
+// maxRetryInterval is the upper bound of backoff between retries
+const maxRetryInterval = 16 * time.Second
+
+// ErrModelClientNotFound means the client of model is not initialized
+var ErrModelClientNotFound = errors.New("model client not found")
+
+// isRetryableError reports whether the request may succeed on another try,
+// rate limit, server errors and broken connections are retryable.
+func isRetryableError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return isRetryableStatus(apiErr.HTTPStatusCode)
+	}
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) {
+		return isRetryableStatus(reqErr.HTTPStatusCode)
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func isRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// retryBackoff returns the interval before the n-th retry (start from 1)
+func retryBackoff(model *config.Model, n int) time.Duration {
+	d := model.GetRetryInterval()
+	for i := 1; i < n && d < maxRetryInterval; i++ {
+		d *= 2
+	}
+	return min(d, maxRetryInterval)
+}
+
+// sleepContext sleeps for d, returns early with error if ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// openChatStream creates a chat completion stream with retry,
+// begins with `models[from]`, and moves to the next model when one keeps failing with retryable errors.
+// It returns the stream and the index of model which answered.
+func openChatStream(ctx context.Context, models []*config.Model, from int,
+	request *openai.ChatCompletionRequest) (*openai.ChatCompletionStream, int, error) {
+	return requestWithRetry(ctx, models, from, request, "create chat completion stream",
+		func(client *openai.Client) (*openai.ChatCompletionStream, error) {
+			return client.CreateChatCompletionStream(ctx, *request)
+		})
+}
+
+// completeChat is openChatStream without streaming, for requests whose answer is not shown as it's generated.
+func completeChat(ctx context.Context, models []*config.Model, from int,
+	request *openai.ChatCompletionRequest) (openai.ChatCompletionResponse, int, error) {
+	return requestWithRetry(ctx, models, from, request, "create chat completion",
+		func(client *openai.Client) (openai.ChatCompletionResponse, error) {
+			return client.CreateChatCompletion(ctx, *request)
+		})
+}
+
+// requestWithRetry calls the model with retry and fallback, sets `request.Model` before every call,
+// and fits `request.Messages` to the model, since fallback models may have smaller prompt limit or no image support.
+func requestWithRetry[T any](ctx context.Context, models []*config.Model, from int,
+	request *openai.ChatCompletionRequest, action string, call func(client *openai.Client) (T, error)) (T, int, error) {
+	var zero T
+	var lastErr error
+	messages := request.Messages
+	for idx := from; idx < len(models); idx++ {
+		model := models[idx]
+		client, ok := clientOf(model.Name)
+		if !ok {
+			log.Error("chat model client not found", zap.String("model", model.Name))
+			lastErr = ErrModelClientNotFound
+			continue
+		}
+		request.Model = model.Model
+		request.Messages = fitMessages(model, messages)
+
+		for attempt := 0; attempt <= model.GetRetryNums(); attempt++ {
+			if attempt > 0 {
+				if err := sleepContext(ctx, retryBackoff(model, attempt)); err != nil {
+					return zero, idx, errors.Join(lastErr, err)
+				}
+			}
+
+			resp, err := call(client)
+			if err == nil {
+				return resp, idx, nil
+			}
+			lastErr = err
+			if !isRetryableError(err) {
+				return zero, idx, err
+			}
+			log.Warn(action+" failed, retrying", zap.String("model", model.Name),
+				zap.Int("attempt", attempt+1), zap.Error(err))
+		}
+
+		if idx+1 < len(models) {
+			log.Warn("chat model keeps failing, fallback to next model", zap.String("model", model.Name),
+				zap.String("next", models[idx+1].Name), zap.Error(lastErr))
+		}
+	}
+	return zero, len(models) - 1, lastErr
+}
@@ -0,0 +1,122 @@
+package chat
+
+import (
+	"context"
+	"csust-got/config"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustAiClient(t *testing.T, m *config.Model) *openai.Client {
+	t.Helper()
+	client, err := newAiClient(m)
+	require.NoError(t, err)
+	return client
+}
+
+func TestIsRetryableError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "nil", err: nil, expected: false},
+		{name: "rate limit", err: &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests}, expected: true},
+		{name: "server error", err: &openai.APIError{HTTPStatusCode: http.StatusBadGateway}, expected: true},
+		{name: "bad request", err: &openai.APIError{HTTPStatusCode: http.StatusBadRequest}, expected: false},
+		{name: "request error", err: &openai.RequestError{HTTPStatusCode: http.StatusServiceUnavailable}, expected: true},
+		{name: "unexpected eof", err: fmt.Errorf("read: %w", io.ErrUnexpectedEOF), expected: true},
+		{name: "canceled", err: context.Canceled, expected: false},
+		{name: "unknown", err: errors.New("unknown"), expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, isRetryableError(tt.err))
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	m := &config.Model{RetryInterval: 1}
+	assert.Equal(t, time.Second, retryBackoff(m, 1))
+	assert.Equal(t, 2*time.Second, retryBackoff(m, 2))
+	assert.Equal(t, 4*time.Second, retryBackoff(m, 3))
+	assert.Equal(t, maxRetryInterval, retryBackoff(m, 10))
+}
+
+func newTestStreamServer(t *testing.T, status int, hits *atomic.Int32) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			_, _ = io.WriteString(w, `{"error":{"message":"oops","type":"server_error"}}`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, `data: {"choices":[{"index":0,"delta":{"content":"hi"}}]}`+"\n\n")
+		_, _ = io.WriteString(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestOpenChatStreamFallback(t *testing.T) {
+	var primaryHits, fallbackHits atomic.Int32
+	primary := newTestStreamServer(t, http.StatusTooManyRequests, &primaryHits)
+	fallback := newTestStreamServer(t, http.StatusOK, &fallbackHits)
+
+	models := []*config.Model{
+		{Name: "primary", Model: "p", BaseUrl: primary.URL, RetryNums: 1, RetryInterval: 0},
+		{Name: "fallback", Model: "f", BaseUrl: fallback.URL},
+	}
+	testClients := map[string]*openai.Client{}
+	for _, m := range models {
+		testClients[m.Name] = mustAiClient(t, m)
+	}
+	clients.Store(&testClients)
+
+	req := &openai.ChatCompletionRequest{Stream: true}
+	stream, idx, err := openChatStream(context.Background(), models, 0, req)
+	require.NoError(t, err)
+	defer func() { _ = stream.Close() }()
+
+	assert.Equal(t, 1, idx)
+	assert.Equal(t, "f", req.Model)
+	assert.Equal(t, int32(2), primaryHits.Load())
+	assert.Equal(t, int32(1), fallbackHits.Load())
+
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "hi", resp.Choices[0].Delta.Content)
+}
+
+func TestOpenChatStreamNotRetryable(t *testing.T) {
+	var hits atomic.Int32
+	srv := newTestStreamServer(t, http.StatusBadRequest, &hits)
+
+	models := []*config.Model{
+		{Name: "primary", Model: "p", BaseUrl: srv.URL, RetryNums: 3},
+		{Name: "fallback", Model: "f", BaseUrl: srv.URL},
+	}
+	testClients := map[string]*openai.Client{}
+	for _, m := range models {
+		testClients[m.Name] = mustAiClient(t, m)
+	}
+	clients.Store(&testClients)
+
+	_, idx, err := openChatStream(context.Background(), models, 0, &openai.ChatCompletionRequest{Stream: true})
+	require.Error(t, err)
+	assert.Equal(t, 0, idx)
+	assert.Equal(t, int32(1), hits.Load())
+}
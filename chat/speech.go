@@ -0,0 +1,128 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"csust-got/config"
+	"csust-got/log"
+	"csust-got/orm"
+	"csust-got/util/ffconv"
+	"errors"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	tb "gopkg.in/telebot.v3"
+)
+
+// maxVoiceChunkLen is the max length of text read in one voice message, so that the text fits in caption
+const maxVoiceChunkLen = 1000
+
+// synthesisTimeout is the timeout of synthesizing all chunks of an answer
+const synthesisTimeout = 3 * time.Minute
+
+var (
+	// ErrSynthesisDisabled means the model of speech synthesis is not set in config
+	ErrSynthesisDisabled = errors.New("speech synthesis is disabled")
+	// ErrNothingToRead means the answer has no text to read aloud
+	ErrNothingToRead = errors.New("nothing to read")
+)
+
+// splitSpeech splits text into chunks at sentence delimiters, every chunk has at most maxLen runes
+func splitSpeech(text string, maxLen int, delimiters []string) []string {
+	var chunks []string
+	for text = strings.TrimSpace(text); text != ""; {
+		if utf8.RuneCountInString(text) <= maxLen {
+			chunks = append(chunks, text)
+			break
+		}
+		runes := []rune(text)
+		cut := len(string(runes[:maxLen]))
+		if pos := findLastSentenceDelimiter(text[:cut], delimiters); pos > 0 {
+			cut = pos
+		}
+		if chunk := strings.TrimSpace(text[:cut]); chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+		text = strings.TrimSpace(text[cut:])
+	}
+	return chunks
+}
+
+// synthesizeSpeech reads text aloud with voice, returns audio in OGG/Opus which can be sent as telegram voice
+func synthesizeSpeech(ctx context.Context, voice, text string) ([]byte, error) {
+	cfg := config.BotConfig().SpeechConfig.Synthesis
+	if cfg.Model == nil || cfg.Model.Model == "" {
+		return nil, ErrSynthesisDisabled
+	}
+
+	client, err := newAiClient(cfg.Model)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.CreateSpeech(ctx, openai.CreateSpeechRequest{
+		Model:          openai.SpeechModel(cfg.Model.Model),
+		Input:          text,
+		Voice:          openai.SpeechVoice(voice),
+		ResponseFormat: openai.SpeechResponseFormatMp3,
+		Speed:          cfg.Speed,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Close() }()
+
+	conv := ffconv.FFConv{}
+	r, errCh := conv.ConvertPipe2Pipe(resp, ffconv.NewPipeInputStream("mp3"),
+		ffconv.FormatArg("ogg"), ffconv.AudioCodecArg("libopus"))
+	data, err := io.ReadAll(r)
+	if err = errors.Join(err, <-errCh); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// sendVoiceAnswer sends answer as voice messages with the text as caption, the first one replies to replyTo.
+// All chunks are synthesized before sending, so nothing is sent if it fails and the text answer can be kept.
+// Returns the last voice message, markup is added to it.
+func sendVoiceAnswer(bot *tb.Bot, v2 *config.ChatConfigSingle, replyTo *tb.Message, answer string,
+	markup *tb.ReplyMarkup) (*tb.Message, error) {
+	chunks := splitSpeech(stripReason(answer), maxVoiceChunkLen, config.BotConfig().SentenceDelimiters)
+	if len(chunks) == 0 {
+		return nil, ErrNothingToRead
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), synthesisTimeout)
+	defer cancel()
+	voices := make([][]byte, 0, len(chunks))
+	for _, chunk := range chunks {
+		data, err := synthesizeSpeech(ctx, v2.Format.Voice, chunk)
+		if err != nil {
+			return nil, err
+		}
+		voices = append(voices, data)
+	}
+
+	var last *tb.Message
+	for i, data := range voices {
+		opts := &tb.SendOptions{ReplyTo: replyTo}
+		if i == len(voices)-1 {
+			opts.ReplyMarkup = markup
+		}
+		msg, err := bot.Send(replyTo.Chat, &tb.Voice{
+			File:    tb.FromReader(bytes.NewReader(data)),
+			Caption: chunks[i],
+		}, opts)
+		if err != nil {
+			return last, err
+		}
+		if err := orm.PushMessageToStream(msg); err != nil {
+			log.Warn("Store bot's voice message to Redis failed", zap.Error(err))
+		}
+		last, replyTo = msg, msg
+	}
+	return last, nil
+}
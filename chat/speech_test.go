@@ -0,0 +1,40 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"csust-got/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitSpeech(t *testing.T) {
+	delimiters := []string{"。", "\n"}
+	assert.Empty(t, splitSpeech("  ", 10, delimiters))
+	assert.Equal(t, []string{"你好。"}, splitSpeech("你好。", 10, delimiters))
+	assert.Equal(t, []string{"第一句。", "第二句话。", "第三句。"}, splitSpeech("第一句。第二句话。第三句。", 6, delimiters))
+
+	// hard cut without delimiter
+	chunks := splitSpeech(strings.Repeat("字", 25), 10, delimiters)
+	require.Len(t, chunks, 3)
+	for _, c := range chunks {
+		assert.LessOrEqual(t, utf8.RuneCountInString(c), 10)
+	}
+}
+
+func TestSendVoiceAnswerDisabled(t *testing.T) {
+	old := config.BotConfig().SpeechConfig
+	defer func() { config.BotConfig().SpeechConfig = old }()
+	config.BotConfig().SpeechConfig = &config.SpeechConfig{}
+
+	v2 := &config.ChatConfigSingle{Format: config.ChatOutputFormatConfig{Voice: "alloy"}}
+	msg, err := sendVoiceAnswer(nil, v2, nil, "<think>hmm</think>hello", nil)
+	assert.Nil(t, msg)
+	assert.ErrorIs(t, err, ErrSynthesisDisabled)
+
+	_, err = sendVoiceAnswer(nil, v2, nil, "<think>hmm</think>", nil)
+	assert.ErrorIs(t, err, ErrNothingToRead)
+}
@@ -0,0 +1,64 @@
+package chat
+
+import (
+	"csust-got/config"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxPartLen is the max length of formatted text in one message,
+// telegram allows 4096 characters, leave some room for the footer.
+const maxPartLen = 4000
+
+const thinkOpenTag = "<think>"
+
+// partFits reports whether the formatted text is short enough to be sent in one message
+func partFits(text string, format *config.ChatOutputFormatConfig) bool {
+	formatted := formatOutput(text, format)
+	// quick path, bytes are never fewer than characters
+	return len(formatted) <= maxPartLen || utf8.RuneCountInString(formatted) <= maxPartLen
+}
+
+// splitPoint returns the position in text where the current message should end,
+// or -1 if the whole text fits in one message.
+// The text is cut after the last sentence delimiter which fits, or at the longest prefix fits if there is no delimiter.
+func splitPoint(text, prefix string, format *config.ChatOutputFormatConfig, delimiters []string) int {
+	if partFits(prefix+text, format) {
+		return -1
+	}
+
+	// binary search the longest prefix of runes fits the limit
+	runes := []rune(text)
+	lo, hi := 1, len(runes)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if partFits(prefix+string(runes[:mid]), format) {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	maxFit := len(string(runes[:lo]))
+
+	if pos := findLastSentenceDelimiter(text[:maxFit], delimiters); pos > 0 {
+		return pos
+	}
+	return maxFit
+}
+
+// continuationPrefix returns the prefix of next part, so that an unclosed reasoning or code block keeps its format.
+func continuationPrefix(part string, format *config.ChatOutputFormatConfig) string {
+	matches := extractReasonPatt.FindStringIndex(part)
+	if len(matches) != 0 {
+		if !strings.Contains(strings.ToLower(part[:matches[1]]), "</think>") {
+			return thinkOpenTag
+		}
+		part = part[matches[1]:]
+	}
+	if format.GetPayloadFormat() == "rich" {
+		if fence := unclosedFence(part); fence != "" {
+			return fence + "\n"
+		}
+	}
+	return ""
+}
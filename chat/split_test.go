@@ -0,0 +1,86 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"csust-got/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func splitAll(text string, format *config.ChatOutputFormatConfig, delimiters []string) []string {
+	var parts []string
+	prefix := ""
+	for {
+		cut := splitPoint(text, prefix, format, delimiters)
+		if cut < 0 {
+			return append(parts, prefix+text)
+		}
+		part := prefix + text[:cut]
+		parts = append(parts, part)
+		prefix = continuationPrefix(part, format)
+		text = text[cut:]
+	}
+}
+
+func TestSplitPoint(t *testing.T) {
+	delimiters := []string{"\n", ".", "。"}
+	format := &config.ChatOutputFormatConfig{}
+
+	t.Run("short text", func(t *testing.T) {
+		assert.Equal(t, -1, splitPoint("Hello world.", "", format, delimiters))
+	})
+
+	t.Run("split at sentence", func(t *testing.T) {
+		text := strings.Repeat("This is a sentence. ", 500)
+		parts := splitAll(text, format, delimiters)
+		require.Greater(t, len(parts), 1)
+		assert.Equal(t, text, strings.Join(parts, ""))
+		for _, part := range parts[:len(parts)-1] {
+			assert.True(t, strings.HasSuffix(part, "."))
+			assert.LessOrEqual(t, utf8.RuneCountInString(formatOutput(part, format)), maxPartLen)
+		}
+	})
+
+	t.Run("escaped chars count", func(t *testing.T) {
+		// every char is escaped in markdown
+		text := strings.Repeat("_", 3000)
+		parts := splitAll(text, format, delimiters)
+		require.Len(t, parts, 2)
+		assert.Len(t, parts[0], maxPartLen/2)
+		assert.Equal(t, text, strings.Join(parts, ""))
+	})
+
+	t.Run("hard cut without delimiter", func(t *testing.T) {
+		text := strings.Repeat("字", 5000)
+		parts := splitAll(text, &config.ChatOutputFormatConfig{Format: "html"}, delimiters)
+		require.Len(t, parts, 2)
+		assert.Equal(t, maxPartLen, utf8.RuneCountInString(parts[0]))
+		assert.True(t, utf8.ValidString(parts[0]))
+	})
+}
+
+func TestContinuationPrefix(t *testing.T) {
+	plain := &config.ChatOutputFormatConfig{}
+	assert.Equal(t, thinkOpenTag, continuationPrefix("<think>reasoning...", plain))
+	assert.Empty(t, continuationPrefix("<think>reasoning</think>answer", plain))
+	assert.Empty(t, continuationPrefix("answer", plain))
+	assert.Empty(t, continuationPrefix("```go\nfunc", plain))
+
+	rich := &config.ChatOutputFormatConfig{Payload: "rich"}
+	assert.Equal(t, "```go\n", continuationPrefix("<think>reasoning</think>```go\nfunc", rich))
+	assert.Empty(t, continuationPrefix("```go\nfunc\n```\n", rich))
+	assert.Equal(t, thinkOpenTag, continuationPrefix("<think>```go\nfunc", rich))
+
+	format := &config.ChatOutputFormatConfig{Reason: "quote"}
+	text := "<think>" + strings.Repeat("thinking. ", 500) + "</think>answer."
+	parts := splitAll(text, format, []string{"."})
+	require.Greater(t, len(parts), 1)
+	for _, part := range parts[:len(parts)-1] {
+		assert.True(t, strings.HasPrefix(formatOutput(part, format), ">"))
+	}
+	assert.Contains(t, formatOutput(parts[len(parts)-1], format), "answer")
+}
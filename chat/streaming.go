@@ -12,6 +12,7 @@ import (
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"github.com/sashabaranov/go-openai"
 	"go.uber.org/zap"
@@ -23,10 +24,14 @@ type streamProcessor struct {
 	chatCtx        context.Context
 	ctx            tb.Context
 	placeholderMsg *tb.Message
+	replyTo        *tb.Message     // The message which the answer replies to
+	runMarkup      *tb.ReplyMarkup // Keyboard shown while answering
 	useMcp         bool
 	request        *openai.ChatCompletionRequest
 	messages       *[]openai.ChatCompletionMessage
 	config         *config.ChatConfigSingle
+	models         []*config.Model // The primary model followed by fallback models
+	modelIdx       int             // Index of the model which is answering
 
 	// State variables
 	fullResponse           strings.Builder
@@ -34,6 +39,15 @@ type streamProcessor struct {
 	ticker                 *time.Ticker
 	done                   chan struct{}
 	currentToolCallsChunks []openai.ToolCall // Store all tool call chunks in a flat slice
+	replyMsg               *tb.Message       // The final answer message
+	streamRetries          int               // Times of recreating stream after mid-stream failures
+	usage                  orm.LLMUsage      // Token usage reported by all streams
+	usageReported          bool              // Whether any stream reported usage
+	allowedTools           map[string]bool   // Tools sent to model, others will not be called
+	toolRounds             int               // Rounds of tool calls in this request
+	parts                  []*tb.Message     // Finished messages of a long answer, placeholderMsg continues the last one
+	partOffset             int               // Position in fullResponse where the current message begins
+	partPrefix             string            // Prefix of the current message to keep the format of previous one
 
 	// Mutex to protect concurrent access to strings.Builder
 	mu sync.RWMutex
@@ -45,10 +59,13 @@ func newStreamProcessor(chatCtx context.Context, ctx tb.Context, placeholderMsg
 		chatCtx:        chatCtx,
 		ctx:            ctx,
 		placeholderMsg: placeholderMsg,
+		replyTo:        ctx.Message(),
 		useMcp:         useMcp,
 		request:        request,
 		messages:       messages,
 		config:         chatConfig,
+		models:         chatConfig.Models(),
+		allowedTools:   toolNameSet(request.Tools),
 		done:           make(chan struct{}), // dont use a buffered channel to ensure proper synchronization
 	}
 }
@@ -95,15 +112,17 @@ func (sp *streamProcessor) startStreamingTicker() {
 
 // updateStreamingMessage updates the message with accumulated content at sentence boundaries
 func (sp *streamProcessor) updateStreamingMessage() {
-	sp.mu.RLock()
-	currentText := sp.fullResponse.String()
-	sp.mu.RUnlock()
+	currentText, err := sp.rollOverParts(sp.pendingText())
+	if err != nil {
+		log.Error("Failed to send full part during streaming", zap.Error(err))
+		return
+	}
 
 	if currentText == "" || currentText == sp.lastSentText {
 		return
 	}
 
-	delimiters := config.BotConfig.SentenceDelimiters
+	delimiters := config.BotConfig().SentenceDelimiters
 	lastDelimEndPos := findLastSentenceDelimiter(currentText, delimiters)
 
 	if lastDelimEndPos <= 0 {
@@ -115,31 +134,138 @@ func (sp *streamProcessor) updateStreamingMessage() {
 		return
 	}
 
-	formattedText := formatOutput(textToSend, &sp.config.Format)
-	formatOpt := sp.getFormatOption()
+	formattedText := formatOutput(strings.TrimSpace(sp.partPrefix+textToSend), &sp.config.Format)
 
-	if formattedText == "" {
+	if strings.TrimSpace(formattedText) == "" {
 		return // Skip if formatted text is empty
 	}
 
-	var err error
-	if sp.placeholderMsg == nil {
-		// If no placeholder message exists, create a reply message for the first time
-		sp.placeholderMsg, err = sp.ctx.Bot().Reply(sp.ctx.Message(), formattedText, formatOpt)
-		if err != nil {
-			log.Error("Failed to create initial reply message during streaming", zap.Error(err))
-			return
+	if _, err := sp.sendPart(formattedText, sp.runMarkup); err != nil {
+		log.Error("Failed to update message during streaming", zap.Error(err))
+		return
+	}
+
+	sp.lastSentText = textToSend
+}
+
+// pendingText returns the response text which is not sent in finished parts
+func (sp *streamProcessor) pendingText() string {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return sp.fullResponse.String()[sp.partOffset:]
+}
+
+// sendPart sends formatted text as the current message,
+// edits the placeholder if exists, or replies to the previous part.
+func (sp *streamProcessor) sendPart(formattedText string, markup *tb.ReplyMarkup) (*tb.Message, error) {
+	opts := sendOptions(markup, sp.getFormatOption())
+	if sp.placeholderMsg != nil {
+		return util.EditMessageWithError(sp.placeholderMsg, formattedText, opts...)
+	}
+
+	replyTo := sp.replyTo
+	if len(sp.parts) > 0 {
+		replyTo = sp.parts[len(sp.parts)-1]
+	}
+	msg, err := sp.ctx.Bot().Reply(replyTo, formattedText, opts...)
+	if err != nil {
+		return nil, err
+	}
+	sp.placeholderMsg = msg
+	return msg, nil
+}
+
+// rollOverParts finishes the current message and continues in a new one, while text is too long for one message.
+// Returns the text left for the current message.
+func (sp *streamProcessor) rollOverParts(text string) (string, error) {
+	delimiters := config.BotConfig().SentenceDelimiters
+	for {
+		cut := splitPoint(text, sp.partPrefix, &sp.config.Format, delimiters)
+		if cut < 0 {
+			return text, nil
 		}
-	} else {
-		// Edit the existing placeholder message
-		_, err = util.EditMessageWithError(sp.placeholderMsg, formattedText, formatOpt)
+
+		part := sp.partPrefix + text[:cut]
+		msg, err := sp.sendPart(formatOutput(strings.TrimSpace(part), &sp.config.Format), nil)
 		if err != nil {
-			log.Error("Failed to edit message during streaming", zap.Error(err))
-			return
+			return text, err
+		}
+		if storeErr := orm.PushMessageToStream(msg); storeErr != nil {
+			log.Warn("Store bot's reply message to Redis failed", zap.Error(storeErr))
 		}
+		log.Debug("long answer continues in a new message", zap.Int("part", len(sp.parts)+1), zap.Int("length", len(part)))
+
+		sp.parts = append(sp.parts, msg)
+		sp.placeholderMsg = nil
+		sp.partOffset += cut
+		sp.partPrefix = continuationPrefix(part, &sp.config.Format)
+		sp.lastSentText = ""
+		text = text[cut:]
 	}
+}
 
-	sp.lastSentText = textToSend
+// discardParts deletes continuation messages of the dropped response,
+// and the next response will be written to the first message again.
+func (sp *streamProcessor) discardParts() {
+	if len(sp.parts) == 0 {
+		return
+	}
+	stale := make([]*tb.Message, 0, len(sp.parts))
+	stale = append(stale, sp.parts[1:]...)
+	stale = append(stale, sp.placeholderMsg)
+	for _, msg := range stale {
+		if msg == nil {
+			continue
+		}
+		if err := sp.ctx.Bot().Delete(msg); err != nil {
+			log.Warn("Failed to delete stale part of answer", zap.Error(err))
+		}
+	}
+	sp.placeholderMsg = sp.parts[0]
+	sp.parts = nil
+}
+
+// answerMarkup returns the keyboard of the final answer, nil if buttons are disabled
+func (sp *streamProcessor) answerMarkup() *tb.ReplyMarkup {
+	if !sp.config.Format.Buttons {
+		return nil
+	}
+	return answerMarkup()
+}
+
+// answerMsg returns the message of answer, or the message which answer replies to if there is no placeholder
+func (sp *streamProcessor) answerMsg() *tb.Message {
+	if sp.placeholderMsg != nil {
+		return sp.placeholderMsg
+	}
+	return sp.replyTo
+}
+
+// deleteAnswer deletes all messages of the text answer
+func (sp *streamProcessor) deleteAnswer() {
+	msgs := append(sp.parts[:len(sp.parts):len(sp.parts)], sp.replyMsg)
+	for _, msg := range msgs {
+		if msg == nil {
+			continue
+		}
+		if err := sp.ctx.Bot().Delete(msg); err != nil {
+			log.Warn("Failed to delete text answer", zap.Int("msg", msg.ID), zap.Error(err))
+		}
+	}
+}
+
+// stopped reports whether the answer is stopped by user
+func (sp *streamProcessor) stopped() bool {
+	return errors.Is(sp.chatCtx.Err(), context.Canceled)
+}
+
+// modelFooter returns the formatted line to show which model answered
+func (sp *streamProcessor) modelFooter() string {
+	name := "via " + sp.models[sp.modelIdx].ShowName()
+	if sp.config.Format.GetFormat() == "html" {
+		return "\n\n<i>" + util.EscapeTgHTMLReservedChars(name) + "</i>"
+	}
+	return "\n\n_" + util.EscapeTgMDv2ReservedChars(name) + "_"
 }
 
 // getFormatOption returns the appropriate Telegram formatting option
@@ -150,11 +276,12 @@ func (sp *streamProcessor) getFormatOption() tb.ParseMode {
 	return tb.ModeMarkdownV2
 }
 
-// stopTicker stops the streaming ticker
+// stopTicker stops the streaming ticker, it's safe to call more than once
 func (sp *streamProcessor) stopTicker() {
 	if sp.ticker != nil {
 		sp.done <- struct{}{}
 		sp.ticker.Stop()
+		sp.ticker = nil
 	}
 }
 
@@ -168,23 +295,68 @@ func (sp *streamProcessor) handleToolCallsInStream(toolCalls []openai.ToolCall)
 		return nil, err
 	}
 
+	// no more tools after too many rounds, so the model has to answer with what it got
+	sp.toolRounds++
+	if sp.toolRounds >= sp.config.GetMaxToolRounds() {
+		log.Warn("tool call rounds reach limit, disable tools for the rest", zap.String("name", sp.config.Name),
+			zap.Int("rounds", sp.toolRounds))
+		sp.request.Tools = nil
+	}
+
 	// Create a new stream for the follow-up request
 	sp.request.Messages = *sp.messages
-	newStream, err := clients[sp.config.Model.Name].CreateChatCompletionStream(sp.chatCtx, *sp.request)
+	newStream, modelIdx, err := openChatStream(sp.chatCtx, sp.models, sp.modelIdx, sp.request)
 	if err != nil {
 		return nil, err
 	}
+	sp.modelIdx = modelIdx
+
+	sp.resetStreamState()
+
+	// Restart ticker if streaming is enabled
+	sp.startStreamingTicker()
+
+	return newStream, nil
+}
 
-	// Reset buffer and tool calls for the new stream
+// resetStreamState resets buffer and tool calls for a new stream
+func (sp *streamProcessor) resetStreamState() {
 	sp.mu.Lock()
 	sp.fullResponse.Reset()
 	sp.currentToolCallsChunks = nil
 	sp.mu.Unlock()
 	sp.lastSentText = ""
+	sp.discardParts()
+	sp.partOffset = 0
+	sp.partPrefix = ""
+}
 
-	// Restart ticker if streaming is enabled
-	sp.startStreamingTicker()
+// recoverStream recreates the stream after it's broken in the middle,
+// the partial response is dropped and the request is sent again.
+func (sp *streamProcessor) recoverStream(streamErr error) (*openai.ChatCompletionStream, error) {
+	model := sp.models[sp.modelIdx]
+	if !isRetryableError(streamErr) || sp.streamRetries >= model.GetRetryNums() {
+		return nil, streamErr
+	}
+	sp.streamRetries++
+	log.Warn("chat completion stream broken, retrying", zap.String("model", model.Name),
+		zap.Int("retries", sp.streamRetries), zap.Error(streamErr))
+
+	if err := sleepContext(sp.chatCtx, retryBackoff(model, sp.streamRetries)); err != nil {
+		return nil, errors.Join(streamErr, err)
+	}
 
+	sp.request.Messages = *sp.messages
+	newStream, modelIdx, err := openChatStream(sp.chatCtx, sp.models, sp.modelIdx, sp.request)
+	if err != nil {
+		return nil, err
+	}
+	sp.modelIdx = modelIdx
+
+	// the ticker should not update messages while they are reset
+	sp.stopTicker()
+	sp.resetStreamState()
+	sp.startStreamingTicker()
 	return newStream, nil
 }
 
@@ -265,42 +437,53 @@ func (sp *streamProcessor) aggregateToolCalls() []openai.ToolCall {
 	return result
 }
 
-// finalizeResponse sends the final response message
+// finalizeResponse sends the final response message, long response is split into several messages.
+// Returns the last message of the response.
 func (sp *streamProcessor) finalizeResponse() (*tb.Message, error) {
 	// Stop the ticker
 	sp.stopTicker()
 
 	// Get the final response
-	sp.mu.RLock()
-	finalResponse := strings.TrimSpace(sp.fullResponse.String())
-	sp.mu.RUnlock()
+	finalResponse, err := sp.rollOverParts(strings.TrimRightFunc(sp.pendingText(), unicode.IsSpace))
+	if err != nil {
+		log.Error("Failed to send full part of final response", zap.Error(err))
+		return nil, err
+	}
+	finalResponse = strings.TrimSpace(finalResponse)
 
-	formattedResponse := formatOutput(finalResponse, &sp.config.Format)
-	if formattedResponse == "" {
+	formattedResponse := ""
+	if finalResponse != "" {
+		formattedResponse = formatOutput(sp.partPrefix+finalResponse, &sp.config.Format)
+	}
+	switch {
+	case formattedResponse == "" && len(sp.parts) > 0:
+		// the response ends exactly at the end of last part
+		replyMsg := sp.parts[len(sp.parts)-1]
+		if sp.placeholderMsg != nil {
+			if err := sp.ctx.Bot().Delete(sp.placeholderMsg); err != nil {
+				log.Warn("Failed to delete empty part of answer", zap.Error(err))
+			}
+		}
+		if markup := sp.answerMarkup(); markup != nil {
+			if _, err := sp.ctx.Bot().EditReplyMarkup(replyMsg, markup); err != nil {
+				log.Warn("Failed to add buttons to answer", zap.Error(err))
+			}
+		}
+		return replyMsg, nil
+	case formattedResponse == "" && sp.stopped():
+		formattedResponse = "⏹ 已停止"
+	case formattedResponse == "":
 		log.Warn("Final response is empty, sending error message instead")
 		formattedResponse = sp.config.GetErrorMessage()
+	case sp.modelIdx > 0:
+		// answered by a fallback model
+		formattedResponse += sp.modelFooter()
 	}
 
-	// Prepare format option
-	formatOpt := sp.getFormatOption()
-
-	var replyMsg *tb.Message
-	var err error
-
-	if sp.placeholderMsg != nil {
-		// If we have a placeholder, edit it with the final response
-		replyMsg, err = util.EditMessageWithError(sp.placeholderMsg, formattedResponse, formatOpt)
-		if err != nil {
-			log.Error("Failed to edit placeholder message with final response", zap.Error(err))
-			return nil, err
-		}
-	} else {
-		// If no placeholder, send a new reply
-		replyMsg, err = sp.ctx.Bot().Reply(sp.ctx.Message(), formattedResponse, formatOpt)
-		if err != nil {
-			log.Error("Failed to send reply", zap.Error(err))
-			return nil, err
-		}
+	replyMsg, err := sp.sendPart(formattedResponse, sp.answerMarkup())
+	if err != nil {
+		log.Error("Failed to send final response", zap.Error(err))
+		return nil, err
 	}
 
 	// Store the message to Redis
@@ -329,12 +512,15 @@ func (sp *streamProcessor) handleToolCalls(toolCalls []openai.ToolCall) error {
 	for _, toolCall := range toolCalls {
 		var result string
 		var toolErr error
-		tool, ok := mcpo.GetTool(toolCall.Function.Name)
-		if !ok {
+		tool, ok := tools.GetTool(toolCall.Function.Name)
+		switch {
+		case !ok || !sp.allowedTools[toolCall.Function.Name]:
 			log.Error("MCP tool not found", zap.String("toolName", toolCall.Function.Name))
 			result = "MCP tool not found"
-		} else {
-			result, toolErr = tool.Call(sp.chatCtx, toolCall.Function.Arguments)
+		case tools.IsDangerous(toolCall.Function.Name) && !sp.confirmToolCall(toolCall):
+			result = "The user did not allow this tool call"
+		default:
+			result, toolErr = tool.Call(withToolReplyTo(withToolEnv(sp.chatCtx, sp.ctx), sp.answerMsg()), toolCall.Function.Arguments)
 			if toolErr != nil {
 				log.Error("Failed to call tool", zap.String("toolName", toolCall.Function.Name), zap.Error(toolErr))
 				result = "Failed to call function tool"
@@ -375,9 +561,22 @@ func (sp *streamProcessor) process(stream *openai.ChatCompletionStream) (string,
 			if errors.Is(err, io.EOF) {
 				break
 			}
-			return "", err
+			if sp.stopped() {
+				log.Info("chat is stopped by user", zap.String("name", sp.config.Name))
+				break
+			}
+			newStream, recoverErr := sp.recoverStream(err)
+			if recoverErr != nil {
+				return "", recoverErr
+			}
+			if err := currentStream.Close(); err != nil {
+				log.Error("Failed to close broken stream", zap.Error(err))
+			}
+			currentStream = newStream
+			continue
 		}
 
+		sp.addUsage(response.Usage, false)
 		if len(response.Choices) == 0 {
 			continue
 		}
@@ -388,16 +587,22 @@ func (sp *streamProcessor) process(stream *openai.ChatCompletionStream) (string,
 		sp.processStreamChunk(choice)
 
 		// Handle tool calls when the stream indicates completion
-		if choice.FinishReason == openai.FinishReasonStop && sp.useMcp {
+		if choice.FinishReason == openai.FinishReasonStop && sp.useMcp && len(sp.request.Tools) > 0 {
 			// Check if we have accumulated tool calls
 			toolCalls := sp.aggregateToolCalls()
 
 			if len(toolCalls) > 0 {
 				// Send bot is typing
 				_ = sp.ctx.Bot().Notify(sp.ctx.Chat(), tb.Typing)
+				// usage of this round comes after the finish chunk
+				sp.drainUsage(currentStream)
 				// Handle tool calls in the stream
 				newStream, err := sp.handleToolCallsInStream(toolCalls)
 				if err != nil {
+					if sp.stopped() {
+						log.Info("chat is stopped by user while calling tools", zap.String("name", sp.config.Name))
+						break
+					}
 					return "", err
 				}
 				// Close current stream and switch to new stream
@@ -412,10 +617,11 @@ func (sp *streamProcessor) process(stream *openai.ChatCompletionStream) (string,
 	}
 
 	// Finalize and send the response
-	_, err := sp.finalizeResponse()
+	replyMsg, err := sp.finalizeResponse()
 	if err != nil {
 		return "", err
 	}
+	sp.replyMsg = replyMsg
 
 	sp.mu.RLock()
 	result := strings.TrimSpace(sp.fullResponse.String())
@@ -0,0 +1,368 @@
+package chat
+
+import (
+	"context"
+	"csust-got/config"
+	"csust-got/log"
+	"csust-got/orm"
+	"csust-got/util"
+	"errors"
+	"fmt"
+	"html"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	tb "gopkg.in/telebot.v3"
+)
+
+const (
+	// defaultSummaryPromptLimit is the prompt limit used to chunk messages if the model has no limit
+	defaultSummaryPromptLimit = 8000
+	// summaryReservedTokens is reserved in every chunk for the instruction of prompt
+	summaryReservedTokens = 500
+	// maxSummaryRounds limits rounds of reducing, in case the model never makes summaries shorter
+	maxSummaryRounds = 5
+	// maxSummaryLen is the max length of digest in runes, to fit in a telegram message
+	maxSummaryLen = 3500
+	// maxShownParticipants is the max count of participants listed in digest
+	maxShownParticipants = 10
+	summaryTimeout       = 5 * time.Minute
+)
+
+var (
+	// ErrInvalidSummaryRange means the argument of `/summary_chat` is neither a count nor a duration
+	ErrInvalidSummaryRange = errors.New("invalid summary range")
+	// ErrEmptySummary means the model answered nothing
+	ErrEmptySummary = errors.New("empty summary")
+)
+
+const (
+	summarySystemPrompt = "你是群聊记录的总结助手。聊天记录每行格式为 `月-日 时:分 昵称: 内容`。" +
+		"只根据记录总结，不要编造内容，使用简体中文。"
+	summaryMapPrompt    = "下面是群聊记录的一部分，请按话题简要总结，每个话题写明参与讨论的人和主要观点、结论。\n\n%s"
+	summaryReducePrompt = "下面是同一段群聊按时间顺序分段得到的总结，请合并相同的话题，" +
+		"保留参与者和主要观点、结论，输出更精简的总结。\n\n%s"
+	summaryFinalPrompt = "请根据下面的%s，整理一份群聊摘要，使用 Markdown：\n" +
+		"先用一两句话概括整体内容，再按话题分点列出，每个话题写明参与者和要点，话题按讨论热度排序，最多 8 个。\n" +
+		"不需要列出参与者统计，也不要添加标题。\n\n%s"
+)
+
+// summaryRange is the range of messages to summarize, last count messages or messages within window
+type summaryRange struct {
+	count  int
+	window time.Duration
+}
+
+// parseSummaryRange parses argument of `/summary_chat`, an integer means last N messages, otherwise a duration like `2h`
+func parseSummaryRange(arg string, defaultWindow time.Duration) (summaryRange, error) {
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		return summaryRange{window: defaultWindow}, nil
+	}
+	if n, err := strconv.Atoi(arg); err == nil {
+		if n <= 0 {
+			return summaryRange{}, ErrInvalidSummaryRange
+		}
+		return summaryRange{count: n}, nil
+	}
+	d, err := util.EvalDuration(arg)
+	if err != nil || d <= 0 {
+		return summaryRange{}, ErrInvalidSummaryRange
+	}
+	return summaryRange{window: d}, nil
+}
+
+// filterSummaryMessages picks messages in range from msgs which are ordered from newest to oldest,
+// commands and messages of bot are skipped. Result is in chronological order.
+func filterSummaryMessages(msgs []*tb.Message, r summaryRange, botID int64, now time.Time) []*tb.Message {
+	since := now.Add(-r.window)
+	picked := make([]*tb.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if r.window > 0 && msg.Time().Before(since) {
+			break
+		}
+		if r.count > 0 && len(picked) >= r.count {
+			break
+		}
+		if msg.Sender == nil || msg.Sender.ID == botID || strings.HasPrefix(msg.Text, "/") || summaryText(msg) == "" {
+			continue
+		}
+		picked = append(picked, msg)
+	}
+	for i, j := 0, len(picked)-1; i < j; i, j = i+1, j-1 {
+		picked[i], picked[j] = picked[j], picked[i]
+	}
+	return picked
+}
+
+func summaryText(msg *tb.Message) string {
+	text := msg.Text
+	if text == "" {
+		text = msg.Caption
+	}
+	if text == "" && imageFile(msg) != nil {
+		text = "[图片]"
+	}
+	return strings.Join(strings.Fields(text), " ")
+}
+
+func summarySenderName(msg *tb.Message) string {
+	return (&userNames{First: msg.Sender.FirstName, Last: msg.Sender.LastName}).ShowName()
+}
+
+// summaryLine formats message compactly to save tokens
+func summaryLine(msg *tb.Message) string {
+	return fmt.Sprintf("%s %s: %s", msg.Time().Format("01-02 15:04"), summarySenderName(msg), summaryText(msg))
+}
+
+type participant struct {
+	name     string
+	messages int
+}
+
+// countParticipants returns senders of msgs ordered by count of messages
+func countParticipants(msgs []*tb.Message) []participant {
+	index := make(map[int64]int)
+	var ps []participant
+	for _, msg := range msgs {
+		i, ok := index[msg.Sender.ID]
+		if !ok {
+			i = len(ps)
+			index[msg.Sender.ID] = i
+			ps = append(ps, participant{name: summarySenderName(msg)})
+		}
+		ps[i].messages++
+	}
+	sort.SliceStable(ps, func(i, j int) bool { return ps[i].messages > ps[j].messages })
+	return ps
+}
+
+func formatParticipants(ps []participant) string {
+	names := make([]string, 0, min(len(ps), maxShownParticipants))
+	for _, p := range ps[:min(len(ps), maxShownParticipants)] {
+		names = append(names, fmt.Sprintf("%s(%d)", p.name, p.messages))
+	}
+	text := strings.Join(names, "、")
+	if len(ps) > maxShownParticipants {
+		text += fmt.Sprintf(" 等 %d 人", len(ps))
+	}
+	return text
+}
+
+// chunkLines joins lines into chunks of at most limit tokens, a line longer than limit is truncated
+func chunkLines(tk tokenizer, lines []string, limit int) []string {
+	var chunks []string
+	var sb strings.Builder
+	tokens := 0
+	for _, line := range lines {
+		line = tk.truncate(line, limit)
+		n := tk.count(line)
+		if sb.Len() > 0 && tokens+n > limit {
+			chunks = append(chunks, sb.String())
+			sb.Reset()
+			tokens = 0
+		}
+		if sb.Len() > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(line)
+		tokens += n
+	}
+	if sb.Len() > 0 {
+		chunks = append(chunks, sb.String())
+	}
+	return chunks
+}
+
+// summarizer summarizes chat records map-reduce style, and accumulates usage of all requests
+type summarizer struct {
+	models      []*config.Model
+	temperature float32
+	limit       int
+
+	modelIdx int
+	usage    orm.LLMUsage
+}
+
+func newSummarizer(v2 *config.ChatConfigSingle) *summarizer {
+	limit := v2.Model.PromptLimit
+	if limit <= 0 {
+		limit = defaultSummaryPromptLimit
+	}
+	return &summarizer{
+		models:      v2.Models(),
+		temperature: v2.GetTemperature(),
+		limit:       max(limit-summaryReservedTokens, summaryReservedTokens),
+	}
+}
+
+// tokenizer returns tokenizer of the model in use
+func (s *summarizer) tokenizer() tokenizer {
+	return tokenizerOf(s.models[s.modelIdx].Model)
+}
+
+func (s *summarizer) complete(ctx context.Context, prompt string) (string, error) {
+	request := openai.ChatCompletionRequest{
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: summarySystemPrompt},
+			{Role: openai.ChatMessageRoleUser, Content: prompt},
+		},
+		Temperature: s.temperature,
+	}
+	resp, idx, err := completeChat(ctx, s.models, s.modelIdx, &request)
+	s.modelIdx = idx
+	if err != nil {
+		return "", err
+	}
+	if resp.Usage.TotalTokens > 0 {
+		s.usage.PromptTokens += int64(resp.Usage.PromptTokens)
+		s.usage.CompletionTokens += int64(resp.Usage.CompletionTokens)
+	} else {
+		s.usage.PromptTokens += int64(tokenizerOf(request.Model).countMessages(request.Messages))
+	}
+	if len(resp.Choices) == 0 {
+		return "", nil
+	}
+	answer := strings.TrimSpace(stripReason(resp.Choices[0].Message.Content))
+	if resp.Usage.TotalTokens == 0 {
+		s.usage.CompletionTokens += int64(tokenizerOf(request.Model).count(answer))
+	}
+	return answer, nil
+}
+
+// summarize summarizes lines of chat records. Records are split into chunks fitting the prompt limit,
+// every chunk is summarized, then the summaries are merged until they fit in one prompt.
+func (s *summarizer) summarize(ctx context.Context, lines []string) (string, error) {
+	chunks := chunkLines(s.tokenizer(), lines, s.limit)
+	if len(chunks) == 1 {
+		return s.complete(ctx, fmt.Sprintf(summaryFinalPrompt, "群聊记录", chunks[0]))
+	}
+
+	partials, err := s.mapChunks(ctx, summaryMapPrompt, chunks)
+	if err != nil {
+		return "", err
+	}
+	for round := 0; ; round++ {
+		groups := chunkLines(s.tokenizer(), partials, s.limit)
+		// the model answered nothing for all chunks
+		if len(groups) == 0 {
+			return "", ErrEmptySummary
+		}
+		if len(groups) == 1 || round >= maxSummaryRounds {
+			return s.complete(ctx, fmt.Sprintf(summaryFinalPrompt, "分段总结", s.tokenizer().truncate(groups[0], s.limit)))
+		}
+		if len(groups) == len(partials) {
+			// every summary is too long to be merged with others, merge them in pairs anyway
+			groups = groups[:0]
+			for i := 0; i < len(partials); i += 2 {
+				groups = append(groups, strings.Join(partials[i:min(i+2, len(partials))], "\n"))
+			}
+		}
+		if partials, err = s.mapChunks(ctx, summaryReducePrompt, groups); err != nil {
+			return "", err
+		}
+	}
+}
+
+func (s *summarizer) mapChunks(ctx context.Context, prompt string, chunks []string) ([]string, error) {
+	results := make([]string, 0, len(chunks))
+	for _, chunk := range chunks {
+		result, err := s.complete(ctx, fmt.Sprintf(prompt, chunk))
+		if err != nil {
+			return nil, err
+		}
+		if result != "" {
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+// SummaryHandler handles `/summary_chat [N|duration]`, summarizes the last N messages
+// or messages within the duration of the group into a digest.
+func SummaryHandler(ctx tb.Context) error {
+	cfg := config.BotConfig().ChatSummary
+	v2 := findChatConfig(cfg.Chat)
+	if v2 == nil {
+		log.Warn("[ChatSummary] chat config not found", zap.String("chat", cfg.Chat))
+		return ctx.Reply("群聊总结没有配置哦")
+	}
+
+	r, err := parseSummaryRange(strings.Join(ctx.Args(), " "), cfg.DefaultWindow)
+	if err != nil {
+		return ctx.Reply("用法：/summary_chat [消息条数|时间范围]，例如 /summary_chat 200 或 /summary_chat 3h")
+	}
+	if !checkQuota(ctx) {
+		return ctx.Reply("你今天的额度已经用完了，明天再来吧😴")
+	}
+
+	fetch := int64(cfg.MaxMessages)
+	if r.count > 0 {
+		// leave some room for skipped commands and messages of bot
+		fetch = int64(min(r.count*2, cfg.MaxMessages))
+	}
+	msgs, err := orm.GetMessagesFromStream(ctx.Chat().ID, "+", "-", fetch, true)
+	if err != nil {
+		return ctx.Reply("获取消息记录失败了😔")
+	}
+	msgs = filterSummaryMessages(msgs, r, ctx.Bot().Me.ID, time.Now())
+	if len(msgs) == 0 {
+		return ctx.Reply("这段时间没有可以总结的消息")
+	}
+
+	placeholder, err := ctx.Bot().Reply(ctx.Message(), "👀 正在总结 "+strconv.Itoa(len(msgs))+" 条消息…")
+	if err != nil {
+		return err
+	}
+
+	digest, err := summarizeMessages(v2, ctx.Chat().ID, ctx.Sender().ID, msgs, "📋 群聊摘要")
+	if err != nil {
+		log.Error("[ChatSummary] summarize failed", zap.Int64("chat", ctx.Chat().ID), zap.Error(err))
+		_, err = ctx.Bot().Edit(placeholder, "总结失败了😔")
+		return err
+	}
+
+	_, err = ctx.Bot().Edit(placeholder, digest, tb.ModeHTML, tb.NoPreview)
+	return err
+}
+
+// summarizeMessages summarizes msgs into a digest in telegram HTML, usage is recorded for the user
+func summarizeMessages(v2 *config.ChatConfigSingle, chatID, userID int64, msgs []*tb.Message, title string) (string, error) {
+	lines := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		lines = append(lines, summaryLine(msg))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), summaryTimeout)
+	defer cancel()
+	s := newSummarizer(v2)
+	digest, err := s.summarize(ctx, lines)
+	if s.usage.Total() > 0 {
+		s.usage.Requests = 1
+		_ = orm.AddLLMUsage(chatID, userID, s.models[s.modelIdx].Name, &s.usage, time.Now())
+	}
+	if err != nil {
+		return "", err
+	}
+	if digest == "" {
+		return "", ErrEmptySummary
+	}
+	return formatDigest(title, msgs, digest), nil
+}
+
+// formatDigest formats digest with statistics of msgs as telegram HTML
+func formatDigest(title string, msgs []*tb.Message, digest string) string {
+	if utf8.RuneCountInString(digest) > maxSummaryLen {
+		digest = string([]rune(digest)[:maxSummaryLen]) + truncatedMark
+	}
+	const layout = "01-02 15:04"
+	header := fmt.Sprintf("<b>%s</b>\n%d 条消息，%s ~ %s\n<b>参与者</b>：%s\n\n",
+		html.EscapeString(title), len(msgs), msgs[0].Time().Format(layout), msgs[len(msgs)-1].Time().Format(layout),
+		html.EscapeString(formatParticipants(countParticipants(msgs))))
+	return header + renderMarkdown(digest, "html")
+}
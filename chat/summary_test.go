@@ -0,0 +1,151 @@
+package chat
+
+import (
+	"context"
+	"csust-got/config"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tb "gopkg.in/telebot.v3"
+)
+
+func TestParseSummaryRange(t *testing.T) {
+	r, err := parseSummaryRange("", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, summaryRange{window: time.Hour}, r)
+
+	r, err = parseSummaryRange("200", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, summaryRange{count: 200}, r)
+
+	r, err = parseSummaryRange("3h", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, summaryRange{window: 3 * time.Hour}, r)
+
+	for _, arg := range []string{"0", "-5", "-1h", "abc"} {
+		_, err = parseSummaryRange(arg, time.Hour)
+		assert.ErrorIs(t, err, ErrInvalidSummaryRange, arg)
+	}
+}
+
+func TestFilterSummaryMessages(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	alice := &tb.User{ID: 1, FirstName: "Alice"}
+	bot := &tb.User{ID: 99, FirstName: "Bot"}
+	// newest first, as read from stream in reverse
+	msgs := []*tb.Message{
+		{ID: 5, Sender: alice, Text: "latest", Unixtime: now.Add(-time.Minute).Unix()},
+		{ID: 4, Sender: bot, Text: "answer", Unixtime: now.Add(-2 * time.Minute).Unix()},
+		{ID: 3, Sender: alice, Text: "/summary_chat", Unixtime: now.Add(-3 * time.Minute).Unix()},
+		{ID: 2, Sender: alice, Text: "earlier", Unixtime: now.Add(-30 * time.Minute).Unix()},
+		{ID: 1, Sender: alice, Text: "too old", Unixtime: now.Add(-2 * time.Hour).Unix()},
+	}
+
+	got := filterSummaryMessages(msgs, summaryRange{window: time.Hour}, bot.ID, now)
+	require.Len(t, got, 2)
+	assert.Equal(t, 2, got[0].ID)
+	assert.Equal(t, 5, got[1].ID)
+
+	got = filterSummaryMessages(msgs, summaryRange{count: 1}, bot.ID, now)
+	require.Len(t, got, 1)
+	assert.Equal(t, 5, got[0].ID)
+}
+
+func TestCountParticipants(t *testing.T) {
+	alice := &tb.User{ID: 1, FirstName: "Alice"}
+	bob := &tb.User{ID: 2, FirstName: "Bob"}
+	msgs := []*tb.Message{{Sender: alice}, {Sender: bob}, {Sender: bob}}
+	ps := countParticipants(msgs)
+	assert.Equal(t, []participant{{name: "Bob", messages: 2}, {name: "Alice", messages: 1}}, ps)
+	assert.Equal(t, "Bob(2)、Alice(1)", formatParticipants(ps))
+}
+
+func TestChunkLines(t *testing.T) {
+	tk := tokenizerOf("gpt-4o")
+	lines := []string{"one two", "three four", "five six"}
+	assert.Equal(t, []string{"one two\nthree four\nfive six"}, chunkLines(tk, lines, 100))
+	assert.Equal(t, []string{"one two", "three four", "five six"}, chunkLines(tk, lines, 3))
+
+	long := strings.Repeat("字", 50)
+	chunks := chunkLines(tk, []string{long}, 10)
+	require.Len(t, chunks, 1)
+	assert.LessOrEqual(t, tk.count(chunks[0]), 11)
+}
+
+func TestSummarizeMapReduce(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		var req openai.ChatCompletionRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		content := fmt.Sprintf("summary %d", n)
+		if strings.HasPrefix(req.Messages[1].Content, "请根据下面的分段总结") {
+			content = "final"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+			Choices: []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Content: content}}},
+			Usage:   openai.Usage{PromptTokens: 10, CompletionTokens: 2, TotalTokens: 12},
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	model := &config.Model{Name: "summary", Model: "m", BaseUrl: srv.URL}
+	clients.Store(&map[string]*openai.Client{model.Name: mustAiClient(t, model)})
+	s := &summarizer{models: []*config.Model{model}, limit: 20}
+
+	lines := make([]string, 10)
+	for i := range lines {
+		lines[i] = strings.Repeat("word ", 8)
+	}
+	chunks := chunkLines(s.tokenizer(), lines, s.limit)
+	require.Greater(t, len(chunks), 1)
+	digest, err := s.summarize(context.Background(), lines)
+	require.NoError(t, err)
+	assert.Equal(t, "final", digest)
+	// every chunk is summarized, then all summaries fit in one final prompt
+	assert.Equal(t, int32(len(chunks)+1), calls.Load())
+	assert.Equal(t, int64(10*(len(chunks)+1)), s.usage.PromptTokens)
+
+	calls.Store(0)
+	digest, err = s.summarize(context.Background(), lines[:1])
+	require.NoError(t, err)
+	assert.Equal(t, "summary 1", digest)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestSummarizeEmptyAnswers(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+			Choices: []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Content: ""}}},
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	model := &config.Model{Name: "summary", Model: "m", BaseUrl: srv.URL}
+	clients.Store(&map[string]*openai.Client{model.Name: mustAiClient(t, model)})
+	s := &summarizer{models: []*config.Model{model}, limit: 20}
+
+	lines := make([]string, 10)
+	for i := range lines {
+		lines[i] = strings.Repeat("word ", 8)
+	}
+	chunks := chunkLines(s.tokenizer(), lines, s.limit)
+	require.Greater(t, len(chunks), 1)
+	_, err := s.summarize(context.Background(), lines)
+	require.ErrorIs(t, err, ErrEmptySummary)
+	// no final request without partial summaries
+	assert.Equal(t, int32(len(chunks)), calls.Load())
+}
@@ -0,0 +1,161 @@
+package chat
+
+import (
+	"csust-got/log"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktokenloader "github.com/pkoukk/tiktoken-go-loader"
+	"github.com/puzpuzpuz/xsync/v4"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+)
+
+const (
+	// tokensPerMessage is the fixed overhead of every message in chat format
+	tokensPerMessage = 4
+	// tokensPerImage is a rough cost of a low-detail image part
+	tokensPerImage = 85
+	// charsPerToken is the average count of latin chars in one token
+	charsPerToken = 4
+)
+
+// defaultEncoding is used by models unknown to tiktoken, such as models not from openai.
+// Their own tokenizers are not public, o200k is close to them for chinese and english text.
+const defaultEncoding = tiktoken.MODEL_O200K_BASE
+
+func init() {
+	// use the embedded vocabularies instead of downloading them
+	tiktoken.SetBpeLoader(tiktokenloader.NewOfflineLoader())
+}
+
+// encodings are loaded encodings by name
+var encodings = xsync.NewMap[string, *tiktoken.Tiktoken]()
+
+// tokenizer counts tokens of text with the BPE encoding of a model
+type tokenizer struct {
+	// enc is nil if the encoding can't be loaded, tokens are estimated then
+	enc *tiktoken.Tiktoken
+}
+
+// tokenizerOf returns tokenizer of model, models unknown to tiktoken use defaultEncoding
+func tokenizerOf(model string) tokenizer {
+	name := defaultEncoding
+	if enc, ok := tiktoken.MODEL_TO_ENCODING[model]; ok {
+		name = enc
+	} else {
+		for prefix, enc := range tiktoken.MODEL_PREFIX_TO_ENCODING {
+			if strings.HasPrefix(model, prefix) {
+				name = enc
+				break
+			}
+		}
+	}
+
+	enc, _ := encodings.LoadOrCompute(name, func() (*tiktoken.Tiktoken, bool) {
+		enc, err := tiktoken.GetEncoding(name)
+		if err != nil {
+			log.Error("load tiktoken encoding failed, estimate tokens instead", zap.String("encoding", name), zap.Error(err))
+			return nil, true
+		}
+		return enc, false
+	})
+	return tokenizer{enc: enc}
+}
+
+// count returns the token count of text
+func (t tokenizer) count(text string) int {
+	if text == "" {
+		return 0
+	}
+	if t.enc == nil {
+		return estimateTokens(text)
+	}
+	return len(t.enc.EncodeOrdinary(text))
+}
+
+// countMessage returns the token count of a chat message, including tool calls
+func (t tokenizer) countMessage(msg *openai.ChatCompletionMessage) int {
+	tokens := tokensPerMessage + t.count(msg.Content) + t.count(msg.Name)
+	for _, part := range msg.MultiContent {
+		switch part.Type {
+		case openai.ChatMessagePartTypeText:
+			tokens += t.count(part.Text)
+		case openai.ChatMessagePartTypeImageURL:
+			tokens += tokensPerImage
+		}
+	}
+	for _, call := range msg.ToolCalls {
+		tokens += t.count(call.Function.Name) + t.count(call.Function.Arguments)
+	}
+	return tokens
+}
+
+// countMessages returns the token count of chat messages
+func (t tokenizer) countMessages(msgs []openai.ChatCompletionMessage) int {
+	tokens := 0
+	for i := range msgs {
+		tokens += t.countMessage(&msgs[i])
+	}
+	return tokens
+}
+
+// truncate cuts text to at most limit tokens
+func (t tokenizer) truncate(text string, limit int) string {
+	if t.count(text) <= limit {
+		return text
+	}
+	runes := []rune(text)
+	lo, hi := 0, len(runes)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if t.count(string(runes[:mid])) <= limit {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return string(runes[:lo]) + truncatedMark
+}
+
+// estimateTokens estimates the token count of text, it's used only if the encoding can't be loaded.
+//
+// It's an approximation of BPE tokenizers like cl100k, without the vocabulary:
+// every CJK char costs one token, runs of latin letters and digits cost one token per 4 chars,
+// and every other visible symbol costs one token. Whitespace is merged into the following word.
+func estimateTokens(text string) int {
+	tokens := 0
+	wordLen := 0
+	flushWord := func() {
+		if wordLen > 0 {
+			tokens += (wordLen + charsPerToken - 1) / charsPerToken
+			wordLen = 0
+		}
+	}
+
+	for len(text) > 0 {
+		r, size := utf8.DecodeRuneInString(text)
+		text = text[size:]
+
+		switch {
+		case r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			wordLen++
+		case unicode.IsSpace(r):
+			flushWord()
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			flushWord()
+			tokens++
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			// non-latin letters usually split into more pieces
+			wordLen += 2
+		default:
+			flushWord()
+			tokens++
+		}
+	}
+	flushWord()
+
+	return tokens
+}
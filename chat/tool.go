@@ -0,0 +1,155 @@
+package chat
+
+import (
+	"context"
+	"csust-got/log"
+	"sync"
+
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+)
+
+// defaultToolSet contains all registered tools
+const defaultToolSet = "_default"
+
+// Tool is a function tool which can be called by llm
+type Tool interface {
+	// Definition returns the function definition sent to llm
+	Definition() openai.Tool
+	// Call calls the tool with json encoded arguments
+	Call(ctx context.Context, param string) (string, error)
+}
+
+// toolRegistry holds all tools from mcpo, mcp servers, and so on
+type toolRegistry struct {
+	mu        sync.RWMutex
+	tools     map[string]Tool
+	toolSets  map[string][]string
+	dangerous map[string]struct{}
+}
+
+var tools = newToolRegistry()
+
+func newToolRegistry() *toolRegistry {
+	return &toolRegistry{
+		tools:     map[string]Tool{},
+		toolSets:  map[string][]string{},
+		dangerous: map[string]struct{}{},
+	}
+}
+
+// Register registers tool into tool set and the default set,
+// returns false if a tool with same name already exists.
+func (r *toolRegistry) Register(set string, tool Tool) bool {
+	name := tool.Definition().Function.Name
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.tools[name]; ok {
+		log.Warn("tool already registered, skip", zap.String("name", name), zap.String("set", set))
+		return false
+	}
+	r.tools[name] = tool
+	r.toolSets[defaultToolSet] = append(r.toolSets[defaultToolSet], name)
+	if set != "" && set != defaultToolSet {
+		r.toolSets[set] = append(r.toolSets[set], name)
+	}
+	return true
+}
+
+// MarkDangerous marks tool as dangerous, which needs confirmation of user before called
+func (r *toolRegistry) MarkDangerous(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dangerous[name] = struct{}{}
+}
+
+// IsDangerous reports whether tool is dangerous
+func (r *toolRegistry) IsDangerous(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.dangerous[name]
+	return ok
+}
+
+// Empty reports whether no tool is registered
+func (r *toolRegistry) Empty() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.tools) == 0
+}
+
+// GetTool get tool by name
+func (r *toolRegistry) GetTool(name string) (Tool, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tool, ok := r.tools[name]
+	return tool, ok
+}
+
+// GetToolSetToolNames get tool names with set name
+func (r *toolRegistry) GetToolSetToolNames(set string) []string {
+	if set == "" {
+		set = defaultToolSet
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.toolSets[set]
+}
+
+// GetToolSet get tool definitions with set name
+func (r *toolRegistry) GetToolSet(set string) []openai.Tool {
+	names := r.GetToolSetToolNames(set)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ret := make([]openai.Tool, 0, len(names))
+	for _, name := range names {
+		ret = append(ret, r.tools[name].Definition())
+	}
+	return ret
+}
+
+// ResolveToolNames resolves tool set names and tool names to tool names without duplicates,
+// all tools are returned if names is empty.
+func (r *toolRegistry) ResolveToolNames(names []string) []string {
+	if len(names) == 0 {
+		return r.GetToolSetToolNames("")
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ret := make([]string, 0, len(names))
+	seen := make(map[string]struct{}, len(names))
+	add := func(name string) {
+		if _, ok := seen[name]; !ok {
+			seen[name] = struct{}{}
+			ret = append(ret, name)
+		}
+	}
+	for _, name := range names {
+		if set, ok := r.toolSets[name]; ok {
+			for _, n := range set {
+				add(n)
+			}
+		} else if _, ok := r.tools[name]; ok {
+			add(name)
+		} else {
+			log.Warn("unknown tool or tool set", zap.String("name", name))
+		}
+	}
+	return ret
+}
+
+// GetTools get tool definitions of tool names
+func (r *toolRegistry) GetTools(names []string) []openai.Tool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ret := make([]openai.Tool, 0, len(names))
+	for _, name := range names {
+		if tool, ok := r.tools[name]; ok {
+			ret = append(ret, tool.Definition())
+		}
+	}
+	return ret
+}
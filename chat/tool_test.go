@@ -0,0 +1,49 @@
+package chat
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+)
+
+type testTool string
+
+func (t testTool) Definition() openai.Tool {
+	return newTestFunctionTool(string(t))
+}
+
+func (t testTool) Call(_ context.Context, param string) (string, error) {
+	return string(t) + param, nil
+}
+
+func TestToolRegistry(t *testing.T) {
+	registry := newToolRegistry()
+	assert.True(t, registry.Empty())
+
+	assert.True(t, registry.Register("mcp_a", testTool("fetch")))
+	assert.True(t, registry.Register("mcp_a", testTool("search")))
+	assert.True(t, registry.Register("mcp_b", testTool("shell")))
+	assert.False(t, registry.Register("mcp_b", testTool("fetch")))
+	registry.MarkDangerous("shell")
+
+	assert.False(t, registry.Empty())
+	assert.True(t, registry.IsDangerous("shell"))
+	assert.False(t, registry.IsDangerous("fetch"))
+	assert.Equal(t, []string{"fetch", "search", "shell"}, registry.GetToolSetToolNames(""))
+	assert.Equal(t, []string{"shell"}, registry.GetToolSetToolNames("mcp_b"))
+
+	t.Run("resolve all", func(t *testing.T) {
+		assert.Equal(t, []string{"fetch", "search", "shell"}, registry.ResolveToolNames(nil))
+	})
+
+	t.Run("resolve sets and names", func(t *testing.T) {
+		names := registry.ResolveToolNames([]string{"shell", "mcp_a", "fetch", "unknown"})
+		assert.Equal(t, []string{"shell", "fetch", "search"}, names)
+
+		defs := registry.GetTools(names)
+		assert.Len(t, defs, 3)
+		assert.Equal(t, map[string]bool{"shell": true, "fetch": true, "search": true}, toolNameSet(defs))
+	})
+}
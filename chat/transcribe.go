@@ -0,0 +1,112 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"csust-got/config"
+	"csust-got/log"
+	"csust-got/util/ffconv"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	ff "github.com/u2takey/ffmpeg-go"
+	"go.uber.org/zap"
+	tb "gopkg.in/telebot.v3"
+)
+
+// transcribeTimeout is the timeout of transcription api
+const transcribeTimeout = 2 * time.Minute
+
+var (
+	// ErrTranscriptionDisabled means transcription is not enabled in config
+	ErrTranscriptionDisabled = errors.New("transcription is disabled")
+	// ErrNoAudio means the message has no voice or video note
+	ErrNoAudio = errors.New("message has no audio")
+	// ErrAudioTooLong means the audio is longer than max duration in config
+	ErrAudioTooLong = errors.New("audio is too long")
+)
+
+// messageAudio returns the file and duration of voice or video note in message
+func messageAudio(msg *tb.Message) (*tb.File, int, bool) {
+	switch {
+	case msg.Voice != nil:
+		return &msg.Voice.File, msg.Voice.Duration, true
+	case msg.VideoNote != nil:
+		return &msg.VideoNote.File, msg.VideoNote.Duration, true
+	default:
+		return nil, 0, false
+	}
+}
+
+// TranscribeMessage converts voice or video note of message to text.
+func TranscribeMessage(bot *tb.Bot, msg *tb.Message) (string, error) {
+	cfg := config.BotConfig().SpeechConfig.Transcription
+	if !cfg.Enabled {
+		return "", ErrTranscriptionDisabled
+	}
+	file, duration, ok := messageAudio(msg)
+	if !ok {
+		return "", ErrNoAudio
+	}
+	if duration > cfg.MaxDuration {
+		return "", ErrAudioTooLong
+	}
+
+	audio, err := convertAudio(bot, file)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), transcribeTimeout)
+	defer cancel()
+
+	client, err := newAiClient(cfg.Model)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.CreateTranscription(ctx, openai.AudioRequest{
+		Model:    cfg.Model.Model,
+		FilePath: "voice.mp3",
+		Reader:   audio,
+		Prompt:   cfg.Prompt,
+		Language: cfg.Language,
+		Format:   openai.AudioResponseFormatJSON,
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(resp.Text), nil
+}
+
+// convertAudio downloads telegram file and converts it to mp3, which is supported by all transcription api.
+// Video notes are mp4 which can't be read from pipe, so files are downloaded to disk first.
+func convertAudio(bot *tb.Bot, file *tb.File) (io.Reader, error) {
+	tmp, err := os.CreateTemp("", "voice-*")
+	if err != nil {
+		return nil, err
+	}
+	_ = tmp.Close()
+	defer func() {
+		if err := os.Remove(tmp.Name()); err != nil {
+			log.Warn("remove temp voice file failed", zap.String("file", tmp.Name()), zap.Error(err))
+		}
+	}()
+
+	if err := bot.Download(file, tmp.Name()); err != nil {
+		return nil, err
+	}
+
+	conv := ffconv.FFConv{}
+	r, errCh := conv.ConvertPipe2Pipe(nil, ffconv.WithStream(ff.Input(tmp.Name())),
+		ffconv.FormatArg("mp3"), ffconv.AudioCodecArg("libmp3lame"),
+		ff.KwArgs{"vn": "", "ac": 1, "ar": 16000})
+	data, err := io.ReadAll(r)
+	if err = errors.Join(err, <-errCh); err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
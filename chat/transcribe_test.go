@@ -0,0 +1,45 @@
+package chat
+
+import (
+	"testing"
+
+	"csust-got/config"
+
+	"github.com/stretchr/testify/assert"
+	tb "gopkg.in/telebot.v3"
+)
+
+func TestMessageAudio(t *testing.T) {
+	voice := &tb.Message{Voice: &tb.Voice{File: tb.File{FileID: "voice"}, Duration: 3}}
+	file, duration, ok := messageAudio(voice)
+	assert.True(t, ok)
+	assert.Equal(t, "voice", file.FileID)
+	assert.Equal(t, 3, duration)
+
+	note := &tb.Message{VideoNote: &tb.VideoNote{File: tb.File{FileID: "note"}, Duration: 5}}
+	file, duration, ok = messageAudio(note)
+	assert.True(t, ok)
+	assert.Equal(t, "note", file.FileID)
+	assert.Equal(t, 5, duration)
+
+	_, _, ok = messageAudio(&tb.Message{Text: "hello"})
+	assert.False(t, ok)
+}
+
+func TestTranscribeMessageErrors(t *testing.T) {
+	old := config.BotConfig().SpeechConfig
+	defer func() { config.BotConfig().SpeechConfig = old }()
+
+	config.BotConfig().SpeechConfig = &config.SpeechConfig{}
+	voice := &tb.Message{Voice: &tb.Voice{Duration: 600}}
+	_, err := TranscribeMessage(nil, voice)
+	assert.ErrorIs(t, err, ErrTranscriptionDisabled)
+
+	config.BotConfig().SpeechConfig = &config.SpeechConfig{Transcription: config.TranscriptionConfig{
+		Enabled: true, Model: &config.Model{Model: "whisper-1"}, MaxDuration: 300,
+	}}
+	_, err = TranscribeMessage(nil, voice)
+	assert.ErrorIs(t, err, ErrAudioTooLong)
+	_, err = TranscribeMessage(nil, &tb.Message{Text: "hello"})
+	assert.ErrorIs(t, err, ErrNoAudio)
+}
@@ -0,0 +1,206 @@
+package chat
+
+import (
+	"csust-got/entities"
+	"csust-got/log"
+	"csust-got/orm"
+	"csust-got/util"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	tb "gopkg.in/telebot.v3"
+)
+
+// usageDays is the days of usage summed up in `/usage`
+const usageDays = 7
+
+// addUsage accumulates usage reported by stream
+func (sp *streamProcessor) addUsage(usage *openai.Usage, toolRound bool) {
+	if usage == nil {
+		return
+	}
+	sp.usageReported = true
+	sp.usage.PromptTokens += int64(usage.PromptTokens)
+	sp.usage.CompletionTokens += int64(usage.CompletionTokens)
+	if toolRound {
+		sp.usage.ToolCallTokens += int64(usage.TotalTokens)
+	}
+}
+
+// drainUsage reads the rest of a tool calling stream for the usage chunk
+func (sp *streamProcessor) drainUsage(stream *openai.ChatCompletionStream) {
+	for {
+		response, err := stream.Recv()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Debug("drain stream for usage failed", zap.Error(err))
+			}
+			return
+		}
+		sp.addUsage(response.Usage, true)
+	}
+}
+
+// finalUsage returns usage of the whole chat, estimates it if the endpoint reported nothing
+func (sp *streamProcessor) finalUsage() *orm.LLMUsage {
+	usage := sp.usage
+	usage.Requests = 1
+	if !sp.usageReported {
+		usage.PromptTokens = int64(tokenizerOf(sp.request.Model).countMessages(sp.request.Messages))
+		sp.mu.RLock()
+		usage.CompletionTokens = int64(tokenizerOf(sp.request.Model).count(sp.fullResponse.String()))
+		sp.mu.RUnlock()
+	}
+	return &usage
+}
+
+// recordUsage saves usage of the chat to redis
+func recordUsage(ctx tb.Context, sp *streamProcessor) {
+	model := sp.models[sp.modelIdx].Name
+	usage := sp.finalUsage()
+	if usage.Total() == 0 {
+		return
+	}
+	log.Info("[ChatUsage] chat usage", zap.Int64("chat", ctx.Chat().ID), zap.Int64("user", ctx.Sender().ID),
+		zap.String("model", model), zap.Bool("reported", sp.usageReported), zap.Any("usage", usage))
+	_ = orm.AddLLMUsage(ctx.Chat().ID, ctx.Sender().ID, model, usage, time.Now())
+}
+
+// checkQuota reports whether user still has daily quota in chat
+func checkQuota(ctx tb.Context) bool {
+	quota, err := orm.GetLLMQuota(ctx.Chat().ID, ctx.Sender().ID)
+	if err != nil || quota <= 0 {
+		return true
+	}
+	usages, err := orm.GetChatMemberLLMUsage(ctx.Chat().ID, ctx.Sender().ID, time.Now())
+	if err != nil {
+		return true
+	}
+	return usages.Sum().Total() < quota
+}
+
+// formatUsage formats usages of all models, with usage of each model if detail
+func formatUsage(title string, usages orm.ModelUsages, detail bool) string {
+	var sb strings.Builder
+	sum := usages.Sum()
+	fmt.Fprintf(&sb, "%s: %d tokens（输入 %d / 输出 %d / 工具 %d），共 %d 次\n", title, sum.Total(),
+		sum.PromptTokens, sum.CompletionTokens, sum.ToolCallTokens, sum.Requests)
+	if detail {
+		for _, model := range slices.Sorted(maps.Keys(usages)) {
+			u := usages[model]
+			fmt.Fprintf(&sb, "  - %s: %d tokens，%d 次\n", model, u.Total(), u.Requests)
+		}
+	}
+	return sb.String()
+}
+
+// sumUsageDays sums usages of the last n days
+func sumUsageDays(get func(day time.Time) (orm.ModelUsages, error), now time.Time, n int) (orm.ModelUsages, error) {
+	sum := make(orm.ModelUsages)
+	for i := range n {
+		usages, err := get(now.AddDate(0, 0, -i))
+		if err != nil {
+			return nil, err
+		}
+		for model, u := range usages {
+			if sum[model] == nil {
+				sum[model] = &orm.LLMUsage{}
+			}
+			sum[model].Add(u)
+		}
+	}
+	return sum, nil
+}
+
+// UsageHandler shows llm usage of user and chat
+func UsageHandler(ctx tb.Context) error {
+	now := time.Now()
+	chatID, userID := ctx.Chat().ID, ctx.Sender().ID
+	userUsage := func(day time.Time) (orm.ModelUsages, error) { return orm.GetUserLLMUsage(userID, day) }
+	chatUsage := func(day time.Time) (orm.ModelUsages, error) { return orm.GetChatLLMUsage(chatID, day) }
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "📊 今日用量（%s）\n", now.Format(time.DateOnly))
+
+	today, err := userUsage(now)
+	if err != nil {
+		return ctx.Reply("获取用量失败了😔")
+	}
+	sb.WriteString(formatUsage("你", today, true))
+
+	isGroup := ctx.Chat().Type != tb.ChatPrivate
+	if isGroup {
+		if today, err = chatUsage(now); err == nil {
+			sb.WriteString(formatUsage("本群", today, true))
+		}
+	}
+
+	fmt.Fprintf(&sb, "\n📅 近 %d 天\n", usageDays)
+	if week, err := sumUsageDays(userUsage, now, usageDays); err == nil {
+		sb.WriteString(formatUsage("你", week, false))
+	}
+	if isGroup {
+		if week, err := sumUsageDays(chatUsage, now, usageDays); err == nil {
+			sb.WriteString(formatUsage("本群", week, false))
+		}
+	}
+
+	if quota, err := orm.GetLLMQuota(chatID, userID); err == nil && quota > 0 {
+		if used, err := orm.GetChatMemberLLMUsage(chatID, userID, now); err == nil {
+			fmt.Fprintf(&sb, "\n你在本群的每日额度: %d tokens，已用 %d\n", quota, used.Sum().Total())
+		}
+	}
+
+	return ctx.Reply(sb.String())
+}
+
+// UsageQuotaHandler sets daily token quota of chat members, admin only.
+// Reply to someone to set quota for the user, or set the default quota of all members.
+func UsageQuotaHandler(ctx tb.Context) error {
+	if !util.IsChatAdmin(ctx.Bot(), ctx.Chat(), ctx.Sender()) {
+		return ctx.Reply("只有管理员才能设置额度哦")
+	}
+
+	command := entities.FromMessage(ctx.Message())
+	if command == nil || command.Argc() != 1 {
+		return ctx.Reply("用法: /usage_quota <每日tokens|reset>，回复某人的消息则只设置该用户，0 表示不限制，reset 表示恢复本群默认额度")
+	}
+
+	var userID int64
+	target := "本群成员默认"
+	if reply := ctx.Message().ReplyTo; reply != nil && reply.Sender != nil {
+		userID = reply.Sender.ID
+		target = reply.Sender.FirstName + reply.Sender.LastName
+	}
+
+	if command.Arg(0) == "reset" {
+		if err := orm.ResetLLMQuota(ctx.Chat().ID, userID); err != nil {
+			return ctx.Reply("设置额度失败了😔")
+		}
+		if userID == 0 {
+			return ctx.Reply("已取消本群成员默认的每日额度限制")
+		}
+		return ctx.Reply(fmt.Sprintf("%s的每日额度已恢复为本群默认", target))
+	}
+
+	quota, err := strconv.ParseInt(command.Arg(0), 10, 64)
+	if err != nil || quota < 0 {
+		return ctx.Reply("额度必须是非负整数或者 reset")
+	}
+	if err := orm.SetLLMQuota(ctx.Chat().ID, userID, quota); err != nil {
+		return ctx.Reply("设置额度失败了😔")
+	}
+
+	if quota == 0 {
+		return ctx.Reply(fmt.Sprintf("已取消%s的每日额度限制", target))
+	}
+	return ctx.Reply(fmt.Sprintf("已将%s的每日额度设置为 %d tokens", target, quota))
+}
@@ -0,0 +1,42 @@
+package chat
+
+import (
+	"csust-got/orm"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddUsage(t *testing.T) {
+	sp := &streamProcessor{}
+	sp.addUsage(nil, false)
+	assert.False(t, sp.usageReported)
+
+	sp.addUsage(&openai.Usage{PromptTokens: 100, CompletionTokens: 20, TotalTokens: 120}, true)
+	sp.addUsage(&openai.Usage{PromptTokens: 150, CompletionTokens: 50, TotalTokens: 200}, false)
+	assert.True(t, sp.usageReported)
+	assert.Equal(t, orm.LLMUsage{PromptTokens: 250, CompletionTokens: 70, ToolCallTokens: 120}, sp.usage)
+}
+
+func TestSumUsageDays(t *testing.T) {
+	now := time.Date(2025, 3, 2, 12, 0, 0, 0, time.Local)
+	days := map[string]orm.ModelUsages{
+		"20250302": {"gpt": {Requests: 1, PromptTokens: 10, CompletionTokens: 5}},
+		"20250301": {"gpt": {Requests: 2, PromptTokens: 20}, "qwen": {Requests: 1, CompletionTokens: 7}},
+	}
+	get := func(day time.Time) (orm.ModelUsages, error) {
+		return days[day.Format("20060102")], nil
+	}
+
+	sum, err := sumUsageDays(get, now, 7)
+	require.NoError(t, err)
+	assert.Equal(t, &orm.LLMUsage{Requests: 3, PromptTokens: 30, CompletionTokens: 5}, sum["gpt"])
+	assert.Equal(t, &orm.LLMUsage{Requests: 4, PromptTokens: 30, CompletionTokens: 12}, sum.Sum())
+
+	assert.Equal(t, "你: 42 tokens（输入 30 / 输出 12 / 工具 0），共 4 次\n"+
+		"  - gpt: 35 tokens，3 次\n"+
+		"  - qwen: 7 tokens，1 次\n", formatUsage("你", sum, true))
+}
@@ -3,7 +3,10 @@ package config
 import (
 	"log"
 	"math"
+	"net/url"
+	"regexp"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/samber/lo"
@@ -25,6 +28,42 @@ type Model struct {
 	Features ModelFeatures `mapstructure:"features"`
 }
 
+// GetRetryNums returns how many times a failed request will be retried
+func (m *Model) GetRetryNums() int {
+	return max(m.RetryNums, 0)
+}
+
+// GetRetryInterval returns the base interval between retries, it's doubled after every retry
+func (m *Model) GetRetryInterval() time.Duration {
+	if m.RetryInterval > 0 {
+		return time.Duration(m.RetryInterval) * time.Second
+	}
+	return time.Second
+}
+
+// ProxyURL parses the proxy of model, returns nil if no proxy
+func (m *Model) ProxyURL() (*url.URL, error) {
+	if m.Proxy == "" {
+		return nil, nil
+	}
+	return url.Parse(m.Proxy)
+}
+
+// checkProxy panics if proxy of model can't be parsed, so that the config is rejected
+func (m *Model) checkProxy() {
+	if m == nil {
+		return
+	}
+	if _, err := m.ProxyURL(); err != nil {
+		zap.L().Panic("cannot parse model proxy", zap.String("model", m.ShowName()), zap.Error(err))
+	}
+}
+
+// ShowName returns the name to show to users
+func (m *Model) ShowName() string {
+	return lo.CoalesceOrEmpty(m.Name, m.Model)
+}
+
 // ModelFeatures is the model features switch
 type ModelFeatures struct {
 	Image     bool `mapstructure:"image"`
@@ -46,12 +85,16 @@ type ChatOutputFormatConfig struct {
 	Format string `mapstructure:"format"`
 	// how to show the reason output: none(default), quote, collapse
 	Reason string `mapstructure:"reason"`
-	// how to show the payload output: plain(default), quote, collapse, block
+	// how to show the payload output: plain(default), quote, collapse, block, markdown-block, rich
 	Payload string `mapstructure:"payload"`
+	// voice: send the answer as voice messages with this voice of `speech.synthesis.model`, empty means text only
+	Voice string `mapstructure:"voice"`
 	// stream_output: enable streaming typewriter effect (false by default)
 	StreamOutput bool `mapstructure:"stream_output"`
 	// edit_interval: minimum time interval between message edits for rate limiting
 	EditInterval string `mapstructure:"edit_interval"`
+	// buttons: show stop button while answering, and regenerate/continue buttons on the answer
+	Buttons bool `mapstructure:"buttons"`
 }
 
 // GetFormat get message format
@@ -99,6 +142,8 @@ func (c *ChatOutputFormatConfig) GetPayloadFormat() string {
 		return "block"
 	case "md", "md-block", "markdown", "markdown-block":
 		return "markdown-block"
+	case "rich", "r":
+		return "rich"
 	default:
 		return ""
 	}
@@ -123,6 +168,7 @@ type ChatConfigV2 []*ChatConfigSingle
 type ChatConfigSingle struct {
 	Name           string                 `mapstructure:"name"`
 	Model          *Model                 `mapstructure:"model"`
+	FallbackModels []*Model               `mapstructure:"fallback_models"`
 	MessageContext int                    `mapstructure:"message_context"`
 	Temperature    *float32               `mapstructure:"temperature"`
 	PlaceHolder    string                 `mapstructure:"place_holder"`
@@ -133,8 +179,59 @@ type ChatConfigSingle struct {
 	Timeout        int                    `mapstructure:"timeout"` // seconds
 	Format         ChatOutputFormatConfig `mapstructure:"format"`
 
-	Features FeatureSetting `mapstructure:"features"`
-	UseMcpo  bool           `mapstructure:"use_mcpo"`
+	Features FeatureSetting   `mapstructure:"features"`
+	Memory   ChatMemoryConfig `mapstructure:"memory"`
+
+	// UseTools allows the chat to call tools, including local tools, native mcp tools and mcpo tools
+	UseTools bool `mapstructure:"use_tools"`
+	// UseMcpo is the old name of UseTools
+	UseMcpo bool `mapstructure:"use_mcpo"`
+	// Tools are tool set names or tool names this chat may use, all tools are allowed if empty.
+	// Tools are enabled without UseTools if it's not empty.
+	Tools []string `mapstructure:"tools"`
+	// MaxToolRounds is the max rounds of tool calls in a request
+	MaxToolRounds int `mapstructure:"max_tool_rounds"`
+}
+
+// ToolsEnabled reports whether the chat may call tools
+func (ccs *ChatConfigSingle) ToolsEnabled() bool {
+	return ccs.UseTools || ccs.UseMcpo || len(ccs.Tools) > 0
+}
+
+// GetMaxToolRounds returns the max rounds of tool calls in a request
+func (ccs *ChatConfigSingle) GetMaxToolRounds() int {
+	if ccs.MaxToolRounds > 0 {
+		return ccs.MaxToolRounds
+	}
+	return 5
+}
+
+// ChatMemoryConfig is the configuration for multi-turn conversation memory
+type ChatMemoryConfig struct {
+	// Enable reload the history when user replies to a bot answer
+	Enable bool `mapstructure:"enable"`
+	// MaxTokens is the token budget of the saved history, oldest turns will be dropped first
+	MaxTokens int `mapstructure:"max_tokens"`
+}
+
+// GetMaxTokens returns the token budget of the conversation history
+func (c *ChatMemoryConfig) GetMaxTokens() int {
+	if c.MaxTokens > 0 {
+		return c.MaxTokens
+	}
+	return 4096
+}
+
+// Models returns the primary model followed by the fallback models in order
+func (ccs *ChatConfigSingle) Models() []*Model {
+	models := make([]*Model, 0, 1+len(ccs.FallbackModels))
+	models = append(models, ccs.Model)
+	for _, m := range ccs.FallbackModels {
+		if m != nil {
+			models = append(models, m)
+		}
+	}
+	return models
 }
 
 // TriggerOnReply checks if the chat will trigger on reply
@@ -147,6 +244,18 @@ func (ccs *ChatConfigSingle) TriggerOnReply() (*ChatTrigger, bool) {
 	return nil, false
 }
 
+// FindByCommand finds the chat triggered by the command
+func (c *ChatConfigV2) FindByCommand(cmd string) (*ChatConfigSingle, *ChatTrigger) {
+	for _, ccs := range *c {
+		for _, t := range ccs.Trigger {
+			if t.Command != "" && t.Command == cmd {
+				return ccs, t
+			}
+		}
+	}
+	return nil, nil
+}
+
 // TriggerForGacha checks if the chat will trigger on gacha
 func (ccs *ChatConfigSingle) TriggerForGacha() ([]int, bool) {
 	stars := lo.FilterMap(ccs.Trigger, func(t *ChatTrigger, _ int) (int, bool) {
@@ -182,12 +291,15 @@ type McpoConfig struct {
 	Url    string   `mapstructure:"url"`
 	Tools  []string `mapstructure:"tools"`
 	ApiKey string   `mapstructure:"api_key"` // Optional API key for MCP servers
+
+	// DangerousTools need confirmation of user before called
+	DangerousTools []string `mapstructure:"dangerous_tools"`
 }
 
 func (c *McpoConfig) readConfig() {
-	err := viper.UnmarshalKey("mcpo_server", c)
+	err := cfgViper().UnmarshalKey("mcpo_server", c)
 	if err != nil {
-		log.Fatal("cannot parse mcpo config", zap.Error(err))
+		log.Panic("cannot parse mcpo config", zap.Error(err))
 	}
 }
 
@@ -243,10 +355,36 @@ func (ccs *ChatConfigSingle) GetErrorMessage() string {
 }
 
 func (c *ChatConfigV2) readConfig() {
-	v := viper.GetViper()
+	v := cfgViper()
 	err := v.UnmarshalKey("chats", c, viper.DecodeHook(DispatchFor()))
 	if err != nil {
 		panic(err)
 	}
 
 }
+
+// checkConfig makes sure templates and triggers of chats can be parsed
+func (c *ChatConfigV2) checkConfig() {
+	for _, ccs := range *c {
+		if ccs.Model == nil {
+			zap.L().Panic("chat model is not set", zap.String("name", ccs.Name))
+		}
+		for _, m := range ccs.Models() {
+			m.checkProxy()
+		}
+		if _, err := template.New("system-prompt").Parse(ccs.SystemPrompt.String()); err != nil {
+			zap.L().Panic("cannot parse chat system prompt", zap.String("name", ccs.Name), zap.Error(err))
+		}
+		if _, err := template.New("prompt").Parse(ccs.PromptTemplate.String()); err != nil {
+			zap.L().Panic("cannot parse chat prompt template", zap.String("name", ccs.Name), zap.Error(err))
+		}
+		for _, tr := range ccs.Trigger {
+			if tr.Regex == "" {
+				continue
+			}
+			if _, err := regexp.Compile(tr.Regex); err != nil {
+				zap.L().Panic("cannot parse chat trigger regex", zap.String("name", ccs.Name), zap.Error(err))
+			}
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package config
+
+import "time"
+
+// ChatSummaryConfig is config of `/summary_chat`
+type ChatSummaryConfig struct {
+	// Chat is name of the chat config whose models are used
+	Chat string `mapstructure:"chat"`
+	// MaxMessages is the max count of messages summarized once
+	MaxMessages int `mapstructure:"max_messages"`
+	// DefaultWindow is the time window summarized if not given
+	DefaultWindow time.Duration `mapstructure:"default_window"`
+}
+
+func (c *ChatSummaryConfig) readConfig() {
+	err := cfgViper().UnmarshalKey("chat_summary", c)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (c *ChatSummaryConfig) checkConfig() {
+	if c.MaxMessages <= 0 {
+		c.MaxMessages = 1000
+	}
+	if c.DefaultWindow <= 0 {
+		c.DefaultWindow = 24 * time.Hour
+	}
+}
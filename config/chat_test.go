@@ -64,3 +64,10 @@ chats:
 		},
 	}, c)
 }
+
+func TestChatConfigSingle_ToolsEnabled(t *testing.T) {
+	assert.False(t, (&ChatConfigSingle{}).ToolsEnabled())
+	assert.True(t, (&ChatConfigSingle{UseTools: true}).ToolsEnabled())
+	assert.True(t, (&ChatConfigSingle{UseMcpo: true}).ToolsEnabled())
+	assert.True(t, (&ChatConfigSingle{Tools: []string{"search_chat_history"}}).ToolsEnabled())
+}
@@ -3,15 +3,38 @@ package config
 import (
 	"fmt"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync/atomic"
 
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	. "gopkg.in/telebot.v3"
 )
 
+// botConfig is the config in use, it's replaced as a whole when reloading.
+var botConfig atomic.Pointer[Config]
+
 // BotConfig can get bot's config globally.
-var BotConfig *Config
+// Don't keep the returned config for long, it may be replaced by reloading.
+func BotConfig() *Config {
+	return botConfig.Load()
+}
+
+// SetBotConfig replaces the whole config.
+func SetBotConfig(c *Config) {
+	botConfig.Store(c)
+}
+
+// configFilePath is the config file used by InitViper, it will be read again when reloading
+var configFilePath string
+
+// configEnvPrefix is the env prefix used by InitViper
+var configEnvPrefix string
+
+// currentViper holds the config in use after reloading, the global viper is used if nil.
+// Reloading reads config file into a new viper, which is adopted only if the config in it is valid.
+var currentViper *viper.Viper
 
 var (
 	noTokenMsg = "bot token is not set! Please set config file config.yaml or env BOT_TOKEN!"
@@ -27,7 +50,7 @@ var (
 
 // InitConfig - init bot config.
 func InitConfig(configFile, envPrefix string) {
-	BotConfig = NewBotConfig()
+	SetBotConfig(NewBotConfig())
 	InitViper(configFile, envPrefix)
 	readConfig()
 	checkConfig()
@@ -49,6 +72,11 @@ func NewBotConfig() *Config {
 		DebugOptConfig:  new(debugOptConfig),
 		ChatConfigV2:    new(ChatConfigV2),
 		McpoServer:      new(McpoConfig),
+		McpServers:      new(McpServersConfig),
+		SpeechConfig:    new(SpeechConfig),
+		MessageStream:   new(MessageStreamConfig),
+		ChatSummary:     new(ChatSummaryConfig),
+		StableDiffusion: new(StableDiffusionConfig),
 	}
 
 	config.WhiteListConfig.SetName("white_list")
@@ -72,6 +100,9 @@ type Config struct {
 	// SentenceDelimiters for intelligent sentence breaking in streaming
 	SentenceDelimiters []string
 
+	// Admins are users who can manage the bot, such as reload config
+	Admins []int64
+
 	RedisConfig     *redisConfig
 	RestrictConfig  *restrictConfig
 	RateLimitConfig *rateLimitConfig
@@ -81,84 +112,132 @@ type Config struct {
 	*GetVoiceConfig
 	ChatConfigV2 *ChatConfigV2
 	McpoServer   *McpoConfig
+	McpServers   *McpServersConfig
 	MeiliConfig  *meiliConfig
 	McConfig     *mcConfig
+	SpeechConfig *SpeechConfig
+
+	MessageStream *MessageStreamConfig
+	ChatSummary   *ChatSummaryConfig
+
+	StableDiffusion *StableDiffusionConfig
 
 	DebugOptConfig *debugOptConfig
 }
 
 // GetBot returns Bot.
 func GetBot() *Bot {
-	return BotConfig.Bot
+	return BotConfig().Bot
+}
+
+// IsAdmin reports whether user is admin of bot
+func (c *Config) IsAdmin(userID int64) bool {
+	return slices.Contains(c.Admins, userID)
 }
 
 // InitViper init viper
 func InitViper(configFile, envPrefix string) {
+	configFilePath, configEnvPrefix = configFile, envPrefix
+	currentViper = nil
 	if configFile != "" {
-		viper.SetConfigFile(configFile)
-		if err := viper.ReadInConfig(); err != nil {
+		if err := readConfigFile(viper.GetViper(), configFile); err != nil {
 			zap.L().Warn("an error was produced when reading config!", zap.String("configFile", configFile), zap.Error(err))
 			return
 		}
-
-		// 检查同一目录下是否存在custom.yaml文件
-		customConfigFile := filepath.Join(filepath.Dir(configFile), "custom.yaml")
-		v := viper.New()
-		v.SetConfigFile(customConfigFile)
-		if err := v.ReadInConfig(); err == nil {
-			// 成功读取了custom.yaml，合并配置
-			if err := viper.MergeConfigMap(v.AllSettings()); err != nil {
-				zap.L().Warn("an error was produced when merging custom config!", zap.String("customConfigFile", customConfigFile), zap.Error(err))
-			} else {
-				zap.L().Info("custom config merged successfully", zap.String("customConfigFile", customConfigFile))
-			}
-		}
 	}
-	viper.SetEnvPrefix(envPrefix)
-	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-	viper.AllowEmptyEnv(true)
-	viper.AutomaticEnv()
+	setupEnv(viper.GetViper(), envPrefix)
 
 	noTokenMsg = fmt.Sprintf("bot token is not set! Please set config file %s or env %s_TOKEN!", configFile, envPrefix)
 	noRedisMsg = fmt.Sprintf("redis address is not set! Please set config file %s or env %s_REDIS_ADDR!", configFile, envPrefix)
 }
 
+// setupEnv makes v read config from env with prefix
+func setupEnv(v *viper.Viper, envPrefix string) {
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AllowEmptyEnv(true)
+	v.AutomaticEnv()
+}
+
+// cfgViper returns the viper which config is read from
+func cfgViper() *viper.Viper {
+	if currentViper != nil {
+		return currentViper
+	}
+	return viper.GetViper()
+}
+
+// readConfigFile reads config file into v, and merges `custom.yaml` in the same directory if exists
+func readConfigFile(v *viper.Viper, configFile string) error {
+	v.SetConfigFile(configFile)
+	if err := v.ReadInConfig(); err != nil {
+		return err
+	}
+
+	// 检查同一目录下是否存在custom.yaml文件
+	customConfigFile := filepath.Join(filepath.Dir(configFile), "custom.yaml")
+	custom := viper.New()
+	custom.SetConfigFile(customConfigFile)
+	if err := custom.ReadInConfig(); err == nil {
+		// 成功读取了custom.yaml，合并配置
+		if err := v.MergeConfigMap(custom.AllSettings()); err != nil {
+			zap.L().Warn("an error was produced when merging custom config!", zap.String("customConfigFile", customConfigFile), zap.Error(err))
+		} else {
+			zap.L().Info("custom config merged successfully", zap.String("customConfigFile", customConfigFile))
+		}
+	}
+	return nil
+}
+
 func readConfig() {
+	readConfigInto(BotConfig())
+}
+
+func readConfigInto(c *Config) {
 	// base config
-	BotConfig.DebugMode = viper.GetBool("debug")
-	BotConfig.URL = viper.GetString("url")
-	BotConfig.Token = viper.GetString("token")
-	BotConfig.Proxy = viper.GetString("proxy")
-	BotConfig.Listen = viper.GetString("listen")
-	BotConfig.SkipDuration = viper.GetInt64("skip_duration")
-	BotConfig.LogFileDir = viper.GetString("log_file_dir")
+	c.DebugMode = cfgViper().GetBool("debug")
+	c.URL = cfgViper().GetString("url")
+	c.Token = cfgViper().GetString("token")
+	c.Proxy = cfgViper().GetString("proxy")
+	c.Listen = cfgViper().GetString("listen")
+	c.SkipDuration = cfgViper().GetInt64("skip_duration")
+	c.LogFileDir = cfgViper().GetString("log_file_dir")
+	c.Admins = make([]int64, 0)
+	for _, v := range cfgViper().GetIntSlice("admins") {
+		c.Admins = append(c.Admins, int64(v))
+	}
 
 	// sentence delimiters for streaming
-	BotConfig.SentenceDelimiters = viper.GetStringSlice("sentence_delimiters")
-	if len(BotConfig.SentenceDelimiters) == 0 {
+	c.SentenceDelimiters = cfgViper().GetStringSlice("sentence_delimiters")
+	if len(c.SentenceDelimiters) == 0 {
 		// Set default sentence delimiters if none provided
-		BotConfig.SentenceDelimiters = []string{
+		c.SentenceDelimiters = []string{
 			"\n", ".", "!", "?", "。", "！", "？", ")", "）", ";",
 		}
 	}
 
 	// other
-	BotConfig.RedisConfig.readConfig()
-	BotConfig.RestrictConfig.readConfig()
-	BotConfig.RateLimitConfig.readConfig()
-	BotConfig.MessageConfig.readConfig()
-	BotConfig.WhiteListConfig.readConfig()
-	BotConfig.BlockListConfig.readConfig()
-	BotConfig.MeiliConfig.readConfig()
-	BotConfig.McConfig.readConfig()
-	BotConfig.ChatConfigV2.readConfig()
-	BotConfig.McpoServer.readConfig()
+	c.RedisConfig.readConfig()
+	c.RestrictConfig.readConfig()
+	c.RateLimitConfig.readConfig()
+	c.MessageConfig.readConfig()
+	c.WhiteListConfig.readConfig()
+	c.BlockListConfig.readConfig()
+	c.MeiliConfig.readConfig()
+	c.McConfig.readConfig()
+	c.ChatConfigV2.readConfig()
+	c.McpoServer.readConfig()
+	c.McpServers.readConfig()
+	c.SpeechConfig.readConfig()
+	c.MessageStream.readConfig()
+	c.ChatSummary.readConfig()
+	c.StableDiffusion.readConfig()
 
 	// genshin voice
-	BotConfig.readConfig()
+	c.readConfig()
 
 	// debug opt
-	BotConfig.DebugOptConfig.readConfig()
+	c.DebugOptConfig.readConfig()
 }
 
 // ReadConfig read config.
@@ -170,27 +249,38 @@ func ReadConfig(configs ...interface{ readConfig() }) {
 
 // check some config value is reasonable, otherwise set to default value.
 func checkConfig() {
-	if BotConfig.Token == "" {
+	checkConfigOf(BotConfig())
+}
+
+// checkConfigOf panics if config is invalid.
+func checkConfigOf(c *Config) {
+	if c.Token == "" {
 		zap.L().Panic(noTokenMsg)
 	}
-	if BotConfig.DebugMode {
+	if c.DebugMode {
 		zap.L().Warn("DEBUG MODE IS ON")
 	}
-	if BotConfig.SkipDuration < 0 {
-		BotConfig.SkipDuration = 0
+	if c.SkipDuration < 0 {
+		c.SkipDuration = 0
 	}
 
-	BotConfig.LogFileDir = strings.TrimRight(BotConfig.LogFileDir, "/")
+	c.LogFileDir = strings.TrimRight(c.LogFileDir, "/")
 
-	BotConfig.RedisConfig.checkConfig()
-	BotConfig.RestrictConfig.checkConfig()
-	BotConfig.RateLimitConfig.checkConfig()
-	BotConfig.MessageConfig.checkConfig()
-	BotConfig.BlockListConfig.checkConfig()
-	BotConfig.WhiteListConfig.checkConfig()
-	BotConfig.checkConfig()
-	BotConfig.MeiliConfig.checkConfig()
-	BotConfig.McConfig.checkConfig()
+	c.RedisConfig.checkConfig()
+	c.RestrictConfig.checkConfig()
+	c.RateLimitConfig.checkConfig()
+	c.MessageConfig.checkConfig()
+	c.BlockListConfig.checkConfig()
+	c.WhiteListConfig.checkConfig()
+	c.checkConfig()
+	c.MeiliConfig.checkConfig()
+	c.McConfig.checkConfig()
+	c.ChatConfigV2.checkConfig()
+	c.McpServers.checkConfig()
+	c.SpeechConfig.checkConfig()
+	c.MessageStream.checkConfig()
+	c.ChatSummary.checkConfig()
+	c.StableDiffusion.checkConfig()
 
-	BotConfig.DebugOptConfig.checkConfig()
+	c.DebugOptConfig.checkConfig()
 }
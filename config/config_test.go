@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/require"
@@ -25,28 +26,28 @@ func TestReadConfigFile(t *testing.T) {
 	req := testInit(t)
 
 	// init config
-	BotConfig = NewBotConfig()
+	SetBotConfig(NewBotConfig())
 	InitViper(testConfigFile, "")
 	readConfig()
 	viper.Reset()
 
 	// some config should read
-	req.False(BotConfig.DebugMode)
-	req.Empty(BotConfig.Token)
-	req.Equal("redis:6379", BotConfig.RedisConfig.RedisAddr)
-	req.Equal("csust-bot-redis-password", BotConfig.RedisConfig.RedisPass)
-	// req.Equal("https://api.csu.st", BotConfig.GenShinConfig.ApiServer)
-	// req.Equal("https://api.csu.st/file/VO_inGame/VO_NPC/NPC_DQ/vo_npc_dq_f_katheryne_01.ogg", BotConfig.GenShinConfig.ErrAudioAddr)
+	req.False(BotConfig().DebugMode)
+	req.Empty(BotConfig().Token)
+	req.Equal("redis:6379", BotConfig().RedisConfig.RedisAddr)
+	req.Equal("csust-bot-redis-password", BotConfig().RedisConfig.RedisPass)
+	// req.Equal("https://api.csu.st", BotConfig().GenShinConfig.ApiServer)
+	// req.Equal("https://api.csu.st/file/VO_inGame/VO_NPC/NPC_DQ/vo_npc_dq_f_katheryne_01.ogg", BotConfig().GenShinConfig.ErrAudioAddr)
 
 	InitViper("not_exist", "")
 	readConfig()
 	defer viper.Reset()
 
 	// some config should empty
-	req.False(BotConfig.DebugMode)
-	req.Empty(BotConfig.Token)
-	req.Empty(BotConfig.RedisConfig.RedisAddr)
-	req.Empty(BotConfig.RedisConfig.RedisPass)
+	req.False(BotConfig().DebugMode)
+	req.Empty(BotConfig().Token)
+	req.Empty(BotConfig().RedisConfig.RedisAddr)
+	req.Empty(BotConfig().RedisConfig.RedisPass)
 }
 
 // nolint:goconst
@@ -60,16 +61,16 @@ func TestReadEnv(t *testing.T) {
 	t.Setenv(testEnvPrefix+"_"+"REDIS_PASS", "some-env-password")
 
 	// init config
-	BotConfig = NewBotConfig()
+	SetBotConfig(NewBotConfig())
 	InitViper("", testEnvPrefix)
 	readConfig()
 	defer viper.Reset()
 
 	// some config should read
-	req.True(BotConfig.DebugMode)
-	req.Equal("some-bot-token", BotConfig.Token)
-	req.Equal("some-env-address", BotConfig.RedisConfig.RedisAddr)
-	req.Equal("some-env-password", BotConfig.RedisConfig.RedisPass)
+	req.True(BotConfig().DebugMode)
+	req.Equal("some-bot-token", BotConfig().Token)
+	req.Equal("some-env-address", BotConfig().RedisConfig.RedisAddr)
+	req.Equal("some-env-password", BotConfig().RedisConfig.RedisPass)
 	checkConfig()
 }
 
@@ -82,16 +83,16 @@ func TestEnvOverrideFile(t *testing.T) {
 	t.Setenv(testEnvPrefix+"_"+"REDIS_ADDR", "some-env-address")
 
 	// init config
-	BotConfig = NewBotConfig()
+	SetBotConfig(NewBotConfig())
 	InitViper(testConfigFile, testEnvPrefix)
 	readConfig()
 	defer viper.Reset()
 
 	// some config should read
-	req.True(BotConfig.DebugMode)
-	req.Equal("some-bot-token", BotConfig.Token)
-	req.Equal("some-env-address", BotConfig.RedisConfig.RedisAddr)
-	req.Equal("csust-bot-redis-password", BotConfig.RedisConfig.RedisPass)
+	req.True(BotConfig().DebugMode)
+	req.Equal("some-bot-token", BotConfig().Token)
+	req.Equal("some-env-address", BotConfig().RedisConfig.RedisAddr)
+	req.Equal("csust-bot-redis-password", BotConfig().RedisConfig.RedisPass)
 }
 
 func TestMustConfig(t *testing.T) {
@@ -104,7 +105,7 @@ func TestMustConfig(t *testing.T) {
 	}
 
 	// all set should not panic
-	BotConfig = NewBotConfig()
+	SetBotConfig(NewBotConfig())
 	InitViper("", testEnvPrefix)
 	readConfig()
 	require.NotPanics(t, func() { checkConfig() })
@@ -124,12 +125,12 @@ func TestRateLimitConfig(t *testing.T) {
 	req := testInit(t)
 
 	// init config
-	BotConfig = NewBotConfig()
+	SetBotConfig(NewBotConfig())
 	InitViper(testConfigFile, testEnvPrefix)
 	readConfig()
 	defer viper.Reset()
 
-	config := BotConfig.RateLimitConfig
+	config := BotConfig().RateLimitConfig
 	req.Equal(20, config.MaxToken)
 	req.Equal(0.5, config.Limit)
 	req.Equal(1, config.Cost)
@@ -147,7 +148,7 @@ func TestRateLimitConfig(t *testing.T) {
 	// should override by env
 	readConfig()
 
-	config = BotConfig.RateLimitConfig
+	config = BotConfig().RateLimitConfig
 	req.Equal(0, config.MaxToken)
 	req.Equal(0.0, config.Limit)
 	req.Equal(-1, config.Cost)
@@ -170,20 +171,20 @@ func TestMessageConfig(t *testing.T) {
 	t.Setenv(testEnvPrefix+"_"+"TOKEN", "some-bot-token")
 	t.Setenv(testEnvPrefix+"_"+"REDIS_ADDR", "some-env-address")
 	// init config
-	BotConfig = NewBotConfig()
+	SetBotConfig(NewBotConfig())
 	InitViper(testConfigFile, testEnvPrefix)
 	readConfig()
 	defer viper.Reset()
 
-	req.Equal("好 的， 我 杀 我 自 己。", BotConfig.MessageConfig.RestrictBot)
+	req.Equal("好 的， 我 杀 我 自 己。", BotConfig().MessageConfig.RestrictBot)
 
 	// set some env
 	t.Setenv(testEnvPrefix+"_"+"MESSAGE_RESTRICT_BOT", "")
 	readConfig()
-	req.Equal("", BotConfig.MessageConfig.RestrictBot)
+	req.Equal("", BotConfig().MessageConfig.RestrictBot)
 
 	checkConfig()
-	req.Equal(missMsg, BotConfig.MessageConfig.RestrictBot)
+	req.Equal(missMsg, BotConfig().MessageConfig.RestrictBot)
 }
 
 func TestSpecialListConfig(t *testing.T) {
@@ -194,32 +195,81 @@ func TestSpecialListConfig(t *testing.T) {
 	t.Setenv(testEnvPrefix+"_"+"REDIS_ADDR", "some-env-address")
 
 	// init config
-	BotConfig = NewBotConfig()
+	SetBotConfig(NewBotConfig())
 
 	InitViper(testConfigFile, testEnvPrefix)
 	readConfig()
 
 	defer viper.Reset()
 
-	req.True(BotConfig.BlockListConfig.Enabled)
-	req.True(BotConfig.WhiteListConfig.Enabled)
+	req.True(BotConfig().BlockListConfig.Enabled)
+	req.True(BotConfig().WhiteListConfig.Enabled)
 }
 
 func TestChatConfigV2(t *testing.T) {
 	req := testInit(t)
 
 	// init config
-	BotConfig = NewBotConfig()
+	SetBotConfig(NewBotConfig())
 
 	InitViper(testConfigFile, testEnvPrefix)
 	readConfig()
 
 	defer viper.Reset()
 
-	t.Logf("%+v", BotConfig.ChatConfigV2)
-	req.Greater(len(*BotConfig.ChatConfigV2), 0)
-	req.NotNil((*BotConfig.ChatConfigV2)[0].Model)
-	req.NotEmpty((*BotConfig.ChatConfigV2)[0].Model.Model)
+	t.Logf("%+v", BotConfig().ChatConfigV2)
+	req.Greater(len(*BotConfig().ChatConfigV2), 0)
+	req.NotNil((*BotConfig().ChatConfigV2)[0].Model)
+	req.NotEmpty((*BotConfig().ChatConfigV2)[0].Model.Model)
+}
+
+func TestSpeechConfig(t *testing.T) {
+	req := testInit(t)
+
+	SetBotConfig(NewBotConfig())
+	InitViper(testConfigFile, testEnvPrefix)
+	readConfig()
+	defer viper.Reset()
+
+	transcription := BotConfig().SpeechConfig.Transcription
+	req.False(transcription.Enabled)
+	req.NotNil(transcription.Model)
+	req.Equal("whisper-1", transcription.Model.Model)
+	req.Equal(300, transcription.MaxDuration)
+
+	req.Equal("tts-1", BotConfig().SpeechConfig.Synthesis.Model.Model)
+
+	c := &SpeechConfig{Transcription: TranscriptionConfig{Enabled: true}, Synthesis: SynthesisConfig{Speed: 5}}
+	c.checkConfig()
+	req.False(c.Transcription.Enabled)
+	req.Equal(300, c.Transcription.MaxDuration)
+	req.Zero(c.Synthesis.Speed)
+}
+
+func TestMessageStreamConfig(t *testing.T) {
+	req := testInit(t)
+
+	SetBotConfig(NewBotConfig())
+	InitViper(testConfigFile, testEnvPrefix)
+	readConfig()
+	defer viper.Reset()
+
+	maxLen, ttl := BotConfig().MessageStream.Retention(-100)
+	req.Equal(int64(1000), maxLen)
+	req.Equal(24*time.Hour, ttl)
+	req.Equal("总结bot", BotConfig().ChatSummary.Chat)
+	req.Equal(24*time.Hour, BotConfig().ChatSummary.DefaultWindow)
+	req.Equal(3*time.Second, BotConfig().StableDiffusion.ProgressInterval)
+	req.Equal(time.Minute, BotConfig().StableDiffusion.HealthCheckInterval)
+
+	c := &MessageStreamConfig{Chats: []MessageStreamChatConfig{{ChatID: -100, MaxLen: 5000}, {ChatID: -200, TTL: time.Hour}}}
+	c.checkConfig()
+	maxLen, ttl = c.Retention(-100)
+	req.Equal(int64(5000), maxLen)
+	req.Equal(24*time.Hour, ttl)
+	maxLen, ttl = c.Retention(-200)
+	req.Equal(int64(1000), maxLen)
+	req.Equal(time.Hour, ttl)
 }
 
 func TestCustomConfig(t *testing.T) {
@@ -239,11 +289,11 @@ func TestCustomConfig(t *testing.T) {
 	req.NoError(err)
 
 	// 初始化配置
-	BotConfig = NewBotConfig()
+	SetBotConfig(NewBotConfig())
 	InitViper(baseConfigPath, "")
 	readConfig()
 
 	// 检查custom.yaml是否覆盖了config.yaml中的配置
-	req.True(BotConfig.DebugMode)
-	req.Equal("custom-token", BotConfig.Token)
+	req.True(BotConfig().DebugMode)
+	req.Equal("custom-token", BotConfig().Token)
 }
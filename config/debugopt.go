@@ -1,15 +1,13 @@
 package config
 
-import "github.com/spf13/viper"
-
 type debugOptConfig struct {
 	ShowThis bool
 }
 
 func (c *debugOptConfig) readConfig() {
 	c.ShowThis = true
-	if viper.IsSet("debugopt.show_this") {
-		c.ShowThis = viper.GetBool("debugopt.show_this")
+	if cfgViper().IsSet("debugopt.show_this") {
+		c.ShowThis = cfgViper().GetBool("debugopt.show_this")
 	}
 }
 
@@ -1,7 +1,5 @@
 package config
 
-import "github.com/spf13/viper"
-
 // GetVoiceConfig is config
 type GetVoiceConfig struct {
 	Enable      bool          `mapstructure:"enable"`
@@ -34,7 +32,7 @@ type IndexConfig struct {
 }
 
 func (c *GetVoiceConfig) readConfig() {
-	err := viper.UnmarshalKey("get_voice", c)
+	err := cfgViper().UnmarshalKey("get_voice", c)
 	if err != nil {
 		panic(err)
 	}
@@ -42,7 +40,7 @@ func (c *GetVoiceConfig) readConfig() {
 
 func (c *GetVoiceConfig) checkConfig() {
 	// 修正字段名为 HostAddr
-	if c.Enable && (BotConfig.MeiliConfig == nil || BotConfig.MeiliConfig.HostAddr == "") {
+	if c.Enable && (BotConfig().MeiliConfig == nil || BotConfig().MeiliConfig.HostAddr == "") {
 		panic("MeiliSearch URL is required when GetVoice is enabled")
 	}
 }
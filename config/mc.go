@@ -1,9 +1,6 @@
 package config
 
-import (
-	"github.com/spf13/viper"
-	"go.uber.org/zap"
-)
+import "go.uber.org/zap"
 
 type mcConfig struct {
 	Mc2Dead int
@@ -21,16 +18,16 @@ type mcConfig struct {
 }
 
 func (c *mcConfig) readConfig() {
-	c.Mc2Dead = viper.GetInt("mc.mc2dead")
+	c.Mc2Dead = cfgViper().GetInt("mc.mc2dead")
 
-	c.Sacrifices = viper.GetIntSlice("mc.sacrifices")
-	c.Odds = viper.GetInt("mc.odds")
-	c.Timout = viper.GetInt("mc.timeout")
+	c.Sacrifices = cfgViper().GetIntSlice("mc.sacrifices")
+	c.Odds = cfgViper().GetInt("mc.odds")
+	c.Timout = cfgViper().GetInt("mc.timeout")
 }
 
 func (c *mcConfig) checkConfig() {
 	if c.Mc2Dead > 10 {
-		zap.L().Fatal("mc config: `Mc2Dead` must in [0, 10], negative means 0, 0 means off", zap.Int("Mc2Dead", c.Mc2Dead))
+		zap.L().Panic("mc config: `Mc2Dead` must in [0, 10], negative means 0, 0 means off", zap.Int("Mc2Dead", c.Mc2Dead))
 	}
 
 	if len(c.Sacrifices) == 0 {
@@ -39,7 +36,7 @@ func (c *mcConfig) checkConfig() {
 
 	for _, sacrifice := range c.Sacrifices {
 		if sacrifice < 30 || sacrifice > 600 {
-			zap.L().Fatal("mc config: `Sacrifices` must in [30, 600]", zap.Int("Sacrifices", sacrifice))
+			zap.L().Panic("mc config: `Sacrifices` must in [30, 600]", zap.Int("Sacrifices", sacrifice))
 		}
 	}
 
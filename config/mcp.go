@@ -0,0 +1,95 @@
+package config
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// mcp transports
+const (
+	McpTransportStdio = "stdio"
+	McpTransportHttp  = "http"
+	// McpTransportSse is the legacy http+sse transport
+	McpTransportSse = "sse"
+)
+
+// McpServersConfig is the configuration for native mcp servers
+type McpServersConfig []*McpServerConfig
+
+// McpServerConfig is the configuration for a mcp server
+type McpServerConfig struct {
+	Name      string `mapstructure:"name"`
+	Enable    bool   `mapstructure:"enable"`
+	Transport string `mapstructure:"transport"` // stdio, http or sse, default is inferred from command and url
+
+	// stdio
+	Command string            `mapstructure:"command"`
+	Args    []string          `mapstructure:"args"`
+	Env     map[string]string `mapstructure:"env"`
+
+	// streamable http or legacy sse
+	Url     string            `mapstructure:"url"`
+	Headers map[string]string `mapstructure:"headers"`
+
+	Timeout int      `mapstructure:"timeout"` // seconds
+	Tools   []string `mapstructure:"tools"`   // only these tools are enabled if not empty
+
+	// DangerousTools need confirmation of user before called
+	DangerousTools []string `mapstructure:"dangerous_tools"`
+}
+
+// GetTransport returns the transport of server
+func (c *McpServerConfig) GetTransport() string {
+	if c.Transport != "" {
+		return c.Transport
+	}
+	if c.Command != "" {
+		return McpTransportStdio
+	}
+	return McpTransportHttp
+}
+
+// GetTimeout returns the timeout of each request to server
+func (c *McpServerConfig) GetTimeout() time.Duration {
+	if c.Timeout <= 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(c.Timeout) * time.Second
+}
+
+func (c *McpServersConfig) readConfig() {
+	err := cfgViper().UnmarshalKey("mcp_servers", c)
+	if err != nil {
+		zap.L().Panic("cannot parse mcp servers config", zap.Error(err))
+	}
+}
+
+func (c *McpServersConfig) checkConfig() {
+	names := make(map[string]struct{}, len(*c))
+	for _, s := range *c {
+		if !s.Enable {
+			continue
+		}
+		if s.Name == "" {
+			zap.L().Panic("mcp server name is empty")
+		}
+		if _, ok := names[s.Name]; ok {
+			zap.L().Panic("duplicate mcp server name", zap.String("name", s.Name))
+		}
+		names[s.Name] = struct{}{}
+
+		switch s.GetTransport() {
+		case McpTransportStdio:
+			if s.Command == "" {
+				zap.L().Panic("mcp server command is empty", zap.String("name", s.Name))
+			}
+		case McpTransportHttp, McpTransportSse:
+			if s.Url == "" {
+				zap.L().Panic("mcp server url is empty", zap.String("name", s.Name))
+			}
+		default:
+			zap.L().Panic("unknown mcp server transport", zap.String("name", s.Name), zap.String("transport", s.Transport))
+		}
+	}
+}
@@ -1,9 +1,6 @@
 package config
 
-import (
-	"github.com/spf13/viper"
-	"go.uber.org/zap"
-)
+import "go.uber.org/zap"
 
 type meiliConfig struct {
 	Enabled     bool
@@ -13,10 +10,10 @@ type meiliConfig struct {
 }
 
 func (c *meiliConfig) readConfig() {
-	c.Enabled = viper.GetBool("meili.enabled")
-	c.HostAddr = viper.GetString("meili.address")
-	c.IndexPrefix = viper.GetString("meili.index_prefix")
-	c.ApiKey = viper.GetString("meili.api_key")
+	c.Enabled = cfgViper().GetBool("meili.enabled")
+	c.HostAddr = cfgViper().GetString("meili.address")
+	c.IndexPrefix = cfgViper().GetString("meili.index_prefix")
+	c.ApiKey = cfgViper().GetString("meili.api_key")
 }
 
 func (c *meiliConfig) checkConfig() {
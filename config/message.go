@@ -3,7 +3,6 @@ package config
 import (
 	"reflect"
 
-	"github.com/spf13/viper"
 	"go.uber.org/zap"
 )
 
@@ -19,12 +18,12 @@ type messageConfig struct {
 }
 
 func (c *messageConfig) readConfig() {
-	c.RestrictBot = viper.GetString("message.restrict_bot")
-	c.FakeBanInCD = viper.GetString("message.fake_ban_in_cd")
-	c.HitokotoNotFound = viper.GetString("message.hitokoto_not_found")
-	c.NoSleep = viper.GetString("message.no_sleep")
-	c.BootFailed = viper.GetString("message.boot_failed")
-	c.WelcomeMessage = viper.GetString("message.welcome")
+	c.RestrictBot = cfgViper().GetString("message.restrict_bot")
+	c.FakeBanInCD = cfgViper().GetString("message.fake_ban_in_cd")
+	c.HitokotoNotFound = cfgViper().GetString("message.hitokoto_not_found")
+	c.NoSleep = cfgViper().GetString("message.no_sleep")
+	c.BootFailed = cfgViper().GetString("message.boot_failed")
+	c.WelcomeMessage = cfgViper().GetString("message.welcome")
 }
 
 func (c *messageConfig) checkConfig() {
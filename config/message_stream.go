@@ -0,0 +1,71 @@
+package config
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultStreamMaxLen = 1000
+	defaultStreamTTL    = 24 * time.Hour
+)
+
+// MessageStreamConfig is config of recent messages kept in redis stream,
+// which are used as context of chats and by `/summary_chat`.
+type MessageStreamConfig struct {
+	MaxLen int64                     `mapstructure:"max_len"`
+	TTL    time.Duration             `mapstructure:"ttl"`
+	Chats  []MessageStreamChatConfig `mapstructure:"chats"`
+}
+
+// MessageStreamChatConfig overrides retention of message stream for a chat, zero values mean default
+type MessageStreamChatConfig struct {
+	ChatID int64         `mapstructure:"chat_id"`
+	MaxLen int64         `mapstructure:"max_len"`
+	TTL    time.Duration `mapstructure:"ttl"`
+}
+
+func (c *MessageStreamConfig) readConfig() {
+	err := cfgViper().UnmarshalKey("message_stream", c)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (c *MessageStreamConfig) checkConfig() {
+	if c.MaxLen <= 0 {
+		c.MaxLen = defaultStreamMaxLen
+	}
+	if c.TTL <= 0 {
+		c.TTL = defaultStreamTTL
+	}
+	for _, chat := range c.Chats {
+		if chat.MaxLen < 0 || chat.TTL < 0 {
+			zap.L().Panic("message stream retention of chat must not be negative", zap.Int64("chat", chat.ChatID))
+		}
+	}
+}
+
+// Retention returns max length and ttl of message stream of chat
+func (c *MessageStreamConfig) Retention(chatID int64) (int64, time.Duration) {
+	maxLen, ttl := c.MaxLen, c.TTL
+	if maxLen <= 0 {
+		maxLen = defaultStreamMaxLen
+	}
+	if ttl <= 0 {
+		ttl = defaultStreamTTL
+	}
+	for _, chat := range c.Chats {
+		if chat.ChatID != chatID {
+			continue
+		}
+		if chat.MaxLen > 0 {
+			maxLen = chat.MaxLen
+		}
+		if chat.TTL > 0 {
+			ttl = chat.TTL
+		}
+	}
+	return maxLen, ttl
+}
@@ -1,9 +1,6 @@
 package config
 
-import (
-	"github.com/spf13/viper"
-	"go.uber.org/zap"
-)
+import "go.uber.org/zap"
 
 type redisConfig struct {
 	RedisAddr string
@@ -12,9 +9,9 @@ type redisConfig struct {
 }
 
 func (c *redisConfig) readConfig() {
-	c.RedisAddr = viper.GetString("redis.addr")
-	c.RedisPass = viper.GetString("redis.pass")
-	c.KeyPrefix = viper.GetString("redis.key_prefix")
+	c.RedisAddr = cfgViper().GetString("redis.addr")
+	c.RedisPass = cfgViper().GetString("redis.pass")
+	c.KeyPrefix = cfgViper().GetString("redis.key_prefix")
 }
 
 func (c *redisConfig) checkConfig() {
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	. "gopkg.in/telebot.v3"
+)
+
+var (
+	// ErrInvalidConfig means the new config is rejected, the old one is still in use
+	ErrInvalidConfig = errors.New("invalid config")
+	// ErrNoConfigFile means bot is not started with a config file
+	ErrNoConfigFile = errors.New("no config file to reload")
+)
+
+var (
+	reloadMu    sync.Mutex
+	loadHooks   []func(c *Config)
+	reloadHooks []func()
+)
+
+// OnLoad registers a hook which is called with the new config before it's in use,
+// it fills parts of config which are not from config file.
+func OnLoad(hook func(c *Config)) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	loadHooks = append(loadHooks, hook)
+}
+
+// OnReload registers a hook which is called after config is reloaded, hooks are called in order of registration.
+func OnReload(hook func()) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	reloadHooks = append(reloadHooks, hook)
+}
+
+// SetBot sets Bot of config.
+func SetBot(bot *Bot) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	c := *BotConfig()
+	c.Bot = bot
+	SetBotConfig(&c)
+}
+
+// ReloadConfig reads the config file again, if the new config is valid,
+// replaces sections of BotConfig which can be changed at runtime as a whole, then calls reload hooks.
+// Connection settings, such as token, proxy, listen, redis, meili and mcp servers, take effect after restart.
+func ReloadConfig() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if configFilePath == "" {
+		return ErrNoConfigFile
+	}
+	v := viper.New()
+	setupEnv(v, configEnvPrefix)
+	if err := readConfigFile(v, configFilePath); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+	c, err := loadConfig(v)
+	if err != nil {
+		return err
+	}
+	currentViper = v
+
+	next := applyConfig(BotConfig(), c)
+	for _, hook := range loadHooks {
+		hook(next)
+	}
+	SetBotConfig(next)
+	for _, hook := range reloadHooks {
+		hook()
+	}
+	zap.L().Info("config reloaded", zap.String("configFile", configFilePath))
+	return nil
+}
+
+// loadConfig reads a new config from v and checks it, panics in checking are returned as error.
+func loadConfig(v *viper.Viper) (c *Config, err error) {
+	old := currentViper
+	currentViper = v
+	defer func() {
+		currentViper = old
+		if r := recover(); r != nil {
+			c, err = nil, fmt.Errorf("%w: %v", ErrInvalidConfig, r)
+		}
+	}()
+
+	c = NewBotConfig()
+	readConfigInto(c)
+	checkConfigOf(c)
+	return c, nil
+}
+
+// applyConfig returns a copy of old, whose sections which can be changed at runtime are replaced by c.
+func applyConfig(old, c *Config) *Config {
+	next := *old
+	next.SkipDuration = c.SkipDuration
+	next.SentenceDelimiters = c.SentenceDelimiters
+	next.Admins = c.Admins
+	next.RestrictConfig = c.RestrictConfig
+	next.RateLimitConfig = c.RateLimitConfig
+	next.MessageConfig = c.MessageConfig
+	next.WhiteListConfig = c.WhiteListConfig
+	next.BlockListConfig = c.BlockListConfig
+	next.McConfig = c.McConfig
+	next.SpeechConfig = c.SpeechConfig
+	next.MessageStream = c.MessageStream
+	next.ChatSummary = c.ChatSummary
+	next.StableDiffusion = c.StableDiffusion
+	next.ChatConfigV2 = c.ChatConfigV2
+	return &next
+}
+
+// WatchConfig reloads config when the config file changes.
+func WatchConfig() {
+	if configFilePath == "" {
+		return
+	}
+	// the watcher is only used to get notified, config is read by ReloadConfig
+	watcher := viper.New()
+	watcher.SetConfigFile(configFilePath)
+	watcher.OnConfigChange(func(e fsnotify.Event) {
+		zap.L().Info("config file changed", zap.String("file", e.Name), zap.String("op", e.Op.String()))
+		if err := ReloadConfig(); err != nil {
+			zap.L().Error("reload config failed, keep using the old config", zap.Error(err))
+		}
+	})
+	watcher.WatchConfig()
+}
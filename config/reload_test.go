@@ -0,0 +1,101 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+const reloadTestConfig = `
+token: "some-bot-token"
+redis:
+  addr: "redis:6379"
+admins: [42]
+rate_limit:
+  max_token: %d
+chats:
+  - name: chat
+    model:
+      name: gpt
+      model: gpt-xxx
+    trigger:
+      - command: chat
+      - regex: %q
+    prompt_template: "{{ .Input }}"
+`
+
+func writeReloadTestConfig(t *testing.T, file string, maxToken int, regex string) {
+	t.Helper()
+	content := []byte(fmt.Sprintf(reloadTestConfig, maxToken, regex))
+	if err := os.WriteFile(file, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	req := testInit(t)
+	defer viper.Reset()
+	defer func() {
+		configFilePath = ""
+		currentViper = nil
+		loadHooks = nil
+		reloadHooks = nil
+	}()
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	writeReloadTestConfig(t, file, 10, "^hi$")
+
+	SetBotConfig(NewBotConfig())
+	InitViper(file, testEnvPrefix)
+	readConfig()
+	checkConfig()
+	req.True(BotConfig().IsAdmin(42))
+	req.False(BotConfig().IsAdmin(1))
+	req.Equal(10, BotConfig().RateLimitConfig.MaxToken)
+	v2, trigger := BotConfig().ChatConfigV2.FindByCommand("chat")
+	req.NotNil(v2)
+	req.Equal("chat", trigger.Command)
+
+	reloaded := 0
+	OnReload(func() { reloaded++ })
+	// load hooks see the new config before it's in use
+	OnLoad(func(c *Config) {
+		req.NotSame(BotConfig(), c)
+		c.WhiteListConfig.Chats = append(c.WhiteListConfig.Chats, 7)
+	})
+
+	// valid config is applied
+	writeReloadTestConfig(t, file, 20, "^hello$")
+	req.NoError(ReloadConfig())
+	req.Equal(1, reloaded)
+	req.Equal(20, BotConfig().RateLimitConfig.MaxToken)
+	req.Equal("^hello$", (*BotConfig().ChatConfigV2)[0].Trigger[1].Regex)
+	req.True(BotConfig().WhiteListConfig.Check(7))
+
+	// invalid config is rejected, and the old one is kept
+	writeReloadTestConfig(t, file, 30, "^(hello$")
+	req.ErrorIs(ReloadConfig(), ErrInvalidConfig)
+	req.Equal(1, reloaded)
+	req.Equal(20, BotConfig().RateLimitConfig.MaxToken)
+	req.Equal("^hello$", (*BotConfig().ChatConfigV2)[0].Trigger[1].Regex)
+
+	// bad proxy of model is rejected
+	bad := strings.Replace(fmt.Sprintf(reloadTestConfig, 40, "^hello$"),
+		"    trigger:", "      proxy: \"http://[::1\"\n    trigger:", 1)
+	req.NoError(os.WriteFile(file, []byte(bad), 0o600))
+	req.ErrorIs(ReloadConfig(), ErrInvalidConfig)
+	req.Equal(20, BotConfig().RateLimitConfig.MaxToken)
+
+	req.NoError(os.WriteFile(file, []byte("chats: [\n"), 0o600))
+	req.ErrorIs(ReloadConfig(), ErrInvalidConfig)
+	req.Equal(20, BotConfig().RateLimitConfig.MaxToken)
+	// the rejected file is not adopted
+	req.Equal(20, cfgViper().GetInt("rate_limit.max_token"))
+
+	configFilePath = ""
+	req.ErrorIs(ReloadConfig(), ErrNoConfigFile)
+}
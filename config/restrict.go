@@ -1,10 +1,6 @@
 package config
 
-import (
-	"time"
-
-	"github.com/spf13/viper"
-)
+import "time"
 
 type restrictConfig struct {
 	KillSeconds          int
@@ -12,8 +8,8 @@ type restrictConfig struct {
 }
 
 func (c *restrictConfig) readConfig() {
-	c.KillSeconds = viper.GetInt("restrict.kill_duration")
-	c.FakeBanMaxAddSeconds = viper.GetInt("restrict.fake_ban_max_add")
+	c.KillSeconds = cfgViper().GetInt("restrict.kill_duration")
+	c.FakeBanMaxAddSeconds = cfgViper().GetInt("restrict.fake_ban_max_add")
 }
 
 func (c *restrictConfig) checkConfig() {
@@ -37,13 +33,13 @@ type rateLimitConfig struct {
 }
 
 func (c *rateLimitConfig) readConfig() {
-	c.MaxToken = viper.GetInt("rate_limit.max_token")
-	c.Limit = viper.GetFloat64("rate_limit.limit")
-	c.Cost = viper.GetInt("rate_limit.cost")
-	c.StickerCost = viper.GetInt("rate_limit.cost_sticker")
-	c.CommandCost = viper.GetInt("rate_limit.cost_command")
+	c.MaxToken = cfgViper().GetInt("rate_limit.max_token")
+	c.Limit = cfgViper().GetFloat64("rate_limit.limit")
+	c.Cost = cfgViper().GetInt("rate_limit.cost")
+	c.StickerCost = cfgViper().GetInt("rate_limit.cost_sticker")
+	c.CommandCost = cfgViper().GetInt("rate_limit.cost_command")
 
-	expire := max(viper.GetInt64("rate_limit.expire_time"), 60*1000)
+	expire := max(cfgViper().GetInt64("rate_limit.expire_time"), 60*1000)
 	c.ExpireTime = time.Duration(expire) * time.Millisecond
 }
 
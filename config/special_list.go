@@ -2,8 +2,6 @@ package config
 
 import "slices"
 
-import "github.com/spf13/viper"
-
 type specialListConfig struct {
 	Name    string
 	Enabled bool
@@ -12,8 +10,8 @@ type specialListConfig struct {
 
 func (c *specialListConfig) readConfig() {
 	c.Chats = make([]int64, 0)
-	c.Enabled = viper.GetBool(c.Name + ".enabled")
-	chats := viper.GetIntSlice(c.Name + ".chats")
+	c.Enabled = cfgViper().GetBool(c.Name + ".enabled")
+	chats := cfgViper().GetIntSlice(c.Name + ".chats")
 	for _, v := range chats {
 		c.Chats = append(c.Chats, int64(v))
 	}
@@ -0,0 +1,50 @@
+package config
+
+import "go.uber.org/zap"
+
+// SpeechConfig is config of speech, models are OpenAI compatible
+type SpeechConfig struct {
+	Transcription TranscriptionConfig `mapstructure:"transcription"`
+	Synthesis     SynthesisConfig     `mapstructure:"synthesis"`
+}
+
+// TranscriptionConfig is config of transcribing voice messages to text
+type TranscriptionConfig struct {
+	Enabled  bool   `mapstructure:"enabled"`
+	Model    *Model `mapstructure:"model"`
+	Language string `mapstructure:"language"` // ISO-639-1 code, empty means auto detect
+	Prompt   string `mapstructure:"prompt"`
+	// MaxDuration is the max duration of audio in seconds, longer ones are not transcribed
+	MaxDuration int `mapstructure:"max_duration"`
+}
+
+// SynthesisConfig is config of reading answers of chat aloud, it's used by chats with `format.voice`
+type SynthesisConfig struct {
+	Model *Model  `mapstructure:"model"`
+	Speed float64 `mapstructure:"speed"` // 0.25 to 4.0, 0 means default
+}
+
+func (c *SpeechConfig) readConfig() {
+	err := cfgViper().UnmarshalKey("speech", c)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (c *SpeechConfig) checkConfig() {
+	c.Transcription.Model.checkProxy()
+	c.Synthesis.Model.checkProxy()
+
+	t := &c.Transcription
+	if t.Enabled && (t.Model == nil || t.Model.Model == "") {
+		zap.L().Warn("speech transcription model is not set, transcription is disabled")
+		t.Enabled = false
+	}
+	if t.MaxDuration <= 0 {
+		t.MaxDuration = 300
+	}
+	if s := &c.Synthesis; s.Speed != 0 && (s.Speed < 0.25 || s.Speed > 4) {
+		zap.L().Warn("speech synthesis speed must in [0.25, 4.0], will use default", zap.Float64("speed", s.Speed))
+		s.Speed = 0
+	}
+}
@@ -0,0 +1,34 @@
+package config
+
+import "time"
+
+// StableDiffusionConfig is config of stable diffusion worker
+type StableDiffusionConfig struct {
+	// ProgressInterval is the interval of polling progress and editing status message, negative to disable
+	ProgressInterval time.Duration `mapstructure:"progress_interval"`
+	// HealthCheckInterval is the interval of checking servers in pool
+	HealthCheckInterval time.Duration `mapstructure:"health_check_interval"`
+}
+
+func (c *StableDiffusionConfig) readConfig() {
+	err := cfgViper().UnmarshalKey("stable_diffusion", c)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (c *StableDiffusionConfig) checkConfig() {
+	if c.ProgressInterval == 0 {
+		c.ProgressInterval = 3 * time.Second
+	}
+	if c.HealthCheckInterval <= 0 {
+		c.HealthCheckInterval = time.Minute
+	}
+	if c.HealthCheckInterval < 10*time.Second {
+		c.HealthCheckInterval = 10 * time.Second
+	}
+	// editing media too often hits the rate limit of telegram
+	if c.ProgressInterval > 0 && c.ProgressInterval < time.Second {
+		c.ProgressInterval = time.Second
+	}
+}
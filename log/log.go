@@ -21,12 +21,12 @@ func InitLogger() {
 func NewLogger() *zap.Logger {
 	var logConfig zap.Config
 	// create log dir if not exists
-	if config.BotConfig.LogFileDir != "" {
-		if err := os.MkdirAll(config.BotConfig.LogFileDir, 0755); err != nil {
+	if config.BotConfig().LogFileDir != "" {
+		if err := os.MkdirAll(config.BotConfig().LogFileDir, 0755); err != nil {
 			zap.L().Fatal("Create log dir failed", zap.Error(err))
 		}
 	}
-	if config.BotConfig.DebugMode {
+	if config.BotConfig().DebugMode {
 		logConfig = devConfig()
 	} else {
 		logConfig = prodConfig()
@@ -40,7 +40,7 @@ func NewLogger() *zap.Logger {
 }
 
 func devConfig() zap.Config {
-	logPath := lo.FilterMap([]string{config.BotConfig.LogFileDir}, func(p string, _ int) (string, bool) {
+	logPath := lo.FilterMap([]string{config.BotConfig().LogFileDir}, func(p string, _ int) (string, bool) {
 		return p, p != ""
 	})
 	return zap.Config{
@@ -67,7 +67,7 @@ func devConfig() zap.Config {
 }
 
 func prodConfig() zap.Config {
-	logPath := lo.FilterMap([]string{config.BotConfig.LogFileDir}, func(p string, _ int) (string, bool) {
+	logPath := lo.FilterMap([]string{config.BotConfig().LogFileDir}, func(p string, _ int) (string, bool) {
 		return p, p != ""
 	})
 	return zap.Config{
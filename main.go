@@ -8,10 +8,12 @@ import (
 	"csust-got/store"
 	"csust-got/util/gacha"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"regexp"
+	"sync/atomic"
 	"time"
 
 	"csust-got/base"
@@ -32,15 +34,29 @@ func main() {
 	defer log.Sync()
 	orm.InitRedis()
 
-	orm.LoadWhiteList()
-	orm.LoadBlockList()
+	orm.LoadWhiteList(config.BotConfig())
+	orm.LoadBlockList(config.BotConfig())
 
 	chat.InitMcpoClient()
-	chat.InitAiClients(*config.BotConfig.ChatConfigV2)
-	initChatRegexHandlers(*config.BotConfig.ChatConfigV2)
+	chat.InitMcpClients()
+	chat.InitLocalTools()
+	chat.InitAiClients(*config.BotConfig().ChatConfigV2)
+	initChatRegexHandlers(*config.BotConfig().ChatConfigV2)
 
 	chat.InitGachaConfigs()
 
+	config.OnLoad(func(c *config.Config) {
+		orm.LoadWhiteList(c)
+		orm.LoadBlockList(c)
+	})
+	config.OnReload(func() {
+		restrict.ResetLimiters()
+		chat.InitAiClients(*config.BotConfig().ChatConfigV2)
+		initChatRegexHandlers(*config.BotConfig().ChatConfigV2)
+		chat.InitGachaConfigs()
+	})
+	config.WatchConfig()
+
 	err := base.InitGetVoice()
 	if err != nil {
 		log.Panic(err.Error())
@@ -53,7 +69,7 @@ func main() {
 		log.Panic(err.Error())
 	}
 
-	if config.BotConfig.DebugMode {
+	if config.BotConfig().DebugMode {
 		registerDebugHandler(bot)
 	}
 
@@ -61,17 +77,29 @@ func main() {
 	registerRestrictHandler(bot)
 	registerEventHandler(bot)
 	registerChatConfigHandler(bot)
+	chat.RegisterCallbackHandlers(bot)
+	bot.Handle("/reload", base.ReloadConfig)
+	bot.Handle("/persona", chat.PersonaHandler)
+	bot.Handle("/usage", chat.UsageHandler)
+	bot.Handle("/usage_quota", util.GroupCommandCtx(chat.UsageQuotaHandler))
+	bot.Handle("/summary_chat", util.GroupCommandCtx(chat.SummaryHandler))
+	bot.Handle("/digest", util.GroupCommandCtx(chat.DigestHandler))
 	bot.Handle("/sd", sd.Handler, whiteMiddleware)
 	bot.Handle("/sdcfg", sd.ConfigHandler)
 	bot.Handle("/sdlast", sd.LastPromptHandler)
+	bot.Handle("/sdupscale", sd.UpscaleHandler, whiteMiddleware)
+	bot.Handle("/sdqueue", sd.QueueHandler)
+	bot.Handle("/sdcancel", sd.CancelHandler)
+	bot.Handle("/sdservers", sd.ServersHandler)
 
 	// inline mode
-	inline.RegisterInlineHandler(bot, config.BotConfig)
+	inline.RegisterInlineHandler(bot, config.BotConfig())
 
 	meili.InitMeili()
 
-	go sd.Process()
+	go sd.Process(bot)
 
+	chat.InitDigest()
 	base.Init()
 
 	store.InitQueues(bot)
@@ -86,8 +114,8 @@ func initBot() (*Bot, error) {
 
 	httpClient := http.DefaultClient
 
-	if config.BotConfig.Proxy != "" {
-		proxyURL, err := url.Parse(config.BotConfig.Proxy)
+	if config.BotConfig().Proxy != "" {
+		proxyURL, err := url.Parse(config.BotConfig().Proxy)
 		if err != nil {
 			log.Panic("proxy is wrong!", zap.Error(err))
 		}
@@ -95,7 +123,7 @@ func initBot() (*Bot, error) {
 	}
 
 	settings := Settings{
-		Token:     config.BotConfig.Token,
+		Token:     config.BotConfig().Token,
 		Updates:   512,
 		ParseMode: ModeDefault,
 		OnError:   errorHandler,
@@ -104,8 +132,8 @@ func initBot() (*Bot, error) {
 		Verbose:   false,
 	}
 
-	if config.BotConfig.URL != "" {
-		settings.URL = config.BotConfig.URL
+	if config.BotConfig().URL != "" {
+		settings.URL = config.BotConfig().URL
 	}
 
 	bot, err := NewBot(settings)
@@ -118,13 +146,13 @@ func initBot() (*Bot, error) {
 		messagesCollectionMiddleware, messageStoreMiddleware, contentFilterMiddleware, byeWorldMiddleware,
 		mcMiddleware)
 
-	config.BotConfig.Bot = bot
+	config.SetBot(bot)
 	log.Info("Success Authorized", zap.String("botUserName", bot.Me.Username))
 	return bot, nil
 }
 
 func registerDebugHandler(bot *Bot) {
-	opts := config.BotConfig.DebugOptConfig
+	opts := config.BotConfig().DebugOptConfig
 
 	if opts.ShowThis {
 		bot.Handle("/_show_this", func(ctx Context) error {
@@ -169,6 +197,14 @@ func registerBaseHandler(bot *Bot) {
 	bot.Handle("/hoocoder", base.HooEncoder)
 
 	bot.Handle("/run_after", base.RunTask)
+	bot.Handle("/remind", base.Remind)
+	bot.Handle("/reminders", base.Reminders)
+	bot.Handle("/remind_cancel", base.RemindCancel)
+	bot.Handle("/timezone", base.ChatTimezone)
+	bot.Handle("/tasks", base.Tasks)
+	bot.Handle("/cancel_task", base.CancelTask)
+	bot.Handle("/edit_task", base.EditTask)
+	bot.Handle(&InlineButton{Unique: base.RemindSnoozeUnique}, base.RemindSnooze)
 
 	bot.Handle("/getvoice", base.GetVoice)
 
@@ -197,6 +233,7 @@ func registerBaseHandler(bot *Bot) {
 }
 
 func stickerDlHandler(ctx Context) error {
+	sd.RememberMask(ctx.Message())
 	if ctx.Chat().Type == ChatPrivate && ctx.Message() != nil && ctx.Message().Sticker != nil {
 		return base.GetSticker(ctx)
 	}
@@ -212,14 +249,57 @@ func customHandler(ctx Context) error {
 		if base.DecodeCommandPatt.MatchString(cmdText) {
 			return base.Decode(ctx)
 		}
-		return nil
+		// command of chat added by reloading config or personas
+		return chatCommandHandler(ctx)
 	}
 
 	text := ctx.Message().Text
 	if text == "" {
 		text = ctx.Message().Caption
 	}
-	for _, v := range regexHandlers {
+	return chatTriggerHandler(ctx, text)
+}
+
+// photoHandler remembers photos which may be masks of `/sd`, then handles caption like text
+func photoHandler(ctx Context) error {
+	sd.RememberMask(ctx.Message())
+	return customHandler(ctx)
+}
+
+// voiceHandler transcribes voice messages in background, so that the transcript is stored
+// in message stream and meilisearch, and triggers chats like text messages.
+func voiceHandler(ctx Context) error {
+	m := ctx.Message()
+	if m.Text != "" || !config.BotConfig().SpeechConfig.Transcription.Enabled {
+		return nil
+	}
+	go func() {
+		text, err := chat.TranscribeMessage(ctx.Bot(), m)
+		if err != nil {
+			if !errors.Is(err, chat.ErrAudioTooLong) {
+				log.Error("transcribe voice message failed", zap.Int64("chat", m.Chat.ID), zap.Int("msg", m.ID), zap.Error(err))
+			}
+			return
+		}
+		if text == "" {
+			return
+		}
+		m.Text = text
+		if err := orm.PushMessageToStream(m); err != nil {
+			log.Error("Store message to Redis failed", zap.Error(err))
+		}
+		// the message was indexed without text, the transcript replaces it
+		addMessageToMeili(m, m.Chat.ID)
+		if err := chatTriggerHandler(ctx, text); err != nil {
+			log.Error("handle voice message failed", zap.Int64("chat", m.Chat.ID), zap.Int("msg", m.ID), zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// chatTriggerHandler triggers chats by regex or replying to bot
+func chatTriggerHandler(ctx Context, text string) error {
+	for _, v := range *regexHandlers.Load() {
 		if v.Regex.MatchString(text) {
 			return v.Func(ctx)
 		}
@@ -229,7 +309,7 @@ func customHandler(ctx Context) error {
 	if text != "" && ctx.Message().ReplyTo != nil {
 		reply := ctx.Message().ReplyTo
 		if reply.Sender.Username == ctx.Bot().Me.Username {
-			for _, v2 := range *config.BotConfig.ChatConfigV2 {
+			for _, v2 := range *config.BotConfig().ChatConfigV2 {
 				if trigger, ok := v2.TriggerOnReply(); ok {
 					return chat.Chat(ctx, v2, trigger)
 				}
@@ -262,49 +342,59 @@ func registerEventHandler(bot *Bot) {
 	// bot.Handle(OnSticker, base.DoNothing)
 	bot.Handle(OnAnimation, base.DoNothing)
 	bot.Handle(OnMedia, base.DoNothing)
-	bot.Handle(OnPhoto, customHandler)
+	bot.Handle(OnPhoto, photoHandler)
 	bot.Handle(OnVideo, base.DoNothing)
-	bot.Handle(OnVoice, base.DoNothing)
-	bot.Handle(OnVideoNote, base.DoNothing)
+	bot.Handle(OnVoice, voiceHandler, whiteMiddleware)
+	bot.Handle(OnVideoNote, voiceHandler, whiteMiddleware)
 	bot.Handle(OnDocument, base.DoNothing)
 }
 
 func registerChatConfigHandler(bot *Bot) {
-	for _, v := range *config.BotConfig.ChatConfigV2 {
+	for _, v := range *config.BotConfig().ChatConfigV2 {
 		for _, tr := range v.Trigger {
 			if tr.Command != "" {
-				// 创建局部副本以避免闭包捕获循环变量
-				vCopy := v
-				trCopy := tr
-				bot.Handle("/"+trCopy.Command, func(ctx Context) error {
-					return chat.Chat(ctx, vCopy, trCopy)
-				})
+				bot.Handle("/"+tr.Command, chatCommandHandler)
 			}
 		}
 	}
 }
 
-var regexHandlers []struct {
+// chatCommandHandler finds the chat by command when called,
+// so that chats can be changed by reloading config or personas of chat
+func chatCommandHandler(ctx Context) error {
+	cmd := entities.FromMessage(ctx.Message())
+	if cmd == nil {
+		return nil
+	}
+	v2, trigger := chat.FindChatByCommand(ctx.Chat().ID, cmd.Name())
+	if v2 == nil {
+		return nil
+	}
+	return chat.Chat(ctx, v2, trigger)
+}
+
+type regexHandler struct {
 	Regex *regexp.Regexp
 	Func  func(Context) error
 }
 
+// regexHandlers are replaced as a whole when reloading
+var regexHandlers atomic.Pointer[[]regexHandler]
+
 func initChatRegexHandlers(v2 []*config.ChatConfigSingle) {
+	var handlers []regexHandler
 	for _, v := range v2 {
 		for _, tr := range v.Trigger {
 			if tr.Regex != "" {
 				vCopy := v   // 创建局部副本
 				trCopy := tr // 创建局部副本
-				regexHandlers = append(regexHandlers, struct {
-					Regex *regexp.Regexp
-					Func  func(Context) error
-				}{Regex: regexp.MustCompile(trCopy.Regex), Func: func(context Context) error {
+				handlers = append(handlers, regexHandler{Regex: regexp.MustCompile(trCopy.Regex), Func: func(context Context) error {
 					return chat.Chat(context, vCopy, trCopy)
 				}})
 			}
 		}
 	}
-
+	regexHandlers.Store(&handlers)
 }
 
 func loggerMiddleware(next HandlerFunc) HandlerFunc {
@@ -315,8 +405,8 @@ func loggerMiddleware(next HandlerFunc) HandlerFunc {
 }
 
 func skipMiddleware(next HandlerFunc) HandlerFunc {
-	skipSec := config.BotConfig.SkipDuration
 	return func(ctx Context) error {
+		skipSec := config.BotConfig().SkipDuration
 		m := ctx.Message()
 		q := ctx.Query()
 		if m == nil && q == nil {
@@ -337,11 +427,11 @@ func skipMiddleware(next HandlerFunc) HandlerFunc {
 
 func blockMiddleware(next HandlerFunc) HandlerFunc {
 	return func(ctx Context) error {
-		if ctx.Chat() != nil && config.BotConfig.BlockListConfig.Check(ctx.Chat().ID) {
+		if ctx.Chat() != nil && config.BotConfig().BlockListConfig.Check(ctx.Chat().ID) {
 			log.Info("chat ignore by block list", zap.String("chat", ctx.Chat().Title))
 			return nil
 		}
-		if ctx.Sender() != nil && config.BotConfig.BlockListConfig.Check(ctx.Sender().ID) {
+		if ctx.Sender() != nil && config.BotConfig().BlockListConfig.Check(ctx.Sender().ID) {
 			log.Info("sender ignore by block list", zap.String("user", ctx.Sender().Username))
 			return nil
 		}
@@ -393,7 +483,7 @@ func rateMiddleware(next HandlerFunc) HandlerFunc {
 
 func whiteMiddleware(next HandlerFunc) HandlerFunc {
 	return func(ctx Context) error {
-		if !config.BotConfig.WhiteListConfig.Enabled {
+		if !config.BotConfig().WhiteListConfig.Enabled {
 			return next(ctx)
 		}
 
@@ -403,7 +493,7 @@ func whiteMiddleware(next HandlerFunc) HandlerFunc {
 			return next(ctx)
 		}
 
-		if ctx.Chat() != nil && !config.BotConfig.WhiteListConfig.Check(ctx.Chat().ID) {
+		if ctx.Chat() != nil && !config.BotConfig().WhiteListConfig.Check(ctx.Chat().ID) {
 			log.Info("chat ignore by white list", zap.String("chat", ctx.Chat().Title))
 			return nil
 		}
@@ -456,25 +546,31 @@ func messagesCollectionMiddleware(next HandlerFunc) HandlerFunc {
 		if m == nil && ctx.Query() != nil {
 			return next(ctx)
 		}
-		if config.BotConfig.MeiliConfig.Enabled {
-			// 将message存入 meilisearch
-			msgJSON, err := json.Marshal(m)
-			if err != nil {
-				log.Error("[MeiliSearch] json marshal message error", zap.Error(err))
-				return next(ctx)
-			}
-			var msgMap map[string]any
-			err = json.Unmarshal(msgJSON, &msgMap)
-			if err != nil {
-				log.Error("[MeiliSearch] json unmarshal message error", zap.Error(err))
-				return next(ctx)
-			}
-			meili.AddData2Meili(msgMap, ctx.Chat().ID)
-		}
+		addMessageToMeili(m, ctx.Chat().ID)
 		return next(ctx)
 	}
 }
 
+// addMessageToMeili indexes message in meilisearch if it's enabled
+func addMessageToMeili(m *Message, chatID int64) {
+	if !config.BotConfig().MeiliConfig.Enabled {
+		return
+	}
+	// 将message存入 meilisearch
+	msgJSON, err := json.Marshal(m)
+	if err != nil {
+		log.Error("[MeiliSearch] json marshal message error", zap.Error(err))
+		return
+	}
+	var msgMap map[string]any
+	err = json.Unmarshal(msgJSON, &msgMap)
+	if err != nil {
+		log.Error("[MeiliSearch] json unmarshal message error", zap.Error(err))
+		return
+	}
+	meili.AddData2Meili(msgMap, chatID)
+}
+
 // contentFilterMiddleware 过滤消息中的内容
 func contentFilterMiddleware(next HandlerFunc) HandlerFunc {
 	return func(ctx Context) error {
@@ -528,13 +624,11 @@ func byeWorldMiddleware(next HandlerFunc) HandlerFunc {
 }
 
 func mcMiddleware(next HandlerFunc) HandlerFunc {
-	if config.BotConfig.McConfig.Mc2Dead <= 0 {
-		return func(ctx Context) error {
+	return func(ctx Context) error {
+		if config.BotConfig().McConfig.Mc2Dead <= 0 {
 			return next(ctx)
 		}
-	}
 
-	return func(ctx Context) error {
 		chat := ctx.Chat()
 		if chat == nil || (chat.Type != ChatGroup && chat.Type != ChatSuperGroup) {
 			return next(ctx)
@@ -566,7 +660,8 @@ func mcMiddleware(next HandlerFunc) HandlerFunc {
 func messageStoreMiddleware(next HandlerFunc) HandlerFunc {
 	return func(ctx Context) error {
 		m := ctx.Message()
-		if m != nil && (m.Text != "" || m.Caption != "") {
+		// album messages are stored even without caption, so that chat can gather all images of album
+		if m != nil && (m.Text != "" || m.Caption != "" || m.AlbumID != "") {
 			// 异步存储完整消息结构体到Redis
 			go func() {
 				err := orm.PushMessageToStream(m)
@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"time"
 
 	"github.com/meilisearch/meilisearch-go"
 	"go.uber.org/zap"
@@ -23,7 +24,9 @@ type resultMsg struct {
 	Text    string `json:"text"`
 	Caption string `json:"caption,omitempty"`
 	Id      int64  `json:"message_id"`
+	Date    int64  `json:"date"`
 	From    struct {
+		Username  string `json:"username"`
 		LastName  string `json:"last_name"`
 		FirstName string `json:"first_name"`
 	} `json:"from"`
@@ -52,6 +55,12 @@ func ExtractFields(hits []any) ([]map[string]string, error) {
 			"name": message.From.FirstName + message.From.LastName,
 			"id":   strconv.FormatInt(message.Id, 10),
 		}
+		if message.From.Username != "" {
+			result[i]["username"] = message.From.Username
+		}
+		if message.Date > 0 {
+			result[i]["date"] = time.Unix(message.Date, 0).Format(time.DateTime)
+		}
 		if message.Text == "" && message.Caption != "" {
 			// If text is empty, use caption as text
 			result[i]["text"] = message.Caption
@@ -81,7 +90,7 @@ func generatePaginationCommand(page int64, searchQuery string, usedChatIdParam b
 
 // SearchHandle handles search command
 func SearchHandle(ctx Context) error {
-	if config.BotConfig.MeiliConfig.Enabled {
+	if config.BotConfig().MeiliConfig.Enabled {
 		rplMsg := executeSearch(ctx)
 		err := ctx.Reply(rplMsg, ModeMarkdownV2)
 		return err
@@ -158,7 +167,7 @@ func executeSearch(ctx Context) string {
 		}
 		query = &searchQuery{
 			Query:         command.ArgAllInOneFrom(searchKeywordIdx),
-			IndexName:     config.BotConfig.MeiliConfig.IndexPrefix + strconv.FormatInt(chatId, 10),
+			IndexName:     config.BotConfig().MeiliConfig.IndexPrefix + strconv.FormatInt(chatId, 10),
 			SearchRequest: searchRequest,
 		}
 	}
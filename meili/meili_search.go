@@ -3,8 +3,11 @@ package meili
 import (
 	"csust-got/config"
 	"csust-got/log"
+	"errors"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
@@ -20,6 +23,8 @@ type searchQuery struct {
 	Query         string
 	IndexName     string
 	SearchRequest meilisearch.SearchRequest
+	// reply receives the result of this query
+	reply chan searchResult
 }
 
 type searchResult struct {
@@ -27,13 +32,14 @@ type searchResult struct {
 	Error  error
 }
 
+// ErrInvalidSearchResponse means meili returns unexpected response
+var ErrInvalidSearchResponse = errors.New("invalid search response")
+
 var (
 	// dataChan pushes data to meili search.
 	dataChan = make(chan meiliData, 100)
 	// searchChan is used to pass search queries.
 	searchChan = make(chan *searchQuery, 100)
-	// resultChan is used to pass the search results back.
-	resultChan = make(chan searchResult, 100)
 	client     meilisearch.ServiceManager
 	clientMux  sync.Mutex
 	// once init meili at bot start.
@@ -54,7 +60,7 @@ func getClient() meilisearch.ServiceManager {
 	clientMux.Lock()
 	defer clientMux.Unlock()
 	if client == nil {
-		client = meilisearch.New(config.BotConfig.MeiliConfig.HostAddr, meilisearch.WithAPIKey(config.BotConfig.MeiliConfig.ApiKey))
+		client = meilisearch.New(config.BotConfig().MeiliConfig.HostAddr, meilisearch.WithAPIKey(config.BotConfig().MeiliConfig.ApiKey))
 	}
 	return client
 }
@@ -76,7 +82,7 @@ func StartWorker() {
 		case data := <-dataChan:
 			handleAddData(data)
 		case query := <-searchChan:
-			handleSearchQuery(query.Query, query.IndexName, &query.SearchRequest)
+			handleSearchQuery(query)
 		}
 	}
 }
@@ -84,7 +90,7 @@ func StartWorker() {
 // handleAddData adds data to meili search.
 func handleAddData(data meiliData) {
 	client := getClient()
-	indexName := config.BotConfig.MeiliConfig.IndexPrefix + strconv.FormatInt(data.ChatID, 10)
+	indexName := config.BotConfig().MeiliConfig.IndexPrefix + strconv.FormatInt(data.ChatID, 10)
 	_, err := client.Index(indexName).FetchInfo()
 
 	if err != nil {
@@ -101,7 +107,7 @@ func handleAddData(data meiliData) {
 
 	getFilterOnce(indexName).Do(func() {
 		// Configure filterable attributes
-		_, err := client.Index(indexName).UpdateFilterableAttributes(&[]string{"text", "caption"})
+		_, err := client.Index(indexName).UpdateFilterableAttributes(&[]string{"text", "caption", "from.id", "date"})
 		if err != nil {
 			log.Error("[MeiliSearch]: update filterable attributes failed", zap.Error(err), zap.String("index", indexName))
 		} else {
@@ -117,23 +123,17 @@ func handleAddData(data meiliData) {
 	log.Debug("[MeiliSearch]: add data to index success", zap.Any("data", data.Data))
 }
 
-// handleSearchQuery searches the query and sends results back through the resultChan.
-func handleSearchQuery(query string, indexName string, searchRequest *meilisearch.SearchRequest) {
+// handleSearchQuery searches the query and sends results back through its reply channel.
+func handleSearchQuery(query *searchQuery) {
 	client := getClient()
 
-	if searchRequest == nil {
-		searchRequest = &meilisearch.SearchRequest{
-			Limit: 10,
-		}
-	}
-
-	searchResp, err := client.Index(indexName).Search(query, searchRequest)
+	searchResp, err := client.Index(query.IndexName).Search(query.Query, &query.SearchRequest)
 	if err != nil {
-		resultChan <- searchResult{Result: nil, Error: err}
+		query.reply <- searchResult{Result: nil, Error: err}
 		return
 	}
 
-	resultChan <- searchResult{Result: searchResp, Error: nil}
+	query.reply <- searchResult{Result: searchResp, Error: nil}
 }
 
 // AddData2Meili adds data to meili search.
@@ -143,7 +143,55 @@ func AddData2Meili(data map[string]any, chatID int64) {
 
 // SearchMeili performs a search query and returns results or error.
 func SearchMeili(query *searchQuery) (any, error) {
+	// every query has its own reply channel, so that concurrent searches don't take results of each other
+	query.reply = make(chan searchResult, 1)
 	searchChan <- query
-	result := <-resultChan
+	result := <-query.reply
 	return result.Result, result.Error
 }
+
+// MessageFilter filters messages by sender and time, zero fields are ignored
+type MessageFilter struct {
+	SenderID int64
+	// Since is inclusive, Until is exclusive
+	Since time.Time
+	Until time.Time
+}
+
+// expr returns the meili filter expression
+func (f MessageFilter) expr() string {
+	// filter out command messages
+	exprs := []string{"text NOT STARTS WITH '/'", "caption NOT STARTS WITH '/'"}
+	if f.SenderID != 0 {
+		exprs = append(exprs, "from.id = "+strconv.FormatInt(f.SenderID, 10))
+	}
+	if !f.Since.IsZero() {
+		exprs = append(exprs, "date >= "+strconv.FormatInt(f.Since.Unix(), 10))
+	}
+	if !f.Until.IsZero() {
+		exprs = append(exprs, "date < "+strconv.FormatInt(f.Until.Unix(), 10))
+	}
+	return strings.Join(exprs, " AND ")
+}
+
+// SearchMessages searches text messages in chat which match filter, returns at most limit messages
+func SearchMessages(chatID int64, keyword string, filter MessageFilter, limit int64) ([]map[string]string, error) {
+	query := &searchQuery{
+		Query:     keyword,
+		IndexName: config.BotConfig().MeiliConfig.IndexPrefix + strconv.FormatInt(chatID, 10),
+		SearchRequest: meilisearch.SearchRequest{
+			Limit:                limit,
+			Filter:               filter.expr(),
+			AttributesToSearchOn: []string{"text", "caption"},
+		},
+	}
+	result, err := SearchMeili(query)
+	if err != nil {
+		return nil, err
+	}
+	resp, ok := result.(*meilisearch.SearchResponse)
+	if !ok {
+		return nil, ErrInvalidSearchResponse
+	}
+	return ExtractFields(resp.Hits)
+}
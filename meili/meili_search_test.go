@@ -0,0 +1,20 @@
+package meili
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageFilterExpr(t *testing.T) {
+	commands := "text NOT STARTS WITH '/' AND caption NOT STARTS WITH '/'"
+	assert.Equal(t, commands, MessageFilter{}.expr())
+
+	f := MessageFilter{
+		SenderID: 42,
+		Since:    time.Unix(1700000000, 0),
+		Until:    time.Unix(1700086400, 0),
+	}
+	assert.Equal(t, commands+" AND from.id = 42 AND date >= 1700000000 AND date < 1700086400", f.expr())
+}
@@ -0,0 +1,59 @@
+package orm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"csust-got/log"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+)
+
+// chatAnswerTTL is how long the buttons on a chat answer keep working
+const chatAnswerTTL = 24 * time.Hour
+
+// ChatAnswer is the request of a chat answer, used to regenerate or continue the answer
+type ChatAnswer struct {
+	Name     string                         `json:"name"`             // name of the chat config
+	UserID   int64                          `json:"user_id"`          // user who triggered the chat
+	ReplyTo  int                            `json:"reply_to"`         // message which the answer replied to
+	Messages []openai.ChatCompletionMessage `json:"messages"`         // messages sent to the model, without images
+	Images   []string                       `json:"images,omitempty"` // file ids of images in messages
+	Answer   string                         `json:"answer"`
+}
+
+// SetChatAnswer saves the request of the answer message
+func SetChatAnswer(chatID int64, msgID int, answer *ChatAnswer) error {
+	answerJSON, err := json.Marshal(answer)
+	if err != nil {
+		log.Error("marshal chat answer failed", zap.Int64("chat", chatID), zap.Int("msg", msgID), zap.Error(err))
+		return err
+	}
+	err = rc.Set(context.TODO(), wrapKeyWithChatMsg("chat_answer", chatID, msgID), answerJSON, chatAnswerTTL).Err()
+	if err != nil {
+		log.Error("set chat answer to redis failed", zap.Int64("chat", chatID), zap.Int("msg", msgID), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// GetChatAnswer gets the request of the answer message
+func GetChatAnswer(chatID int64, msgID int) (*ChatAnswer, error) {
+	answerJSON, err := rc.Get(context.TODO(), wrapKeyWithChatMsg("chat_answer", chatID, msgID)).Result()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Error("get chat answer from redis failed", zap.Int64("chat", chatID), zap.Int("msg", msgID), zap.Error(err))
+		}
+		return nil, err
+	}
+	answer := &ChatAnswer{}
+	if err = json.Unmarshal([]byte(answerJSON), answer); err != nil {
+		log.Error("unmarshal chat answer failed", zap.Int64("chat", chatID), zap.Int("msg", msgID), zap.Error(err))
+		return nil, err
+	}
+	return answer, nil
+}
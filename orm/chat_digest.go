@@ -0,0 +1,64 @@
+package orm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"csust-got/log"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// ChatDigest is the setting of daily digest of a chat.
+type ChatDigest struct {
+	// Time is the time of day to post digest, in `15:04` format
+	Time string `json:"time"`
+	// Repeat is the schedule rule of the digest task
+	Repeat    string `json:"repeat"`
+	UpdatedBy int64  `json:"updated_by"`
+	// UpdatedAt is also SetTime of the digest task, tasks set before are outdated
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+// SetChatDigest saves daily digest setting of chat
+func SetChatDigest(chatID int64, digest *ChatDigest) error {
+	digestJSON, err := json.Marshal(digest)
+	if err != nil {
+		log.Error("marshal chat digest failed", zap.Int64("chat", chatID), zap.Error(err))
+		return err
+	}
+	err = rc.Set(context.TODO(), wrapKeyWithChat("chat_digest", chatID), digestJSON, 0).Err()
+	if err != nil {
+		log.Error("set chat digest to redis failed", zap.Int64("chat", chatID), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// GetChatDigest gets daily digest setting of chat, returns redis.Nil if not set
+func GetChatDigest(chatID int64) (*ChatDigest, error) {
+	digestJSON, err := rc.Get(context.TODO(), wrapKeyWithChat("chat_digest", chatID)).Result()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Error("get chat digest from redis failed", zap.Int64("chat", chatID), zap.Error(err))
+		}
+		return nil, err
+	}
+	digest := &ChatDigest{}
+	if err = json.Unmarshal([]byte(digestJSON), digest); err != nil {
+		log.Error("unmarshal chat digest failed", zap.Int64("chat", chatID), zap.Error(err))
+		return nil, err
+	}
+	return digest, nil
+}
+
+// DelChatDigest disables daily digest of chat
+func DelChatDigest(chatID int64) error {
+	err := rc.Del(context.TODO(), wrapKeyWithChat("chat_digest", chatID)).Err()
+	if err != nil {
+		log.Error("delete chat digest from redis failed", zap.Int64("chat", chatID), zap.Error(err))
+	}
+	return err
+}
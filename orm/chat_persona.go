@@ -0,0 +1,90 @@
+package orm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"csust-got/log"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// ChatPersona overrides a chat config in config file for a telegram chat.
+// If Name is same as Base, it overrides the chat config, otherwise it's a new persona triggered by Command.
+type ChatPersona struct {
+	Name           string   `json:"name"`
+	Base           string   `json:"base"` // name of chat config in config file
+	Command        string   `json:"command,omitempty"`
+	SystemPrompt   *string  `json:"system_prompt,omitempty"`
+	PromptTemplate *string  `json:"prompt_template,omitempty"`
+	Temperature    *float32 `json:"temperature,omitempty"`
+	UpdatedBy      int64    `json:"updated_by"`
+	UpdatedAt      int64    `json:"updated_at"`
+}
+
+// SetChatPersona saves persona of chat
+func SetChatPersona(chatID int64, persona *ChatPersona) error {
+	personaJSON, err := json.Marshal(persona)
+	if err != nil {
+		log.Error("marshal chat persona failed", zap.Int64("chat", chatID), zap.String("name", persona.Name), zap.Error(err))
+		return err
+	}
+	err = rc.HSet(context.TODO(), wrapKeyWithChat("chat_persona", chatID), persona.Name, personaJSON).Err()
+	if err != nil {
+		log.Error("set chat persona to redis failed", zap.Int64("chat", chatID), zap.String("name", persona.Name), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// GetChatPersona gets persona of chat by name, returns redis.Nil if not exists
+func GetChatPersona(chatID int64, name string) (*ChatPersona, error) {
+	personaJSON, err := rc.HGet(context.TODO(), wrapKeyWithChat("chat_persona", chatID), name).Result()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Error("get chat persona from redis failed", zap.Int64("chat", chatID), zap.String("name", name), zap.Error(err))
+		}
+		return nil, err
+	}
+	persona := &ChatPersona{}
+	if err = json.Unmarshal([]byte(personaJSON), persona); err != nil {
+		log.Error("unmarshal chat persona failed", zap.Int64("chat", chatID), zap.String("name", name), zap.Error(err))
+		return nil, err
+	}
+	return persona, nil
+}
+
+// GetChatPersonas gets all personas of chat, sorted by name
+func GetChatPersonas(chatID int64) ([]*ChatPersona, error) {
+	m, err := rc.HGetAll(context.TODO(), wrapKeyWithChat("chat_persona", chatID)).Result()
+	if err != nil {
+		log.Error("get chat personas from redis failed", zap.Int64("chat", chatID), zap.Error(err))
+		return nil, err
+	}
+	personas := make([]*ChatPersona, 0, len(m))
+	for name, personaJSON := range m {
+		persona := &ChatPersona{}
+		if err := json.Unmarshal([]byte(personaJSON), persona); err != nil {
+			log.Warn("unmarshal chat persona failed", zap.Int64("chat", chatID), zap.String("name", name), zap.Error(err))
+			continue
+		}
+		personas = append(personas, persona)
+	}
+	sort.Slice(personas, func(i, j int) bool {
+		return personas[i].Name < personas[j].Name
+	})
+	return personas, nil
+}
+
+// DelChatPersona deletes persona of chat, returns false if not exists
+func DelChatPersona(chatID int64, name string) (bool, error) {
+	n, err := rc.HDel(context.TODO(), wrapKeyWithChat("chat_persona", chatID), name).Result()
+	if err != nil {
+		log.Error("delete chat persona failed", zap.Int64("chat", chatID), zap.String("name", name), zap.Error(err))
+		return false, err
+	}
+	return n > 0, nil
+}
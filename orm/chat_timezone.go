@@ -0,0 +1,48 @@
+package orm
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"csust-got/log"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// SetChatTimezone saves the time zone name of chat, such as `Asia/Shanghai`
+func SetChatTimezone(chatID int64, tz string) error {
+	err := rc.Set(context.TODO(), wrapKeyWithChat("chat_timezone", chatID), tz, 0).Err()
+	if err != nil {
+		log.Error("set chat timezone to redis failed", zap.Int64("chat", chatID), zap.Error(err))
+	}
+	return err
+}
+
+// GetChatTimezone gets the time zone name of chat, empty if not set
+func GetChatTimezone(chatID int64) string {
+	tz, err := rc.Get(context.TODO(), wrapKeyWithChat("chat_timezone", chatID)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		log.Error("get chat timezone from redis failed", zap.Int64("chat", chatID), zap.Error(err))
+	}
+	return tz
+}
+
+// GetChatLocation returns the time zone of chat, local time zone of bot if not set
+func GetChatLocation(chatID int64) *time.Location {
+	return loadLocation(GetChatTimezone(chatID))
+}
+
+// loadLocation loads time zone by name, returns local time zone of bot if tz is empty or invalid
+func loadLocation(tz string) *time.Location {
+	if tz == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		log.Warn("load time zone failed", zap.String("tz", tz), zap.Error(err))
+		return time.Local
+	}
+	return loc
+}
@@ -0,0 +1,186 @@
+package orm
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"csust-got/log"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// llmUsageTTL is how long daily usage records are kept
+const llmUsageTTL = 90 * 24 * time.Hour
+
+// LLMUsage is the token usage of llm requests
+type LLMUsage struct {
+	Requests         int64
+	PromptTokens     int64
+	CompletionTokens int64
+	ToolCallTokens   int64 // tokens spent in the rounds which call tools, already included in prompt and completion
+}
+
+// Total returns the total tokens
+func (u *LLMUsage) Total() int64 {
+	return u.PromptTokens + u.CompletionTokens
+}
+
+// Add adds other usage to u
+func (u *LLMUsage) Add(other *LLMUsage) {
+	u.Requests += other.Requests
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+	u.ToolCallTokens += other.ToolCallTokens
+}
+
+func (u *LLMUsage) fields() map[string]int64 {
+	return map[string]int64{
+		"requests":   u.Requests,
+		"prompt":     u.PromptTokens,
+		"completion": u.CompletionTokens,
+		"tool":       u.ToolCallTokens,
+	}
+}
+
+func (u *LLMUsage) setField(name string, v int64) {
+	switch name {
+	case "requests":
+		u.Requests = v
+	case "prompt":
+		u.PromptTokens = v
+	case "completion":
+		u.CompletionTokens = v
+	case "tool":
+		u.ToolCallTokens = v
+	}
+}
+
+// ModelUsages is the usage of each model
+type ModelUsages map[string]*LLMUsage
+
+// Sum returns the usage of all models
+func (m ModelUsages) Sum() *LLMUsage {
+	sum := &LLMUsage{}
+	for _, u := range m {
+		sum.Add(u)
+	}
+	return sum
+}
+
+func usageDay(day time.Time) string {
+	return day.Format("20060102")
+}
+
+// AddLLMUsage records usage of model in chat by user, totals of user, chat and chat member are updated.
+func AddLLMUsage(chatID, userID int64, model string, usage *LLMUsage, day time.Time) error {
+	d := usageDay(day)
+	keys := []string{
+		wrapKeyWithUser("llm_usage:"+d, userID),
+		wrapKeyWithChat("llm_usage:"+d, chatID),
+		wrapKeyWithChatMember("llm_usage:"+d, chatID, userID),
+	}
+
+	pipe := rc.TxPipeline()
+	for _, key := range keys {
+		for name, v := range usage.fields() {
+			if v != 0 {
+				pipe.HIncrBy(context.TODO(), key, model+":"+name, v)
+			}
+		}
+		pipe.Expire(context.TODO(), key, llmUsageTTL)
+	}
+	if _, err := pipe.Exec(context.TODO()); err != nil {
+		log.Error("add llm usage failed", zap.Int64("chat", chatID), zap.Int64("user", userID),
+			zap.String("model", model), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+func getLLMUsage(key string) (ModelUsages, error) {
+	res, err := rc.HGetAll(context.TODO(), key).Result()
+	if err != nil {
+		log.Error("get llm usage failed", zap.String("key", key), zap.Error(err))
+		return nil, err
+	}
+
+	usages := make(ModelUsages)
+	for field, value := range res {
+		idx := strings.LastIndex(field, ":")
+		if idx < 0 {
+			continue
+		}
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			log.Warn("invalid llm usage value", zap.String("key", key), zap.String("field", field), zap.String("value", value))
+			continue
+		}
+		model := field[:idx]
+		if usages[model] == nil {
+			usages[model] = &LLMUsage{}
+		}
+		usages[model].setField(field[idx+1:], v)
+	}
+	return usages, nil
+}
+
+// GetUserLLMUsage returns usage of user in all chats at the day
+func GetUserLLMUsage(userID int64, day time.Time) (ModelUsages, error) {
+	return getLLMUsage(wrapKeyWithUser("llm_usage:"+usageDay(day), userID))
+}
+
+// GetChatLLMUsage returns usage of all members in chat at the day
+func GetChatLLMUsage(chatID int64, day time.Time) (ModelUsages, error) {
+	return getLLMUsage(wrapKeyWithChat("llm_usage:"+usageDay(day), chatID))
+}
+
+// GetChatMemberLLMUsage returns usage of user in chat at the day
+func GetChatMemberLLMUsage(chatID, userID int64, day time.Time) (ModelUsages, error) {
+	return getLLMUsage(wrapKeyWithChatMember("llm_usage:"+usageDay(day), chatID, userID))
+}
+
+// SetLLMQuota sets the daily token quota of user in chat,
+// userID 0 means the default quota of every member, quota <= 0 means unlimited.
+// Unlimited quota of user is kept, so that the default quota doesn't apply to the user.
+func SetLLMQuota(chatID, userID int64, quota int64) error {
+	if quota <= 0 && userID == 0 {
+		return ResetLLMQuota(chatID, userID)
+	}
+	err := rc.Set(context.TODO(), wrapKeyWithChatMember("llm_quota", chatID, userID), max(quota, 0), 0).Err()
+	if err != nil {
+		log.Error("set llm quota failed", zap.Int64("chat", chatID), zap.Int64("user", userID), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// ResetLLMQuota removes the daily token quota of user in chat, the default quota of chat applies to the user then.
+// userID 0 removes the default quota.
+func ResetLLMQuota(chatID, userID int64) error {
+	err := rc.Del(context.TODO(), wrapKeyWithChatMember("llm_quota", chatID, userID)).Err()
+	if err != nil {
+		log.Error("reset llm quota failed", zap.Int64("chat", chatID), zap.Int64("user", userID), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// GetLLMQuota returns the daily token quota of user in chat,
+// the quota of user overrides the default quota of chat, 0 means unlimited.
+func GetLLMQuota(chatID, userID int64) (int64, error) {
+	for _, uid := range []int64{userID, 0} {
+		quota, err := rc.Get(context.TODO(), wrapKeyWithChatMember("llm_quota", chatID, uid)).Int64()
+		if err == nil {
+			return quota, nil
+		}
+		if !errors.Is(err, redis.Nil) {
+			log.Error("get llm quota failed", zap.Int64("chat", chatID), zap.Int64("user", uid), zap.Error(err))
+			return 0, err
+		}
+	}
+	return 0, nil
+}
@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"time"
 
+	"csust-got/config"
 	"csust-got/log"
 
 	"github.com/redis/go-redis/v9"
@@ -44,6 +45,7 @@ func PushMessageToStream(msg *Message) error {
 	}
 
 	key := wrapKeyWithChat("message_stream", msg.Chat.ID)
+	maxLen, ttl := config.BotConfig().MessageStream.Retention(msg.Chat.ID)
 
 	// 序列化消息对象为JSON
 	jsonData, err := json.Marshal(msg)
@@ -54,7 +56,7 @@ func PushMessageToStream(msg *Message) error {
 
 	resp := rc.XAdd(context.TODO(), &redis.XAddArgs{
 		Stream: key,
-		MaxLen: 1000,
+		MaxLen: maxLen,
 		Approx: true,
 		ID:     strconv.Itoa(msg.ID),
 		Values: []any{"message", jsonData},
@@ -63,7 +65,7 @@ func PushMessageToStream(msg *Message) error {
 		log.Error("push message to redis stream failed", zap.Int64("chat", msg.Chat.ID), zap.Int("message", msg.ID), zap.Error(resp.Err()))
 		return resp.Err()
 	}
-	_ = rc.Expire(context.TODO(), key, 24*time.Hour)
+	_ = rc.Expire(context.TODO(), key, ttl)
 	return nil
 }
 
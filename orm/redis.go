@@ -27,13 +27,13 @@ func InitRedis() {
 // NewClient new redis client.
 func NewClient() *redis.Client {
 	return redis.NewClient(&redis.Options{
-		Addr:     config.BotConfig.RedisConfig.RedisAddr,
-		Password: config.BotConfig.RedisConfig.RedisPass,
+		Addr:     config.BotConfig().RedisConfig.RedisAddr,
+		Password: config.BotConfig().RedisConfig.RedisPass,
 	})
 }
 
 func wrapKey(key string) string {
-	return config.BotConfig.RedisConfig.KeyPrefix + key
+	return config.BotConfig().RedisConfig.KeyPrefix + key
 }
 
 func wrapKeyWithChat(key string, chatID int64) string {
@@ -69,18 +69,18 @@ func loadSpecialList(key string) []string {
 	return list
 }
 
-// LoadWhiteList load white list.
-func LoadWhiteList() {
+// LoadWhiteList load white list into c, c should not be in use.
+func LoadWhiteList(c *config.Config) {
 	chats := util.StringsToInts(loadSpecialList("white_list"))
-	config.BotConfig.WhiteListConfig.Chats = append(config.BotConfig.WhiteListConfig.Chats, chats...)
-	log.Info("White List has load.", zap.Int("length", len(config.BotConfig.WhiteListConfig.Chats)))
+	c.WhiteListConfig.Chats = append(c.WhiteListConfig.Chats, chats...)
+	log.Info("White List has load.", zap.Int("length", len(c.WhiteListConfig.Chats)))
 }
 
-// LoadBlockList load black list.
-func LoadBlockList() {
+// LoadBlockList load black list into c, c should not be in use.
+func LoadBlockList(c *config.Config) {
 	chats := util.StringsToInts(loadSpecialList("black_list"))
-	config.BotConfig.BlockListConfig.Chats = append(config.BotConfig.BlockListConfig.Chats, chats...)
-	log.Info("Block List has load.", zap.Int("length", len(config.BotConfig.BlockListConfig.Chats)))
+	c.BlockListConfig.Chats = append(c.BlockListConfig.Chats, chats...)
+	log.Info("Block List has load.", zap.Int("length", len(c.BlockListConfig.Chats)))
 }
 
 // IsNoStickerMode check group in NoSticker mode.
@@ -228,7 +228,7 @@ func GetHitokoto(from bool) string {
 	res, err := rc.SRandMember(context.TODO(), wrapKey("hitokoto")).Result()
 	if err != nil {
 		log.Error("get hitokoto from redis failed", zap.Error(err))
-		return config.BotConfig.MessageConfig.HitokotoNotFound
+		return config.BotConfig().MessageConfig.HitokotoNotFound
 	}
 	if !from {
 		res = res[:strings.LastIndex(res, " by ")+1]
@@ -710,8 +710,8 @@ func KeepByeWorldDuration(chatID int64, userID int64) {
 // McRaiseSoul raise a soul to chips area.
 // return true if endgame, and get all souls in the area.
 func McRaiseSoul(chatID int64, userID int64) (endgame bool, souls []string, err error) {
-	expireTime := time.Duration(config.BotConfig.McConfig.Timout) * time.Second
-	maxCount := config.BotConfig.McConfig.Mc2Dead
+	expireTime := time.Duration(config.BotConfig().McConfig.Timout) * time.Second
+	maxCount := config.BotConfig().McConfig.Mc2Dead
 
 	rKey := wrapKeyWithChat("mc_souls", chatID)
 
@@ -800,7 +800,7 @@ func IsPrayerInPost(chatID int64, userID int64) (bool, error) {
 func SetPrayer(chatID int64, userID int64) error {
 	prayerKey := wrapKeyWithChatMember("mc_prayer", chatID, userID)
 
-	err := rc.Set(context.TODO(), prayerKey, config.BotConfig.McConfig.Odds, 0).Err()
+	err := rc.Set(context.TODO(), prayerKey, config.BotConfig().McConfig.Odds, 0).Err()
 	if err != nil {
 		log.Error("set mc_prayer failed", zap.Int64("chat", chatID), zap.Int64("user", userID), zap.Error(err))
 		return err
@@ -0,0 +1,41 @@
+package orm
+
+import (
+	"context"
+
+	"csust-got/log"
+
+	"go.uber.org/zap"
+)
+
+// SetSDJob saves stable diffusion job which is queued or running.
+func SetSDJob(id string, job string) error {
+	err := rc.HSet(context.TODO(), wrapKey("stable_diffusion_jobs"), id, job).Err()
+	if err != nil {
+		log.Error("set stable diffusion job to redis failed", zap.String("id", id), zap.Error(err))
+	}
+	return err
+}
+
+// DelSDJob deletes stable diffusion job which is finished or cancelled.
+func DelSDJob(id string) error {
+	err := rc.HDel(context.TODO(), wrapKey("stable_diffusion_jobs"), id).Err()
+	if err != nil {
+		log.Error("delete stable diffusion job from redis failed", zap.String("id", id), zap.Error(err))
+	}
+	return err
+}
+
+// GetSDJobs gets all saved stable diffusion jobs.
+func GetSDJobs() ([]string, error) {
+	m, err := rc.HGetAll(context.TODO(), wrapKey("stable_diffusion_jobs")).Result()
+	if err != nil {
+		log.Error("get stable diffusion jobs from redis failed", zap.Error(err))
+		return nil, err
+	}
+	jobs := make([]string, 0, len(m))
+	for _, job := range m {
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
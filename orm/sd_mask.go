@@ -0,0 +1,33 @@
+package orm
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"csust-got/log"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// sdMaskTTL is how long a mask message can be used for inpainting
+const sdMaskTTL = 24 * time.Hour
+
+// SetSDMaskSource saves the source image of mask message, which is a sticker or photo replying to a photo.
+func SetSDMaskSource(chatID int64, msgID int, source string) error {
+	err := rc.Set(context.TODO(), wrapKeyWithChatMsg("stable_diffusion_mask", chatID, msgID), source, sdMaskTTL).Err()
+	if err != nil {
+		log.Error("set stable diffusion mask source to redis failed", zap.Int64("chat", chatID), zap.Int("msg", msgID), zap.Error(err))
+	}
+	return err
+}
+
+// GetSDMaskSource gets the source image of mask message, returns redis.Nil if it's not a mask.
+func GetSDMaskSource(chatID int64, msgID int) (string, error) {
+	source, err := rc.Get(context.TODO(), wrapKeyWithChatMsg("stable_diffusion_mask", chatID, msgID)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		log.Error("get stable diffusion mask source from redis failed", zap.Int64("chat", chatID), zap.Int("msg", msgID), zap.Error(err))
+	}
+	return source, err
+}
@@ -0,0 +1,83 @@
+package orm
+
+import (
+	"context"
+	"errors"
+
+	"csust-got/log"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// SetSDPreset saves named stable diffusion preset of user.
+func SetSDPreset(userID int64, name string, preset string) error {
+	err := rc.HSet(context.TODO(), wrapKeyWithUser("stable_diffusion_presets", userID), name, preset).Err()
+	if err != nil {
+		log.Error("set stable diffusion preset to redis failed", zap.Int64("user", userID), zap.String("name", name), zap.Error(err))
+	}
+	return err
+}
+
+// GetSDPreset gets named stable diffusion preset of user, returns redis.Nil if not exists.
+func GetSDPreset(userID int64, name string) (string, error) {
+	preset, err := rc.HGet(context.TODO(), wrapKeyWithUser("stable_diffusion_presets", userID), name).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		log.Error("get stable diffusion preset from redis failed", zap.Int64("user", userID), zap.String("name", name), zap.Error(err))
+	}
+	return preset, err
+}
+
+// GetSDPresets gets all stable diffusion presets of user, by name.
+func GetSDPresets(userID int64) (map[string]string, error) {
+	presets, err := rc.HGetAll(context.TODO(), wrapKeyWithUser("stable_diffusion_presets", userID)).Result()
+	if err != nil {
+		log.Error("get stable diffusion presets from redis failed", zap.Int64("user", userID), zap.Error(err))
+	}
+	return presets, err
+}
+
+// DelSDPreset deletes named stable diffusion preset of user, reports whether it existed.
+func DelSDPreset(userID int64, name string) (bool, error) {
+	n, err := rc.HDel(context.TODO(), wrapKeyWithUser("stable_diffusion_presets", userID), name).Result()
+	if err != nil {
+		log.Error("delete stable diffusion preset from redis failed", zap.Int64("user", userID), zap.String("name", name), zap.Error(err))
+	}
+	return n > 0, err
+}
+
+// SetSDStyle saves stable diffusion style published to chat.
+func SetSDStyle(chatID int64, name string, style string) error {
+	err := rc.HSet(context.TODO(), wrapKeyWithChat("stable_diffusion_styles", chatID), name, style).Err()
+	if err != nil {
+		log.Error("set stable diffusion style to redis failed", zap.Int64("chat", chatID), zap.String("name", name), zap.Error(err))
+	}
+	return err
+}
+
+// GetSDStyle gets stable diffusion style published to chat, returns redis.Nil if not exists.
+func GetSDStyle(chatID int64, name string) (string, error) {
+	style, err := rc.HGet(context.TODO(), wrapKeyWithChat("stable_diffusion_styles", chatID), name).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		log.Error("get stable diffusion style from redis failed", zap.Int64("chat", chatID), zap.String("name", name), zap.Error(err))
+	}
+	return style, err
+}
+
+// GetSDStyles gets all stable diffusion styles published to chat, by name.
+func GetSDStyles(chatID int64) (map[string]string, error) {
+	styles, err := rc.HGetAll(context.TODO(), wrapKeyWithChat("stable_diffusion_styles", chatID)).Result()
+	if err != nil {
+		log.Error("get stable diffusion styles from redis failed", zap.Int64("chat", chatID), zap.Error(err))
+	}
+	return styles, err
+}
+
+// DelSDStyle deletes stable diffusion style published to chat.
+func DelSDStyle(chatID int64, name string) error {
+	err := rc.HDel(context.TODO(), wrapKeyWithChat("stable_diffusion_styles", chatID), name).Err()
+	if err != nil {
+		log.Error("delete stable diffusion style from redis failed", zap.Int64("chat", chatID), zap.String("name", name), zap.Error(err))
+	}
+	return err
+}
@@ -0,0 +1,36 @@
+package orm
+
+import (
+	"context"
+
+	"csust-got/log"
+
+	"go.uber.org/zap"
+)
+
+// SetSDPoolServer adds stable diffusion server to pool, or changes url of it.
+func SetSDPoolServer(name string, url string) error {
+	err := rc.HSet(context.TODO(), wrapKey("stable_diffusion::servers"), name, url).Err()
+	if err != nil {
+		log.Error("set stable diffusion pool server to redis failed", zap.String("name", name), zap.Error(err))
+	}
+	return err
+}
+
+// DelSDPoolServer removes stable diffusion server from pool, reports whether it existed.
+func DelSDPoolServer(name string) (bool, error) {
+	n, err := rc.HDel(context.TODO(), wrapKey("stable_diffusion::servers"), name).Result()
+	if err != nil {
+		log.Error("delete stable diffusion pool server from redis failed", zap.String("name", name), zap.Error(err))
+	}
+	return n > 0, err
+}
+
+// GetSDPoolServers gets urls of stable diffusion servers in pool, by name.
+func GetSDPoolServers() (map[string]string, error) {
+	servers, err := rc.HGetAll(context.TODO(), wrapKey("stable_diffusion::servers")).Result()
+	if err != nil {
+		log.Error("get stable diffusion pool servers from redis failed", zap.Error(err))
+	}
+	return servers, err
+}
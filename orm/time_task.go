@@ -6,6 +6,8 @@ import (
 	"csust-got/util"
 	"encoding/json"
 	"errors"
+	"math"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
@@ -28,6 +30,8 @@ func TimeTaskKey() string {
 
 // Task is a struct stores the task info.
 type Task struct {
+	// ID is the stable id of task, it's kept by all runs of recurring task. Tasks added by old versions have no id.
+	ID     string `json:"id,omitempty"`
 	User   string `json:"u"`
 	UserId int64  `json:"uid"`
 	ChatId int64  `json:"cid"`
@@ -37,6 +41,38 @@ type Task struct {
 	ExecTime int64 `json:"et"`
 	// SetTime is the time when the task is added, MilliSecond and UTC.
 	SetTime int64 `json:"st"`
+
+	// Kind is the kind of task, empty means a reminder.
+	Kind string `json:"k,omitempty"`
+	// Repeat is the schedule rule of recurring task, see util.ParseSchedule. Empty means one-shot task.
+	Repeat string `json:"r,omitempty"`
+	// TZ is the time zone which Repeat is evaluated in, empty means local time zone of bot.
+	TZ string `json:"tz,omitempty"`
+}
+
+// Location returns the time zone of task.
+func (t *Task) Location() *time.Location {
+	return loadLocation(t.TZ)
+}
+
+// NextRun returns the next run of recurring task after now, ExecTime of the returned task is set to the next time.
+func (t *Task) NextRun(now time.Time) (*Task, error) {
+	schedule, err := util.ParseSchedule(t.Repeat)
+	if err != nil {
+		return nil, err
+	}
+	// the task may be run a little earlier than ExecTime, don't run it twice
+	after := time.UnixMilli(t.ExecTime)
+	if now.After(after) {
+		after = now
+	}
+	next := schedule.Next(after.In(t.Location()))
+	if next.IsZero() {
+		return nil, ErrNoTask
+	}
+	task := *t
+	task.ExecTime = next.UnixMilli()
+	return &task, nil
 }
 
 // TaskNonced is Task with nonce.
@@ -62,6 +98,16 @@ func NewTaskNonced(t *Task) *TaskNonced {
 	}
 }
 
+// Raw returns the serialized task, which is the member of task in redis.
+func (t *TaskNonced) Raw() (string, error) {
+	value, err := json.Marshal(t)
+	if err != nil {
+		log.Error("json marshal failed", zap.Error(err), zap.Any("task", t))
+		return "", err
+	}
+	return string(value), nil
+}
+
 // AddTasks adds tasks to redis.
 func AddTasks(tasks ...*TaskNonced) error {
 	if len(tasks) == 0 {
@@ -70,14 +116,13 @@ func AddTasks(tasks ...*TaskNonced) error {
 
 	zs := make([]redis.Z, 0, len(tasks))
 	for _, t := range tasks {
-		value, err := json.Marshal(t)
+		value, err := t.Raw()
 		if err != nil {
-			log.Error("json marshal failed", zap.Error(err), zap.Any("task", t))
 			return err
 		}
 		zs = append(zs, redis.Z{
 			Score:  float64(t.ExecTime),
-			Member: string(value),
+			Member: value,
 		})
 	}
 
@@ -165,3 +210,108 @@ func DeleteTasks(raws ...string) error {
 	}
 	return rc.ZRem(context.TODO(), TimeTaskKey(), is...).Err()
 }
+
+// ReplaceTask replaces task old with next in a transaction, old is the raw task in redis, empty if none.
+// It returns the raw string of next.
+func ReplaceTask(old string, next *TaskNonced) (string, error) {
+	value, err := next.Raw()
+	if err != nil {
+		return "", err
+	}
+	_, err = rc.TxPipelined(context.TODO(), func(pipe redis.Pipeliner) error {
+		if old != "" {
+			pipe.ZRem(context.TODO(), TimeTaskKey(), old)
+		}
+		pipe.ZAdd(context.TODO(), TimeTaskKey(), redis.Z{Score: float64(next.ExecTime), Member: value})
+		return nil
+	})
+	if err != nil {
+		log.Error("replace task failed", zap.String("id", next.ID), zap.Error(err))
+		return "", err
+	}
+	return value, nil
+}
+
+// DedupRecurringTasks keeps only the latest run of every recurring task in redis,
+// duplicated runs may be left by old versions. It returns count of deleted runs.
+func DedupRecurringTasks() (int, error) {
+	tasks, err := QueryTasks(0, math.MaxInt64)
+	if err != nil {
+		return 0, err
+	}
+	latest := make(map[string]*RawTask)
+	var stale []string
+	for _, t := range tasks {
+		if t.ID == "" || t.Repeat == "" {
+			continue
+		}
+		// tasks are ordered by exec time
+		if old, ok := latest[t.ID]; ok {
+			stale = append(stale, old.Raw)
+		}
+		latest[t.ID] = t
+	}
+	if err = DeleteTasks(stale...); err != nil {
+		log.Error("delete duplicated recurring tasks failed", zap.Error(err))
+		return 0, err
+	}
+	return len(stale), nil
+}
+
+// DeleteTaskByID deletes the task with id from redis, returns the deleted task, or ErrNoTask if not found.
+func DeleteTaskByID(id string) (*Task, error) {
+	tasks, err := QueryTasks(0, math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+	var found *Task
+	var raws []string
+	for _, t := range tasks {
+		if t.ID == id {
+			found = &t.Task
+			raws = append(raws, t.Raw)
+		}
+	}
+	if found == nil {
+		return nil, ErrNoTask
+	}
+	if err = DeleteTasks(raws...); err != nil {
+		log.Error("delete task failed", zap.String("id", id), zap.Error(err))
+		return nil, err
+	}
+	return found, nil
+}
+
+// firedTaskTTL is how long a fired task is kept, so that it can be snoozed
+const firedTaskTTL = 24 * time.Hour
+
+// SetFiredTask saves the task which has just fired
+func SetFiredTask(task *Task) error {
+	taskJSON, err := json.Marshal(task)
+	if err != nil {
+		log.Error("json marshal failed", zap.Error(err), zap.Any("task", task))
+		return err
+	}
+	err = rc.Set(context.TODO(), wrapKey("fired_task:"+task.ID), taskJSON, firedTaskTTL).Err()
+	if err != nil {
+		log.Error("set fired task failed", zap.String("id", task.ID), zap.Error(err))
+	}
+	return err
+}
+
+// GetFiredTask gets the task fired in a day, returns redis.Nil if not found
+func GetFiredTask(id string) (*Task, error) {
+	taskJSON, err := rc.Get(context.TODO(), wrapKey("fired_task:"+id)).Result()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Error("get fired task failed", zap.String("id", id), zap.Error(err))
+		}
+		return nil, err
+	}
+	task := &Task{}
+	if err = json.Unmarshal([]byte(taskJSON), task); err != nil {
+		log.Error("json unmarshal failed", zap.Error(err), zap.String("task", taskJSON))
+		return nil, err
+	}
+	return task, nil
+}
@@ -25,13 +25,13 @@ func FakeBan(m *Message) {
 
 // Kill someone.
 func Kill(m *Message) {
-	seconds := config.BotConfig.RestrictConfig.KillSeconds
+	seconds := config.BotConfig().RestrictConfig.KillSeconds
 	banTime := time.Duration(seconds) * time.Second
 	ExecFakeBan(m, banTime)
 }
 
 func fakeBanCheck(m *Message, d time.Duration) bool {
-	conf := config.BotConfig.RestrictConfig
+	conf := config.BotConfig().RestrictConfig
 	if m.ReplyTo == nil {
 		util.SendReply(m.Chat, "用这个命令回复某一条“不合适”的消息，这样我大概就会帮你解决掉他，即便他是苟管理也义不容辞。", m)
 		return false
@@ -63,14 +63,14 @@ func ExecFakeBan(m *Message, d time.Duration) {
 	text := fmt.Sprintf("好了，我出发了，我将会追杀 %s，直到时间过去所谓“%v”。", bannedName, d)
 	if banned.ID == config.GetBot().Me.ID {
 		// ban who want to ban bot
-		text = config.BotConfig.MessageConfig.RestrictBot
+		text = config.BotConfig().MessageConfig.RestrictBot
 		banned = m.Sender
 	} else if banned.ID == m.Sender.ID {
 		// they want to ban themselves
 		text = fmt.Sprintf("那我就不客气了，我将会追杀你，直到时间过去所谓“%v”。", d)
 	}
 	// check if user 'banned' already banned
-	maxAdd := time.Duration(config.BotConfig.RestrictConfig.FakeBanMaxAddSeconds) * time.Second
+	maxAdd := time.Duration(config.BotConfig().RestrictConfig.FakeBanMaxAddSeconds) * time.Second
 	ad := min(d, maxAdd)
 	if orm.AddBanDuration(m.Chat.ID, m.Sender.ID, banned.ID, ad) {
 		text = fmt.Sprintf("好耶，成功为 %s 追加%v，希望 %s 过得开心", bannedName, ad, bannedName)
@@ -2,37 +2,51 @@ package restrict
 
 import (
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"csust-got/config"
 	"csust-got/entities"
 	"csust-got/util"
 
+	"github.com/puzpuzpuz/xsync/v4"
 	"golang.org/x/time/rate"
 	. "gopkg.in/telebot.v3"
 )
 
-var limitMap = make(map[string]*rate.Limiter, 16)
+// limitMap is replaced as a whole when limiters are reset
+var limitMap atomic.Pointer[xsync.Map[string, *rate.Limiter]]
+
+func init() {
+	ResetLimiters()
+}
+
+// ResetLimiters drops all limiters, new limiters will be created with the current config.
+func ResetLimiters() {
+	limitMap.Store(xsync.NewMap[string, *rate.Limiter](xsync.WithPresize(16)))
+}
 
 // CheckLimit 限制消息发送的频率，以防止刷屏.
 func CheckLimit(m *Message) bool {
-	rateConfig := config.BotConfig.RateLimitConfig
+	rateConfig := config.BotConfig().RateLimitConfig
 	key := strconv.FormatInt(m.Chat.ID, 10) + ":" + strconv.FormatInt(m.Sender.ID, 10)
-	if limiter, ok := limitMap[key]; ok {
-		if checkRate(m, limiter) {
-			return true
-		}
-		// 令牌不足撤回消息
-		util.DeleteMessage(m)
-		return false
+	limiter, loaded := limitMap.Load().LoadOrCompute(key, func() (*rate.Limiter, bool) {
+		return rate.NewLimiter(rate.Limit(rateConfig.Limit), rateConfig.MaxToken), false
+	})
+	if !loaded {
+		return true
+	}
+	if checkRate(m, limiter) {
+		return true
 	}
-	limitMap[key] = rate.NewLimiter(rate.Limit(rateConfig.Limit), rateConfig.MaxToken)
-	return true
+	// 令牌不足撤回消息
+	util.DeleteMessage(m)
+	return false
 }
 
 // return false if message should be limited.
 func checkRate(m *Message, limiter *rate.Limiter) bool {
-	rateConfig := config.BotConfig.RateLimitConfig
+	rateConfig := config.BotConfig().RateLimitConfig
 
 	msgTime := m.Time()
 	checkTime := time.Now()
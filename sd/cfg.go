@@ -262,8 +262,39 @@ func (c *StableDiffusionConfig) GenStableDiffusionRequest() *StableDiffusionReq
 	return req
 }
 
+// GenImg2ImgRequest generate img2img request by config, size is fit to source image.
+func (c *StableDiffusionConfig) GenImg2ImgRequest(srcWidth, srcHeight int) *StableDiffusionReq {
+	req := c.GenStableDiffusionRequest()
+	req.HiResEnabled = false
+	req.HiResScale, req.HiResUpscaler, req.HiResSecondPassSteps = 0, "", 0
+	req.BatchSize = c.GetValueByKey("number").(int)
+	req.DenoisingStrength = c.GetValueByKey("denoising_strength").(float64)
+	req.Width, req.Height = fitSize(srcWidth, srcHeight, req.Width, req.Height)
+	req.MaskBlur = 4
+	return req
+}
+
+// GenUpscaleRequest generate upscale request by config, latent upscalers only work in hi-res fix.
+func (c *StableDiffusionConfig) GenUpscaleRequest() *UpscaleReq {
+	upscaler := c.GetValueByKey("hr_upscaler").(string)
+	if strings.HasPrefix(upscaler, "Latent") {
+		upscaler = defaultUpscaler
+	}
+	return &UpscaleReq{
+		UpscalingResize: c.GetValueByKey("hr_scale").(float64),
+		Upscaler1:       upscaler,
+	}
+}
+
 const helpInfo = "sdcfg set \\<key\\> \\<value\\>\n" +
 	"sdcfg get \\<key\\>\n" +
+	"sdcfg save \\<name\\>: save current config as preset\\.\n" +
+	"sdcfg use \\<name\\>: switch to preset\\.\n" +
+	"sdcfg presets: list your presets\\.\n" +
+	"sdcfg delete \\<name\\>: delete preset\\.\n" +
+	"sdcfg publish \\<name\\>: publish preset to group as style, everyone can use it by `/sd @style:name <prompt>`\\.\n" +
+	"sdcfg unpublish \\<name\\>: remove style from group\\.\n" +
+	"sdcfg styles: list styles of group\\.\n" +
 	"available keys: \n" +
 	"`server`: your own stable diffusion server address\\(write only\\)\\.\n" +
 	"`prompt`: your default prompt, will add to your every command call\\.\n" +
@@ -274,14 +305,21 @@ const helpInfo = "sdcfg set \\<key\\> \\<value\\>\n" +
 	"`number`: number of images for once command call\\.\n" +
 	"`sampler`: sampler for stable diffusion, default is `Euler a`\\.\n" +
 	"`hr`: high resolution fix `on`/`off`, will force `number` to 1\\.\n" +
-	"`denoising_strength`: denoising strength for high resolution\\.\n" +
-	"`hr_scale`: high resolution scale\\.\n" +
-	"`hr_upscaler`: high resolution upscaler, default is `Latent`\\.\n" +
+	"`denoising_strength`: denoising strength for high resolution and img2img\\.\n" +
+	"`hr_scale`: high resolution scale, also used by `/sdupscale`\\.\n" +
+	"`hr_upscaler`: high resolution upscaler, default is `Latent`, `/sdupscale` uses `R\\-ESRGAN 4x\\+` instead of latent ones\\.\n" +
 	"`hr_second_pass_steps`: high resolution fix steps\\."
 
 const (
-	sdSubCmdSet = "set"
-	sdSubCmdGet = "get"
+	sdSubCmdSet       = "set"
+	sdSubCmdGet       = "get"
+	sdSubCmdSave      = "save"
+	sdSubCmdUse       = "use"
+	sdSubCmdPresets   = "presets"
+	sdSubCmdDelete    = "delete"
+	sdSubCmdPublish   = "publish"
+	sdSubCmdUnpublish = "unpublish"
+	sdSubCmdStyles    = "styles"
 )
 
 // ConfigHandler handle /sdcfg command.
@@ -300,6 +338,8 @@ func ConfigHandler(ctx Context) error {
 
 	var mode, key, value string
 	switch command.Arg(0) {
+	case sdSubCmdSave, sdSubCmdUse, sdSubCmdPresets, sdSubCmdDelete, sdSubCmdPublish, sdSubCmdUnpublish, sdSubCmdStyles:
+		return presetHandler(ctx, config, command)
 	case sdSubCmdSet:
 		if command.Argc() < 3 {
 			return ctx.Reply(helpInfo, ModeMarkdownV2)
@@ -330,11 +370,7 @@ func ConfigHandler(ctx Context) error {
 		if err != nil {
 			return ctx.Reply(err.Error())
 		}
-		configStr, err := json.MarshalIndent(&config, "", "")
-		if err != nil {
-			return ctx.Reply("感觉有点问题")
-		}
-		err = orm.SetSDConfig(userID, string(configStr))
+		err = saveConfig(userID, config)
 		if err != nil {
 			return ctx.Reply("完了，删库跑路了")
 		}
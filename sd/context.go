@@ -1,10 +1,7 @@
 package sd
 
-import . "gopkg.in/telebot.v3"
-
-// StableDiffusionContext is the context of stable diffusion worker.
-type StableDiffusionContext struct {
-	BotContext Context
-	UserConfig StableDiffusionConfig
-	Request    StableDiffusionReq
+// GenerateResult is the result of a stable diffusion request.
+type GenerateResult struct {
+	Images int
+	Err    error
 }
@@ -9,4 +9,12 @@ var (
 	ErrConfigKeyNotSupport = errors.New("config key not support")
 	ErrConfigIsInvalid     = errors.New("config is invalid")
 	ErrRequestNotOK        = errors.New("request not ok")
+	ErrServerError         = errors.New("server error")
+	ErrUserBusy            = errors.New("too many requests of user in queue")
+	ErrQueueFull           = errors.New("queue is full")
+	ErrJobNotFound         = errors.New("job not found")
+	ErrJobNotOwned         = errors.New("job is not owned by user")
+	ErrJobCancelled        = errors.New("job is cancelled")
+	ErrImageNotSupported   = errors.New("image not supported")
+	ErrPresetNotFound      = errors.New("preset not found")
 )
@@ -0,0 +1,252 @@
+package sd
+
+import (
+	"context"
+	"csust-got/entities"
+	"csust-got/log"
+	"csust-got/orm"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	. "gopkg.in/telebot.v3"
+)
+
+// JobMode is what the job draws.
+type JobMode string
+
+// job mode, empty means txt2img
+const (
+	ModeTxt2Img JobMode = ""
+	ModeImg2Img JobMode = "img2img"
+	ModeInpaint JobMode = "inpaint"
+	ModeUpscale JobMode = "upscale"
+)
+
+// maxImageSide is the max width or height of img2img
+const maxImageSide = 1024
+
+// defaultUpscaler is used when upscaler of user is only for hi-res fix
+const defaultUpscaler = "R-ESRGAN 4x+"
+
+// sourceImage is the image which img2img draws on.
+type sourceImage struct {
+	FileID string `json:"file_id"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// UpscaleReq is the request body of `/sdapi/v1/extra-single-image`.
+type UpscaleReq struct {
+	Image           string  `json:"image"`
+	UpscalingResize float64 `json:"upscaling_resize"`
+	Upscaler1       string  `json:"upscaler_1"`
+}
+
+// UpscaleResp is the response of `/sdapi/v1/extra-single-image`.
+type UpscaleResp struct {
+	Image string `json:"image"`
+}
+
+// imageOf returns the image of message, which is a photo or static sticker.
+func imageOf(msg *Message) (*sourceImage, error) {
+	switch {
+	case msg.Photo != nil:
+		return &sourceImage{FileID: msg.Photo.FileID, Width: msg.Photo.Width, Height: msg.Photo.Height}, nil
+	case msg.Sticker != nil && !msg.Sticker.Animated && !msg.Sticker.Video:
+		return &sourceImage{FileID: msg.Sticker.FileID, Width: msg.Sticker.Width, Height: msg.Sticker.Height}, nil
+	case msg.Sticker != nil:
+		return nil, ErrImageNotSupported
+	default:
+		return nil, nil
+	}
+}
+
+// RememberMask saves the photo which msg replies to if msg is an image,
+// so that `/sd` replying to msg inpaints the photo with msg as mask.
+// Telegram doesn't tell us what the replied message replies to, so we have to remember it.
+func RememberMask(msg *Message) {
+	if msg == nil || msg.ReplyTo == nil || msg.ReplyTo.Photo == nil {
+		return
+	}
+	if mask, err := imageOf(msg); err != nil || mask == nil {
+		return
+	}
+	src, _ := imageOf(msg.ReplyTo)
+	bs, err := json.Marshal(src)
+	if err != nil {
+		return
+	}
+	_ = orm.SetSDMaskSource(msg.Chat.ID, msg.ID, string(bs))
+}
+
+// imageSource decides mode of `/sd` by the message it replies to,
+// returns the source image and mask for img2img and inpainting.
+func imageSource(reply *Message) (JobMode, *sourceImage, string, error) {
+	if reply == nil {
+		return ModeTxt2Img, nil, "", nil
+	}
+	img, err := imageOf(reply)
+	if err != nil || img == nil {
+		return ModeTxt2Img, nil, "", err
+	}
+
+	raw, err := orm.GetSDMaskSource(reply.Chat.ID, reply.ID)
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			return ModeTxt2Img, nil, "", err
+		}
+		return ModeImg2Img, img, "", nil
+	}
+	src := &sourceImage{}
+	if err = json.Unmarshal([]byte(raw), src); err != nil {
+		return ModeTxt2Img, nil, "", err
+	}
+	return ModeInpaint, src, img.FileID, nil
+}
+
+// fitSize returns size of img2img, which keeps aspect ratio of source and has the same area as width*height.
+func fitSize(srcW, srcH, width, height int) (int, int) {
+	if srcW <= 0 || srcH <= 0 {
+		return width, height
+	}
+	ratio := float64(srcW) / float64(srcH)
+	w := math.Sqrt(float64(width*height) * ratio)
+	h := w / ratio
+	if s := max(w, h) / maxImageSide; s > 1 {
+		w, h = w/s, h/s
+	}
+	return roundSize(w), roundSize(h)
+}
+
+// roundSize rounds size to multiple of 64, as stable diffusion prefers.
+func roundSize(x float64) int {
+	return max(64, int(math.Round(x/64))*64)
+}
+
+// downloadImage downloads file from telegram, returns it in base64.
+func downloadImage(bot *Bot, fileID string) (string, error) {
+	reader, err := bot.File(&File{FileID: fileID})
+	if err != nil {
+		log.Error("download image for stable diffusion failed", zap.String("file", fileID), zap.Error(err))
+		return "", err
+	}
+	defer func() { _ = reader.Close() }()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// draw requests server by mode of job, returns images in base64.
+func (job *Job) draw(ctx context.Context, bot *Bot) ([]string, error) {
+	switch job.Mode {
+	case ModeImg2Img, ModeInpaint:
+		req := job.Request
+		image, err := downloadImage(bot, job.Image)
+		if err != nil {
+			return nil, err
+		}
+		req.InitImages = []string{image}
+		if job.Mode == ModeInpaint {
+			if req.Mask, err = downloadImage(bot, job.Mask); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := requestAPI[StableDiffusionResp](ctx, job.Server, "/sdapi/v1/img2img", &req)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Images, nil
+	case ModeUpscale:
+		req := *job.Upscale
+		image, err := downloadImage(bot, job.Image)
+		if err != nil {
+			return nil, err
+		}
+		req.Image = image
+		resp, err := requestAPI[UpscaleResp](ctx, job.Server, "/sdapi/v1/extra-single-image", &req)
+		if err != nil {
+			return nil, err
+		}
+		return []string{resp.Image}, nil
+	default:
+		resp, err := requestAPI[StableDiffusionResp](ctx, job.Server, "/sdapi/v1/txt2img", &job.Request)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Images, nil
+	}
+}
+
+// UpscaleHandler handles `/sdupscale [scale]` replying to an image, upscales it with upscaler of user.
+func UpscaleHandler(ctx Context) error {
+	command := entities.FromMessage(ctx.Message())
+
+	var img *sourceImage
+	var err error
+	if reply := ctx.Message().ReplyTo; reply != nil {
+		img, err = imageOf(reply)
+	}
+	if err != nil || img == nil {
+		return ctx.Reply("回复一张图片或者静态贴纸来放大它，用法：/sdupscale [倍数]")
+	}
+
+	config, err := getConfigByUserID(ctx.Sender().ID)
+	if err != nil {
+		return ctx.Reply("完了，删库跑路了")
+	}
+	server, usePool, err := jobServer(config)
+	switch {
+	case errors.Is(err, ErrServerNotConfigured):
+		return ctx.Reply("喂喂喂，你还没有配置服务器好吧。" +
+			"快使用 /sdcfg 配置一个属于自己的服务器，或者找好心人捐赠一个服务器吧")
+	case err != nil:
+		return ctx.Reply("服务器池里的服务器都挂了，等会再来吧，或者用 /sdcfg 配置一个自己的服务器")
+	}
+
+	req := config.GenUpscaleRequest()
+	if command.Argc() > 0 {
+		scale, err := strconv.ParseFloat(command.Arg(0), 64)
+		if err != nil || scale < 1 || scale > 4 {
+			return ctx.Reply("倍数必须在 1 到 4 之间")
+		}
+		req.UpscalingResize = scale
+	}
+
+	return enqueueWithStatus(ctx, &Job{
+		UserID:    ctx.Sender().ID,
+		ChatID:    ctx.Chat().ID,
+		MessageID: ctx.Message().ID,
+		Server:    server,
+		Pool:      usePool,
+		Mode:      ModeUpscale,
+		Image:     img.FileID,
+		Upscale:   req,
+	})
+}
+
+// modeText is the status text of running job.
+func (job *Job) modeText() string {
+	switch job.Mode {
+	case ModeImg2Img:
+		return "🎨 在照着画了"
+	case ModeInpaint:
+		return "🎨 在重画了"
+	case ModeUpscale:
+		return fmt.Sprintf("🔍 在放大了（%gx，%s）", job.Upscale.UpscalingResize, job.Upscale.Upscaler1)
+	default:
+		text := "🎨 在画了在画了"
+		if job.Request.HiResEnabled {
+			text += "，高清修复已开启，可能会比较慢，耐心等待一下~"
+		}
+		return text
+	}
+}
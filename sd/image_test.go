@@ -0,0 +1,104 @@
+package sd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	. "gopkg.in/telebot.v3"
+)
+
+func Test_fitSize(t *testing.T) {
+	tests := []struct {
+		name          string
+		srcW, srcH    int
+		width, height int
+		wantW, wantH  int
+	}{
+		{"unknown source", 0, 0, 512, 768, 512, 768},
+		{"square", 1000, 1000, 512, 512, 512, 512},
+		{"landscape", 1280, 720, 512, 512, 704, 384},
+		{"portrait", 720, 1280, 512, 512, 384, 704},
+		{"too wide", 4000, 1000, 1024, 1024, 1024, 256},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, h := fitSize(tt.srcW, tt.srcH, tt.width, tt.height)
+			require.Equal(t, tt.wantW, w)
+			require.Equal(t, tt.wantH, h)
+		})
+	}
+}
+
+func Test_imageOf(t *testing.T) {
+	req := require.New(t)
+
+	img, err := imageOf(&Message{Photo: &Photo{File: File{FileID: "photo"}, Width: 1280, Height: 720}})
+	req.NoError(err)
+	req.Equal(&sourceImage{FileID: "photo", Width: 1280, Height: 720}, img)
+
+	img, err = imageOf(&Message{Sticker: &Sticker{File: File{FileID: "sticker"}, Width: 512, Height: 512}})
+	req.NoError(err)
+	req.Equal("sticker", img.FileID)
+
+	_, err = imageOf(&Message{Sticker: &Sticker{File: File{FileID: "animated"}, Animated: true}})
+	req.ErrorIs(err, ErrImageNotSupported)
+
+	img, err = imageOf(&Message{Text: "hello"})
+	req.NoError(err)
+	req.Nil(img)
+}
+
+func TestStableDiffusionConfig_GenImg2ImgRequest(t *testing.T) {
+	req := require.New(t)
+	c := &StableDiffusionConfig{HiResEnabled: "on", Number: 2, DenoisingStrength: 0.5}
+
+	r := c.GenImg2ImgRequest(1280, 720)
+	req.False(r.HiResEnabled)
+	req.Equal(2, r.BatchSize)
+	req.Equal(0.5, r.DenoisingStrength)
+	req.Equal(704, r.Width)
+	req.Equal(384, r.Height)
+
+	bs, err := json.Marshal(r)
+	req.NoError(err)
+	req.NotContains(string(bs), "enable_hr")
+	req.NotContains(string(bs), "hr_upscaler")
+}
+
+func TestStableDiffusionConfig_GenUpscaleRequest(t *testing.T) {
+	req := require.New(t)
+
+	r := (&StableDiffusionConfig{}).GenUpscaleRequest()
+	req.Equal(&UpscaleReq{UpscalingResize: 2, Upscaler1: defaultUpscaler}, r)
+
+	r = (&StableDiffusionConfig{HiResUpscaler: "4x-UltraSharp", HiResScale: 3}).GenUpscaleRequest()
+	req.Equal(&UpscaleReq{UpscalingResize: 3, Upscaler1: "4x-UltraSharp"}, r)
+}
+
+func Test_requestAPI(t *testing.T) {
+	req := require.New(t)
+
+	var got map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/sdapi/v1/extra-single-image" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		_ = json.NewEncoder(w).Encode(UpscaleResp{Image: "upscaled"})
+	}))
+	defer server.Close()
+
+	resp, err := requestAPI[UpscaleResp](context.Background(), server.URL, "/sdapi/v1/extra-single-image",
+		&UpscaleReq{Image: "image", UpscalingResize: 2, Upscaler1: defaultUpscaler})
+	req.NoError(err)
+	req.Equal("upscaled", resp.Image)
+	req.Equal(map[string]any{"image": "image", "upscaling_resize": 2.0, "upscaler_1": defaultUpscaler}, got)
+
+	_, err = requestAPI[StableDiffusionResp](context.Background(), server.URL, "/sdapi/v1/img2img", &StableDiffusionReq{})
+	req.ErrorIs(err, ErrRequestNotOK)
+}
@@ -0,0 +1,14 @@
+package sd
+
+import (
+	"csust-got/config"
+	"csust-got/log"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	config.SetBotConfig(config.NewBotConfig())
+	log.InitLogger()
+	os.Exit(m.Run())
+}
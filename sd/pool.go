@@ -0,0 +1,368 @@
+package sd
+
+import (
+	"context"
+	"csust-got/config"
+	"csust-got/entities"
+	"csust-got/log"
+	"csust-got/orm"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	. "gopkg.in/telebot.v3"
+)
+
+// maxAttempts is the max count of servers in pool a job tries
+const maxAttempts = 3
+
+// checkTimeout is the timeout of checking a server
+const checkTimeout = 10 * time.Second
+
+// maxPoolWait is the max time queued jobs of pool wait for a healthy server
+const maxPoolWait = 5 * time.Minute
+
+// sdOptions is part of response of `/sdapi/v1/options`.
+type sdOptions struct {
+	Checkpoint string `json:"sd_model_checkpoint"`
+}
+
+// sdModel is an item of response of `/sdapi/v1/sd-models`.
+type sdModel struct {
+	Title string `json:"title"`
+}
+
+// poolServer is status of a server in pool.
+type poolServer struct {
+	Name    string
+	URL     string
+	Healthy bool
+	// Checkpoint is the model which server is running
+	Checkpoint string
+	Models     int
+	Err        string
+	CheckedAt  time.Time
+	// pickedAt is the last time a job is dispatched to it, idle servers are picked in turn
+	pickedAt time.Time
+}
+
+// serverPool is servers managed by admins, used by users who don't have their own server.
+type serverPool struct {
+	mu sync.RWMutex
+	// servers by url
+	servers map[string]*poolServer
+	check   func(ctx context.Context, url string) (checkpoint string, models int, err error)
+	// onChange is called when some servers become healthy
+	onChange func()
+	// downSince is the time since which no server is healthy, zero if some are healthy
+	downSince time.Time
+}
+
+// pool is the stable diffusion server pool.
+var pool = newServerPool(checkServer)
+
+func newServerPool(check func(ctx context.Context, url string) (string, int, error)) *serverPool {
+	return &serverPool{
+		servers: make(map[string]*poolServer),
+		check:   check,
+	}
+}
+
+// checkServer gets the running checkpoint and models of server.
+func checkServer(ctx context.Context, url string) (string, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	options, err := getAPI[sdOptions](ctx, url, "/sdapi/v1/options")
+	if err != nil {
+		return "", 0, err
+	}
+	models, err := getAPI[[]sdModel](ctx, url, "/sdapi/v1/sd-models")
+	if err != nil {
+		return "", 0, err
+	}
+	if len(*models) == 0 {
+		return "", 0, fmt.Errorf("%w: no model", ErrServerNotAvailable)
+	}
+	return options.Checkpoint, len(*models), nil
+}
+
+// Load replaces servers in pool with urls by name, status of servers kept is not changed.
+// New servers are unhealthy until checked.
+func (p *serverPool) Load(urls map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	servers := make(map[string]*poolServer, len(urls))
+	for name, url := range urls {
+		s, ok := p.servers[url]
+		if !ok {
+			s = &poolServer{URL: url, Err: "还没有检查"}
+		}
+		s.Name = name
+		servers[url] = s
+	}
+	p.servers = servers
+}
+
+// Refresh checks all servers in pool.
+func (p *serverPool) Refresh(ctx context.Context) {
+	p.mu.RLock()
+	urls := slices.Collect(maps.Keys(p.servers))
+	p.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	recovered := false
+	var recoveredMu sync.Mutex
+	for _, url := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if p.refreshOne(ctx, url) {
+				recoveredMu.Lock()
+				recovered = true
+				recoveredMu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	switch {
+	case p.hasHealthyLocked():
+		p.downSince = time.Time{}
+	case p.downSince.IsZero():
+		p.downSince = time.Now()
+	}
+	p.mu.Unlock()
+
+	if recovered && p.onChange != nil {
+		p.onChange()
+	}
+}
+
+// refreshOne checks server of url, reports whether it becomes healthy.
+func (p *serverPool) refreshOne(ctx context.Context, url string) bool {
+	checkpoint, models, err := p.check(ctx, url)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.servers[url]
+	if !ok {
+		return false
+	}
+	wasHealthy := s.Healthy
+	s.CheckedAt = time.Now()
+	if err != nil {
+		if wasHealthy {
+			log.Warn("stable diffusion server is down", zap.String("server", s.Name), zap.Error(err))
+		}
+		s.Healthy, s.Err = false, err.Error()
+		return false
+	}
+	s.Healthy, s.Err = true, ""
+	s.Checkpoint, s.Models = checkpoint, models
+	return !wasHealthy
+}
+
+// MarkFailed marks server unhealthy until next check.
+func (p *serverPool) MarkFailed(url string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s, ok := p.servers[url]; ok {
+		s.Healthy, s.Err = false, err.Error()
+	}
+}
+
+// Size returns count of servers in pool.
+func (p *serverPool) Size() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.servers)
+}
+
+// HasHealthy reports whether some servers in pool are healthy.
+func (p *serverPool) HasHealthy() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.hasHealthyLocked()
+}
+
+func (p *serverPool) hasHealthyLocked() bool {
+	for _, s := range p.servers {
+		if s.Healthy {
+			return true
+		}
+	}
+	return false
+}
+
+// Unavailable reports whether the pool is empty, or no server is healthy for wait since checked.
+func (p *serverPool) Unavailable(wait time.Duration) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.servers) == 0 {
+		return true
+	}
+	return !p.downSince.IsZero() && time.Since(p.downSince) >= wait
+}
+
+// Pick returns the healthy and idle server with least jobs waiting for it, empty if none.
+// Servers with the same depth are picked in turn.
+func (p *serverPool) Pick(busy map[string]bool, depth map[string]int) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var picked *poolServer
+	for _, s := range p.servers {
+		if !s.Healthy || busy[s.URL] {
+			continue
+		}
+		if picked == nil || depth[s.URL] < depth[picked.URL] ||
+			depth[s.URL] == depth[picked.URL] && s.pickedAt.Before(picked.pickedAt) {
+			picked = s
+		}
+	}
+	if picked == nil {
+		return ""
+	}
+	picked.pickedAt = time.Now()
+	return picked.URL
+}
+
+// Status returns status of servers, sorted by name.
+func (p *serverPool) Status() []poolServer {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	servers := make([]poolServer, 0, len(p.servers))
+	for _, s := range p.servers {
+		servers = append(servers, *s)
+	}
+	slices.SortFunc(servers, func(a, b poolServer) int { return strings.Compare(a.Name, b.Name) })
+	return servers
+}
+
+// reloadPool loads servers of pool from redis and checks them.
+func reloadPool(ctx context.Context) {
+	urls, err := orm.GetSDPoolServers()
+	if err != nil {
+		return
+	}
+	pool.Load(urls)
+	pool.Refresh(ctx)
+}
+
+// failStuckJobs fails queued jobs of pool if no server in pool can run them,
+// so that they don't wait forever.
+func failStuckJobs(bot *Bot) {
+	if !pool.Unavailable(maxPoolWait) {
+		return
+	}
+	stuck := jobs.DropPool()
+	if len(stuck) > 0 {
+		log.Warn("no stable diffusion server in pool is available, queued jobs failed", zap.Int("count", len(stuck)))
+	}
+	for _, job := range stuck {
+		job.fail(bot, "❌ 服务器池里没有能用的服务器了", ErrServerNotAvailable)
+	}
+}
+
+// watchPool checks servers of pool periodically.
+func watchPool(bot *Bot) {
+	for {
+		reloadPool(context.Background())
+		failStuckJobs(bot)
+		time.Sleep(config.BotConfig().StableDiffusion.HealthCheckInterval)
+	}
+}
+
+// isServerDown reports whether err means the server can't work, so that job should run on another server.
+func isServerDown(err error) bool {
+	return errors.Is(err, ErrServerNotAvailable) || errors.Is(err, ErrServerError)
+}
+
+// jobServer returns server of job of user, or usePool if user doesn't have own server and the pool is not empty.
+func jobServer(c *StableDiffusionConfig) (server string, usePool bool, err error) {
+	if c.Server == "" && pool.Size() > 0 {
+		if !pool.HasHealthy() {
+			return "", true, ErrServerNotAvailable
+		}
+		return "", true, nil
+	}
+	server = c.GetServer()
+	if server == "" {
+		return "", false, ErrServerNotConfigured
+	}
+	return server, false, nil
+}
+
+// formatServers formats status of servers with their load.
+func formatServers(servers []poolServer, busy map[string]bool, depth map[string]int, poolQueued int) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "服务器池共 %d 台服务器，%d 个任务在等待空闲服务器\n", len(servers), poolQueued)
+	for _, s := range servers {
+		if !s.Healthy {
+			fmt.Fprintf(&sb, "❌ %s：%s\n", s.Name, s.Err)
+			continue
+		}
+		state := "空闲"
+		if busy[s.URL] {
+			state = "正在画"
+		}
+		fmt.Fprintf(&sb, "✅ %s：%s，模型 %s（共 %d 个）", s.Name, state, s.Checkpoint, s.Models)
+		if n := depth[s.URL]; n > 0 {
+			fmt.Fprintf(&sb, "，另有 %d 个任务指定了它", n)
+		}
+		sb.WriteString("\n")
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// ServersHandler handles `/sdservers [add <name> <url>|remove <name>|check]`,
+// shows status of server pool, admins of bot can manage servers.
+func ServersHandler(ctx Context) error {
+	command := entities.FromMessage(ctx.Message())
+	sub := command.Arg(0)
+	if sub == "" {
+		if pool.Size() == 0 {
+			return ctx.Reply("服务器池是空的，大家只能用自己的服务器了")
+		}
+		busy, depth, poolQueued := jobs.Load()
+		return ctx.Reply(formatServers(pool.Status(), busy, depth, poolQueued))
+	}
+
+	if !config.BotConfig().IsAdmin(ctx.Sender().ID) {
+		return ctx.Reply("只有 bot 管理员可以管理服务器池哦")
+	}
+	switch {
+	case sub == "add" && command.Argc() == 3:
+		name, url := command.Arg(1), strings.TrimSuffix(command.Arg(2), "/")
+		if !validPresetName(name) || !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			return ctx.Reply("用法：/sdservers add <名字> <http(s)://地址>")
+		}
+		if err := orm.SetSDPoolServer(name, url); err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+	case sub == "remove" && command.Argc() == 2:
+		ok, err := orm.DelSDPoolServer(command.Arg(1))
+		if err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		if !ok {
+			return ctx.Reply("服务器池里没有这台服务器")
+		}
+	case sub == "check" && command.Argc() == 1:
+	default:
+		return ctx.Reply("用法：/sdservers [add <名字> <地址>|remove <名字>|check]")
+	}
+
+	reloadPool(context.Background())
+	failStuckJobs(ctx.Bot())
+	busy, depth, poolQueued := jobs.Load()
+	return ctx.Reply(formatServers(pool.Status(), busy, depth, poolQueued))
+}
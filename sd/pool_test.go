@@ -0,0 +1,211 @@
+package sd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPool(healthy ...string) *serverPool {
+	p := newServerPool(func(_ context.Context, url string) (string, int, error) {
+		for _, h := range healthy {
+			if h == url {
+				return "model-" + url, 2, nil
+			}
+		}
+		return "", 0, ErrServerNotAvailable
+	})
+	p.Load(map[string]string{"a": "a", "b": "b", "c": "c"})
+	p.Refresh(context.Background())
+	return p
+}
+
+func Test_serverPool_Pick(t *testing.T) {
+	req := require.New(t)
+	p := newTestPool("a", "b")
+
+	req.True(p.HasHealthy())
+	req.Equal(3, p.Size())
+
+	// servers with less jobs waiting for them first
+	req.Equal("b", p.Pick(nil, map[string]int{"a": 2}))
+	// busy and unhealthy servers are skipped
+	req.Equal("a", p.Pick(map[string]bool{"b": true}, nil))
+	req.Empty(p.Pick(map[string]bool{"a": true, "b": true}, nil))
+
+	// idle servers are picked in turn
+	first := p.Pick(nil, nil)
+	second := p.Pick(nil, nil)
+	req.NotEqual(first, second)
+	req.Equal(first, p.Pick(nil, nil))
+
+	p.MarkFailed("a", ErrServerError)
+	req.Equal("b", p.Pick(nil, nil))
+	req.Equal("b", p.Pick(nil, nil))
+}
+
+func Test_serverPool_Refresh(t *testing.T) {
+	req := require.New(t)
+	healthy := map[string]bool{}
+	p := newServerPool(func(_ context.Context, url string) (string, int, error) {
+		if healthy[url] {
+			return "anything-v5", 3, nil
+		}
+		return "", 0, ErrServerNotAvailable
+	})
+	changed := 0
+	p.onChange = func() { changed++ }
+
+	p.Load(map[string]string{"gpu": "http://gpu"})
+	p.Refresh(context.Background())
+	req.False(p.HasHealthy())
+	req.Equal(0, changed)
+
+	healthy["http://gpu"] = true
+	p.Refresh(context.Background())
+	req.True(p.HasHealthy())
+	req.Equal(1, changed)
+	p.Refresh(context.Background())
+	req.Equal(1, changed)
+
+	// status is kept when renamed
+	p.Load(map[string]string{"4090": "http://gpu"})
+	status := p.Status()
+	req.Len(status, 1)
+	req.Equal("4090", status[0].Name)
+	req.True(status[0].Healthy)
+	req.Equal("anything-v5", status[0].Checkpoint)
+	req.Equal(3, status[0].Models)
+}
+
+func Test_jobQueue_pool(t *testing.T) {
+	req := require.New(t)
+	store := newFakeJobStore()
+	q := newJobQueue(store, newTestPool("a", "b"))
+
+	a1 := &Job{UserID: 1, Pool: true}
+	b1 := &Job{UserID: 2, Pool: true}
+	c1 := &Job{UserID: 3, Pool: true}
+	for _, job := range []*Job{a1, b1, c1} {
+		_, err := q.Enqueue(job)
+		req.NoError(err)
+	}
+	// jobs waiting for server a make pool prefer b
+	own := enqueue(t, q, 4, "a")
+
+	req.Equal(a1, q.Next())
+	req.Equal("b", a1.Server)
+	req.Equal(b1, q.Next())
+	req.Equal("a", b1.Server)
+	// no idle server for c1 and own
+	req.Nil(q.Next())
+
+	busy, depth, poolQueued := q.Load()
+	req.Equal(map[string]bool{"a": true, "b": true}, busy)
+	req.Equal(map[string]int{"a": 1}, depth)
+	req.Equal(1, poolQueued)
+
+	// a1 fails on b, and runs again before others
+	q.Retry(a1)
+	req.Equal(1, a1.Attempts)
+	req.Empty(a1.Server)
+	req.Equal(JobQueued, store.jobs[a1.ID].Status)
+	req.Equal(a1, q.Next())
+	req.Equal("b", a1.Server)
+
+	q.Finish(b1)
+	// own is the head of its user, but c1 is earlier in round
+	req.Equal(c1, q.Next())
+	q.Finish(c1)
+	req.Equal(own, q.Next())
+}
+
+func Test_serverPool_Unavailable(t *testing.T) {
+	req := require.New(t)
+	req.True(newServerPool(nil).Unavailable(time.Hour))
+
+	p := newTestPool("a")
+	req.False(p.Unavailable(0))
+
+	p = newTestPool()
+	req.True(p.Unavailable(0))
+	req.False(p.Unavailable(time.Hour))
+	p.downSince = time.Now().Add(-2 * time.Hour)
+	req.True(p.Unavailable(time.Hour))
+}
+
+func Test_jobQueue_DropPool(t *testing.T) {
+	req := require.New(t)
+	store := newFakeJobStore()
+	q := newJobQueue(store, newTestPool())
+
+	a1 := &Job{UserID: 1, Pool: true}
+	_, err := q.Enqueue(a1)
+	req.NoError(err)
+	a2 := enqueue(t, q, 1, "own")
+	b1 := &Job{UserID: 2, Pool: true}
+	_, err = q.Enqueue(b1)
+	req.NoError(err)
+
+	dropped := q.DropPool()
+	req.ElementsMatch([]*Job{a1, b1}, dropped)
+	req.Len(store.jobs, 1)
+	req.Contains(store.jobs, a2.ID)
+	req.Equal(a2, q.Next())
+	req.Nil(q.Next())
+	req.Empty(q.DropPool())
+}
+
+func Test_checkServer(t *testing.T) {
+	req := require.New(t)
+	models := []sdModel{{Title: "anything-v5.safetensors"}, {Title: "sdxl.safetensors"}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sdapi/v1/options":
+			_ = json.NewEncoder(w).Encode(sdOptions{Checkpoint: "anything-v5.safetensors"})
+		case "/sdapi/v1/sd-models":
+			_ = json.NewEncoder(w).Encode(models)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	checkpoint, n, err := checkServer(context.Background(), server.URL)
+	req.NoError(err)
+	req.Equal("anything-v5.safetensors", checkpoint)
+	req.Equal(2, n)
+
+	models = nil
+	_, _, err = checkServer(context.Background(), server.URL)
+	req.ErrorIs(err, ErrServerNotAvailable)
+
+	server.Close()
+	_, _, err = checkServer(context.Background(), server.URL)
+	req.ErrorIs(err, ErrServerNotAvailable)
+}
+
+func Test_isServerDown(t *testing.T) {
+	req := require.New(t)
+	req.True(isServerDown(ErrServerNotAvailable))
+	req.True(isServerDown(errors.Join(ErrRequestNotOK, ErrServerError)))
+	req.False(isServerDown(ErrRequestNotOK))
+	req.False(isServerDown(ErrJobCancelled))
+}
+
+func Test_formatServers(t *testing.T) {
+	servers := []poolServer{
+		{Name: "3090", URL: "a", Healthy: true, Checkpoint: "anything-v5", Models: 2},
+		{Name: "4090", URL: "b", Err: "server not available"},
+	}
+	require.Equal(t, "服务器池共 2 台服务器，1 个任务在等待空闲服务器\n"+
+		"✅ 3090：正在画，模型 anything-v5（共 2 个），另有 1 个任务指定了它\n"+
+		"❌ 4090：server not available",
+		formatServers(servers, map[string]bool{"a": true}, map[string]int{"a": 1}, 1))
+}
@@ -0,0 +1,266 @@
+package sd
+
+import (
+	"csust-got/entities"
+	"csust-got/orm"
+	"csust-got/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/redis/go-redis/v9"
+	. "gopkg.in/telebot.v3"
+)
+
+const (
+	// maxPresets is the max count of presets of a user
+	maxPresets = 20
+	// maxStyles is the max count of styles published to a chat
+	maxStyles = 50
+	// maxPresetNameLen is the max length of name of preset or style
+	maxPresetNameLen = 32
+)
+
+// stylePrefix marks the style used by `/sd`, such as `/sd @style:anime 1girl`
+const stylePrefix = "@style:"
+
+// presetKeys are keys saved in preset, server is not included.
+var presetKeys = []string{
+	"prompt", "negative_prompt", "steps", "scale", "width", "height", "number", "sampler",
+	"hr", "denoising_strength", "hr_scale", "hr_upscaler", "hr_second_pass_steps",
+}
+
+// sdStyle is a preset published to chat.
+type sdStyle struct {
+	Owner     int64                 `json:"owner"`
+	OwnerName string                `json:"owner_name"`
+	Config    StableDiffusionConfig `json:"config"`
+}
+
+// validPresetName reports whether name can be used as name of preset or style.
+func validPresetName(name string) bool {
+	return name != "" && utf8.RuneCountInString(name) <= maxPresetNameLen && !strings.ContainsAny(name, ":@")
+}
+
+// normalizePreset validates preset by setting its keys through SetValueByKey, returns the parsed preset without server.
+func normalizePreset(c *StableDiffusionConfig) (*StableDiffusionConfig, error) {
+	preset := &StableDiffusionConfig{}
+	for _, key := range presetKeys {
+		if err := preset.SetValueByKey(key, fmt.Sprint(c.GetValueByKey(key))); err != nil {
+			return nil, err
+		}
+	}
+	return preset, nil
+}
+
+// withPreset returns config of preset, with server of c.
+func (c *StableDiffusionConfig) withPreset(preset *StableDiffusionConfig) *StableDiffusionConfig {
+	config := *preset
+	config.Server = c.Server
+	return &config
+}
+
+// parsePreset unmarshals and validates preset saved in redis.
+func parsePreset(raw string) (*StableDiffusionConfig, error) {
+	preset := &StableDiffusionConfig{}
+	if err := json.Unmarshal([]byte(raw), preset); err != nil {
+		return nil, err
+	}
+	return normalizePreset(preset)
+}
+
+// loadPreset loads preset of user.
+func loadPreset(userID int64, name string) (*StableDiffusionConfig, error) {
+	raw, err := orm.GetSDPreset(userID, name)
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrPresetNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parsePreset(raw)
+}
+
+// loadStyle loads style published to chat.
+func loadStyle(chatID int64, name string) (*sdStyle, error) {
+	raw, err := orm.GetSDStyle(chatID, name)
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrPresetNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	style := &sdStyle{}
+	if err = json.Unmarshal([]byte(raw), style); err != nil {
+		return nil, err
+	}
+	preset, err := normalizePreset(&style.Config)
+	if err != nil {
+		return nil, err
+	}
+	style.Config = *preset
+	return style, nil
+}
+
+// findStyle finds style of `/sd @style:<name>` in chat, then in presets of user.
+func findStyle(chatID, userID int64, name string) (*StableDiffusionConfig, error) {
+	style, err := loadStyle(chatID, name)
+	if err == nil {
+		return &style.Config, nil
+	}
+	if !errors.Is(err, ErrPresetNotFound) {
+		return nil, err
+	}
+	return loadPreset(userID, name)
+}
+
+// styleOf returns name of style in args of `/sd`, and index of the first arg of prompt.
+func styleOf(command *entities.BotCommand) (string, int) {
+	if name, ok := strings.CutPrefix(command.Arg(0), stylePrefix); ok {
+		return name, 1
+	}
+	return "", 0
+}
+
+// saveConfig saves config of user.
+func saveConfig(userID int64, config *StableDiffusionConfig) error {
+	configStr, err := json.MarshalIndent(config, "", "")
+	if err != nil {
+		return err
+	}
+	return orm.SetSDConfig(userID, string(configStr))
+}
+
+// presetHandler handles preset sub commands of `/sdcfg`.
+func presetHandler(ctx Context, config *StableDiffusionConfig, command *entities.BotCommand) error {
+	userID := ctx.Sender().ID
+	sub, name := command.Arg(0), command.Arg(1)
+	if sub != sdSubCmdPresets && sub != sdSubCmdStyles && !validPresetName(name) {
+		return ctx.Reply(fmt.Sprintf("用法：/sdcfg %s <名字>，名字不能超过 %d 个字，也不能包含 : 和 @", sub, maxPresetNameLen))
+	}
+
+	switch sub {
+	case sdSubCmdSave:
+		presets, err := orm.GetSDPresets(userID)
+		if err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		if _, ok := presets[name]; !ok && len(presets) >= maxPresets {
+			return ctx.Reply(fmt.Sprintf("最多只能保存 %d 个预设，先用 /sdcfg delete <名字> 删掉一些吧", maxPresets))
+		}
+		preset, err := normalizePreset(config)
+		if err != nil {
+			return ctx.Reply(err.Error())
+		}
+		bs, err := json.Marshal(preset)
+		if err != nil {
+			return ctx.Reply("感觉有点问题")
+		}
+		if err = orm.SetSDPreset(userID, name, string(bs)); err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		return ctx.Reply(fmt.Sprintf("已把当前配置保存为预设 %s，用 /sdcfg use %s 切换", name, name))
+
+	case sdSubCmdUse:
+		preset, err := loadPreset(userID, name)
+		if errors.Is(err, ErrPresetNotFound) {
+			return ctx.Reply("没有这个预设，用 /sdcfg presets 看看你的预设")
+		}
+		if err != nil {
+			return ctx.Reply(err.Error())
+		}
+		if err = saveConfig(userID, config.withPreset(preset)); err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		return ctx.Reply("已切换到预设 " + name)
+
+	case sdSubCmdPresets:
+		presets, err := orm.GetSDPresets(userID)
+		if err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		if len(presets) == 0 {
+			return ctx.Reply("你还没有预设，用 /sdcfg save <名字> 保存当前配置")
+		}
+		return ctx.Reply("你的预设：" + strings.Join(slices.Sorted(maps.Keys(presets)), ", "))
+
+	case sdSubCmdDelete:
+		ok, err := orm.DelSDPreset(userID, name)
+		if err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		if !ok {
+			return ctx.Reply("没有这个预设")
+		}
+		return ctx.Reply("已删除预设 " + name + "，已经发布到群里的风格不受影响")
+
+	case sdSubCmdPublish:
+		if ctx.Chat().Type == ChatPrivate {
+			return ctx.Reply("只能把预设发布到群里哦")
+		}
+		preset, err := loadPreset(userID, name)
+		if errors.Is(err, ErrPresetNotFound) {
+			return ctx.Reply("没有这个预设，先用 /sdcfg save " + name + " 保存一个吧")
+		}
+		if err != nil {
+			return ctx.Reply(err.Error())
+		}
+		styles, err := orm.GetSDStyles(ctx.Chat().ID)
+		if err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		if raw, ok := styles[name]; ok {
+			old := &sdStyle{}
+			if json.Unmarshal([]byte(raw), old) == nil && old.Owner != userID {
+				return ctx.Reply(fmt.Sprintf("%s 已经被 %s 发布了，换个名字吧", name, old.OwnerName))
+			}
+		} else if len(styles) >= maxStyles {
+			return ctx.Reply(fmt.Sprintf("本群最多只能发布 %d 个风格", maxStyles))
+		}
+		bs, err := json.Marshal(&sdStyle{Owner: userID, OwnerName: ctx.Sender().FirstName + ctx.Sender().LastName, Config: *preset})
+		if err != nil {
+			return ctx.Reply("感觉有点问题")
+		}
+		if err = orm.SetSDStyle(ctx.Chat().ID, name, string(bs)); err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		return ctx.Reply(fmt.Sprintf("已发布风格 %s，群友可以用 /sd %s%s <prompt> 来画", name, stylePrefix, name))
+
+	case sdSubCmdUnpublish:
+		style, err := loadStyle(ctx.Chat().ID, name)
+		if errors.Is(err, ErrPresetNotFound) {
+			return ctx.Reply("本群没有这个风格")
+		}
+		// broken style can be removed by anyone
+		if err == nil && style.Owner != userID && !util.IsChatAdmin(ctx.Bot(), ctx.Chat(), ctx.Sender()) {
+			return ctx.Reply("只能撤下自己发布的风格哦")
+		}
+		if err = orm.DelSDStyle(ctx.Chat().ID, name); err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		return ctx.Reply("已撤下风格 " + name)
+
+	case sdSubCmdStyles:
+		styles, err := orm.GetSDStyles(ctx.Chat().ID)
+		if err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		if len(styles) == 0 {
+			return ctx.Reply("本群还没有风格，用 /sdcfg publish <预设名> 发布一个吧")
+		}
+		var sb strings.Builder
+		sb.WriteString("本群的风格：\n")
+		for _, name := range slices.Sorted(maps.Keys(styles)) {
+			style := &sdStyle{}
+			_ = json.Unmarshal([]byte(styles[name]), style)
+			fmt.Fprintf(&sb, "%s%s（%s）\n", stylePrefix, name, style.OwnerName)
+		}
+		sb.WriteString("用 /sd @style:<名字> <prompt> 来画")
+		return ctx.Reply(sb.String())
+	}
+	return ctx.Reply(helpInfo, ModeMarkdownV2)
+}
@@ -0,0 +1,70 @@
+package sd
+
+import (
+	"testing"
+
+	"csust-got/entities"
+
+	"github.com/stretchr/testify/require"
+	. "gopkg.in/telebot.v3"
+)
+
+func Test_validPresetName(t *testing.T) {
+	req := require.New(t)
+	req.True(validPresetName("anime"))
+	req.True(validPresetName("二次元"))
+	req.False(validPresetName(""))
+	req.False(validPresetName("style:anime"))
+	req.False(validPresetName("@anime"))
+	req.False(validPresetName("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"))
+}
+
+func Test_normalizePreset(t *testing.T) {
+	req := require.New(t)
+
+	preset, err := normalizePreset(&StableDiffusionConfig{
+		Server:  "http://127.0.0.1:7860",
+		Steps:   20,
+		Width:   700,
+		Sampler: "DPM++ 2M Karras",
+	})
+	req.NoError(err)
+	req.Empty(preset.Server)
+	req.Equal(20, preset.Steps)
+	req.Equal(640, preset.Width)
+	req.Equal(512, preset.Height)
+	req.Equal("DPM++ 2M Karras", preset.Sampler)
+	req.Equal("off", preset.HiResEnabled)
+	req.Equal(0.6, preset.DenoisingStrength)
+
+	// the same preset is normalized to itself
+	again, err := normalizePreset(preset)
+	req.NoError(err)
+	req.Equal(preset, again)
+
+	_, err = normalizePreset(&StableDiffusionConfig{Steps: 100})
+	req.ErrorIs(err, ErrConfigIsInvalid)
+	_, err = parsePreset(`{"hr_scale": 8}`)
+	req.ErrorIs(err, ErrConfigIsInvalid)
+}
+
+func TestStableDiffusionConfig_withPreset(t *testing.T) {
+	c := &StableDiffusionConfig{Server: "http://127.0.0.1:7860", Steps: 20}
+	config := c.withPreset(&StableDiffusionConfig{Steps: 30, Sampler: "Euler"})
+	require.Equal(t, &StableDiffusionConfig{Server: "http://127.0.0.1:7860", Steps: 30, Sampler: "Euler"}, config)
+	require.Equal(t, 20, c.Steps)
+}
+
+func Test_styleOf(t *testing.T) {
+	req := require.New(t)
+
+	command := entities.FromMessage(&Message{Text: "/sd @style:anime 1girl, smile"})
+	name, from := styleOf(command)
+	req.Equal("anime", name)
+	req.Equal("1girl, smile", command.ArgAllInOneFrom(from))
+
+	command = entities.FromMessage(&Message{Text: "/sd 1girl"})
+	name, from = styleOf(command)
+	req.Empty(name)
+	req.Equal("1girl", command.ArgAllInOneFrom(from))
+}
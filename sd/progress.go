@@ -0,0 +1,159 @@
+package sd
+
+import (
+	"bytes"
+	"context"
+	"csust-got/log"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	. "gopkg.in/telebot.v3"
+)
+
+// ProgressResp is the response of `/sdapi/v1/progress`.
+type ProgressResp struct {
+	// Progress is from 0 to 1
+	Progress float64 `json:"progress"`
+	// EtaRelative is the estimated seconds left
+	EtaRelative float64 `json:"eta_relative"`
+	State       struct {
+		SamplingStep  int `json:"sampling_step"`
+		SamplingSteps int `json:"sampling_steps"`
+	} `json:"state"`
+	// CurrentImage is the base64 encoded preview, empty if none
+	CurrentImage string `json:"current_image"`
+}
+
+// Text is the status text of progress.
+func (p *ProgressResp) Text() string {
+	text := fmt.Sprintf("🎨 在画了在画了 %d%%", int(p.Progress*100))
+	if p.State.SamplingSteps > 0 {
+		text += fmt.Sprintf("（第 %d/%d 步）", p.State.SamplingStep, p.State.SamplingSteps)
+	}
+	if p.EtaRelative > 0 {
+		text += fmt.Sprintf("，预计还要 %.0f 秒", p.EtaRelative)
+	}
+	return text
+}
+
+// getAPI gets api of stable diffusion server, and decodes the response.
+func getAPI[T any](ctx context.Context, addr, path string) (*T, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, addr+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("request stable diffusion %s failed: %w", path, ErrServerNotAvailable)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	bts, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: request stable diffusion %s failed, status code: %d", ErrRequestNotOK, path, resp.StatusCode)
+	}
+
+	var data T
+	if err = json.Unmarshal(bts, &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// watchProgress polls progress of server every interval until ctx is done,
+// update is called when text or preview changes, preview is nil if it doesn't change.
+func watchProgress(ctx context.Context, addr string, interval time.Duration, update func(text string, preview []byte)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastText, lastImage := "", ""
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		progress, err := getAPI[ProgressResp](ctx, addr, "/sdapi/v1/progress")
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Debug("get stable diffusion progress failed", zap.String("server", addr), zap.Error(err))
+			}
+			continue
+		}
+		// the server is still loading, or has finished the job
+		if progress.Progress <= 0 || progress.Progress >= 1 {
+			continue
+		}
+
+		var preview []byte
+		if progress.CurrentImage != "" && progress.CurrentImage != lastImage {
+			preview, err = base64.StdEncoding.DecodeString(progress.CurrentImage)
+			if err != nil {
+				log.Debug("decode stable diffusion preview failed", zap.Error(err))
+				preview = nil
+			} else {
+				lastImage = progress.CurrentImage
+			}
+		}
+		text := progress.Text()
+		if text == lastText && preview == nil {
+			continue
+		}
+		lastText = text
+		if ctx.Err() == nil {
+			update(text, preview)
+		}
+	}
+}
+
+// progressPreview shows the preview image of running job, as reply of status message.
+type progressPreview struct {
+	bot *Bot
+	job *Job
+	msg *Message
+}
+
+// update edits status message with text, and sends or edits the preview message.
+func (p *progressPreview) update(text string, preview []byte) {
+	p.job.setStatus(p.bot, text)
+	if preview == nil {
+		return
+	}
+
+	photo := &Photo{File: File{FileReader: bytes.NewReader(preview)}, Caption: "预览"}
+	if p.msg == nil {
+		status := &Message{ID: p.job.StatusMessageID, Chat: &Chat{ID: p.job.ChatID}}
+		msg, err := p.bot.Send(ChatID(p.job.ChatID), photo, &SendOptions{ReplyTo: status, DisableNotification: true})
+		if err != nil {
+			log.Error("send stable diffusion preview failed", zap.String("id", p.job.ID), zap.Error(err))
+			return
+		}
+		p.msg = msg
+		return
+	}
+	msg := &StoredMessage{MessageID: strconv.Itoa(p.msg.ID), ChatID: p.job.ChatID}
+	if _, err := p.bot.Edit(msg, photo); err != nil && !errors.Is(err, ErrSameMessageContent) {
+		log.Error("edit stable diffusion preview failed", zap.String("id", p.job.ID), zap.Error(err))
+	}
+}
+
+// clear deletes the preview message, images are sent then.
+func (p *progressPreview) clear() {
+	if p.msg == nil {
+		return
+	}
+	if err := p.bot.Delete(p.msg); err != nil {
+		log.Error("delete stable diffusion preview failed", zap.String("id", p.job.ID), zap.Error(err))
+	}
+}
@@ -0,0 +1,87 @@
+package sd
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgressResp_Text(t *testing.T) {
+	p := &ProgressResp{Progress: 0.426, EtaRelative: 12.4}
+	require.Equal(t, "🎨 在画了在画了 42%，预计还要 12 秒", p.Text())
+
+	p.State.SamplingStep, p.State.SamplingSteps = 12, 28
+	require.Equal(t, "🎨 在画了在画了 42%（第 12/28 步），预计还要 12 秒", p.Text())
+}
+
+func Test_watchProgress(t *testing.T) {
+	req := require.New(t)
+
+	image := base64.StdEncoding.EncodeToString([]byte("preview"))
+	responses := []ProgressResp{
+		{Progress: 0},
+		{Progress: 0.5, EtaRelative: 10, CurrentImage: image},
+		{Progress: 0.5, EtaRelative: 10, CurrentImage: image},
+		{Progress: 0.75, EtaRelative: 5, CurrentImage: image},
+		{Progress: 1},
+	}
+	var mu sync.Mutex
+	polled := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/sdapi/v1/progress" {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		resp := responses[min(polled, len(responses)-1)]
+		polled++
+		mu.Unlock()
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	type update struct {
+		text    string
+		preview []byte
+	}
+	updates := make(chan update, 10)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watchProgress(ctx, server.URL, 10*time.Millisecond, func(text string, preview []byte) {
+			updates <- update{text, preview}
+		})
+	}()
+
+	first := <-updates
+	req.Equal("🎨 在画了在画了 50%，预计还要 10 秒", first.text)
+	req.Equal([]byte("preview"), first.preview)
+
+	// same progress is skipped, and same preview is not sent again
+	second := <-updates
+	req.Equal("🎨 在画了在画了 75%，预计还要 5 秒", second.text)
+	req.Nil(second.preview)
+
+	// finished progress is not shown
+	for {
+		mu.Lock()
+		n := polled
+		mu.Unlock()
+		if n > len(responses) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	req.Empty(updates)
+}
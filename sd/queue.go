@@ -0,0 +1,418 @@
+package sd
+
+import (
+	"context"
+	"csust-got/log"
+	"csust-got/orm"
+	"csust-got/util"
+	"encoding/json"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// maxUserJobs is the max count of queued and running jobs of a user
+	maxUserJobs = 3
+	// maxQueuedJobs is the max count of queued jobs of all users
+	maxQueuedJobs = 50
+)
+
+// jobIDChars are chars of job id, without chars look alike.
+const jobIDChars = "abcdefghijkmnpqrstuvwxyz23456789"
+
+// JobStatus is the status of stable diffusion job.
+type JobStatus string
+
+// job status
+const (
+	JobQueued  JobStatus = "queued"
+	JobRunning JobStatus = "running"
+)
+
+// Job is a stable diffusion request waiting in queue or running.
+type Job struct {
+	ID string `json:"id"`
+	// Seq is the order of enqueue
+	Seq    int64 `json:"seq"`
+	UserID int64 `json:"user_id"`
+	ChatID int64 `json:"chat_id"`
+	// MessageID is the message which images reply to
+	MessageID int `json:"message_id"`
+	// StatusMessageID is the message showing status of job, 0 if none
+	StatusMessageID int                `json:"status_message_id"`
+	Server          string             `json:"server"`
+	Request         StableDiffusionReq `json:"request"`
+	Status          JobStatus          `json:"status"`
+
+	Mode JobMode `json:"mode,omitempty"`
+	// Image is file id of source image of img2img, inpainting and upscaling
+	Image string `json:"image,omitempty"`
+	// Mask is file id of mask of inpainting
+	Mask    string      `json:"mask,omitempty"`
+	Upscale *UpscaleReq `json:"upscale,omitempty"`
+
+	// Pool means Server is picked from server pool when the job starts
+	Pool bool `json:"pool,omitempty"`
+	// Attempts is count of servers in pool failed the job
+	Attempts int `json:"attempts,omitempty"`
+
+	// done receives the result if someone is waiting, it's lost after restart.
+	done chan<- GenerateResult
+	// ctx is cancelled when the running job is cancelled.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// statusMu keeps edits of status message in order.
+	statusMu sync.Mutex
+}
+
+// jobStore persists jobs, so that they resume after restart.
+type jobStore interface {
+	Save(job *Job)
+	Delete(id string)
+	Load() []*Job
+}
+
+// redisJobStore saves jobs in redis.
+type redisJobStore struct{}
+
+func (redisJobStore) Save(job *Job) {
+	bs, err := json.Marshal(job)
+	if err != nil {
+		log.Error("marshal stable diffusion job failed", zap.String("id", job.ID), zap.Error(err))
+		return
+	}
+	_ = orm.SetSDJob(job.ID, string(bs))
+}
+
+func (redisJobStore) Delete(id string) {
+	_ = orm.DelSDJob(id)
+}
+
+func (redisJobStore) Load() []*Job {
+	raws, err := orm.GetSDJobs()
+	if err != nil {
+		return nil
+	}
+	jobs := make([]*Job, 0, len(raws))
+	for _, raw := range raws {
+		job := &Job{}
+		if err := json.Unmarshal([]byte(raw), job); err != nil {
+			log.Error("unmarshal stable diffusion job failed", zap.String("job", raw), zap.Error(err))
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// serverPicker picks idle server for jobs of server pool.
+type serverPicker interface {
+	Pick(busy map[string]bool, depth map[string]int) string
+}
+
+// jobQueue dispatches jobs round-robin across users, each server runs one job at a time.
+type jobQueue struct {
+	mu sync.Mutex
+	// users are users with queued jobs, in round-robin order
+	users   []int64
+	queued  map[int64][]*Job
+	running map[string]*Job
+	// busyServers are servers running a job
+	busyServers map[string]bool
+	seq         int64
+	idGen       interface{ RandStr() string }
+
+	store  jobStore
+	picker serverPicker
+	// wake is notified when a job may be dispatched
+	wake chan struct{}
+}
+
+func newJobQueue(store jobStore, picker serverPicker) *jobQueue {
+	return &jobQueue{
+		queued:      make(map[int64][]*Job),
+		running:     make(map[string]*Job),
+		busyServers: make(map[string]bool),
+		idGen:       util.NewRandStrWithSeedLength(jobIDChars, 6),
+		store:       store,
+		picker:      picker,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+func (q *jobQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// userJobsLocked returns count of queued and running jobs of user.
+func (q *jobQueue) userJobsLocked(userID int64) int {
+	n := len(q.queued[userID])
+	for _, job := range q.running {
+		if job.UserID == userID {
+			n++
+		}
+	}
+	return n
+}
+
+// Enqueue assigns id to job and adds it to queue, returns count of jobs before it.
+func (q *jobQueue) Enqueue(job *Job) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.userJobsLocked(job.UserID) >= maxUserJobs {
+		return 0, ErrUserBusy
+	}
+	if len(q.orderLocked()) >= maxQueuedJobs {
+		return 0, ErrQueueFull
+	}
+
+	q.seq++
+	job.ID = q.idGen.RandStr()
+	job.Seq = q.seq
+	job.Status = JobQueued
+	q.pushLocked(job)
+	q.store.Save(job)
+	q.notify()
+	return q.positionLocked(job.ID), nil
+}
+
+func (q *jobQueue) pushLocked(job *Job) {
+	if len(q.queued[job.UserID]) == 0 {
+		q.users = append(q.users, job.UserID)
+	}
+	q.queued[job.UserID] = append(q.queued[job.UserID], job)
+}
+
+// Restore loads saved jobs, running jobs interrupted by restart are queued again.
+func (q *jobQueue) Restore() int {
+	jobs := q.store.Load()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Seq < jobs[j].Seq })
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, job := range jobs {
+		job.Status = JobQueued
+		if job.Pool {
+			job.Server = ""
+		}
+		q.pushLocked(job)
+		q.seq = max(q.seq, job.Seq)
+	}
+	if len(jobs) > 0 {
+		q.notify()
+	}
+	return len(jobs)
+}
+
+// depthLocked returns count of queued jobs waiting for each server, jobs of server pool are not counted.
+func (q *jobQueue) depthLocked() map[string]int {
+	depth := make(map[string]int)
+	for _, jobs := range q.queued {
+		for _, job := range jobs {
+			if !job.Pool {
+				depth[job.Server]++
+			}
+		}
+	}
+	return depth
+}
+
+// Next takes the first job in round-robin order whose server is idle, returns nil if none.
+// Jobs of server pool take the idle server picked by pool.
+// The user of the taken job moves to the end of round.
+func (q *jobQueue) Next() *Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var depth map[string]int
+	for i, userID := range q.users {
+		jobs := q.queued[userID]
+		job := jobs[0]
+		if job.Pool {
+			if depth == nil {
+				depth = q.depthLocked()
+			}
+			server := q.picker.Pick(q.busyServers, depth)
+			if server == "" {
+				continue
+			}
+			job.Server = server
+		} else if q.busyServers[job.Server] {
+			continue
+		}
+
+		q.users = append(q.users[:i:i], q.users[i+1:]...)
+		if len(jobs) > 1 {
+			q.queued[userID] = jobs[1:]
+			q.users = append(q.users, userID)
+		} else {
+			delete(q.queued, userID)
+		}
+
+		job.ctx, job.cancel = context.WithCancel(context.Background())
+		job.Status = JobRunning
+		q.running[job.ID] = job
+		q.busyServers[job.Server] = true
+		return job
+	}
+	return nil
+}
+
+// Finish removes the running job, and frees its server.
+func (q *jobQueue) Finish(job *Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.running, job.ID)
+	delete(q.busyServers, job.Server)
+	q.store.Delete(job.ID)
+	q.notify()
+}
+
+// Retry puts the running job back to the head of queue, it runs on another server of pool then.
+func (q *jobQueue) Retry(job *Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.running, job.ID)
+	delete(q.busyServers, job.Server)
+
+	job.Server = ""
+	job.Attempts++
+	job.Status = JobQueued
+	q.users = slices.DeleteFunc(q.users, func(id int64) bool { return id == job.UserID })
+	q.users = append([]int64{job.UserID}, q.users...)
+	q.queued[job.UserID] = append([]*Job{job}, q.queued[job.UserID]...)
+	q.store.Save(job)
+	q.notify()
+}
+
+// DropPool removes all queued jobs of server pool, and returns them.
+func (q *jobQueue) DropPool() []*Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var dropped []*Job
+	users := make([]int64, 0, len(q.users))
+	for _, userID := range q.users {
+		jobs := slices.DeleteFunc(q.queued[userID], func(job *Job) bool {
+			if !job.Pool {
+				return false
+			}
+			dropped = append(dropped, job)
+			q.store.Delete(job.ID)
+			return true
+		})
+		if len(jobs) == 0 {
+			delete(q.queued, userID)
+			continue
+		}
+		q.queued[userID] = jobs
+		users = append(users, userID)
+	}
+	q.users = users
+	return dropped
+}
+
+// Load returns busy servers, count of queued jobs waiting for each server, and count of queued jobs of server pool.
+func (q *jobQueue) Load() (busy map[string]bool, depth map[string]int, poolQueued int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, jobs := range q.queued {
+		for _, job := range jobs {
+			if job.Pool {
+				poolQueued++
+			}
+		}
+	}
+	return maps.Clone(q.busyServers), q.depthLocked(), poolQueued
+}
+
+// Cancel cancels queued or running job of user. Running job is stopped and finished by its worker.
+func (q *jobQueue) Cancel(id string, userID int64) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if job, ok := q.running[id]; ok {
+		if job.UserID != userID {
+			return nil, ErrJobNotOwned
+		}
+		job.cancel()
+		return job, nil
+	}
+
+	for i, uid := range q.users {
+		jobs := q.queued[uid]
+		for j, job := range jobs {
+			if job.ID != id {
+				continue
+			}
+			if job.UserID != userID {
+				return nil, ErrJobNotOwned
+			}
+			jobs = append(jobs[:j:j], jobs[j+1:]...)
+			if len(jobs) == 0 {
+				delete(q.queued, uid)
+				q.users = append(q.users[:i:i], q.users[i+1:]...)
+			} else {
+				q.queued[uid] = jobs
+			}
+			q.store.Delete(id)
+			return job, nil
+		}
+	}
+	return nil, ErrJobNotFound
+}
+
+// orderLocked returns queued jobs in the order they will be dispatched if all servers are idle.
+func (q *jobQueue) orderLocked() []*Job {
+	var order []*Job
+	for round := 0; ; round++ {
+		added := false
+		for _, userID := range q.users {
+			if jobs := q.queued[userID]; round < len(jobs) {
+				order = append(order, jobs[round])
+				added = true
+			}
+		}
+		if !added {
+			return order
+		}
+	}
+}
+
+// positionLocked returns count of queued jobs before the job, -1 if it's not queued.
+func (q *jobQueue) positionLocked(id string) int {
+	for i, job := range q.orderLocked() {
+		if job.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// UserJobs returns running and queued jobs of user, with count of jobs before each queued job.
+func (q *jobQueue) UserJobs(userID int64) (running []*Job, queued []*Job, positions []int, total int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, job := range q.running {
+		if job.UserID == userID {
+			running = append(running, job)
+		}
+	}
+	order := q.orderLocked()
+	for i, job := range order {
+		if job.UserID == userID {
+			queued = append(queued, job)
+			positions = append(positions, i)
+		}
+	}
+	return running, queued, positions, len(order)
+}
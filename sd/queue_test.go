@@ -0,0 +1,135 @@
+package sd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeJobStore struct {
+	jobs map[string]*Job
+}
+
+func newFakeJobStore() *fakeJobStore {
+	return &fakeJobStore{jobs: make(map[string]*Job)}
+}
+
+func (s *fakeJobStore) Save(job *Job) { s.jobs[job.ID] = job }
+
+func (s *fakeJobStore) Delete(id string) { delete(s.jobs, id) }
+
+func (s *fakeJobStore) Load() []*Job {
+	jobs := make([]*Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, &Job{ID: job.ID, Seq: job.Seq, UserID: job.UserID, Server: job.Server, Status: job.Status})
+	}
+	return jobs
+}
+
+func enqueue(t *testing.T, q *jobQueue, userID int64, server string) *Job {
+	t.Helper()
+	job := &Job{UserID: userID, Server: server}
+	_, err := q.Enqueue(job)
+	require.NoError(t, err)
+	return job
+}
+
+func Test_jobQueue_fairness(t *testing.T) {
+	req := require.New(t)
+	q := newJobQueue(newFakeJobStore(), nil)
+
+	a1 := enqueue(t, q, 1, "a")
+	a2 := enqueue(t, q, 1, "b")
+	a3 := enqueue(t, q, 1, "c")
+	b1 := enqueue(t, q, 2, "d")
+
+	_, err := q.Enqueue(&Job{UserID: 1, Server: "a"})
+	req.ErrorIs(err, ErrUserBusy)
+
+	running, queued, positions, total := q.UserJobs(1)
+	req.Empty(running)
+	req.Equal([]*Job{a1, a2, a3}, queued)
+	req.Equal([]int{0, 2, 3}, positions)
+	req.Equal(4, total)
+
+	req.Equal(a1, q.Next())
+	req.Equal(b1, q.Next())
+	req.Equal(a2, q.Next())
+	req.Equal(a3, q.Next())
+	req.Nil(q.Next())
+	req.Equal(JobRunning, a1.Status)
+}
+
+func Test_jobQueue_busyServer(t *testing.T) {
+	req := require.New(t)
+	q := newJobQueue(newFakeJobStore(), nil)
+
+	a1 := enqueue(t, q, 1, "s")
+	a2 := enqueue(t, q, 1, "s")
+	b1 := enqueue(t, q, 2, "t")
+
+	req.Equal(a1, q.Next())
+	// a2 waits for server of a1, and b1 goes first
+	req.Equal(b1, q.Next())
+	req.Nil(q.Next())
+
+	q.Finish(a1)
+	req.Equal(a2, q.Next())
+}
+
+func Test_jobQueue_cancel(t *testing.T) {
+	req := require.New(t)
+	store := newFakeJobStore()
+	q := newJobQueue(store, nil)
+
+	a1 := enqueue(t, q, 1, "s")
+	a2 := enqueue(t, q, 1, "s")
+	b1 := enqueue(t, q, 2, "s")
+
+	_, err := q.Cancel(a2.ID, 2)
+	req.ErrorIs(err, ErrJobNotOwned)
+	_, err = q.Cancel("nothing", 1)
+	req.ErrorIs(err, ErrJobNotFound)
+
+	job, err := q.Cancel(a2.ID, 1)
+	req.NoError(err)
+	req.Equal(a2, job)
+	req.NotContains(store.jobs, a2.ID)
+
+	req.Equal(a1, q.Next())
+	job, err = q.Cancel(a1.ID, 1)
+	req.NoError(err)
+	req.Equal(JobRunning, job.Status)
+	req.Error(a1.ctx.Err())
+
+	q.Finish(a1)
+	req.Equal(b1, q.Next())
+	req.Empty(store.jobs[a1.ID])
+}
+
+func Test_jobQueue_restore(t *testing.T) {
+	req := require.New(t)
+	store := newFakeJobStore()
+	q := newJobQueue(store, nil)
+
+	a1 := enqueue(t, q, 1, "s")
+	b1 := enqueue(t, q, 2, "s")
+	a2 := enqueue(t, q, 1, "s")
+	req.Equal(a1, q.Next())
+
+	restored := newJobQueue(store, nil)
+	req.Equal(3, restored.Restore())
+
+	// the running job is queued again, in order of enqueue
+	var ids []string
+	for _, job := range restored.orderLocked() {
+		ids = append(ids, job.ID)
+		req.Equal(JobQueued, job.Status)
+	}
+	req.Equal([]string{a1.ID, b1.ID, a2.ID}, ids)
+
+	job := &Job{UserID: 3, Server: "s"}
+	_, err := restored.Enqueue(job)
+	req.NoError(err)
+	req.Equal(int64(4), job.Seq)
+}
@@ -3,18 +3,20 @@ package sd
 import (
 	"bytes"
 	"context"
+	"csust-got/config"
 	"csust-got/entities"
 	"csust-got/log"
 	"csust-got/orm"
 	"csust-got/util"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/quic-go/quic-go"
@@ -24,11 +26,8 @@ import (
 	. "gopkg.in/telebot.v3"
 )
 
-var (
-	mu       sync.Mutex
-	ch       = make(chan *StableDiffusionContext, 10)
-	busyUser = make(map[int64]int)
-)
+// jobs is the queue of stable diffusion jobs.
+var jobs = newJobQueue(redisJobStore{}, pool)
 
 var httpClient *http.Client
 
@@ -80,11 +79,6 @@ func init() {
 
 // Handler stable diffusion handler.
 func Handler(ctx Context) error {
-	if !mu.TryLock() {
-		return ctx.Reply("忙不过来了")
-	}
-	defer mu.Unlock()
-
 	command := entities.FromMessage(ctx.Message())
 
 	userID := ctx.Sender().ID
@@ -93,12 +87,28 @@ func Handler(ctx Context) error {
 		return ctx.Reply("完了，删库跑路了")
 	}
 
-	if config.GetServer() == "" {
+	server, usePool, err := jobServer(config)
+	switch {
+	case errors.Is(err, ErrServerNotConfigured):
 		return ctx.Reply("喂喂喂，你还没有配置服务器好吧。" +
 			"快使用 /sdcfg 配置一个属于自己的服务器，或者找好心人捐赠一个服务器吧")
+	case err != nil:
+		return ctx.Reply("服务器池里的服务器都挂了，等会再来吧，或者用 /sdcfg 配置一个自己的服务器")
 	}
 
-	prompt := command.ArgAllInOneFrom(0)
+	style, from := styleOf(command)
+	if style != "" {
+		preset, err := findStyle(ctx.Chat().ID, userID, style)
+		if errors.Is(err, ErrPresetNotFound) {
+			return ctx.Reply("没有找到风格 " + style + "，用 /sdcfg styles 看看本群有哪些风格")
+		}
+		if err != nil {
+			return ctx.Reply(err.Error())
+		}
+		config = config.withPreset(preset)
+	}
+
+	prompt := command.ArgAllInOneFrom(from)
 	prompt = strings.ReplaceAll(prompt, "，", ",")
 	if prompt == "" {
 		prompt, _ = orm.GetSDLastPrompt(userID)
@@ -106,122 +116,236 @@ func Handler(ctx Context) error {
 		_ = orm.SetSDLastPrompt(userID, prompt)
 	}
 
+	mode, src, mask, err := imageSource(ctx.Message().ReplyTo)
+	if errors.Is(err, ErrImageNotSupported) {
+		return ctx.Reply("只能照着图片或者静态贴纸画哦")
+	}
+	if err != nil {
+		return ctx.Reply("完了，删库跑路了")
+	}
+
+	job := &Job{
+		UserID:    userID,
+		ChatID:    ctx.Chat().ID,
+		MessageID: ctx.Message().ID,
+		Server:    server,
+		Pool:      usePool,
+		Mode:      mode,
+	}
 	req := config.GenStableDiffusionRequest()
+	if src != nil {
+		req = config.GenImg2ImgRequest(src.Width, src.Height)
+		job.Image, job.Mask = src.FileID, mask
+	}
 	req.Prompt += ", " + prompt
+	job.Request = *req
+
+	return enqueueWithStatus(ctx, job)
+}
+
+// enqueueWithStatus replies a status message of job, and adds job to queue.
+func enqueueWithStatus(ctx Context, job *Job) error {
+	status, err := ctx.Bot().Reply(ctx.Message(), "🕒 排队中")
+	if err != nil {
+		return err
+	}
+	job.StatusMessageID = status.ID
+
+	// hold status of job, so that the worker can't edit it before us
+	job.statusMu.Lock()
+	defer job.statusMu.Unlock()
+	pos, err := jobs.Enqueue(job)
+	switch {
+	case errors.Is(err, ErrUserBusy):
+		_, err = ctx.Bot().Edit(status, "听我说你先别急，你还有3个没画完")
+		return err
+	case err != nil:
+		_, err = ctx.Bot().Edit(status, "忙不过来了")
+		return err
+	}
+	_, err = ctx.Bot().Edit(status, queuedText(job, pos))
+	return err
+}
+
+// queuedText is the status text of queued job.
+func queuedText(job *Job, pos int) string {
+	text := "🕒 排队中"
+	if pos > 0 {
+		text += fmt.Sprintf("，前面还有 %d 个任务", pos)
+	}
+	return text + fmt.Sprintf("\n任务 ID: %s，发送 /sdcancel %s 可以取消", job.ID, job.ID)
+}
+
+// Generate draws images of prompt with config of user who sent the message in botCtx,
+// the request goes through the same queue as `/sd`, and it waits until images are sent as reply of replyTo.
+func Generate(ctx context.Context, botCtx Context, replyTo *Message, prompt string) (int, error) {
+	config, err := getConfigByUserID(botCtx.Sender().ID)
+	if err != nil {
+		return 0, err
+	}
+	server, usePool, err := jobServer(config)
+	if err != nil {
+		return 0, err
+	}
 
-	if busyUser[userID] >= 3 {
-		return ctx.Reply("听我说你先别急，你还有3个没画完")
+	req := config.GenStableDiffusionRequest()
+	req.Prompt += ", " + strings.ReplaceAll(prompt, "，", ",")
+
+	done := make(chan GenerateResult, 1)
+	job := &Job{
+		UserID:  botCtx.Sender().ID,
+		ChatID:  botCtx.Chat().ID,
+		Server:  server,
+		Pool:    usePool,
+		Request: *req,
+		done:    done,
+	}
+	if replyTo != nil {
+		job.MessageID = replyTo.ID
+	}
+	if _, err = jobs.Enqueue(job); err != nil {
+		return 0, err
 	}
 
 	select {
-	case ch <- &StableDiffusionContext{
-		BotContext: ctx,
-		UserConfig: *config,
-		Request:    *req,
-	}:
-		busyUser[userID]++
-		msg := "在画了在画了"
-		if req.HiResEnabled {
-			msg += "，高清修复已开启，可能会比较慢，耐心等待一下~"
-		}
-		return ctx.Reply(msg)
-	default:
-		return ctx.Reply("忙不过来了")
+	case r := <-done:
+		return r.Images, r.Err
+	case <-ctx.Done():
+		_, _ = jobs.Cancel(job.ID, job.UserID)
+		return 0, ctx.Err()
+	}
+}
+
+// setStatus edits the status message of job, if it has one.
+func (job *Job) setStatus(bot *Bot, text string) {
+	if job.StatusMessageID == 0 {
+		return
 	}
+	job.statusMu.Lock()
+	defer job.statusMu.Unlock()
+	msg := &StoredMessage{MessageID: strconv.Itoa(job.StatusMessageID), ChatID: job.ChatID}
+	if _, err := bot.Edit(msg, text); err != nil && !errors.Is(err, ErrSameMessageContent) {
+		log.Error("edit stable diffusion status failed", zap.String("id", job.ID), zap.Error(err))
+	}
+}
 
+// replyTo returns the message which images and failures reply to.
+func (job *Job) replyTo() *SendOptions {
+	if job.MessageID == 0 {
+		return &SendOptions{}
+	}
+	return &SendOptions{ReplyTo: &Message{ID: job.MessageID, Chat: &Chat{ID: job.ChatID}}}
 }
 
-// Process is the stable diffusion background worker.
-func Process() {
-	lock := new(sync.Mutex)
-	inUsedServer := make(map[string]chan *StableDiffusionContext)
-	maxWorker := make(chan struct{}, 10)
-
-	for ctx := range ch {
-		select {
-		case maxWorker <- struct{}{}:
-			// Do nothing
-		default:
-			err := ctx.BotContext.Reply("任务堆积太多，忙不过来了。")
-			if err != nil {
-				log.Error("reply error", zap.Error(err))
-			}
+// fail reports the failure to caller, or tells user if no one is waiting.
+func (job *Job) fail(bot *Bot, msg string, err error) {
+	if job.done != nil {
+		job.done <- GenerateResult{Err: err}
+		return
+	}
+	if job.StatusMessageID != 0 {
+		job.setStatus(bot, msg)
+		return
+	}
+	if _, err := bot.Send(ChatID(job.ChatID), msg, job.replyTo()); err != nil {
+		log.Error("reply stable diffusion failed", zap.Error(err))
+	}
+}
+
+// Process is the stable diffusion background worker, it resumes jobs saved before restart.
+func Process(bot *Bot) {
+	pool.onChange = jobs.notify
+	go watchPool(bot)
+
+	if n := jobs.Restore(); n > 0 {
+		log.Info("stable diffusion jobs restored", zap.Int("count", n))
+	}
+	for {
+		job := jobs.Next()
+		if job == nil {
+			<-jobs.wake
 			continue
 		}
+		go runJob(bot, job)
+	}
+}
 
-		server := ctx.UserConfig.GetServer()
+// startProgress shows progress of the job in its status message, returns a func which stops it and waits.
+func startProgress(job *Job, preview *progressPreview) (stop func()) {
+	interval := config.BotConfig().StableDiffusion.ProgressInterval
+	if job.StatusMessageID == 0 || interval <= 0 {
+		return func() {}
+	}
 
-		lock.Lock()
-		serverCh, ok := inUsedServer[server]
-		if !ok {
-			serverCh = make(chan *StableDiffusionContext, 10)
-			inUsedServer[ctx.UserConfig.GetServer()] = serverCh
+	ctx, cancel := context.WithCancel(job.ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watchProgress(ctx, job.Server, interval, preview.update)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func runJob(bot *Bot, job *Job) {
+	retried := false
+	defer func() {
+		if !retried {
+			jobs.Finish(job)
 		}
-		lock.Unlock()
-		serverCh <- ctx
-
-		processFn := func() {
-			for {
-				select {
-				case ctx := <-serverCh:
-					func() {
-						ctx := ctx
-						defer func() {
-							<-maxWorker
-
-							mu.Lock()
-							busyUser[ctx.BotContext.Sender().ID]--
-							mu.Unlock()
-						}()
-						resp, err := requestStableDiffusion(ctx.UserConfig.GetServer(), &ctx.Request)
-						if err != nil {
-							err = ctx.BotContext.Reply("寄了")
-							if err != nil {
-								log.Error("reply stable diffusion failed", zap.Error(err))
-							}
-							return
-						}
-
-						photos := Album{}
-						for _, v := range resp.Images {
-							var data []byte
-							data, err = base64.StdEncoding.DecodeString(v)
-							if err != nil {
-								log.Error("decode stable diffusion image failed", zap.Error(err))
-								continue
-							}
-							photos = append(photos, &Photo{
-								File: File{FileReader: bytes.NewReader(data)},
-							})
-						}
-
-						err = ctx.BotContext.SendAlbum(photos)
-						if err != nil {
-							log.Error("send stable diffusion album failed", zap.Error(err))
-							err = ctx.BotContext.Reply("非常的寄")
-							if err != nil {
-								log.Error("reply stable diffusion failed", zap.Error(err))
-							}
-							return
-						}
-					}()
-				default:
-					lock.Lock()
-					if len(serverCh) == 0 {
-						delete(inUsedServer, server)
-						lock.Unlock()
-						return
-					}
-					lock.Unlock()
-				}
-			}
+	}()
+	defer job.cancel()
+
+	job.setStatus(bot, job.modeText())
+
+	preview := &progressPreview{bot: bot, job: job}
+	stopProgress := startProgress(job, preview)
+	images, err := job.draw(job.ctx, bot)
+	stopProgress()
+	defer preview.clear()
+	if errors.Is(job.ctx.Err(), context.Canceled) {
+		job.fail(bot, "🚫 已取消", ErrJobCancelled)
+		return
+	}
+	if err != nil && job.Pool && isServerDown(err) {
+		pool.MarkFailed(job.Server, err)
+		log.Warn("stable diffusion server of pool failed", zap.String("id", job.ID), zap.Int("attempts", job.Attempts+1), zap.Error(err))
+		if job.Attempts+1 < maxAttempts {
+			job.setStatus(bot, "⚠️ 服务器出错了，换一台重新画")
+			retried = true
+			jobs.Retry(job)
+			return
 		}
+	}
+	if err != nil {
+		job.fail(bot, "❌ 寄了", err)
+		return
+	}
 
-		if !ok {
-			go processFn()
+	photos := Album{}
+	for _, v := range images {
+		var data []byte
+		data, err = base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			log.Error("decode stable diffusion image failed", zap.Error(err))
+			continue
 		}
+		photos = append(photos, &Photo{
+			File: File{FileReader: bytes.NewReader(data)},
+		})
 	}
 
+	if _, err = bot.SendAlbum(ChatID(job.ChatID), photos, job.replyTo()); err != nil {
+		log.Error("send stable diffusion album failed", zap.Error(err))
+		job.fail(bot, "❌ 非常的寄", err)
+		return
+	}
+	job.setStatus(bot, "✅ 画好了")
+	if job.done != nil {
+		job.done <- GenerateResult{Images: len(photos)}
+	}
 }
 
 /*
@@ -269,11 +393,16 @@ type StableDiffusionReq struct {
 	BatchSize      int    `json:"batch_size"`
 	SamplerIndex   string `json:"sampler_index"`
 
-	HiResEnabled         bool    `json:"enable_hr"`
+	HiResEnabled         bool    `json:"enable_hr,omitempty"`
 	DenoisingStrength    float64 `json:"denoising_strength"`
-	HiResScale           float64 `json:"hr_scale"`
-	HiResUpscaler        string  `json:"hr_upscaler"`
-	HiResSecondPassSteps int     `json:"hr_second_pass_steps"`
+	HiResScale           float64 `json:"hr_scale,omitempty"`
+	HiResUpscaler        string  `json:"hr_upscaler,omitempty"`
+	HiResSecondPassSteps int     `json:"hr_second_pass_steps,omitempty"`
+
+	// img2img and inpainting only
+	InitImages []string `json:"init_images,omitempty"`
+	Mask       string   `json:"mask,omitempty"`
+	MaskBlur   int      `json:"mask_blur,omitempty"`
 }
 
 /*
@@ -355,7 +484,8 @@ type StableDiffusionResp struct {
 	Images []string `json:"images"`
 }
 
-func requestStableDiffusion(addr string, req *StableDiffusionReq) (*StableDiffusionResp, error) {
+// requestAPI posts req to api of stable diffusion server, and decodes the response.
+func requestAPI[T any](ctx context.Context, addr, path string, req any) (*T, error) {
 	if addr == "" {
 		return nil, ErrServerNotConfigured
 	}
@@ -366,9 +496,9 @@ func requestStableDiffusion(addr string, req *StableDiffusionReq) (*StableDiffus
 		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Minute)
 	defer cancel()
-	httpReq, err := http.NewRequest("POST", addr+"/sdapi/v1/txt2img", bytes.NewReader(bs))
+	httpReq, err := http.NewRequest("POST", addr+path, bytes.NewReader(bs))
 	if err != nil {
 		log.Error("create stable diffusion request failed", zap.Error(err))
 		return nil, err
@@ -393,11 +523,15 @@ func requestStableDiffusion(addr string, req *StableDiffusionReq) (*StableDiffus
 	if resp.StatusCode != http.StatusOK {
 		log.Error("stable diffusion response status code is not 200",
 			zap.Int("status code", resp.StatusCode), zap.String("response body", string(bts)))
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return nil, fmt.Errorf("%w: %w: request stable diffusion failed, status code: %d, response: %s",
+				ErrRequestNotOK, ErrServerError, resp.StatusCode, string(bts))
+		}
 		return nil, fmt.Errorf("%w: request stable diffusion failed, status code: %d, response: %s",
 			ErrRequestNotOK, resp.StatusCode, string(bts))
 	}
 
-	var respData StableDiffusionResp
+	var respData T
 	err = json.Unmarshal(bts, &respData)
 	if err != nil {
 		log.Error("unmarshal stable diffusion response failed", zap.Error(err))
@@ -430,3 +564,43 @@ func LastPromptHandler(ctx Context) error {
 
 	return ctx.Reply("Your last prompt is:\n`"+prompt+"`", ModeMarkdownV2)
 }
+
+// QueueHandler handles `/sdqueue`, shows jobs of user and their positions in queue.
+func QueueHandler(ctx Context) error {
+	running, queued, positions, total := jobs.UserJobs(ctx.Sender().ID)
+	if len(running) == 0 && len(queued) == 0 {
+		return ctx.Reply(fmt.Sprintf("你没有在排队的任务，队列里一共有 %d 个任务", total))
+	}
+
+	var sb strings.Builder
+	for _, job := range running {
+		fmt.Fprintf(&sb, "🎨 %s 正在画\n", job.ID)
+	}
+	for i, job := range queued {
+		fmt.Fprintf(&sb, "🕒 %s 排在第 %d 位\n", job.ID, positions[i]+1)
+	}
+	fmt.Fprintf(&sb, "队列里一共有 %d 个任务，发送 /sdcancel <ID> 可以取消", total)
+	return ctx.Reply(sb.String())
+}
+
+// CancelHandler handles `/sdcancel <id>`, cancels queued or running job of user.
+func CancelHandler(ctx Context) error {
+	if len(ctx.Args()) != 1 {
+		return ctx.Reply("用法：/sdcancel <ID>，ID 可以用 /sdqueue 查看")
+	}
+	job, err := jobs.Cancel(ctx.Args()[0], ctx.Sender().ID)
+	switch {
+	case errors.Is(err, ErrJobNotFound):
+		return ctx.Reply("没有找到这个任务，可能已经画完了")
+	case errors.Is(err, ErrJobNotOwned):
+		return ctx.Reply("只能取消自己的任务哦")
+	case err != nil:
+		return ctx.Reply("取消失败了😔")
+	}
+
+	// running job is stopped and reported by its worker
+	if job.Status == JobQueued {
+		job.fail(ctx.Bot(), "🚫 已取消", ErrJobCancelled)
+	}
+	return ctx.Reply("已取消任务 " + job.ID)
+}
@@ -5,6 +5,9 @@ import (
 	"csust-got/orm"
 	"csust-got/util"
 	"errors"
+	"math"
+	"sort"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
@@ -16,6 +19,13 @@ const TaskDeadTime = time.Hour * 6 // 6h
 // FetchTaskTime fetch the task in the future.
 const FetchTaskTime = time.Minute // 1min
 
+// cancelledKeepTime is how long ids of cancelled tasks are remembered,
+// so that a recurring task running while it's cancelled won't be rescheduled.
+const cancelledKeepTime = 10 * time.Minute
+
+// taskIDChars are chars of task id, without chars look alike.
+const taskIDChars = "abcdefghijkmnpqrstuvwxyz23456789"
+
 // Task is an alias of orm.Task.
 type Task = orm.Task
 
@@ -30,6 +40,15 @@ type TimeTask struct {
 	nextTime util.RWMutexed[int64]
 
 	fn func(task *Task)
+	// alive reports whether a recurring task should be rescheduled, nil means always.
+	alive func(task *Task) bool
+
+	mu sync.Mutex
+	// scheduled are tasks waiting in memory for their exec time.
+	scheduled map[*Task]*scheduledTask
+	// cancelled are ids of cancelled tasks, and when they are cancelled.
+	cancelled map[string]time.Time
+	idGen     interface{ RandStr() string }
 
 	// add task to this channel,
 	// it will be added to redis or add scheduler directly depending on execTime.
@@ -42,10 +61,20 @@ type TimeTask struct {
 	toRunChan chan *RawTask
 }
 
+// scheduledTask is a task waiting in memory for its exec time.
+type scheduledTask struct {
+	// raw is the task in redis, nil if the task is not saved.
+	raw   *RawTask
+	timer *time.Timer
+}
+
 // NewTimeTask creates a new time task runner.
 func NewTimeTask(fn func(task *Task)) *TimeTask {
 	return &TimeTask{
 		fn:          fn,
+		scheduled:   make(map[*Task]*scheduledTask),
+		cancelled:   make(map[string]time.Time),
+		idGen:       util.NewRandStrWithSeedLength(taskIDChars, 6),
 		addChan:     make(chan *Task, 64),
 		deleteChan:  make(chan *RawTask, 64),
 		runningChan: make(chan *Task, 64),
@@ -53,21 +82,91 @@ func NewTimeTask(fn func(task *Task)) *TimeTask {
 	}
 }
 
+// SetAliveCheck sets the function which reports whether a recurring task should be rescheduled,
+// so recurring tasks can be stopped.
+func (t *TimeTask) SetAliveCheck(alive func(task *Task) bool) {
+	t.alive = alive
+}
+
 // RunTaskFn returns function to add task to scheduler.
 func (t *TimeTask) RunTaskFn(task *Task) func() {
 	return func() {
-		t.fn(task)
+		if t.reschedule(task, nil) {
+			t.fn(task)
+		}
 	}
 }
 
 // RunTaskAndDeleteFn returns function to add task to scheduler, and delete from redis after finished.
+// Recurring task is replaced by its next run before running instead.
 func (t *TimeTask) RunTaskAndDeleteFn(task *RawTask) func() {
 	return func() {
+		if task.Repeat != "" {
+			if t.reschedule(&task.Task, task) {
+				t.fn(&task.Task)
+			}
+			return
+		}
 		t.fn(&task.Task)
 		t.DeleteTask(task)
 	}
 }
 
+// Reschedule adds the next run of recurring task.
+// It returns false if the task is a recurring task which is not alive anymore and should not run.
+func (t *TimeTask) Reschedule(task *Task) bool {
+	return t.reschedule(task, nil)
+}
+
+// reschedule replaces raw, the run of recurring task in redis, with its next run,
+// before running it so that it survives failures and restarts in this run. raw is nil if task is not saved.
+func (t *TimeTask) reschedule(task *Task, raw *RawTask) bool {
+	if task.Repeat == "" {
+		return true
+	}
+	if t.isCancelled(task.ID) || t.alive != nil && !t.alive(task) {
+		log.Info("recurring task is not alive, stop it", zap.Any("task", task))
+		if raw != nil {
+			t.DeleteTask(raw)
+		}
+		return false
+	}
+	next, err := task.NextRun(time.Now())
+	if err != nil {
+		log.Error("get next run of recurring task failed", zap.Any("task", task), zap.Error(err))
+		if raw != nil {
+			t.DeleteTask(raw)
+		}
+		return true
+	}
+	t.replaceTask(raw, next)
+	return true
+}
+
+// replaceTask saves next run of recurring task in place of raw at once, so that there is always one run in redis.
+func (t *TimeTask) replaceTask(raw *RawTask, next *Task) {
+	old := ""
+	if raw != nil {
+		old = raw.Raw
+	}
+
+	t.nextTime.Lock()
+	value, err := orm.ReplaceTask(old, orm.NewTaskNonced(next))
+	// tasks before nextTime have been fetched, so it should be scheduled here
+	if err == nil && next.ExecTime < t.nextTime.Get() {
+		t.toRunChan <- &RawTask{Task: *next, Raw: value}
+	}
+	t.nextTime.Unlock()
+
+	if err != nil {
+		// add it by loop, which retries
+		t.AddTask(next)
+		if raw != nil {
+			t.DeleteTask(raw)
+		}
+	}
+}
+
 // Run start running loop.
 func (t *TimeTask) Run() {
 	const maxTries = 16
@@ -102,11 +201,136 @@ func (t *TimeTask) Run() {
 	log.Fatal("time task loop exited too many times", zap.Int("tries", tries))
 }
 
-// AddTask adds a task to addChan.
+// AddTask adds a task to addChan, an id is assigned to the task if it has none.
 func (t *TimeTask) AddTask(task *Task) {
+	if task.ID == "" {
+		t.mu.Lock()
+		task.ID = t.idGen.RandStr()
+		t.mu.Unlock()
+	}
 	t.addChan <- task
 }
 
+// CancelTask removes the pending task with id from memory and redis, all future runs of recurring task are cancelled.
+// It returns the cancelled task, or orm.ErrNoTask if not found.
+func (t *TimeTask) CancelTask(id string) (*Task, error) {
+	var found *Task
+	now := time.Now()
+
+	t.mu.Lock()
+	for task, s := range t.scheduled {
+		if task.ID != id || !s.timer.Stop() {
+			continue
+		}
+		found = task
+		delete(t.scheduled, task)
+		if s.raw != nil {
+			t.deleteChan <- s.raw
+		}
+	}
+	for cid, at := range t.cancelled {
+		if now.Sub(at) > cancelledKeepTime {
+			delete(t.cancelled, cid)
+		}
+	}
+	t.cancelled[id] = now
+	t.mu.Unlock()
+
+	task, err := orm.DeleteTaskByID(id)
+	if err == nil {
+		return task, nil
+	}
+	if found != nil {
+		return found, nil
+	}
+	return nil, err
+}
+
+// EditTask changes the pending task with id by edit, the task keeps its id.
+// It returns the edited task, or orm.ErrNoTask if not found.
+func (t *TimeTask) EditTask(id string, edit func(task *Task)) (*Task, error) {
+	task, err := t.CancelTask(id)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	delete(t.cancelled, id)
+	t.mu.Unlock()
+
+	edited := *task
+	edit(&edited)
+	t.AddTask(&edited)
+	return &edited, nil
+}
+
+// PendingTasks returns tasks waiting to run which filter returns true, ordered by exec time.
+func (t *TimeTask) PendingTasks(filter func(task *Task) bool) ([]*Task, error) {
+	raws, err := orm.QueryTasks(0, math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+
+	type taskKey struct {
+		id       string
+		execTime int64
+	}
+	seen := make(map[taskKey]bool)
+	tasks := make([]*Task, 0)
+	add := func(task *Task) {
+		key := taskKey{task.ID, task.ExecTime}
+		if seen[key] || !filter(task) {
+			return
+		}
+		seen[key] = true
+		tasks = append(tasks, task)
+	}
+
+	for _, raw := range raws {
+		add(&raw.Task)
+	}
+	t.mu.Lock()
+	for task := range t.scheduled {
+		add(task)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].ExecTime < tasks[j].ExecTime })
+	return tasks, nil
+}
+
+func (t *TimeTask) isCancelled(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.cancelled[id]
+	return ok
+}
+
+// schedule runs task at its exec time, raw is the task in redis which is deleted after running, nil if not saved.
+func (t *TimeTask) schedule(task *Task, raw *RawTask) {
+	run := t.RunTaskFn(task)
+	if raw != nil {
+		run = t.RunTaskAndDeleteFn(raw)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.cancelled[task.ID]; ok {
+		if raw != nil {
+			t.deleteChan <- raw
+		}
+		return
+	}
+	t.scheduled[task] = &scheduledTask{
+		raw: raw,
+		timer: time.AfterFunc(time.Until(time.UnixMilli(task.ExecTime)), func() {
+			t.mu.Lock()
+			delete(t.scheduled, task)
+			t.mu.Unlock()
+			run()
+		}),
+	}
+}
+
 // DeleteTask add a task to deleteChan.
 func (t *TimeTask) DeleteTask(task *RawTask) {
 	t.deleteChan <- task
@@ -134,13 +358,16 @@ func (t *TimeTask) addTaskLoop() {
 			t.nextTime.Lock()
 			defer t.nextTime.Unlock()
 
-			ts, next := t.parseTasks(tasks)
+			ts, toRun, next := t.parseTasks(tasks)
 			// if add to redis error, then reset timer in 10ms, and try again.
 			if err := orm.AddTasks(ts...); err != nil {
 				log.Error("add tasks error", zap.Error(err))
 				timer.Reset(time.Microsecond * 10)
 				return
 			}
+			for _, task := range toRun {
+				t.toRunChan <- task
+			}
 
 			// if next < t.nextTime means a newer task has been added.
 			if next < t.nextTime.Get() {
@@ -153,21 +380,38 @@ func (t *TimeTask) addTaskLoop() {
 	}
 }
 
-func (t *TimeTask) parseTasks(tasks []*orm.Task) ([]*orm.TaskNonced, int64) {
+// parseTasks returns tasks should be saved to redis, and saved tasks should be scheduled now.
+// Tasks will run soon are scheduled directly, except recurring tasks, which are always saved to survive restarts.
+func (t *TimeTask) parseTasks(tasks []*orm.Task) ([]*orm.TaskNonced, []*RawTask, int64) {
 	ts := make([]*TaskNonced, 0, len(tasks))
+	var toRun []*RawTask
 	next := t.nextTime.Get()
 	for _, task := range tasks {
 		now := time.Now()
-		if task.ExecTime < now.Add(FetchTaskTime).UnixMilli() || task.ExecTime <= next {
+		soon := task.ExecTime < now.Add(FetchTaskTime).UnixMilli() || task.ExecTime <= next
+		switch {
+		case soon && task.Repeat != "":
+			nonced := orm.NewTaskNonced(task)
+			raw, err := nonced.Raw()
+			if err != nil {
+				t.runningChan <- task
+				continue
+			}
+			ts = append(ts, nonced)
+			// it won't be fetched if it's before nextTime
+			if task.ExecTime < next {
+				toRun = append(toRun, &RawTask{Task: *task, Raw: raw})
+			}
+		case soon:
 			t.runningChan <- task
-		} else {
+		default:
 			if task.ExecTime < next {
 				next = task.ExecTime
 			}
 			ts = append(ts, orm.NewTaskNonced(task))
 		}
 	}
-	return ts, next
+	return ts, toRun, next
 }
 
 func (t *TimeTask) deleteTaskLoop() {
@@ -203,9 +447,9 @@ func (t *TimeTask) runningTaskLoop() {
 	for {
 		select {
 		case task := <-t.runningChan:
-			time.AfterFunc(time.Until(time.UnixMilli(task.ExecTime)), t.RunTaskFn(task))
+			t.schedule(task, nil)
 		case task := <-t.toRunChan:
-			time.AfterFunc(time.Until(time.UnixMilli(task.ExecTime)), t.RunTaskAndDeleteFn(task))
+			t.schedule(&task.Task, task)
 		}
 	}
 }
@@ -213,15 +457,19 @@ func (t *TimeTask) runningTaskLoop() {
 func (t *TimeTask) fetchTaskLoop() {
 	ticker := time.NewTicker(time.Second)
 	for range ticker.C {
-		startTime := t.nextTime.LockGet()
+		// hold the lock while fetching, so that tasks saved meanwhile won't be skipped by nextTime
+		t.nextTime.Lock()
+		startTime := t.nextTime.Get()
 		endTime := time.Now().Add(FetchTaskTime).UnixMilli()
 
 		if startTime > endTime {
+			t.nextTime.Unlock()
 			continue
 		}
 
 		// fetch tasks from redis, and add to toRunChan
 		err := t.fetchTask(startTime, endTime)
+		t.nextTime.Unlock()
 		if err != nil {
 			if !errors.Is(err, orm.ErrNoTask) {
 				log.Error("query tasks error", zap.Error(err))
@@ -230,6 +478,7 @@ func (t *TimeTask) fetchTaskLoop() {
 	}
 }
 
+// fetchTask fetches tasks from redis, the caller should hold lock of nextTime.
 func (t *TimeTask) fetchTask(from, to int64) error {
 	// fetch tasks from redis, and add to toRunChan
 	ts, err := orm.QueryTasks(from, to)
@@ -244,12 +493,12 @@ func (t *TimeTask) fetchTask(from, to int64) error {
 	// fetch next time from redis
 	next, err := orm.NextTaskTime(to)
 	if errors.Is(err, orm.ErrNoTask) {
-		t.nextTime.LockSet(time.Now().Add(FetchTaskTime).UnixMilli())
+		t.nextTime.Set(time.Now().Add(FetchTaskTime).UnixMilli())
 		return nil
 	} else if err != nil {
 		return err
 	}
-	t.nextTime.LockSet(next)
+	t.nextTime.Set(next)
 	return nil
 }
 
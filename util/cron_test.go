@@ -0,0 +1,47 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSchedule(t *testing.T) {
+	base := time.Date(2024, 1, 31, 10, 30, 15, 0, time.Local) // Wednesday
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"0 20 * * *", time.Date(2024, 1, 31, 20, 0, 0, 0, time.Local)},
+		{"30 10 * * *", time.Date(2024, 2, 1, 10, 30, 0, 0, time.Local)},
+		{"*/15 * * * *", time.Date(2024, 1, 31, 10, 45, 0, 0, time.Local)},
+		{"0 9 * * 1-5", time.Date(2024, 2, 1, 9, 0, 0, 0, time.Local)},
+		{"0 9 * * 0", time.Date(2024, 2, 4, 9, 0, 0, 0, time.Local)},
+		{"0 9 * * 7", time.Date(2024, 2, 4, 9, 0, 0, 0, time.Local)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.Local)},
+		{"0 8 1,15 * *", time.Date(2024, 2, 1, 8, 0, 0, 0, time.Local)},
+		{"@daily", time.Date(2024, 2, 1, 0, 0, 0, 0, time.Local)},
+		{"@every 2h", base.Add(2 * time.Hour)},
+	}
+	for _, tt := range tests {
+		s, err := ParseSchedule(tt.spec)
+		require.NoError(t, err, tt.spec)
+		assert.Equal(t, tt.want, s.Next(base), tt.spec)
+	}
+}
+
+func TestParseScheduleInvalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "5-1 * * * *", "*/0 * * * *",
+		"a * * * *", "@every 10s", "@every x"} {
+		_, err := ParseSchedule(spec)
+		assert.ErrorIs(t, err, ErrInvalidSchedule, spec)
+	}
+}
+
+func TestScheduleNeverMatch(t *testing.T) {
+	s, err := ParseSchedule("0 0 30 2 *")
+	require.NoError(t, err)
+	assert.True(t, s.Next(time.Now()).IsZero())
+}
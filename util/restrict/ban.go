@@ -12,7 +12,7 @@ import (
 
 // Ban is used to ban someone.
 func Ban(chat *tb.Chat, user *tb.User, hard bool, duration time.Duration) Result {
-	member, err := config.BotConfig.Bot.ChatMemberOf(chat, user)
+	member, err := config.BotConfig().Bot.ChatMemberOf(chat, user)
 	if err != nil {
 		log.Error("get ChatMemberOf failed", zap.Int64("chatID", chat.ID),
 			zap.Int64("userID", user.ID), zap.Error(err))
@@ -47,7 +47,7 @@ func hardBan(chat *tb.Chat, member *tb.ChatMember) bool {
 }
 
 func ban(chat *tb.Chat, member *tb.ChatMember) bool {
-	err := config.BotConfig.Bot.Restrict(chat, member)
+	err := config.BotConfig().Bot.Restrict(chat, member)
 	if err != nil {
 		log.Warn("Can't restrict chat member.", zap.Error(err))
 	}
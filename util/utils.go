@@ -47,7 +47,7 @@ func SendReply(to tb.Recipient, what any, replyMsg *tb.Message, ops ...any) *tb.
 
 // SendMessageWithError is same as SendMessage but return error.
 func SendMessageWithError(to tb.Recipient, what any, ops ...any) (*tb.Message, error) {
-	msg, err := config.BotConfig.Bot.Send(to, what, ops...)
+	msg, err := config.BotConfig().Bot.Send(to, what, ops...)
 	if err != nil {
 		log.Error("Can't send message", zap.Error(err))
 	}
@@ -77,7 +77,7 @@ func SendReplyWithError(to tb.Recipient, what any, replyMsg *tb.Message, ops ...
 
 // DeleteMessage delete a message.
 func DeleteMessage(m *tb.Message) {
-	err := config.BotConfig.Bot.Delete(m)
+	err := config.BotConfig().Bot.Delete(m)
 	if err != nil {
 		log.Error("Can't delete message", zap.Error(err))
 	}
@@ -85,7 +85,7 @@ func DeleteMessage(m *tb.Message) {
 
 // GetFile get file from telegram.
 func GetFile(file *tb.File) (io.ReadCloser, error) {
-	return config.BotConfig.Bot.File(file)
+	return config.BotConfig().Bot.File(file)
 }
 
 // GetName can get user's name.
@@ -108,7 +108,7 @@ func GetUserNameFromString(s string) (string, bool) {
 // GetAdminList can get admin list from chat.
 func GetAdminList(chatID int64) []tb.ChatMember {
 	chat := &tb.Chat{ID: chatID}
-	admins, err := config.BotConfig.Bot.AdminsOf(chat)
+	admins, err := config.BotConfig().Bot.AdminsOf(chat)
 	if err != nil {
 		log.Error("Can't get admin list", zap.Int64("chatID", chatID), zap.Error(err))
 		return []tb.ChatMember{}
@@ -118,7 +118,7 @@ func GetAdminList(chatID int64) []tb.ChatMember {
 
 // CanRestrictMembers can check if someone can restrict members.
 func CanRestrictMembers(chat *tb.Chat, user *tb.User) bool {
-	member, err := config.BotConfig.Bot.ChatMemberOf(chat, user)
+	member, err := config.BotConfig().Bot.ChatMemberOf(chat, user)
 	if err != nil {
 		log.Error("can get CanRestrictMembers", zap.Int64("chatID", chat.ID),
 			zap.Int64("userID", user.ID), zap.Error(err))
@@ -127,6 +127,16 @@ func CanRestrictMembers(chat *tb.Chat, user *tb.User) bool {
 	return member.CanRestrictMembers
 }
 
+// IsChatAdmin reports whether user is the admin of chat.
+func IsChatAdmin(bot *tb.Bot, chat *tb.Chat, user *tb.User) bool {
+	member, err := bot.ChatMemberOf(chat, user)
+	if err != nil {
+		log.Error("get ChatMemberOf failed", zap.Int64("chatID", chat.ID), zap.Int64("userID", user.ID), zap.Error(err))
+		return false
+	}
+	return member.Role == tb.Administrator || member.Role == tb.Creator
+}
+
 // RandomChoice - rand one from slice.
 func RandomChoice[T any](s []T) T {
 	var ret T